@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+// RequireAuth rejects requests without a valid bearer token and stores the
+// authenticated user in the request context. Browsers can't set headers on
+// websocket upgrades, so those may pass the token as ?token= instead.
+func RequireAuth(auth *services.AuthService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := bearerToken(r)
+			if token == "" && websocket.IsWebSocketUpgrade(r) {
+				token = r.URL.Query().Get("token")
+			}
+			if token == "" {
+				http.Error(w, "authentication required", http.StatusUnauthorized)
+				return
+			}
+
+			user, err := auth.Verify(token)
+			if err != nil {
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), userContextKey, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RedactToken hides a ?token= query parameter from the request URI that
+// access logs print, leaving the parsed URL intact for RequireAuth. It has to
+// run before the logger.
+func RedactToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Has("token") {
+			query.Set("token", "REDACTED")
+			redacted := *r.URL
+			redacted.RawQuery = query.Encode()
+			r = r.Clone(r.Context())
+			r.RequestURI = redacted.RequestURI()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// UserFromContext returns the user authenticated by RequireAuth.
+func UserFromContext(ctx context.Context) (*models.User, bool) {
+	user, ok := ctx.Value(userContextKey).(*models.User)
+	return user, ok
+}
+
+// originChecker allows requests without an Origin header (non-browser
+// clients still need a token) and those from one of the allowed origins.
+func originChecker(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, o := range allowed {
+			if strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+func init() {
+	registerMessageType("blame", messageType{
+		newPayload: func() Payload { return &BlameRequest{} },
+		optional:   true,
+		handle:     (*WebSocketHandler).handleBlame,
+	})
+}
+
+// BlameRequest asks for the blame of the file at Path, or of the main file.
+type BlameRequest struct {
+	Path string `json:"path,omitempty"`
+}
+
+func (r *BlameRequest) Validate() error {
+	if r.Path == "" {
+		return nil
+	}
+	return models.ValidatePath(r.Path)
+}
+
+// BlameLine attributes one line, numbered from 1.
+type BlameLine struct {
+	Line     int    `json:"line"`
+	UserID   string `json:"user_id"`
+	Revision int    `json:"revision"`
+}
+
+// BlameResponse attributes every line of the file at Path as of Revision.
+// Users holds the present authors, so their colors can be shown.
+type BlameResponse struct {
+	SessionID string                 `json:"session_id"`
+	Path      string                 `json:"path"`
+	Revision  int                    `json:"revision"`
+	Lines     []BlameLine            `json:"lines"`
+	Users     map[string]models.User `json:"users"`
+}
+
+func buildBlame(store services.SessionStore, session *models.Session, path string) (*BlameResponse, error) {
+	if path == "" {
+		path = session.MainFile
+	}
+	blame, revision, err := store.GetBlame(session.ID, path)
+	if err != nil {
+		return nil, err
+	}
+
+	present := make(map[string]models.User, len(session.Users))
+	for _, user := range session.Users {
+		present[user.ID] = user
+	}
+
+	response := &BlameResponse{
+		SessionID: session.ID,
+		Path:      path,
+		Revision:  revision,
+		Lines:     make([]BlameLine, len(blame)),
+		Users:     make(map[string]models.User),
+	}
+	for i, line := range blame {
+		response.Lines[i] = BlameLine{Line: i + 1, UserID: line.UserID, Revision: line.Revision}
+		if user, ok := present[line.UserID]; ok {
+			response.Users[line.UserID] = user
+		}
+	}
+	return response, nil
+}
+
+// GetBlame returns who last touched each line of the file given by the
+// path query parameter, or of the main file.
+func (h *SessionHandler) GetBlame(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	response, err := buildBlame(h.store, session, r.URL.Query().Get("path"))
+	if errors.Is(err, services.ErrFileNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *WebSocketHandler) handleBlame(client *Client, payload Payload) {
+	request := payload.(*BlameRequest)
+
+	session, err := h.store.GetSession(client.sessionID)
+	if err != nil {
+		h.sendError(client, "blame", errUnavailable, err.Error())
+		return
+	}
+
+	response, err := buildBlame(h.store, session, request.Path)
+	if errors.Is(err, services.ErrFileNotFound) {
+		h.sendError(client, "blame", errInvalidPayload, err.Error())
+		return
+	}
+	if err != nil {
+		h.sendError(client, "blame", errUnavailable, err.Error())
+		return
+	}
+
+	h.sendToClient(client, models.WSMessage{
+		Type:      "blame",
+		SessionID: client.sessionID,
+		Data:      response,
+	})
+}
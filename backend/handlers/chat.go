@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+const (
+	// chatSnapshotSize is how many recent chat messages a snapshot carries.
+	chatSnapshotSize = 50
+	maxChatPage      = 200
+)
+
+func init() {
+	registerMessageType("chat_message", messageType{
+		newPayload: func() Payload { return &models.NewChatMessage{} },
+		handle:     (*WebSocketHandler).handleChatMessage,
+	})
+}
+
+// PostMessage saves a chat message by userID and broadcasts it to every
+// connected client, the author's included, so they learn its ID.
+func (h *WebSocketHandler) PostMessage(sessionID, userID string, req *models.NewChatMessage) (*models.ChatMessage, error) {
+	message, err := services.PostMessage(h.store, sessionID, userID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	h.broadcastToSession(sessionID, models.WSMessage{
+		Type:      "chat_message",
+		SessionID: sessionID,
+		UserID:    userID,
+		Data:      message,
+	}, nil)
+	return message, nil
+}
+
+func (h *WebSocketHandler) handleChatMessage(client *Client, payload Payload) {
+	_, err := h.PostMessage(client.sessionID, client.user.ID, payload.(*models.NewChatMessage))
+	switch {
+	case err == nil:
+	case errors.Is(err, services.ErrForbidden):
+		h.sendError(client, "chat_message", errForbidden, err.Error())
+	case errors.Is(err, services.ErrFileNotFound), errors.Is(err, services.ErrInvalidAnchor):
+		h.sendError(client, "chat_message", errInvalidPayload, err.Error())
+	default:
+		log.Printf("Chat message failed: %v", err)
+		h.sendError(client, "chat_message", errUnavailable, err.Error())
+	}
+}
+
+// ListMessages returns a page of the session's chat, oldest first: the
+// latest ?limit= messages from before the ID ?before=, or the latest
+// messages if it is left out.
+func (h *SessionHandler) ListMessages(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	var before int64
+	if v := r.URL.Query().Get("before"); v != "" {
+		var err error
+		if before, err = strconv.ParseInt(v, 10, 64); err != nil || before < 1 {
+			http.Error(w, "before must be a message ID", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := chatSnapshotSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxChatPage {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxChatPage), http.StatusBadRequest)
+			return
+		}
+	}
+
+	messages, err := h.store.GetMessages(session.ID, before, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+func init() {
+	registerMessageType("comment_create", messageType{
+		newPayload: func() Payload { return &models.NewComment{} },
+		handle:     (*WebSocketHandler).handleCommentCreate,
+	})
+	registerMessageType("comment_update", messageType{
+		newPayload: func() Payload { return &models.CommentUpdate{} },
+		handle:     (*WebSocketHandler).handleCommentUpdate,
+	})
+	registerMessageType("comment_delete", messageType{
+		newPayload: func() Payload { return &models.CommentRef{} },
+		handle:     (*WebSocketHandler).handleCommentDelete,
+	})
+}
+
+// CommentDeletion lists the comments deleted along with ID: the replies of
+// a deleted thread.
+type CommentDeletion struct {
+	ID      string   `json:"id"`
+	Deleted []string `json:"deleted"`
+}
+
+// CommentAnchors lists the comments a revision moved or outdated.
+type CommentAnchors struct {
+	Revision int              `json:"revision"`
+	Comments []models.Comment `json:"comments"`
+}
+
+// AddComment saves a comment on behalf of userID and broadcasts it to every
+// connected client, the author's included, so they learn its ID.
+func (h *WebSocketHandler) AddComment(sessionID, userID string, req *models.NewComment) (*models.Comment, error) {
+	// Anchoring under the write lock keeps edits from moving the comment
+	// before it is broadcast
+	defer h.lockSession(sessionID)()
+
+	comment, err := services.AddComment(h.store, sessionID, userID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	h.broadcastToSession(sessionID, models.WSMessage{
+		Type:      "comment_create",
+		SessionID: sessionID,
+		UserID:    userID,
+		Data:      comment,
+	}, nil)
+	return comment, nil
+}
+
+func (h *WebSocketHandler) EditComment(sessionID, userID string, update *models.CommentUpdate) (*models.Comment, error) {
+	comment, err := services.EditComment(h.store, sessionID, userID, update)
+	if err != nil {
+		return nil, err
+	}
+
+	h.broadcastToSession(sessionID, models.WSMessage{
+		Type:      "comment_update",
+		SessionID: sessionID,
+		UserID:    userID,
+		Data:      comment,
+	}, nil)
+	return comment, nil
+}
+
+func (h *WebSocketHandler) RemoveComment(sessionID, userID, commentID string) error {
+	deleted, err := services.RemoveComment(h.store, sessionID, userID, commentID)
+	if err != nil {
+		return err
+	}
+
+	h.broadcastToSession(sessionID, models.WSMessage{
+		Type:      "comment_delete",
+		SessionID: sessionID,
+		UserID:    userID,
+		Data:      CommentDeletion{ID: commentID, Deleted: deleted},
+	}, nil)
+	return nil
+}
+
+// broadcastAnchors tells every client about the comments and suggestions
+// record moved, and the review it sent back for review.
+func (h *WebSocketHandler) broadcastAnchors(sessionID string, record *models.OpRecord) {
+	if len(record.Comments) > 0 {
+		h.broadcastToSession(sessionID, models.WSMessage{
+			Type:      "comment_anchors",
+			SessionID: sessionID,
+			Data:      CommentAnchors{Revision: record.Revision, Comments: record.Comments},
+		}, nil)
+	}
+	if len(record.Suggestions) > 0 {
+		h.broadcastToSession(sessionID, models.WSMessage{
+			Type:      "suggestion_rebase",
+			SessionID: sessionID,
+			Data:      SuggestionRebase{Revision: record.Revision, Suggestions: record.Suggestions},
+		}, nil)
+	}
+	if record.Review != nil {
+		h.broadcastReview(sessionID, record.UserID, record.Review)
+	}
+}
+
+func (h *WebSocketHandler) handleCommentCreate(client *Client, payload Payload) {
+	_, err := h.AddComment(client.sessionID, client.user.ID, payload.(*models.NewComment))
+	h.replyToComment(client, "comment_create", err)
+}
+
+func (h *WebSocketHandler) handleCommentUpdate(client *Client, payload Payload) {
+	_, err := h.EditComment(client.sessionID, client.user.ID, payload.(*models.CommentUpdate))
+	h.replyToComment(client, "comment_update", err)
+}
+
+func (h *WebSocketHandler) handleCommentDelete(client *Client, payload Payload) {
+	err := h.RemoveComment(client.sessionID, client.user.ID, payload.(*models.CommentRef).ID)
+	h.replyToComment(client, "comment_delete", err)
+}
+
+// replyToComment reports a failed comment change. Successful ones reach
+// the sender through their broadcast.
+func (h *WebSocketHandler) replyToComment(client *Client, msgType string, err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, services.ErrForbidden):
+		h.sendError(client, msgType, errForbidden, err.Error())
+	case isCommentRejection(err):
+		h.sendError(client, msgType, errInvalidPayload, err.Error())
+	default:
+		log.Printf("Comment change failed: %v", err)
+		h.sendError(client, msgType, errUnavailable, err.Error())
+	}
+}
+
+// isCommentRejection reports whether err is down to the request rather
+// than the store.
+func isCommentRejection(err error) bool {
+	for _, target := range []error{
+		services.ErrCommentNotFound,
+		services.ErrInvalidAnchor,
+		services.ErrNotThread,
+		services.ErrFileNotFound,
+		services.ErrRevisionUnavailable,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListComments returns every comment of the session, oldest first. Replies
+// name their thread.
+func (h *SessionHandler) ListComments(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	comments, err := h.store.GetComments(session.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comments)
+}
+
+func (h *SessionHandler) CreateComment(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.NewComment
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, _ := UserFromContext(r.Context())
+
+	comment, err := h.ws.AddComment(session.ID, user.ID, &req)
+	if err != nil {
+		writeCommentError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(comment)
+}
+
+// UpdateComment edits the comment's body or resolves its thread.
+func (h *SessionHandler) UpdateComment(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	var update models.CommentUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	update.ID = chi.URLParam(r, "commentID")
+	if err := update.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, _ := UserFromContext(r.Context())
+
+	comment, err := h.ws.EditComment(session.ID, user.ID, &update)
+	if err != nil {
+		writeCommentError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comment)
+}
+
+// DeleteComment deletes the comment, and its replies if it starts a thread.
+func (h *SessionHandler) DeleteComment(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	user, _ := UserFromContext(r.Context())
+
+	if err := h.ws.RemoveComment(session.ID, user.ID, chi.URLParam(r, "commentID")); err != nil {
+		writeCommentError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeCommentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, services.ErrCommentNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrRevisionUnavailable):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case isCommentRejection(err):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+const (
+	defaultDiffContext = 3
+	maxDiffContext     = 100
+)
+
+type DiffResponse struct {
+	SessionID string            `json:"session_id"`
+	Path      string            `json:"path,omitempty"`
+	From      int               `json:"from"`
+	To        int               `json:"to"`
+	Unified   string            `json:"unified"`
+	Hunks     []models.DiffHunk `json:"hunks"`
+}
+
+// GetDiff compares the code at ?from= with the code at ?to=. from is a
+// revision, or "joined" for the one the caller last joined at; to defaults
+// to the live code. ?path= picks the file, defaulting to the main file at
+// each revision; a file missing at one of them diffs as empty. ?context=
+// sets the unchanged lines kept around changes, and ?format=unified returns
+// the unified diff alone as text.
+func (h *SessionHandler) GetDiff(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	user, _ := UserFromContext(r.Context())
+
+	var from int
+	var err error
+	switch v := query.Get("from"); v {
+	case "":
+		http.Error(w, "from revision required", http.StatusBadRequest)
+		return
+	case "joined":
+		from, err = services.JoinedRevision(h.store, session.ID, user.ID)
+		if err != nil {
+			writeRevisionError(w, err)
+			return
+		}
+	default:
+		if from, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid from revision", http.StatusBadRequest)
+			return
+		}
+	}
+
+	to := session.Revision
+	if v := query.Get("to"); v != "" && v != "live" {
+		if to, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid to revision", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, revision := range []int{from, to} {
+		if revision < 0 || revision > session.Revision {
+			http.Error(w, fmt.Sprintf("revisions must be between 0 and %d", session.Revision), http.StatusBadRequest)
+			return
+		}
+	}
+
+	contextLines := defaultDiffContext
+	if v := query.Get("context"); v != "" {
+		if contextLines, err = strconv.Atoi(v); err != nil || contextLines < 0 || contextLines > maxDiffContext {
+			http.Error(w, fmt.Sprintf("context must be between 0 and %d", maxDiffContext), http.StatusBadRequest)
+			return
+		}
+	}
+
+	path := query.Get("path")
+	if path != "" {
+		if err := models.ValidatePath(path); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	oldCode, err := codeAt(h.store, session, from, path)
+	if err != nil {
+		writeRevisionError(w, err)
+		return
+	}
+	newCode, err := codeAt(h.store, session, to, path)
+	if err != nil {
+		writeRevisionError(w, err)
+		return
+	}
+
+	name := "code"
+	if path != "" {
+		name = path
+	}
+	hunks := services.Diff(oldCode, newCode, contextLines)
+	unified := services.FormatUnified(fmt.Sprintf("a/%s@%d", name, from), fmt.Sprintf("b/%s@%d", name, to), hunks)
+
+	if query.Get("format") == "unified" {
+		w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+		w.Write([]byte(unified))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DiffResponse{
+		SessionID: session.ID,
+		Path:      path,
+		From:      from,
+		To:        to,
+		Unified:   unified,
+		Hunks:     hunks,
+	})
+}
+
+// codeAt returns the code of the file at path, or of the main file, as of
+// revision, rebuilding it from the history unless it is the live one.
+func codeAt(store services.SessionStore, session *models.Session, revision int, path string) (string, error) {
+	workspace := &session.Workspace
+	if revision != session.Revision {
+		snapshot, err := services.Rebuild(store, session.ID, revision)
+		if err != nil {
+			return "", err
+		}
+		workspace = &snapshot.Workspace
+	}
+
+	if path == "" {
+		path = workspace.MainFile
+	}
+	if file := workspace.File(path); file != nil {
+		return file.Code, nil
+	}
+	return "", nil
+}
+
+func writeRevisionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, services.ErrRevisionUnavailable) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
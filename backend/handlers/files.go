@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+func init() {
+	for _, action := range []string{models.FileCreate, models.FileRename, models.FileDelete} {
+		action := action
+		registerMessageType("file_"+action, messageType{
+			newPayload: func() Payload { return &models.FileChange{Action: action} },
+			handle:     (*WebSocketHandler).handleFileChange,
+			mutating:   true,
+		})
+	}
+}
+
+// WorkspaceState is the whole workspace as of Revision, sent to clients
+// joining or falling behind.
+type WorkspaceState struct {
+	Revision int `json:"revision"`
+	models.Workspace
+}
+
+func newWorkspaceState(session *models.Session) WorkspaceState {
+	return WorkspaceState{Revision: session.Revision, Workspace: session.Workspace}
+}
+
+// FileInfo describes a workspace file without its code. Size counts
+// characters.
+type FileInfo struct {
+	Path     string `json:"path"`
+	Language string `json:"language"`
+	Size     int    `json:"size"`
+}
+
+type FileListResponse struct {
+	SessionID string     `json:"session_id"`
+	Revision  int        `json:"revision"`
+	MainFile  string     `json:"main_file"`
+	Files     []FileInfo `json:"files"`
+}
+
+type FileResponse struct {
+	SessionID string `json:"session_id"`
+	Revision  int    `json:"revision"`
+	models.File
+}
+
+// ListFiles returns the files of the session's workspace, by path.
+func (h *SessionHandler) ListFiles(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	response := FileListResponse{
+		SessionID: session.ID,
+		Revision:  session.Revision,
+		MainFile:  session.MainFile,
+		Files:     make([]FileInfo, len(session.Files)),
+	}
+	for i, file := range session.Files {
+		response.Files[i] = FileInfo{
+			Path:     file.Path,
+			Language: file.Language,
+			Size:     utf8.RuneCountInString(file.Code),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetFile returns one file of the session's workspace with its code.
+func (h *SessionHandler) GetFile(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	file := session.File(chi.URLParam(r, "*"))
+	if file == nil {
+		http.Error(w, services.ErrFileNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(FileResponse{
+		SessionID: session.ID,
+		Revision:  session.Revision,
+		File:      *file,
+	})
+}
+
+func (h *WebSocketHandler) handleFileChange(client *Client, payload Payload) {
+	change := payload.(*models.FileChange)
+
+	unlock := h.lockSession(client.sessionID)
+	record, err := h.store.ChangeFile(client.sessionID, client.user.ID, change)
+	if err == nil {
+		broadcast := *change
+		broadcast.Revision = record.Revision
+		broadcast.Language = record.Language
+		h.broadcastToSession(client.sessionID, models.WSMessage{
+			Type:      "file_" + change.Action,
+			SessionID: client.sessionID,
+			UserID:    client.user.ID,
+			Data:      broadcast,
+		}, client)
+		h.broadcastAnchors(client.sessionID, record)
+	}
+	unlock()
+
+	if errors.Is(err, services.ErrFileNotFound) || errors.Is(err, services.ErrFileExists) || errors.Is(err, services.ErrMainFile) {
+		// Rejected for its path rather than for being behind, so the client
+		// needs no snapshot
+		h.sendError(client, "file_"+change.Action, errInvalidPayload, err.Error())
+		return
+	}
+	h.replyToWrite(client, record, err)
+}
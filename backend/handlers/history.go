@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+const (
+	defaultLogCount = 100
+	maxLogCount     = 1000
+)
+
+// SessionLogResponse carries one page of history. Next, when set, is the
+// start to pass for the following page.
+type SessionLogResponse struct {
+	Entries []models.HistoryEntry `json:"entries"`
+	Next    string                `json:"next,omitempty"`
+}
+
+// GetSessionLog returns the history entries between ?start= and ?end=,
+// which take entry IDs as XRANGE does, oldest first and at most ?count= of
+// them.
+func (h *SessionHandler) GetSessionLog(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	count := defaultLogCount
+	if v := query.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLogCount {
+			http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxLogCount), http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+
+	entries, err := h.store.GetHistory(session.ID, query.Get("start"), query.Get("end"), count)
+	if errors.Is(err, services.ErrInvalidEntryID) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := SessionLogResponse{Entries: entries}
+	if len(entries) == count {
+		response.Next = "(" + entries[len(entries)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// SessionHistoryResponse lists the revisions still in the history. Any
+// revision from Earliest to Revision can be fetched.
+type SessionHistoryResponse struct {
+	Revision  int                      `json:"revision"`
+	Earliest  int                      `json:"earliest"`
+	Revisions []models.RevisionSummary `json:"revisions"`
+}
+
+func (h *SessionHandler) GetSessionHistory(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	earliest, err := services.EarliestRevision(h.store, session.ID)
+	if errors.Is(err, services.ErrRevisionUnavailable) {
+		// Nothing snapshotted yet, as with sessions older than the history
+		earliest = session.Revision
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	revisions, err := services.ListRevisions(h.store, session.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SessionHistoryResponse{
+		Revision:  session.Revision,
+		Earliest:  earliest,
+		Revisions: revisions,
+	})
+}
+
+// RevisionResponse holds the workspace as of Revision. Code and Language
+// are those of its main file.
+type RevisionResponse struct {
+	SessionID string `json:"session_id"`
+	Revision  int    `json:"revision"`
+	Code      string `json:"code"`
+	Language  string `json:"language"`
+	models.Workspace
+}
+
+// GetRevision returns the workspace as of a past revision.
+func (h *SessionHandler) GetRevision(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	revision, err := strconv.Atoi(chi.URLParam(r, "rev"))
+	if err != nil || revision < 0 || revision > session.Revision {
+		http.Error(w, fmt.Sprintf("revision must be between 0 and %d", session.Revision), http.StatusBadRequest)
+		return
+	}
+
+	snapshot, err := services.Rebuild(h.store, session.ID, revision)
+	if err != nil {
+		writeRevisionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RevisionResponse{
+		SessionID: session.ID,
+		Revision:  snapshot.Revision,
+		Code:      snapshot.Code,
+		Language:  snapshot.Language,
+		Workspace: snapshot.Workspace,
+	})
+}
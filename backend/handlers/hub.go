@@ -0,0 +1,467 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+// heartbeatInterval is how often hubs renew the leases of their clients'
+// connections, and how often expired ones are looked for.
+const heartbeatInterval = services.ConnectionLease / 3
+
+// deliveryPolicy decides what happens to a broadcast that doesn't fit in a
+// client's send buffer.
+type deliveryPolicy int
+
+const (
+	// policyResync drops the backlog and resends a fresh snapshot.
+	policyResync deliveryPolicy = iota
+	// policyCoalesce keeps only the latest message per sender until the
+	// client catches up.
+	policyCoalesce
+)
+
+var deliveryPolicies = map[string]deliveryPolicy{
+	"cursor_move": policyCoalesce,
+	"presence":    policyCoalesce,
+}
+
+// sessionHub owns the clients of one session on this instance. Its client
+// set is only touched by its own goroutine, which also delivers everything
+// published to the session through the store. Snapshots and replays are
+// loaded beside it and handed back through caughtUp.
+type sessionHub struct {
+	sessionID  string
+	handler    *WebSocketHandler
+	clients    map[*Client]bool
+	held       map[*Client]*heldBack // clients waiting for a snapshot or replay
+	refs       int                   // joined clients, guarded by handler.mu
+	register   chan *Client
+	unregister chan *Client
+	caughtUp   chan catchUp
+	stats      chan chan []ClientStats
+	conns      chan chan []string
+	lost       chan []string
+	stop       chan struct{}
+}
+
+// catchUp is a snapshot or replay loaded for one client.
+type catchUp struct {
+	client *Client
+	frames frameList
+}
+
+// heldBack keeps the broadcasts for a client until it has caught up, so none
+// reach it ahead of the state they follow.
+type heldBack struct {
+	envelopes []services.Envelope
+	stale     bool // more arrived than fit, so a fresh snapshot is needed
+}
+
+func newSessionHub(sessionID string, handler *WebSocketHandler) *sessionHub {
+	return &sessionHub{
+		sessionID:  sessionID,
+		handler:    handler,
+		clients:    make(map[*Client]bool),
+		held:       make(map[*Client]*heldBack),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		caughtUp:   make(chan catchUp),
+		stats:      make(chan chan []ClientStats),
+		conns:      make(chan chan []string),
+		lost:       make(chan []string),
+		stop:       make(chan struct{}),
+	}
+}
+
+func (hub *sessionHub) run() {
+	sub := hub.handler.store.Subscribe(hub.sessionID)
+	defer sub.Close()
+
+	go hub.renewLeases()
+
+	messages := sub.Messages()
+	for {
+		select {
+		case client := <-hub.register:
+			hub.clients[client] = true
+
+			// Tell the client its connection, which it can resume with
+			// ?connection= when it reconnects
+			hub.handler.sendToClient(client, models.WSMessage{
+				Type:      "connected",
+				SessionID: hub.sessionID,
+				Data:      map[string]string{"connection_id": client.id},
+			})
+
+			// Bring the newly connected client up to date
+			if client.since >= 0 {
+				hub.catchUp(client, hub.handler.missedEvents)
+			} else {
+				hub.catchUp(client, hub.handler.snapshot)
+			}
+
+		case done := <-hub.caughtUp:
+			hub.finishCatchUp(done)
+
+		case client := <-hub.unregister:
+			if hub.clients[client] {
+				delete(hub.clients, client)
+				delete(hub.held, client)
+				client.close()
+			}
+
+		case reply := <-hub.stats:
+			reply <- hub.clientStats()
+
+		case reply := <-hub.conns:
+			connIDs := make([]string, 0, len(hub.clients))
+			for client := range hub.clients {
+				connIDs = append(connIDs, client.id)
+			}
+			reply <- connIDs
+
+		case connIDs := <-hub.lost:
+			hub.closeLost(connIDs)
+
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			var env services.Envelope
+			if err := json.Unmarshal(msg, &env); err != nil {
+				log.Printf("Invalid session broadcast: %v", err)
+				continue
+			}
+			hub.deliver(env)
+			hub.applyMembership(env)
+
+		case <-hub.stop:
+			return
+		}
+	}
+}
+
+func (hub *sessionHub) deliver(env services.Envelope) {
+	policy := deliveryPolicies[env.Type]
+	key := env.Type + ":" + env.UserID
+	for client := range hub.clients {
+		if client.id == env.Exclude {
+			continue
+		}
+		hub.deliverTo(client, env, policy, key)
+	}
+}
+
+func (hub *sessionHub) deliverTo(client *Client, env services.Envelope, policy deliveryPolicy, key string) {
+	if held := hub.held[client]; held != nil {
+		if len(held.envelopes) < cap(client.send) {
+			held.envelopes = append(held.envelopes, env)
+		} else {
+			held.envelopes, held.stale = nil, true
+		}
+		return
+	}
+
+	// A newer message must not overtake one still parked for its key
+	if policy == policyCoalesce && client.replacePending(key, env.Message) {
+		return
+	}
+	if client.trySend(env.Message) {
+		return
+	}
+
+	// The client is too slow to keep up
+	switch policy {
+	case policyCoalesce:
+		client.coalesce(key, env.Message)
+	default:
+		hub.resync(client)
+	}
+}
+
+// applyMembership keeps local clients in step with role changes and
+// removals made through any instance.
+func (hub *sessionHub) applyMembership(env services.Envelope) {
+	if env.Type != "role_change" && env.Type != "participant_removed" {
+		return
+	}
+
+	var msg struct {
+		Data models.RoleChange `json:"data"`
+	}
+	if err := json.Unmarshal(env.Message, &msg); err != nil {
+		return
+	}
+
+	for client := range hub.clients {
+		if client.user.ID != msg.Data.UserID {
+			continue
+		}
+		if env.Type == "role_change" {
+			client.setRole(msg.Data.Role)
+		} else {
+			// Removed participants get the notice, then are disconnected
+			delete(hub.clients, client)
+			delete(hub.held, client)
+			client.close()
+		}
+	}
+}
+
+// resync replaces a lagging client's backlog with a resync notice and a
+// fresh snapshot, which also reflects the message that didn't fit.
+func (hub *sessionHub) resync(client *Client) {
+	dropped := client.drain()
+	client.resyncs++
+	log.Printf("Client %s in session %s fell behind, dropped %d messages", client.id, hub.sessionID, dropped)
+
+	hub.handler.sendToClient(client, models.WSMessage{
+		Type:      "resync_required",
+		SessionID: hub.sessionID,
+		Data: map[string]interface{}{
+			"reason":  "slow_consumer",
+			"dropped": dropped,
+		},
+	})
+	hub.catchUp(client, hub.handler.snapshot)
+}
+
+// catchUp holds back broadcasts for client while load reads what it missed
+// from the store, off the hub goroutine so other clients aren't kept
+// waiting.
+func (hub *sessionHub) catchUp(client *Client, load func(*Client) frameList) {
+	hub.held[client] = &heldBack{}
+	go func() {
+		frames := load(client)
+		select {
+		case hub.caughtUp <- catchUp{client: client, frames: frames}:
+		case <-hub.stop:
+		}
+	}()
+}
+
+// finishCatchUp sends a client what was loaded for it, followed by the
+// broadcasts held back meanwhile.
+func (hub *sessionHub) finishCatchUp(done catchUp) {
+	held := hub.held[done.client]
+	delete(hub.held, done.client)
+	if held == nil || !hub.clients[done.client] {
+		return
+	}
+	if held.stale {
+		hub.resync(done.client)
+		return
+	}
+
+	done.frames.send(done.client)
+	for _, env := range held.envelopes {
+		hub.deliverTo(done.client, env, deliveryPolicies[env.Type], env.Type+":"+env.UserID)
+	}
+}
+
+// renewLeases keeps the connections of the hub's clients leased until the
+// hub stops. It runs beside the hub so the store round trip doesn't hold up
+// delivery.
+func (hub *sessionHub) renewLeases() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-hub.stop:
+			return
+		}
+
+		reply := make(chan []string, 1)
+		select {
+		case hub.conns <- reply:
+		case <-hub.stop:
+			return
+		}
+		lost, err := hub.handler.store.RenewConnections(hub.sessionID, <-reply)
+		if err != nil {
+			log.Printf("Failed to renew connections in session %s: %v", hub.sessionID, err)
+			continue
+		}
+		if len(lost) == 0 {
+			continue
+		}
+		select {
+		case hub.lost <- lost:
+		case <-hub.stop:
+			return
+		}
+	}
+}
+
+// closeLost hangs up on clients whose leases ran out before they could be
+// renewed, say while the store was out of reach. Their users were seen to
+// leave, so they reconnect to join again rather than linger unseen.
+func (hub *sessionHub) closeLost(connIDs []string) {
+	lost := make(map[string]bool, len(connIDs))
+	for _, connID := range connIDs {
+		lost[connID] = true
+	}
+	for client := range hub.clients {
+		if lost[client.id] {
+			log.Printf("Connection %s to session %s lost its lease, closing it", client.id, hub.sessionID)
+			delete(hub.clients, client)
+			delete(hub.held, client)
+			client.close()
+		}
+	}
+}
+
+func (hub *sessionHub) clientStats() []ClientStats {
+	stats := make([]ClientStats, 0, len(hub.clients))
+	for client := range hub.clients {
+		client.mu.Lock()
+		stats = append(stats, ClientStats{
+			ClientID:  client.id,
+			SessionID: hub.sessionID,
+			UserID:    client.user.ID,
+			Queued:    len(client.send) + len(client.pending),
+			Capacity:  cap(client.send),
+			Coalesced: client.coalesced,
+			Resyncs:   client.resyncs,
+		})
+		client.mu.Unlock()
+	}
+	return stats
+}
+
+// join marks client's user present and attaches client to its session's
+// hub, starting the hub if this is the session's first client on this
+// instance. Clients that can't connect aren't attached.
+func (h *WebSocketHandler) join(client *Client) error {
+	first, err := h.store.Connect(client.sessionID, client.profile(), client.id)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	hub := h.hubs[client.sessionID]
+	if hub == nil {
+		hub = newSessionHub(client.sessionID, h)
+		h.hubs[client.sessionID] = hub
+		go hub.run()
+	}
+	hub.refs++
+	h.mu.Unlock()
+
+	hub.register <- client
+
+	// Notify others about new user, unless they are already connected
+	if first {
+		user := client.profile()
+		h.broadcastToSession(client.sessionID, models.WSMessage{
+			Type:      "user_join",
+			SessionID: client.sessionID,
+			UserID:    user.ID,
+			User:      &user,
+		}, client)
+	}
+	return nil
+}
+
+// leave detaches client from its hub and tears the hub down once its last
+// client is gone.
+func (h *WebSocketHandler) leave(client *Client) {
+	h.mu.Lock()
+	hub := h.hubs[client.sessionID]
+	h.mu.Unlock()
+	if hub == nil {
+		return
+	}
+
+	hub.unregister <- client
+
+	h.mu.Lock()
+	hub.refs--
+	if hub.refs == 0 {
+		delete(h.hubs, client.sessionID)
+		close(hub.stop)
+	}
+	h.mu.Unlock()
+
+	// Remove user from session once their last connection is gone
+	left, err := h.store.Disconnect(client.sessionID, client.id)
+	if err != nil {
+		// The connection's lease will run out instead
+		log.Printf("Failed to disconnect %s from session %s: %v", client.user.ID, client.sessionID, err)
+		return
+	}
+	if left {
+		h.userLeft(client.sessionID, client.user.ID)
+	}
+}
+
+// userLeft notifies the others in a session about a user leaving.
+func (h *WebSocketHandler) userLeft(sessionID, userID string) {
+	h.broadcastToSession(sessionID, models.WSMessage{
+		Type:      "user_leave",
+		SessionID: sessionID,
+		UserID:    userID,
+	}, nil)
+}
+
+// ExpireGhosts drops users whose connections' leases ran out, because the
+// instance holding them went away, and tells their sessions they left. It
+// runs until the process exits.
+func (h *WebSocketHandler) ExpireGhosts() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		h.expireGhosts(now)
+	}
+}
+
+func (h *WebSocketHandler) expireGhosts(now time.Time) {
+	departures, err := h.store.ExpireConnections(now)
+	if err != nil {
+		log.Printf("Failed to expire connections: %v", err)
+	}
+	for _, departure := range departures {
+		log.Printf("Connection of %s to session %s expired", departure.UserID, departure.SessionID)
+		h.userLeft(departure.SessionID, departure.UserID)
+	}
+}
+
+// lockSession serializes writes to one session on this instance so their
+// broadcasts go out in revision order. It returns the unlock function.
+func (h *WebSocketHandler) lockSession(sessionID string) func() {
+	h.mu.Lock()
+	l := h.locks[sessionID]
+	if l == nil {
+		l = &sessionLock{}
+		h.locks[sessionID] = l
+	}
+	l.waiters++
+	h.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		h.mu.Lock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(h.locks, sessionID)
+		}
+		h.mu.Unlock()
+	}
+}
+
+type sessionLock struct {
+	sync.Mutex
+	waiters int // guarded by handler.mu
+}
@@ -0,0 +1,444 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+func newTestHandler(t *testing.T) *WebSocketHandler {
+	t.Helper()
+
+	store := services.NewMemoryStore()
+	return NewWebSocketHandler(store, services.NewInviteService(store), nil)
+}
+
+func newTestClient(sessionID, userID string) *Client {
+	return newClient(nil, sessionID, models.User{ID: userID}, -1)
+}
+
+// createTestSession creates a session that each of userIDs may join.
+func createTestSession(t *testing.T, h *WebSocketHandler, sessionID string, userIDs ...string) {
+	t.Helper()
+
+	if err := h.store.CreateSession(&models.Session{ID: sessionID, Language: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range userIDs {
+		if _, err := h.store.AdmitUser(sessionID, models.User{ID: userID}, models.RoleEditor); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// joinTestClient joins client to its session, failing the test if it can't.
+func joinTestClient(t *testing.T, h *WebSocketHandler, client *Client) {
+	t.Helper()
+
+	if err := h.join(client); err != nil {
+		t.Errorf("client %s failed to join %s: %v", client.user.ID, client.sessionID, err)
+	}
+}
+
+// waitForType reads from client until it has seen n messages of the given
+// type, ignoring everything else.
+func waitForType(t *testing.T, client *Client, msgType string, n int) []models.WSMessage {
+	t.Helper()
+
+	var got []models.WSMessage
+	timeout := time.After(10 * time.Second)
+	for len(got) < n {
+		select {
+		case data, ok := <-client.send:
+			if !ok {
+				t.Fatalf("client %s closed after %d/%d %s messages", client.user.ID, len(got), n, msgType)
+			}
+			var msg models.WSMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatalf("invalid message: %v", err)
+			}
+			if msg.Type == msgType {
+				got = append(got, msg)
+			}
+		case <-timeout:
+			t.Fatalf("client %s got %d/%d %s messages", client.user.ID, len(got), n, msgType)
+		}
+	}
+	return got
+}
+
+func assertNoHubs(t *testing.T, h *WebSocketHandler) {
+	t.Helper()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.hubs) != 0 {
+		t.Fatalf("expected all hubs torn down, %d left", len(h.hubs))
+	}
+	if len(h.locks) != 0 {
+		t.Fatalf("expected all session locks released, %d left", len(h.locks))
+	}
+}
+
+func TestHubsIsolateManyConcurrentSessions(t *testing.T) {
+	h := newTestHandler(t)
+
+	const sessions = 300
+	const perSession = 3
+
+	clients := make([][]*Client, sessions)
+	for s := range clients {
+		sessionID := fmt.Sprintf("s%d", s)
+		createTestSession(t, h, sessionID, "u0", "u1", "u2")
+		for c := 0; c < perSession; c++ {
+			clients[s] = append(clients[s], newTestClient(sessionID, fmt.Sprintf("u%d", c)))
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, session := range clients {
+		for _, client := range session {
+			wg.Add(1)
+			go func(client *Client) {
+				defer wg.Done()
+				joinTestClient(t, h, client)
+			}(client)
+		}
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	if len(h.hubs) != sessions {
+		t.Fatalf("expected %d hubs, got %d", sessions, len(h.hubs))
+	}
+	h.mu.Unlock()
+
+	for _, session := range clients {
+		for _, client := range session {
+			wg.Add(1)
+			go func(client *Client) {
+				defer wg.Done()
+				h.broadcastToSession(client.sessionID, models.WSMessage{
+					Type:      "cursor_move",
+					SessionID: client.sessionID,
+					UserID:    client.user.ID,
+				}, client)
+			}(client)
+		}
+	}
+	wg.Wait()
+
+	for _, session := range clients {
+		for _, client := range session {
+			for _, msg := range waitForType(t, client, "cursor_move", perSession-1) {
+				if msg.SessionID != client.sessionID {
+					t.Fatalf("client in %s received message for %s", client.sessionID, msg.SessionID)
+				}
+				if msg.UserID == client.user.ID {
+					t.Fatalf("client %s received its own broadcast", client.user.ID)
+				}
+			}
+		}
+	}
+
+	for _, session := range clients {
+		for _, client := range session {
+			wg.Add(1)
+			go func(client *Client) {
+				defer wg.Done()
+				h.leave(client)
+			}(client)
+		}
+	}
+	wg.Wait()
+
+	assertNoHubs(t, h)
+	for _, session := range clients {
+		for _, client := range session {
+			// A closed client's channel drains and then reports closed
+			timeout := time.After(10 * time.Second)
+		drain:
+			for {
+				select {
+				case _, ok := <-client.send:
+					if !ok {
+						break drain
+					}
+				case <-timeout:
+					t.Fatalf("client %s in %s was not closed", client.user.ID, client.sessionID)
+				}
+			}
+		}
+	}
+}
+
+func TestHubChurnRecreatesHub(t *testing.T) {
+	h := newTestHandler(t)
+	users := []string{"a", "b"}
+	for i := 0; i < 50; i++ {
+		users = append(users, fmt.Sprintf("u%d", i))
+	}
+	createTestSession(t, h, "churn", users...)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				client := newTestClient("churn", fmt.Sprintf("u%d", i))
+				joinTestClient(t, h, client)
+				h.leave(client)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assertNoHubs(t, h)
+
+	a := newTestClient("churn", "a")
+	b := newTestClient("churn", "b")
+	joinTestClient(t, h, a)
+	joinTestClient(t, h, b)
+
+	h.broadcastToSession("churn", models.WSMessage{Type: "cursor_move", UserID: "b"}, b)
+	waitForType(t, a, "cursor_move", 1)
+
+	h.leave(a)
+	h.leave(b)
+	assertNoHubs(t, h)
+}
+
+func TestUserStaysUntilLastTabCloses(t *testing.T) {
+	h := newTestHandler(t)
+	createTestSession(t, h, "tabs", "owner", "watcher")
+
+	watcher := newTestClient("tabs", "watcher")
+	joinTestClient(t, h, watcher)
+	tabs := []*Client{newTestClient("tabs", "owner"), newTestClient("tabs", "owner")}
+	for _, tab := range tabs {
+		joinTestClient(t, h, tab)
+	}
+	h.leave(tabs[0])
+
+	session, err := h.store.GetSession("tabs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(session.Users) != 2 || session.Users[0].ID != "owner" {
+		t.Fatalf("expected the owner still present with a tab open, got %+v", session.Users)
+	}
+
+	h.leave(tabs[1])
+	h.broadcastToSession("tabs", models.WSMessage{Type: "cursor_move", UserID: "owner"}, nil)
+
+	// Everything the watcher saw up to the marker counts each change once
+	seen := make(map[string]int)
+	for seen["cursor_move"] == 0 {
+		var msg models.WSMessage
+		json.Unmarshal(<-watcher.send, &msg)
+		seen[msg.Type]++
+	}
+	if seen["user_join"] != 1 || seen["user_leave"] != 1 {
+		t.Fatalf("expected one join and one leave, got %v", seen)
+	}
+	if session, _ = h.store.GetSession("tabs"); len(session.Users) != 1 {
+		t.Fatalf("expected the owner gone with their last tab, got %+v", session.Users)
+	}
+
+	h.leave(watcher)
+	assertNoHubs(t, h)
+}
+
+func TestReplaySkipsOnlyTheResumedConnection(t *testing.T) {
+	h := newTestHandler(t)
+	createTestSession(t, h, "replay", "bob")
+
+	since, err := h.store.GetEventSeq("replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := newTestClient("replay", "bob")
+	h.broadcastToSession("replay", models.WSMessage{Type: "edit", SessionID: "replay", UserID: "bob"}, writer)
+
+	// The writer's own reconnect skips its edit, while another tab of the
+	// same user gets it
+	for _, tab := range []struct {
+		resumes string
+		want    int
+	}{{writer.id, 0}, {"other-tab", 1}, {"", 1}} {
+		client := newTestClient("replay", "bob")
+		client.since, client.resumes = since, tab.resumes
+		h.replay(client)
+		if len(client.send) != tab.want {
+			t.Fatalf("resuming %q replayed %d events, want %d", tab.resumes, len(client.send), tab.want)
+		}
+	}
+}
+
+func TestSessionLocksSerializeWrites(t *testing.T) {
+	h := newTestHandler(t)
+
+	// Each counter is only protected by its session's lock
+	counts := make([]int, 100)
+	var wg sync.WaitGroup
+	for s := range counts {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(s int) {
+				defer wg.Done()
+				unlock := h.lockSession(fmt.Sprintf("s%d", s))
+				counts[s]++
+				unlock()
+			}(s)
+		}
+	}
+	wg.Wait()
+
+	for s, got := range counts {
+		if got != 10 {
+			t.Fatalf("expected 10 writes to s%d, got %d", s, got)
+		}
+	}
+	assertNoHubs(t, h)
+}
+
+func TestSlowConsumerCoalescesThenResyncs(t *testing.T) {
+	h := newTestHandler(t)
+	if err := h.store.CreateSession(&models.Session{ID: "slow", Code: "x", Language: "go"}); err != nil {
+		t.Fatal(err)
+	}
+
+	hub := newSessionHub("slow", h)
+	client := newTestClient("slow", "reader")
+	hub.clients[client] = true
+
+	for client.trySend([]byte(`{"type":"filler"}`)) {
+	}
+
+	// Cursor moves from the same user collapse into the latest one
+	for i := 0; i < 3; i++ {
+		hub.deliver(services.Envelope{Type: "cursor_move", UserID: "writer", Message: json.RawMessage(fmt.Sprintf(`{"type":"cursor_move","seq":%d}`, i))})
+	}
+
+	// Once there is room again, a newer move still waits behind the parked
+	// one rather than overtaking it
+	<-client.send
+	hub.deliver(services.Envelope{Type: "cursor_move", UserID: "writer", Message: json.RawMessage(`{"type":"cursor_move","seq":3}`)})
+	if len(client.send) != cap(client.send)-1 {
+		t.Fatal("cursor move overtook the parked one")
+	}
+
+	pending := client.takePending()
+	if len(pending) != 1 || string(pending[0]) != `{"type":"cursor_move","seq":3}` {
+		t.Fatalf("expected only the latest cursor move, got %q", pending)
+	}
+	if client.coalesced != 3 {
+		t.Fatalf("expected 3 coalesced messages, got %d", client.coalesced)
+	}
+	client.trySend([]byte(`{"type":"filler"}`))
+
+	// Anything else that doesn't fit triggers a resync instead of a kick
+	hub.deliver(services.Envelope{Type: "code_change", UserID: "writer", Message: json.RawMessage(`{"type":"code_change"}`)})
+	if client.closed {
+		t.Fatal("slow client was disconnected")
+	}
+	if client.resyncs != 1 {
+		t.Fatalf("expected 1 resync, got %d", client.resyncs)
+	}
+
+	// The snapshot is loaded beside the hub, which holds back what arrives
+	// meanwhile so it can't overtake the snapshot
+	hub.deliver(services.Envelope{Type: "edit", UserID: "writer", Message: json.RawMessage(`{"type":"edit"}`)})
+	if len(client.send) != 1 {
+		t.Fatalf("expected only the resync notice before the snapshot, got %d messages", len(client.send))
+	}
+	hub.finishCatchUp(<-hub.caughtUp)
+
+	var types []string
+	for len(client.send) > 0 {
+		var msg models.WSMessage
+		json.Unmarshal(<-client.send, &msg)
+		types = append(types, msg.Type)
+	}
+	if strings.Join(types, " ") != "resync_required workspace code_change language_change comments suggestions review chat_history presence_state edit" {
+		t.Fatalf("expected resync notice followed by a snapshot and the held edit, got %v", types)
+	}
+
+	stats := hub.clientStats()
+	if len(stats) != 1 || stats[0].Resyncs != 1 || stats[0].Queued != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestClientsThatLostTheirLeaseAreClosed(t *testing.T) {
+	h := newTestHandler(t)
+	createTestSession(t, h, "blip", "ada", "bob")
+
+	ada := newTestClient("blip", "ada")
+	bob := newTestClient("blip", "bob")
+	joinTestClient(t, h, ada)
+	joinTestClient(t, h, bob)
+
+	// Ada's lease runs out, as if this instance couldn't renew it in time
+	if _, err := h.store.Disconnect("blip", ada.id); err != nil {
+		t.Fatal(err)
+	}
+	lost, err := h.store.RenewConnections("blip", []string{ada.id, bob.id})
+	if err != nil || len(lost) != 1 || lost[0] != ada.id {
+		t.Fatalf("expected ada's connection lost, got %v %v", lost, err)
+	}
+	h.mu.Lock()
+	hub := h.hubs["blip"]
+	h.mu.Unlock()
+	hub.lost <- lost
+
+	// Ada is hung up on so the client reconnects, while bob stays
+	timeout := time.After(10 * time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-ada.send:
+		case <-timeout:
+			t.Fatal("client that lost its lease was kept open")
+		}
+	}
+	h.broadcastToSession("blip", models.WSMessage{Type: "cursor_move", UserID: "ada"}, nil)
+	waitForType(t, bob, "cursor_move", 1)
+
+	h.leave(ada)
+	h.leave(bob)
+	assertNoHubs(t, h)
+}
+
+func TestCursorMovesCarryTheSendersProfile(t *testing.T) {
+	h := newTestHandler(t)
+	createTestSession(t, h, "cursors", "ada", "bob")
+
+	ada := newClient(nil, "cursors", models.User{ID: "ada", Name: "Ada", Color: "#ef4444"}, -1)
+	bob := newTestClient("cursors", "bob")
+	joinTestClient(t, h, ada)
+	joinTestClient(t, h, bob)
+
+	h.dispatch(ada, []byte(`{"type":"cursor_move","data":{"line":3,"column":1,"user_id":"bob","user":{"id":"bob","name":"Mallory","color":"#000000"}}}`))
+
+	msg := waitForType(t, bob, "cursor_move", 1)[0]
+	data, _ := json.Marshal(msg.Data)
+	var cursor models.CursorPosition
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		t.Fatal(err)
+	}
+	if cursor.Line != 3 || cursor.UserID != "ada" || cursor.User == nil ||
+		cursor.User.ID != "ada" || cursor.User.Name != "Ada" || cursor.User.Color != "#ef4444" {
+		t.Fatalf("cursor %+v from ada carries user %+v", cursor, cursor.User)
+	}
+
+	h.leave(ada)
+	h.leave(bob)
+	assertNoHubs(t, h)
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+const defaultInviteTTL = 24 * time.Hour
+
+// CreateInviteRequest fields are optional: the role defaults to the
+// session's default role, the expiry to a day and uses to unlimited.
+type CreateInviteRequest struct {
+	Role      models.Role `json:"role"`
+	ExpiresIn int         `json:"expires_in"` // seconds
+	MaxUses   int         `json:"max_uses"`
+}
+
+type CreateInviteResponse struct {
+	Invite models.Invite `json:"invite"`
+	Token  string        `json:"token"`
+}
+
+func (h *SessionHandler) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var req CreateInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = session.DefaultRole
+	}
+	if req.Role != models.RoleEditor && req.Role != models.RoleViewer {
+		http.Error(w, "role must be editor or viewer", http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	if ttl == 0 {
+		ttl = defaultInviteTTL
+	}
+	if ttl < 0 || ttl > services.MaxInviteTTL {
+		http.Error(w, fmt.Sprintf("expires_in must be between 1 and %d seconds", int(services.MaxInviteTTL.Seconds())), http.StatusBadRequest)
+		return
+	}
+
+	if req.MaxUses < 0 {
+		http.Error(w, "max_uses must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	user, _ := UserFromContext(r.Context())
+
+	invite, token, err := h.invites.Create(session.ID, user.ID, req.Role, ttl, req.MaxUses)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateInviteResponse{
+		Invite: *invite,
+		Token:  token,
+	})
+}
+
+func (h *SessionHandler) ListInvites(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	invites, err := h.invites.List(session.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+}
+
+func (h *SessionHandler) RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.invites.Revoke(session.ID, chi.URLParam(r, "inviteID"))
+	if errors.Is(err, services.ErrInviteNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJoinError reports why a user couldn't be admitted to a session.
+func writeJoinError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrSessionNotFound):
+		http.Error(w, "session not found", http.StatusNotFound)
+	case errors.Is(err, services.ErrNotParticipant):
+		http.Error(w, "an invite is required to join this session", http.StatusForbidden)
+	case errors.Is(err, services.ErrInvalidInvite),
+		errors.Is(err, services.ErrInviteExpired),
+		errors.Is(err, services.ErrInviteUsedUp):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
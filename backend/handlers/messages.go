@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"codestream/models"
+)
+
+// Error codes sent in "error" replies.
+const (
+	errInvalidJSON    = "invalid_json"
+	errUnknownType    = "unknown_type"
+	errInvalidPayload = "invalid_payload"
+	errWriteRejected  = "write_rejected"
+	errForbidden      = "forbidden"
+	errUnavailable    = "unavailable"
+)
+
+// Payload is the typed data of an incoming websocket message.
+type Payload interface {
+	Validate() error
+}
+
+type messageHandler func(h *WebSocketHandler, client *Client, payload Payload)
+
+type messageType struct {
+	newPayload func() Payload // nil for messages without data
+	optional   bool           // data may be left out, leaving the payload empty
+	handle     messageHandler
+	mutating   bool // changes the document, so viewers may not send it
+	ownerOnly  bool
+}
+
+var messageTypes = map[string]messageType{}
+
+// registerMessageType makes a client message type known to readPump. Files
+// adding new message types call it from init.
+func registerMessageType(name string, mt messageType) {
+	if _, ok := messageTypes[name]; ok {
+		panic(fmt.Sprintf("message type %q registered twice", name))
+	}
+	messageTypes[name] = mt
+}
+
+func init() {
+	registerMessageType("cursor_move", messageType{
+		newPayload: func() Payload { return &models.CursorPosition{} },
+		handle:     (*WebSocketHandler).handleCursorMove,
+	})
+	registerMessageType("presence", messageType{
+		newPayload: func() Payload { return &models.Presence{} },
+		handle:     (*WebSocketHandler).handlePresence,
+	})
+	registerMessageType("code_change", messageType{
+		newPayload: func() Payload { return &models.CodeChange{} },
+		handle:     (*WebSocketHandler).handleCodeChange,
+		mutating:   true,
+	})
+	registerMessageType("edit", messageType{
+		newPayload: func() Payload { return &models.EditData{} },
+		handle:     (*WebSocketHandler).handleEdit,
+		mutating:   true,
+	})
+	registerMessageType("language_change", messageType{
+		newPayload: func() Payload { return &models.LanguageChange{} },
+		handle:     (*WebSocketHandler).handleLanguageChange,
+		mutating:   true,
+	})
+	registerMessageType("ping", messageType{
+		handle: (*WebSocketHandler).handlePing,
+	})
+}
+
+// inboundMessage is an incoming frame with its data left undecoded until the
+// type is known.
+type inboundMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// dispatch decodes, validates and handles one incoming frame, replying with
+// a structured error when it can't be accepted.
+func (h *WebSocketHandler) dispatch(client *Client, frame []byte) {
+	var msg inboundMessage
+	if err := json.Unmarshal(frame, &msg); err != nil {
+		h.sendError(client, "", errInvalidJSON, err.Error())
+		return
+	}
+
+	mt, ok := messageTypes[msg.Type]
+	if !ok {
+		h.sendError(client, msg.Type, errUnknownType, fmt.Sprintf("unknown message type %q", msg.Type))
+		return
+	}
+
+	role := client.role()
+	if (mt.mutating && role != models.RoleOwner && role != models.RoleEditor) ||
+		(mt.ownerOnly && role != models.RoleOwner) {
+		h.sendError(client, msg.Type, errForbidden, fmt.Sprintf("%s may not send %s", role, msg.Type))
+		return
+	}
+
+	var payload Payload
+	if mt.newPayload != nil {
+		payload = mt.newPayload()
+		if len(msg.Data) == 0 || bytes.Equal(msg.Data, []byte("null")) {
+			if !mt.optional {
+				h.sendError(client, msg.Type, errInvalidPayload, "data is required")
+				return
+			}
+		} else if err := json.Unmarshal(msg.Data, payload); err != nil {
+			h.sendError(client, msg.Type, errInvalidPayload, err.Error())
+			return
+		}
+		if err := payload.Validate(); err != nil {
+			h.sendError(client, msg.Type, errInvalidPayload, err.Error())
+			return
+		}
+	}
+
+	mt.handle(h, client, payload)
+}
+
+func (h *WebSocketHandler) sendError(client *Client, msgType, code, message string) {
+	h.sendToClient(client, models.WSMessage{
+		Type:      "error",
+		SessionID: client.sessionID,
+		Data: models.WSError{
+			Code:    code,
+			Message: message,
+			Type:    msgType,
+		},
+	})
+}
+
+func (h *WebSocketHandler) handleCursorMove(client *Client, payload Payload) {
+	cursor := payload.(*models.CursorPosition)
+
+	// Others label the cursor with who it belongs to, which only the
+	// server can vouch for
+	user := client.profile()
+	cursor.UserID = user.ID
+	cursor.User = &user
+
+	// Broadcast cursor position to other clients
+	h.broadcastToSession(client.sessionID, models.WSMessage{
+		Type:      "cursor_move",
+		SessionID: client.sessionID,
+		UserID:    client.user.ID,
+		Data:      cursor,
+	}, client)
+}
+
+// handlePresence keeps the sender's latest presence for clients joining
+// later and relays it to those connected now.
+func (h *WebSocketHandler) handlePresence(client *Client, payload Payload) {
+	presence := payload.(*models.Presence)
+	presence.UserID = client.user.ID
+	presence.UpdatedAt = time.Now()
+
+	if err := h.store.SetPresence(client.sessionID, presence); err != nil {
+		log.Printf("Failed to save presence of %s in session %s: %v", client.user.ID, client.sessionID, err)
+		h.sendError(client, "presence", errUnavailable, err.Error())
+		return
+	}
+
+	h.broadcastToSession(client.sessionID, models.WSMessage{
+		Type:      "presence",
+		SessionID: client.sessionID,
+		UserID:    client.user.ID,
+		Data:      presence,
+	}, client)
+}
+
+func (h *WebSocketHandler) handleCodeChange(client *Client, payload Payload) {
+	change := payload.(*models.CodeChange)
+
+	record, err := h.commitContent(client.sessionID, client.user.ID, change.Path, change.Revision, &change.Code, nil, client)
+	h.replyToWrite(client, record, err)
+}
+
+func (h *WebSocketHandler) handleEdit(client *Client, payload Payload) {
+	edit := payload.(*models.EditData)
+
+	unlock := h.lockSession(client.sessionID)
+	record, err := h.store.ApplyEdit(client.sessionID, client.user.ID, edit.Path, edit.Revision, edit.Ops)
+	if err == nil {
+		// Only the transformed delta goes out to other clients
+		h.broadcastToSession(client.sessionID, models.WSMessage{
+			Type:      "edit",
+			SessionID: client.sessionID,
+			UserID:    client.user.ID,
+			Data:      record,
+		}, client)
+		h.broadcastAnchors(client.sessionID, record)
+	}
+	unlock()
+	h.replyToWrite(client, record, err)
+}
+
+func (h *WebSocketHandler) handleLanguageChange(client *Client, payload Payload) {
+	change := payload.(*models.LanguageChange)
+
+	record, err := h.commitContent(client.sessionID, client.user.ID, change.Path, change.Revision, nil, &change.Language, client)
+	h.replyToWrite(client, record, err)
+}
+
+func (h *WebSocketHandler) handlePing(client *Client, _ Payload) {
+	h.sendToClient(client, models.WSMessage{
+		Type:      "pong",
+		SessionID: client.sessionID,
+	})
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+func init() {
+	registerMessageType("set_role", messageType{
+		newPayload: func() Payload { return &models.RoleChange{} },
+		handle:     (*WebSocketHandler).handleSetRole,
+		ownerOnly:  true,
+	})
+	registerMessageType("remove_participant", messageType{
+		newPayload: func() Payload { return &models.ParticipantRemoval{} },
+		handle:     (*WebSocketHandler).handleRemoveParticipant,
+		ownerOnly:  true,
+	})
+}
+
+// SetRole promotes or demotes a participant and tells the session.
+func (h *WebSocketHandler) SetRole(sessionID, userID string, role models.Role) error {
+	if err := h.store.SetRole(sessionID, userID, role); err != nil {
+		return err
+	}
+
+	h.broadcastToSession(sessionID, models.WSMessage{
+		Type:      "role_change",
+		SessionID: sessionID,
+		Data:      models.RoleChange{UserID: userID, Role: role},
+	}, nil)
+	h.withdrawVerdict(sessionID, userID)
+	return nil
+}
+
+// RemoveParticipant revokes a participant's access, which also disconnects
+// them on every instance.
+func (h *WebSocketHandler) RemoveParticipant(sessionID, userID string) error {
+	if err := h.store.RemoveParticipant(sessionID, userID); err != nil {
+		return err
+	}
+
+	h.broadcastToSession(sessionID, models.WSMessage{
+		Type:      "participant_removed",
+		SessionID: sessionID,
+		Data:      models.ParticipantRemoval{UserID: userID},
+	}, nil)
+	h.withdrawVerdict(sessionID, userID)
+	return nil
+}
+
+// withdrawVerdict drops the verdict of a participant who was removed or
+// whose role changed and tells the session how the review stands now.
+func (h *WebSocketHandler) withdrawVerdict(sessionID, userID string) {
+	review, err := services.WithdrawVerdict(h.store, sessionID, userID)
+	if err != nil {
+		log.Printf("Failed to withdraw the verdict of %s in session %s: %v", userID, sessionID, err)
+		return
+	}
+	if review != nil {
+		h.broadcastReview(sessionID, userID, review)
+	}
+}
+
+func (h *WebSocketHandler) handleSetRole(client *Client, payload Payload) {
+	change := payload.(*models.RoleChange)
+	if err := h.SetRole(client.sessionID, change.UserID, change.Role); err != nil {
+		h.sendError(client, "set_role", participantErrorCode(err), err.Error())
+	}
+}
+
+func (h *WebSocketHandler) handleRemoveParticipant(client *Client, payload Payload) {
+	removal := payload.(*models.ParticipantRemoval)
+	if err := h.RemoveParticipant(client.sessionID, removal.UserID); err != nil {
+		h.sendError(client, "remove_participant", participantErrorCode(err), err.Error())
+	}
+}
+
+func participantErrorCode(err error) string {
+	if errors.Is(err, services.ErrForbidden) {
+		return errForbidden
+	}
+	return errInvalidPayload
+}
+
+type SetRoleRequest struct {
+	Role models.Role `json:"role"`
+}
+
+func (h *SessionHandler) SetParticipantRole(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var req SetRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	change := models.RoleChange{UserID: chi.URLParam(r, "userID"), Role: req.Role}
+	if err := change.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.ws.SetRole(session.ID, change.UserID, change.Role); err != nil {
+		writeParticipantError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(change)
+}
+
+func (h *SessionHandler) RemoveParticipant(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.ws.RemoveParticipant(session.ID, chi.URLParam(r, "userID")); err != nil {
+		writeParticipantError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireOwner checks that the authenticated user owns the session in the
+// URL, writing an error response if not.
+func (h *SessionHandler) requireOwner(w http.ResponseWriter, r *http.Request) (*models.Session, bool) {
+	sessionID := chi.URLParam(r, "id")
+	if sessionID == "" {
+		http.Error(w, "session ID required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	session, err := h.store.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	user, _ := UserFromContext(r.Context())
+	if session.RoleOf(user.ID) != models.RoleOwner {
+		http.Error(w, "only the session owner can do that", http.StatusForbidden)
+		return nil, false
+	}
+
+	return session, true
+}
+
+// requireParticipant checks that the authenticated user has a role in the
+// session in the URL, writing an error response if not. Outsiders get the
+// same 404 as for a missing session, so they can't probe for session IDs.
+// Joining goes through JoinSession instead.
+func (h *SessionHandler) requireParticipant(w http.ResponseWriter, r *http.Request) (*models.Session, bool) {
+	sessionID := chi.URLParam(r, "id")
+	if sessionID == "" {
+		http.Error(w, "session ID required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	session, err := h.store.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	user, _ := UserFromContext(r.Context())
+	if session.RoleOf(user.ID) == "" {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return session, true
+}
+
+func writeParticipantError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrNotParticipant):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
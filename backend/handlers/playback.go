@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+const (
+	maxPlaybackSpeed = 100.0
+	// maxPlaybackGap caps the pause between two changes, so idle stretches
+	// of a session don't stall playback.
+	maxPlaybackGap = 2 * time.Second
+	playbackPage   = 500
+)
+
+// playbackControl is a message a viewer sends during playback: "pause",
+// "resume", "speed" with a new speed, or "ping".
+type playbackControl struct {
+	Type string `json:"type"`
+	Data struct {
+		Speed float64 `json:"speed"`
+	} `json:"data"`
+}
+
+// playback streams a session's recorded changes to one read-only viewer.
+// Only run writes to the connection.
+type playback struct {
+	store     services.SessionStore
+	conn      *websocket.Conn
+	sessionID string
+	state     *models.Snapshot // content as of the last change played
+	to        int
+	speed     float64
+	paused    bool
+	controls  chan playbackControl
+	done      chan struct{} // closed when the viewer goes away
+	ping      *time.Ticker
+}
+
+// HandlePlayback replays a session's history to a viewer, spacing changes
+// as they happened divided by ?speed=. ?from= and ?to= bound the revisions
+// played, defaulting to the whole history. Any participant may watch; the
+// viewer can't change the session.
+func (h *WebSocketHandler) HandlePlayback(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	sessionID := query.Get("session")
+	if sessionID == "" {
+		http.Error(w, "session ID required", http.StatusBadRequest)
+		return
+	}
+
+	session, err := h.store.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if session.RoleOf(user.ID) == "" {
+		http.Error(w, "not a participant of this session", http.StatusForbidden)
+		return
+	}
+
+	speed := 1.0
+	if v := query.Get("speed"); v != "" {
+		speed, err = strconv.ParseFloat(v, 64)
+		if err != nil || speed <= 0 || speed > maxPlaybackSpeed {
+			http.Error(w, fmt.Sprintf("speed must be above 0 and at most %g", maxPlaybackSpeed), http.StatusBadRequest)
+			return
+		}
+	}
+
+	from, err := services.EarliestRevision(h.store, sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if v := query.Get("from"); v != "" {
+		if from, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid from revision", http.StatusBadRequest)
+			return
+		}
+	}
+	to := session.Revision
+	if v := query.Get("to"); v != "" {
+		if to, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid to revision", http.StatusBadRequest)
+			return
+		}
+	}
+	if from < 0 || from > to || to > session.Revision {
+		http.Error(w, fmt.Sprintf("need 0 <= from <= to <= %d", session.Revision), http.StatusBadRequest)
+		return
+	}
+
+	state, err := services.Rebuild(h.store, sessionID, from)
+	if errors.Is(err, services.ErrRevisionUnavailable) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
+
+	p := &playback{
+		store:     h.store,
+		conn:      conn,
+		sessionID: sessionID,
+		state:     state,
+		to:        to,
+		speed:     speed,
+		controls:  make(chan playbackControl, 16),
+		done:      make(chan struct{}),
+	}
+	go p.readControls()
+	go p.run()
+}
+
+func (p *playback) readControls() {
+	defer close(p.done)
+
+	p.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	p.conn.SetPongHandler(func(string) error {
+		p.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		return nil
+	})
+
+	for {
+		_, message, err := p.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var control playbackControl
+		if err := json.Unmarshal(message, &control); err != nil || control.Type == "" {
+			control = playbackControl{}
+		}
+		select {
+		case p.controls <- control:
+		default:
+			// The viewer is flooding us; dropping controls only hurts them
+		}
+	}
+}
+
+func (p *playback) run() {
+	p.ping = time.NewTicker(54 * time.Second)
+	defer func() {
+		p.ping.Stop()
+		p.conn.Close()
+	}()
+
+	p.send("playback_start", "", map[string]interface{}{
+		"from":  p.state.Revision,
+		"to":    p.to,
+		"speed": p.speed,
+	})
+	p.send("workspace", "", WorkspaceState{
+		Revision:  p.state.Revision,
+		Workspace: p.state.Workspace,
+	})
+	p.send("code_change", "", map[string]interface{}{
+		"code":     p.state.Code,
+		"revision": p.state.Revision,
+	})
+	p.send("language_change", "", map[string]interface{}{
+		"language": p.state.Language,
+		"revision": p.state.Revision,
+	})
+
+	var last int64 // timestamp of the last change played
+	for {
+		entries, err := p.store.GetHistory(p.sessionID, "("+p.state.EntryID, "+", playbackPage)
+		if err != nil {
+			log.Printf("Playback of session %s failed: %v", p.sessionID, err)
+			return
+		}
+
+		for _, entry := range entries {
+			if entry.Revision > p.to {
+				p.finish()
+				return
+			}
+
+			var gap time.Duration
+			if last != 0 {
+				gap = time.Duration(float64(time.Duration(entry.Timestamp-last)*time.Millisecond) / p.speed)
+			}
+			if gap > maxPlaybackGap {
+				gap = maxPlaybackGap
+			}
+			if !p.wait(gap) {
+				return
+			}
+
+			p.play(entry)
+			p.state.EntryID = entry.ID
+			last = entry.Timestamp
+		}
+		if len(entries) < playbackPage {
+			p.finish()
+			return
+		}
+	}
+}
+
+// wait sleeps for gap while handling controls, and reports false once the
+// viewer has gone.
+func (p *playback) wait(gap time.Duration) bool {
+	timer := time.NewTimer(gap)
+	defer timer.Stop()
+
+	for {
+		// A paused playback lets the timer fire unheard, so resuming plays
+		// the next change straight away
+		var fired <-chan time.Time
+		if !p.paused {
+			fired = timer.C
+		}
+
+		select {
+		case <-fired:
+			return true
+		case control := <-p.controls:
+			p.handleControl(control)
+		case <-p.ping.C:
+			p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := p.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return false
+			}
+		case <-p.done:
+			return false
+		}
+	}
+}
+
+func (p *playback) handleControl(control playbackControl) {
+	switch control.Type {
+	case "pause":
+		p.paused = true
+	case "resume":
+		p.paused = false
+	case "speed":
+		if control.Data.Speed <= 0 || control.Data.Speed > maxPlaybackSpeed {
+			p.sendError(control.Type, errInvalidPayload, fmt.Sprintf("speed must be above 0 and at most %g", maxPlaybackSpeed))
+			return
+		}
+		p.speed = control.Data.Speed
+	case "ping":
+		p.send("pong", "", nil)
+		return
+	case "":
+		p.sendError("", errInvalidJSON, "expected a playback control with a type")
+		return
+	default:
+		p.sendError(control.Type, errUnknownType, fmt.Sprintf("playback does not accept %q", control.Type))
+		return
+	}
+
+	p.send("playback_state", "", map[string]interface{}{
+		"paused": p.paused,
+		"speed":  p.speed,
+	})
+}
+
+// play sends entry as the message live clients got for the same change.
+func (p *playback) play(entry models.HistoryEntry) {
+	switch entry.Type {
+	case models.HistoryEdit:
+		p.send("edit", entry.UserID, models.OpRecord{
+			Revision:  entry.Revision,
+			UserID:    entry.UserID,
+			Path:      entry.Path,
+			Ops:       entry.Ops,
+			Timestamp: entry.Timestamp,
+		})
+	case models.HistoryLanguage:
+		p.send("language_change", entry.UserID, map[string]interface{}{
+			"path":     entry.Path,
+			"language": entry.Language,
+			"revision": entry.Revision,
+		})
+	case models.HistoryFileCreate:
+		code, _ := services.ApplyOps("", entry.Ops)
+		p.send("file_create", entry.UserID, models.FileChange{
+			Path:     entry.Path,
+			Language: entry.Language,
+			Code:     code,
+			Revision: entry.Revision,
+		})
+	case models.HistoryFileRename:
+		p.send("file_rename", entry.UserID, models.FileChange{
+			Path:     entry.Path,
+			NewPath:  entry.NewPath,
+			Revision: entry.Revision,
+		})
+	case models.HistoryFileDelete:
+		p.send("file_delete", entry.UserID, models.FileChange{
+			Path:     entry.Path,
+			Revision: entry.Revision,
+		})
+	case models.HistoryJoin:
+		p.send("user_join", entry.UserID, nil)
+	case models.HistoryLeave:
+		p.send("user_leave", entry.UserID, nil)
+	}
+}
+
+func (p *playback) finish() {
+	p.send("playback_end", "", map[string]interface{}{"revision": p.to})
+	p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	p.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+func (p *playback) send(messageType, userID string, data interface{}) {
+	message, err := json.Marshal(models.WSMessage{
+		Type:      messageType,
+		SessionID: p.sessionID,
+		UserID:    userID,
+		Data:      data,
+	})
+	if err != nil {
+		log.Printf("JSON marshal error: %v", err)
+		return
+	}
+
+	p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	p.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+func (p *playback) sendError(msgType, code, message string) {
+	p.send("error", "", models.WSError{
+		Code:    code,
+		Message: message,
+		Type:    msgType,
+	})
+}
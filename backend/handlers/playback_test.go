@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+// Playing a session back from its start ends with the code it has now.
+func TestPlaybackReplaysHistory(t *testing.T) {
+	h := newTestHandler(t)
+	err := h.store.CreateSession(&models.Session{
+		ID:       "s1",
+		Code:     "start\n",
+		Language: "go",
+		Users:    []models.User{},
+		OwnerID:  "owner",
+		Roles:    map[string]models.Role{"owner": models.RoleOwner},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := "start\n"
+	for revision, line := range []string{"one\n", "two\n", "three\n"} {
+		code += line
+		if _, err := h.store.UpdateContent("s1", "owner", "", revision, &code, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	language := "python"
+	if _, err := h.store.UpdateContent("s1", "owner", "", 3, nil, &language); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), userContextKey, &models.User{ID: "owner"})
+		h.HandlePlayback(w, r.WithContext(ctx))
+	}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?session=s1&speed=100"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	var played, playedLanguage string
+	var types []string
+	for {
+		var msg struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("playback ended early: %v (got %v)", err, types)
+		}
+		types = append(types, msg.Type)
+
+		switch msg.Type {
+		case "code_change":
+			var change models.CodeChange
+			json.Unmarshal(msg.Data, &change)
+			played = change.Code
+		case "language_change":
+			var change models.LanguageChange
+			json.Unmarshal(msg.Data, &change)
+			playedLanguage = change.Language
+		case "edit":
+			var record models.OpRecord
+			json.Unmarshal(msg.Data, &record)
+			if played, err = services.ApplyOps(played, record.Ops); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if msg.Type == "playback_end" {
+			break
+		}
+	}
+
+	want := "playback_start workspace code_change language_change edit edit edit language_change playback_end"
+	if got := strings.Join(types, " "); got != want {
+		t.Fatalf("played %q, want %q", got, want)
+	}
+	if played != code || playedLanguage != language {
+		t.Fatalf("playback ended at %q in %s, want %q in %s", played, playedLanguage, code, language)
+	}
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+func init() {
+	registerMessageType("review_status", messageType{
+		newPayload: func() Payload { return &models.ReviewStatusChange{} },
+		handle:     (*WebSocketHandler).handleReviewStatus,
+		ownerOnly:  true,
+	})
+	registerMessageType("review_verdict", messageType{
+		newPayload: func() Payload { return &models.ReviewVerdict{} },
+		handle:     (*WebSocketHandler).handleReviewVerdict,
+	})
+}
+
+// ChangeReviewStatus moves the session's review to status on behalf of
+// userID and broadcasts the review to every connected client.
+func (h *WebSocketHandler) ChangeReviewStatus(sessionID, userID, status string) (*models.Review, error) {
+	review, err := services.ChangeReviewStatus(h.store, sessionID, userID, status)
+	if err != nil {
+		return nil, err
+	}
+
+	h.broadcastReview(sessionID, userID, review)
+	return review, nil
+}
+
+// SetVerdict records userID's verdict and broadcasts the review to every
+// connected client.
+func (h *WebSocketHandler) SetVerdict(sessionID, userID string, verdict *models.ReviewVerdict) (*models.Review, error) {
+	review, err := services.SetVerdict(h.store, sessionID, userID, verdict)
+	if err != nil {
+		return nil, err
+	}
+
+	h.broadcastReview(sessionID, userID, review)
+	return review, nil
+}
+
+func (h *WebSocketHandler) broadcastReview(sessionID, userID string, review *models.Review) {
+	h.broadcastToSession(sessionID, models.WSMessage{
+		Type:      "review",
+		SessionID: sessionID,
+		UserID:    userID,
+		Data:      review,
+	}, nil)
+}
+
+func (h *WebSocketHandler) handleReviewStatus(client *Client, payload Payload) {
+	_, err := h.ChangeReviewStatus(client.sessionID, client.user.ID, payload.(*models.ReviewStatusChange).Status)
+	h.replyToReview(client, "review_status", err)
+}
+
+func (h *WebSocketHandler) handleReviewVerdict(client *Client, payload Payload) {
+	_, err := h.SetVerdict(client.sessionID, client.user.ID, payload.(*models.ReviewVerdict))
+	h.replyToReview(client, "review_verdict", err)
+}
+
+// replyToReview reports a failed review change. Successful ones reach the
+// sender through their broadcast.
+func (h *WebSocketHandler) replyToReview(client *Client, msgType string, err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, services.ErrForbidden):
+		h.sendError(client, msgType, errForbidden, err.Error())
+	case isReviewRejection(err):
+		h.sendError(client, msgType, errInvalidPayload, err.Error())
+	default:
+		log.Printf("Review change failed: %v", err)
+		h.sendError(client, msgType, errUnavailable, err.Error())
+	}
+}
+
+func isReviewRejection(err error) bool {
+	return errors.Is(err, services.ErrInvalidTransition) || errors.Is(err, services.ErrNotInReview)
+}
+
+// GetReview returns the session's review status, the verdicts of the
+// current round and every status change so far.
+func (h *SessionHandler) GetReview(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	review, err := h.store.GetReview(session.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(review)
+}
+
+// ChangeReviewStatus asks for review, or takes the session back to draft.
+func (h *SessionHandler) ChangeReviewStatus(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var change models.ReviewStatusChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := change.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, _ := UserFromContext(r.Context())
+
+	review, err := h.ws.ChangeReviewStatus(session.ID, user.ID, change.Status)
+	if err != nil {
+		writeReviewError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(review)
+}
+
+// SetVerdict records the caller's verdict in the current review round.
+func (h *SessionHandler) SetVerdict(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	var verdict models.ReviewVerdict
+	if err := json.NewDecoder(r.Body).Decode(&verdict); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := verdict.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, _ := UserFromContext(r.Context())
+
+	review, err := h.ws.SetVerdict(session.ID, user.ID, &verdict)
+	if err != nil {
+		writeReviewError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(review)
+}
+
+func writeReviewError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case isReviewRejection(err):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"time"
 
@@ -13,18 +15,25 @@ import (
 )
 
 type SessionHandler struct {
-	redis *services.RedisService
+	store   services.SessionStore
+	ws      *WebSocketHandler
+	invites *services.InviteService
+	archive *services.ArchivingStore
 }
 
-func NewSessionHandler(redis *services.RedisService) *SessionHandler {
+func NewSessionHandler(store services.SessionStore, ws *WebSocketHandler, invites *services.InviteService, archive *services.ArchivingStore) *SessionHandler {
 	return &SessionHandler{
-		redis: redis,
+		store:   store,
+		ws:      ws,
+		invites: invites,
+		archive: archive,
 	}
 }
 
 type CreateSessionRequest struct {
-	Language string `json:"language"`
-	Code     string `json:"code"`
+	Language    string      `json:"language"`
+	Code        string      `json:"code"`
+	DefaultRole models.Role `json:"default_role"`
 }
 
 type CreateSessionResponse struct {
@@ -42,15 +51,29 @@ func (h *SessionHandler) CreateSession(w http.ResponseWriter, r *http.Request) {
 		req.Language = "javascript"
 	}
 
+	if req.DefaultRole == "" {
+		req.DefaultRole = models.RoleEditor
+	}
+	if req.DefaultRole != models.RoleEditor && req.DefaultRole != models.RoleViewer {
+		http.Error(w, "default_role must be editor or viewer", http.StatusBadRequest)
+		return
+	}
+
+	// The creator owns the session
+	user, _ := UserFromContext(r.Context())
+
 	session := &models.Session{
-		ID:        uuid.New().String(),
-		Code:      req.Code,
-		Language:  req.Language,
-		CreatedAt: time.Now(),
-		Users:     []models.User{},
+		ID:          uuid.New().String(),
+		Code:        req.Code,
+		Language:    req.Language,
+		CreatedAt:   time.Now(),
+		Users:       []models.User{},
+		OwnerID:     user.ID,
+		DefaultRole: req.DefaultRole,
+		Roles:       map[string]models.Role{user.ID: models.RoleOwner},
 	}
 
-	if err := h.redis.CreateSession(session); err != nil {
+	if err := h.store.CreateSession(session); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -62,28 +85,108 @@ func (h *SessionHandler) CreateSession(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *SessionHandler) GetSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+// UpdateSessionRequest writes the file at Path, or the main file.
+type UpdateSessionRequest struct {
+	Path     string  `json:"path,omitempty"`
+	Revision int     `json:"revision"`
+	Code     *string `json:"code,omitempty"`
+	Language *string `json:"language,omitempty"`
+}
+
+func (h *SessionHandler) UpdateSession(w http.ResponseWriter, r *http.Request) {
 	sessionID := chi.URLParam(r, "id")
 	if sessionID == "" {
 		http.Error(w, "session ID required", http.StatusBadRequest)
 		return
 	}
 
-	session, err := h.redis.GetSession(sessionID)
-	if err != nil {
+	var req UpdateSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Code == nil && req.Language == nil {
+		http.Error(w, "code or language is required", http.StatusBadRequest)
+		return
+	}
+
+	user, _ := UserFromContext(r.Context())
+
+	_, err := h.ws.UpdateContent(sessionID, user.ID, req.Path, req.Revision, req.Code, req.Language)
+	var conflict *services.ConflictError
+	switch {
+	case errors.As(err, &conflict):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(conflict)
+		return
+	case errors.Is(err, services.ErrSessionNotFound):
 		http.Error(w, "session not found", http.StatusNotFound)
 		return
+	case errors.Is(err, services.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	session, err := h.store.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(session)
 }
 
+type ArchiveSessionResponse struct {
+	SessionID  string    `json:"session_id"`
+	Revision   int       `json:"revision"`
+	ArchivedAt time.Time `json:"archived_at"`
+	ArchivedBy string    `json:"archived_by"`
+}
+
+// ArchiveSession saves the session to durable storage, from where it is
+// restored when opened after the live copy has expired.
+func (h *SessionHandler) ArchiveSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	user, _ := UserFromContext(r.Context())
+
+	archived, err := h.archive.Archive(session.ID, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ArchiveSessionResponse{
+		SessionID:  archived.Session.ID,
+		Revision:   archived.Session.Revision,
+		ArchivedAt: archived.ArchivedAt,
+		ArchivedBy: archived.ArchivedBy,
+	})
+}
+
+// JoinSessionRequest is optional; only newcomers need an invite, which may
+// also be passed as ?invite=.
 type JoinSessionRequest struct {
-	UserID   string `json:"user_id"`
-	UserName string `json:"user_name"`
-	Email    string `json:"email"`
-	Color    string `json:"color"`
-	ImageURL string `json:"image_url"`
+	Invite string `json:"invite"`
 }
 
 func (h *SessionHandler) JoinSession(w http.ResponseWriter, r *http.Request) {
@@ -94,26 +197,23 @@ func (h *SessionHandler) JoinSession(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req JoinSessionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	session, err := h.redis.GetSession(sessionID)
-	if err != nil {
-		http.Error(w, "session not found", http.StatusNotFound)
-		return
+	if req.Invite == "" {
+		req.Invite = r.URL.Query().Get("invite")
 	}
 
-	user := models.User{
-		ID:       req.UserID,
-		Name:     req.UserName,
-		Email:    req.Email,
-		Color:    req.Color,
-		ImageURL: req.ImageURL,
+	user, _ := UserFromContext(r.Context())
+
+	if _, err := h.invites.Admit(sessionID, *user, req.Invite); err != nil {
+		writeJoinError(w, err)
+		return
 	}
 
-	if err := h.redis.AddUserToSession(sessionID, user); err != nil {
+	session, err := h.store.GetSession(sessionID)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"codestream/models"
+)
+
+func newTestSessionHandler(t *testing.T) *SessionHandler {
+	t.Helper()
+
+	ws := newTestHandler(t)
+	return NewSessionHandler(ws.store, ws, ws.invites, nil)
+}
+
+// serve sends one request through the session routes as userID.
+func serve(h *SessionHandler, method, target, userID, body string) *httptest.ResponseRecorder {
+	r := chi.NewRouter()
+	r.Get("/api/sessions/{id}", h.GetSession)
+	r.Post("/api/sessions/{id}/join", h.JoinSession)
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), userContextKey, &models.User{ID: userID}))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+// Outsiders can't tell a session they aren't in from one that doesn't exist.
+func TestGetSessionHidesSessionsFromOutsiders(t *testing.T) {
+	h := newTestSessionHandler(t)
+	createTestSession(t, h.ws, "s1", "member")
+
+	if rec := serve(h, http.MethodGet, "/api/sessions/s1", "member", ""); rec.Code != http.StatusOK {
+		t.Fatalf("participant got %d: %s", rec.Code, rec.Body)
+	}
+
+	outsider := serve(h, http.MethodGet, "/api/sessions/s1", "outsider", "")
+	missing := serve(h, http.MethodGet, "/api/sessions/missing", "member", "")
+	if outsider.Code != http.StatusNotFound || outsider.Body.String() != missing.Body.String() {
+		t.Fatalf("outsider got %d %q, a missing session %d %q", outsider.Code, outsider.Body, missing.Code, missing.Body)
+	}
+}
+
+func TestJoinSessionRejectsABadInvite(t *testing.T) {
+	h := newTestSessionHandler(t)
+	createTestSession(t, h.ws, "s1")
+
+	rec := serve(h, http.MethodPost, "/api/sessions/s1/join", "mallory", `{"invite":"not-a-token"}`)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	session, err := h.store.GetSession("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role := session.RoleOf("mallory"); role != "" {
+		t.Fatalf("rejected user was given role %q", role)
+	}
+
+	_, token, err := h.invites.Create("s1", "owner", models.RoleViewer, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(h, http.MethodPost, "/api/sessions/s1/join?invite="+token, "bob", ""); rec.Code != http.StatusOK {
+		t.Fatalf("valid invite got %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"codestream/models"
+	"codestream/services"
+)
+
+func init() {
+	registerMessageType("suggest", messageType{
+		newPayload: func() Payload { return &models.EditData{} },
+		handle:     (*WebSocketHandler).handleSuggest,
+		mutating:   true,
+	})
+	registerMessageType("suggestion_accept", messageType{
+		newPayload: func() Payload { return &models.SuggestionRef{} },
+		handle:     (*WebSocketHandler).handleSuggestionAccept,
+		mutating:   true,
+	})
+	registerMessageType("suggestion_reject", messageType{
+		newPayload: func() Payload { return &models.SuggestionRef{} },
+		handle:     (*WebSocketHandler).handleSuggestionReject,
+		mutating:   true,
+	})
+}
+
+// SuggestionRebase lists the suggestions a revision rebased, accepted or
+// outdated.
+type SuggestionRebase struct {
+	Revision    int                 `json:"revision"`
+	Suggestions []models.Suggestion `json:"suggestions"`
+}
+
+// Suggest saves an edit by userID as a pending suggestion and broadcasts it
+// to every connected client, the author's included, so they learn its ID.
+func (h *WebSocketHandler) Suggest(sessionID, userID string, edit *models.EditData) (*models.Suggestion, error) {
+	// Under the write lock, no edit rebasing the suggestion is broadcast
+	// before it
+	defer h.lockSession(sessionID)()
+
+	suggestion, err := h.store.Suggest(sessionID, userID, edit.Path, edit.Revision, edit.Ops)
+	if err != nil {
+		return nil, err
+	}
+
+	h.broadcastToSession(sessionID, models.WSMessage{
+		Type:      "suggestion",
+		SessionID: sessionID,
+		UserID:    userID,
+		Data:      suggestion,
+	}, nil)
+	return suggestion, nil
+}
+
+// AcceptSuggestion commits a suggestion as an edit by its author and
+// broadcasts that edit to every connected client, the one accepting
+// included, as none of them has it yet.
+func (h *WebSocketHandler) AcceptSuggestion(sessionID, userID, suggestionID string) (*models.OpRecord, error) {
+	defer h.lockSession(sessionID)()
+
+	record, err := h.store.AcceptSuggestion(sessionID, suggestionID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Left without a sender, so no one skips it on replay
+	h.broadcastToSession(sessionID, models.WSMessage{
+		Type:      "edit",
+		SessionID: sessionID,
+		Data:      record,
+	}, nil)
+	h.broadcastAnchors(sessionID, record)
+	return record, nil
+}
+
+func (h *WebSocketHandler) RejectSuggestion(sessionID, userID, suggestionID string) (*models.Suggestion, error) {
+	suggestion, err := services.RejectSuggestion(h.store, sessionID, userID, suggestionID)
+	if err != nil {
+		return nil, err
+	}
+
+	h.broadcastToSession(sessionID, models.WSMessage{
+		Type:      "suggestion_reject",
+		SessionID: sessionID,
+		UserID:    userID,
+		Data:      suggestion,
+	}, nil)
+	return suggestion, nil
+}
+
+func (h *WebSocketHandler) handleSuggest(client *Client, payload Payload) {
+	_, err := h.Suggest(client.sessionID, client.user.ID, payload.(*models.EditData))
+	h.replyToSuggestion(client, "suggest", err)
+}
+
+func (h *WebSocketHandler) handleSuggestionAccept(client *Client, payload Payload) {
+	_, err := h.AcceptSuggestion(client.sessionID, client.user.ID, payload.(*models.SuggestionRef).ID)
+	h.replyToSuggestion(client, "suggestion_accept", err)
+}
+
+func (h *WebSocketHandler) handleSuggestionReject(client *Client, payload Payload) {
+	_, err := h.RejectSuggestion(client.sessionID, client.user.ID, payload.(*models.SuggestionRef).ID)
+	h.replyToSuggestion(client, "suggestion_reject", err)
+}
+
+// replyToSuggestion reports a failed suggestion change. Successful ones
+// reach the sender through their broadcast.
+func (h *WebSocketHandler) replyToSuggestion(client *Client, msgType string, err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, services.ErrForbidden):
+		h.sendError(client, msgType, errForbidden, err.Error())
+	case isSuggestionRejection(err):
+		h.sendError(client, msgType, errInvalidPayload, err.Error())
+	default:
+		log.Printf("Suggestion change failed: %v", err)
+		h.sendError(client, msgType, errUnavailable, err.Error())
+	}
+}
+
+// isSuggestionRejection reports whether err is down to the request rather
+// than the store.
+func isSuggestionRejection(err error) bool {
+	for _, target := range []error{
+		services.ErrSuggestionNotFound,
+		services.ErrSuggestionClosed,
+		services.ErrInvalidSuggestion,
+		services.ErrFileNotFound,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListSuggestions returns the session's suggestions, oldest first, or only
+// those with the given ?status=.
+func (h *SessionHandler) ListSuggestions(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", models.SuggestionPending, models.SuggestionAccepted, models.SuggestionRejected, models.SuggestionOutdated:
+	default:
+		http.Error(w, "status must be pending, accepted, rejected or outdated", http.StatusBadRequest)
+		return
+	}
+
+	suggestions, err := h.store.GetSuggestions(session.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status != "" {
+		matching := suggestions[:0]
+		for _, suggestion := range suggestions {
+			if suggestion.Status == status {
+				matching = append(matching, suggestion)
+			}
+		}
+		suggestions = matching
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestions)
+}
+
+// CreateSuggestion saves an edit, given as for the "edit" message, as a
+// pending suggestion.
+func (h *SessionHandler) CreateSuggestion(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	var edit models.EditData
+	if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := edit.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, _ := UserFromContext(r.Context())
+
+	suggestion, err := h.ws.Suggest(session.ID, user.ID, &edit)
+	if err != nil {
+		writeSuggestionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(suggestion)
+}
+
+// AcceptSuggestion applies the suggestion and returns the revision it made.
+func (h *SessionHandler) AcceptSuggestion(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	user, _ := UserFromContext(r.Context())
+
+	record, err := h.ws.AcceptSuggestion(session.ID, user.ID, chi.URLParam(r, "suggestionID"))
+	if err != nil {
+		writeSuggestionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
+
+func (h *SessionHandler) RejectSuggestion(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	user, _ := UserFromContext(r.Context())
+
+	suggestion, err := h.ws.RejectSuggestion(session.ID, user.ID, chi.URLParam(r, "suggestionID"))
+	if err != nil {
+		writeSuggestionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestion)
+}
+
+func writeSuggestionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, services.ErrSuggestionNotFound), errors.Is(err, services.ErrFileNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrSuggestionClosed):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case isSuggestionRejection(err):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
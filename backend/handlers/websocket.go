@@ -1,205 +1,273 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 
 	"codestream/models"
 	"codestream/services"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins
-	},
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
 type Client struct {
+	id        string
 	conn      *websocket.Conn
 	send      chan []byte
 	sessionID string
 	user      models.User
+	since     int64  // last sequence number seen before reconnecting, or -1
+	resumes   string // the connection this one reconnects, if it said
+	mu        sync.Mutex
+	closed    bool
+	pending   map[string][]byte // coalesced messages waiting for buffer space
+	wake      chan struct{}     // signals writePump that pending has entries
+	coalesced int64             // messages merged away while the client lagged
+	resyncs   int64             // times the client fell too far behind
 }
 
-type WebSocketHandler struct {
-	redis      *services.RedisService
-	clients    map[string]map[*Client]bool // sessionID -> clients
-	register   chan *Client
-	unregister chan *Client
-	broadcast  chan *BroadcastMessage
-	mu         sync.RWMutex
+func newClient(conn *websocket.Conn, sessionID string, user models.User, since int64) *Client {
+	return &Client{
+		id:        uuid.New().String(),
+		conn:      conn,
+		send:      make(chan []byte, 256),
+		sessionID: sessionID,
+		user:      user,
+		since:     since,
+		pending:   make(map[string][]byte),
+		wake:      make(chan struct{}, 1),
+	}
 }
 
-type BroadcastMessage struct {
-	sessionID string
-	message   []byte
-	exclude   *Client
+// trySend queues data without blocking and reports whether it fit.
+func (c *Client) trySend(data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	select {
+	case c.send <- data:
+		return true
+	default:
+		return false
+	}
 }
 
-func NewWebSocketHandler(redis *services.RedisService) *WebSocketHandler {
-	h := &WebSocketHandler{
-		redis:      redis,
-		clients:    make(map[string]map[*Client]bool),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		broadcast:  make(chan *BroadcastMessage, 256),
+// coalesce parks data under key until writePump has room, replacing any
+// older message parked under the same key.
+func (c *Client) coalesce(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	if _, ok := c.pending[key]; ok {
+		c.coalesced++
+	}
+	c.pending[key] = data
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// replacePending swaps data in for a message already parked under key and
+// reports whether there was one.
+func (c *Client) replacePending(key string, data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.pending[key]; !ok || c.closed {
+		return false
 	}
+	c.pending[key] = data
+	c.coalesced++
+	return true
+}
+
+func (c *Client) takePending() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	go h.run()
-	return h
+	messages := make([][]byte, 0, len(c.pending))
+	for key, data := range c.pending {
+		messages = append(messages, data)
+		delete(c.pending, key)
+	}
+	return messages
 }
 
-func (h *WebSocketHandler) run() {
+// drain discards everything queued for the client and returns how many
+// messages were dropped.
+func (c *Client) drain() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dropped := len(c.pending)
+	c.pending = make(map[string][]byte)
+	if c.closed {
+		return dropped
+	}
 	for {
 		select {
-		case client := <-h.register:
-			h.mu.Lock()
-			if h.clients[client.sessionID] == nil {
-				h.clients[client.sessionID] = make(map[*Client]bool)
-			}
-			h.clients[client.sessionID][client] = true
-			h.mu.Unlock()
-
-			// Send current session state to the newly connected client
-			session, err := h.redis.GetSession(client.sessionID)
-			if err == nil {
-				// Send current code state
-				codeStateMsg := models.WSMessage{
-					Type:      "code_change",
-					SessionID: client.sessionID,
-					Data: map[string]interface{}{
-						"code": session.Code,
-					},
-				}
-				if data, err := json.Marshal(codeStateMsg); err == nil {
-					select {
-					case client.send <- data:
-					default:
-						// Channel full, skip
-					}
-				}
+		case <-c.send:
+			dropped++
+		default:
+			return dropped
+		}
+	}
+}
 
-				// Send current language state
-				langStateMsg := models.WSMessage{
-					Type:      "language_change",
-					SessionID: client.sessionID,
-					Data: map[string]interface{}{
-						"language": session.Language,
-					},
-				}
-				if data, err := json.Marshal(langStateMsg); err == nil {
-					select {
-					case client.send <- data:
-					default:
-						// Channel full, skip
-					}
-				}
-			}
+func (c *Client) role() models.Role {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user.Role
+}
 
-			// Notify others about new user
-			h.broadcastToSession(client.sessionID, models.WSMessage{
-				Type:      "user_join",
-				SessionID: client.sessionID,
-				User:      &client.user,
-			}, client)
-
-		case client := <-h.unregister:
-			h.mu.Lock()
-			if clients, ok := h.clients[client.sessionID]; ok {
-				if _, ok := clients[client]; ok {
-					delete(clients, client)
-					close(client.send)
-
-					if len(clients) == 0 {
-						delete(h.clients, client.sessionID)
-					}
-				}
-			}
-			h.mu.Unlock()
-
-			// Remove user from session
-			h.redis.RemoveUserFromSession(client.sessionID, client.user.ID)
-
-			// Notify others about user leaving
-			h.broadcastToSession(client.sessionID, models.WSMessage{
-				Type:      "user_leave",
-				SessionID: client.sessionID,
-				UserID:    client.user.ID,
-			}, nil)
-
-		case msg := <-h.broadcast:
-			h.mu.RLock()
-			if clients, ok := h.clients[msg.sessionID]; ok {
-				for client := range clients {
-					if client != msg.exclude {
-						select {
-						case client.send <- msg.message:
-						default:
-							close(client.send)
-							delete(clients, client)
-						}
-					}
-				}
-			}
-			h.mu.RUnlock()
-		}
+// profile returns a copy of the client's user, safe to hand to other
+// goroutines while its role may change.
+func (c *Client) profile() models.User {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user
+}
+
+func (c *Client) setRole(role models.Role) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.user.Role = role
+}
+
+// close shuts the send channel once, which makes writePump hang up.
+func (c *Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+type WebSocketHandler struct {
+	store    services.SessionStore
+	invites  *services.InviteService
+	upgrader websocket.Upgrader
+	hubs     map[string]*sessionHub  // sessionID -> hub for local clients
+	locks    map[string]*sessionLock // sessionID -> write lock
+	mu       sync.Mutex
+}
+
+// ClientStats describes how far behind a connected client is.
+type ClientStats struct {
+	ClientID  string `json:"client_id"`
+	SessionID string `json:"session_id"`
+	UserID    string `json:"user_id"`
+	Queued    int    `json:"queued"`
+	Capacity  int    `json:"capacity"`
+	Coalesced int64  `json:"coalesced"`
+	Resyncs   int64  `json:"resyncs"`
+}
+
+func NewWebSocketHandler(store services.SessionStore, invites *services.InviteService, allowedOrigins []string) *WebSocketHandler {
+	return &WebSocketHandler{
+		store:   store,
+		invites: invites,
+		upgrader: websocket.Upgrader{
+			CheckOrigin:     originChecker(allowedOrigins),
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+		},
+		hubs:  make(map[string]*sessionHub),
+		locks: make(map[string]*sessionLock),
 	}
 }
 
 func (h *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
 		return
 	}
 
 	sessionID := r.URL.Query().Get("session")
-	userID := r.URL.Query().Get("user_id")
-	userName := r.URL.Query().Get("user_name")
-	userEmail := r.URL.Query().Get("user_email")
-	userColor := r.URL.Query().Get("user_color")
-	userImage := r.URL.Query().Get("user_image")
-
-	if sessionID == "" || userID == "" {
-		conn.Close()
+	if sessionID == "" {
+		http.Error(w, "session ID required", http.StatusBadRequest)
 		return
 	}
 
-	user := models.User{
-		ID:       userID,
-		Name:     userName,
-		Email:    userEmail,
-		Color:    userColor,
-		ImageURL: userImage,
+	// Add user to session, redeeming an invite if they aren't a participant
+	joined, err := h.invites.Admit(sessionID, *user, r.URL.Query().Get("invite"))
+	if err != nil {
+		writeJoinError(w, err)
+		return
 	}
 
-	client := &Client{
-		conn:      conn,
-		send:      make(chan []byte, 256),
-		sessionID: sessionID,
-		user:      user,
+	since := int64(-1)
+	if v := r.URL.Query().Get("since"); v != "" {
+		if seq, err := strconv.ParseInt(v, 10, 64); err == nil && seq >= 0 {
+			since = seq
+		}
 	}
 
-	// Add user to session
-	h.redis.AddUserToSession(sessionID, user)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
 
-	h.register <- client
+	client := newClient(conn, sessionID, *joined, since)
+	client.resumes = r.URL.Query().Get("connection")
+	if err := h.join(client); err != nil {
+		log.Printf("Failed to connect %s to session %s: %v", user.ID, sessionID, err)
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "could not join session"))
+		conn.Close()
+		return
+	}
 
 	// Start goroutines
 	go h.writePump(client)
 	go h.readPump(client)
 }
 
+// ClientStats reports per-client lag for every connection on this instance.
+func (h *WebSocketHandler) ClientStats(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	hubs := make([]*sessionHub, 0, len(h.hubs))
+	for _, hub := range h.hubs {
+		hubs = append(hubs, hub)
+	}
+	h.mu.Unlock()
+
+	stats := make([]ClientStats, 0)
+	for _, hub := range hubs {
+		reply := make(chan []ClientStats, 1)
+		select {
+		case hub.stats <- reply:
+			stats = append(stats, <-reply...)
+		case <-hub.stop:
+			// Torn down since we looked
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
 func (h *WebSocketHandler) readPump(client *Client) {
 	defer func() {
-		h.unregister <- client
+		h.leave(client)
 		client.conn.Close()
 	}()
 
@@ -218,48 +286,7 @@ func (h *WebSocketHandler) readPump(client *Client) {
 			break
 		}
 
-		var wsMsg models.WSMessage
-		if err := json.Unmarshal(message, &wsMsg); err != nil {
-			log.Printf("JSON unmarshal error: %v", err)
-			continue
-		}
-
-		// Handle different message types
-		switch wsMsg.Type {
-		case "cursor_move":
-			// Broadcast cursor position to other clients
-			h.broadcastToSession(client.sessionID, wsMsg, client)
-
-		case "code_change":
-			// Update code in Redis
-			if codeData, ok := wsMsg.Data.(map[string]interface{}); ok {
-				if code, ok := codeData["code"].(string); ok {
-					h.redis.UpdateCode(client.sessionID, code)
-				}
-			}
-			// Broadcast to other clients
-			h.broadcastToSession(client.sessionID, wsMsg, client)
-
-		case "language_change":
-			// Update language in Redis
-			if langData, ok := wsMsg.Data.(map[string]interface{}); ok {
-				if language, ok := langData["language"].(string); ok {
-					h.redis.UpdateLanguage(client.sessionID, language)
-				}
-			}
-			// Broadcast to other clients
-			h.broadcastToSession(client.sessionID, wsMsg, client)
-
-		case "ping":
-			// Respond with pong
-			response := models.WSMessage{
-				Type:      "pong",
-				SessionID: client.sessionID,
-			}
-			if data, err := json.Marshal(response); err == nil {
-				client.send <- data
-			}
-		}
+		h.dispatch(client, message)
 	}
 }
 
@@ -285,16 +312,40 @@ func (h *WebSocketHandler) writePump(client *Client) {
 			}
 			w.Write(message)
 
-			// Add queued messages
+			// Add queued messages, without waiting if the hub drained them
 			n := len(client.send)
+		queued:
 			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-client.send)
+				select {
+				case message, ok := <-client.send:
+					if !ok {
+						break queued
+					}
+					w.Write([]byte{'\n'})
+					w.Write(message)
+				default:
+					break queued
+				}
 			}
 
 			if err := w.Close(); err != nil {
 				return
 			}
+			if len(client.send) == 0 {
+				if err := writePending(client); err != nil {
+					return
+				}
+			}
+
+		case <-client.wake:
+			// Messages queued before the coalesced ones go first; the case
+			// above writes these once it has drained the queue
+			if len(client.send) > 0 {
+				continue
+			}
+			if err := writePending(client); err != nil {
+				return
+			}
 
 		case <-ticker.C:
 			client.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
@@ -305,16 +356,246 @@ func (h *WebSocketHandler) writePump(client *Client) {
 	}
 }
 
-func (h *WebSocketHandler) broadcastToSession(sessionID string, message models.WSMessage, exclude *Client) {
+// writePending writes the client's coalesced messages in one frame.
+func writePending(client *Client) error {
+	pending := client.takePending()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	client.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return client.conn.WriteMessage(websocket.TextMessage, bytes.Join(pending, []byte{'\n'}))
+}
+
+// UpdateContent applies a revision-checked write on behalf of a REST caller
+// and broadcasts the result to every connected client.
+func (h *WebSocketHandler) UpdateContent(sessionID, userID, path string, revision int, code, language *string) (*models.OpRecord, error) {
+	return h.commitContent(sessionID, userID, path, revision, code, language, nil)
+}
+
+func (h *WebSocketHandler) commitContent(sessionID, userID, path string, revision int, code, language *string, exclude *Client) (*models.OpRecord, error) {
+	defer h.lockSession(sessionID)()
+
+	record, err := h.store.UpdateContent(sessionID, userID, path, revision, code, language)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != nil {
+		h.broadcastToSession(sessionID, models.WSMessage{
+			Type:      "code_change",
+			SessionID: sessionID,
+			UserID:    userID,
+			Data: map[string]interface{}{
+				"path":     record.Path,
+				"code":     *code,
+				"revision": record.Revision,
+			},
+		}, exclude)
+	}
+	if language != nil {
+		h.broadcastToSession(sessionID, models.WSMessage{
+			Type:      "language_change",
+			SessionID: sessionID,
+			UserID:    userID,
+			Data: map[string]interface{}{
+				"path":     record.Path,
+				"language": *language,
+				"revision": record.Revision,
+			},
+		}, exclude)
+	}
+	h.broadcastAnchors(sessionID, record)
+
+	return record, nil
+}
+
+// replyToWrite tells the writer how its change was handled: an ack with the
+// new revision, a typed conflict carrying the current state, or a fresh
+// snapshot when the write could not be applied at all.
+func (h *WebSocketHandler) replyToWrite(client *Client, record *models.OpRecord, err error) {
+	if err == nil {
+		h.sendToClient(client, models.WSMessage{
+			Type:      "ack",
+			SessionID: client.sessionID,
+			Data:      map[string]interface{}{"revision": record.Revision},
+		})
+		return
+	}
+
+	var conflict *services.ConflictError
+	if errors.As(err, &conflict) {
+		h.sendToClient(client, models.WSMessage{
+			Type:      "conflict",
+			SessionID: client.sessionID,
+			Data:      conflict,
+		})
+		return
+	}
+
+	if errors.Is(err, services.ErrForbidden) {
+		h.sendError(client, "", errForbidden, err.Error())
+		return
+	}
+
+	log.Printf("Write rejected: %v", err)
+	h.sendError(client, "", errWriteRejected, err.Error())
+	h.sendSnapshot(client)
+}
+
+// replay sends a reconnecting client every broadcast it missed, falling back
+// to a full snapshot when the log no longer covers the gap.
+func (h *WebSocketHandler) replay(client *Client) {
+	h.missedEvents(client).send(client)
+}
+
+// missedEvents loads what replay sends.
+func (h *WebSocketHandler) missedEvents(client *Client) frameList {
+	events, ok, err := h.store.GetEventsSince(client.sessionID, client.since)
+	if err != nil || !ok {
+		return h.snapshot(client)
+	}
+
+	frames := make(frameList, 0, len(events))
+	for _, data := range events {
+		// The connection being resumed already knows what it sent, and
+		// learns its writes landed from the revisions that follow them
+		var event models.WSMessage
+		if err := json.Unmarshal(data, &event); err == nil && client.resumes != "" && event.Origin == client.resumes {
+			continue
+		}
+		frames = append(frames, data)
+	}
+	return frames
+}
+
+func (h *WebSocketHandler) sendSnapshot(client *Client) {
+	h.snapshot(client).send(client)
+}
+
+// snapshot loads the session state as the messages that carry it to client.
+func (h *WebSocketHandler) snapshot(client *Client) frameList {
+	var frames frameList
+
+	// Read the sequence first so nothing after it is missing from the state
+	seq, err := h.store.GetEventSeq(client.sessionID)
+	if err != nil {
+		log.Printf("Failed to read event sequence of session %s: %v", client.sessionID, err)
+		return nil
+	}
+
+	session, err := h.store.GetSession(client.sessionID)
+	if err != nil {
+		log.Printf("Failed to load session %s: %v", client.sessionID, err)
+		return nil
+	}
+
+	frames.add(models.WSMessage{
+		Type:      "workspace",
+		Seq:       seq,
+		SessionID: client.sessionID,
+		Data:      newWorkspaceState(session),
+	})
+
+	// Send current code state of the main file, for single-file clients
+	frames.add(models.WSMessage{
+		Type:      "code_change",
+		Seq:       seq,
+		SessionID: client.sessionID,
+		Data: map[string]interface{}{
+			"code":     session.Code,
+			"revision": session.Revision,
+		},
+	})
+
+	// Send current language state
+	frames.add(models.WSMessage{
+		Type:      "language_change",
+		Seq:       seq,
+		SessionID: client.sessionID,
+		Data: map[string]interface{}{
+			"language": session.Language,
+			"revision": session.Revision,
+		},
+	})
+
+	// The rest is sent part by part, so one the store fails to load doesn't
+	// keep the others from the client
+	comments, err := h.store.GetComments(client.sessionID)
+	frames.addPart(client.sessionID, seq, "comments", comments, err)
+
+	suggestions, err := h.store.GetSuggestions(client.sessionID)
+	pending := make([]models.Suggestion, 0, len(suggestions))
+	for _, suggestion := range suggestions {
+		if suggestion.Status == models.SuggestionPending {
+			pending = append(pending, suggestion)
+		}
+	}
+	frames.addPart(client.sessionID, seq, "suggestions", pending, err)
+
+	review, err := h.store.GetReview(client.sessionID)
+	frames.addPart(client.sessionID, seq, "review", review, err)
+
+	messages, err := h.store.GetMessages(client.sessionID, 0, chatSnapshotSize)
+	frames.addPart(client.sessionID, seq, "chat_history", messages, err)
+
+	presence, err := h.store.GetPresence(client.sessionID)
+	frames.addPart(client.sessionID, seq, "presence_state", presence, err)
+
+	return frames
+}
+
+// frameList holds encoded messages for one client, so they can be loaded
+// away from the goroutine that sends them.
+type frameList [][]byte
+
+func (f *frameList) add(message models.WSMessage) {
 	data, err := json.Marshal(message)
 	if err != nil {
 		log.Printf("JSON marshal error: %v", err)
 		return
 	}
+	*f = append(*f, data)
+}
 
-	h.broadcast <- &BroadcastMessage{
-		sessionID: sessionID,
-		message:   data,
-		exclude:   exclude,
+// addPart adds one part of the session state, or logs why it couldn't be
+// loaded.
+func (f *frameList) addPart(sessionID string, seq int64, msgType string, data interface{}, err error) {
+	if err != nil {
+		log.Printf("Failed to load %s of session %s: %v", msgType, sessionID, err)
+		return
+	}
+	f.add(models.WSMessage{
+		Type:      msgType,
+		Seq:       seq,
+		SessionID: sessionID,
+		Data:      data,
+	})
+}
+
+func (f frameList) send(client *Client) {
+	for _, data := range f {
+		client.trySend(data)
+	}
+}
+
+func (h *WebSocketHandler) sendToClient(client *Client, message models.WSMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("JSON marshal error: %v", err)
+		return
+	}
+
+	client.trySend(data)
+}
+
+func (h *WebSocketHandler) broadcastToSession(sessionID string, message models.WSMessage, exclude *Client) {
+	// Every broadcast is sequenced and logged so reconnecting clients can
+	// catch up on what they missed
+	if exclude != nil {
+		message.Origin = exclude.id
+	}
+	if err := h.store.Broadcast(sessionID, &message); err != nil {
+		log.Printf("Failed to broadcast to session %s: %v", sessionID, err)
 	}
 }
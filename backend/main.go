@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -18,24 +19,59 @@ import (
 func main() {
 	godotenv.Load()
 
-	redisService := services.NewRedisService()
-	defer redisService.Close()
+	sessionStore, err := services.NewSessionStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	archive, err := services.NewSessionArchive()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Archived sessions are restored into the session store when opened
+	store := services.NewArchivingStore(sessionStore, archive)
+	defer store.Close()
+
+	if redisService, ok := sessionStore.(*services.RedisService); ok {
+		go func() {
+			migrated, err := redisService.MigrateLegacySessions()
+			if err != nil {
+				log.Printf("Failed to migrate legacy sessions: %v", err)
+			}
+			if migrated > 0 {
+				log.Printf("Migrated %d legacy sessions", migrated)
+			}
+		}()
+	}
 
 	aiService := services.NewAIService(os.Getenv("ANTHROPIC_API_KEY"))
+	authService := services.NewAuthService()
+	inviteService := services.NewInviteService(store)
+
+	allowedOrigins := []string{"http://localhost:3000", "http://localhost:3001"}
+	if origins := os.Getenv("ALLOWED_ORIGINS"); origins != "" {
+		allowedOrigins = nil
+		for _, origin := range strings.Split(origins, ",") {
+			allowedOrigins = append(allowedOrigins, strings.TrimSpace(origin))
+		}
+	}
 
-	wsHandler := handlers.NewWebSocketHandler(redisService)
-	sessionHandler := handlers.NewSessionHandler(redisService)
+	wsHandler := handlers.NewWebSocketHandler(store, inviteService, allowedOrigins)
+	go wsHandler.ExpireGhosts()
+	sessionHandler := handlers.NewSessionHandler(store, wsHandler, inviteService, store)
 	aiHandler := handlers.NewAIHandler(aiService)
 	codeRunnerHandler := handlers.NewCodeRunnerHandler()
 
 	r := chi.NewRouter()
 
+	r.Use(handlers.RedactToken)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
 
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:3000", "http://localhost:3001"},
+		AllowedOrigins:   allowedOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		ExposedHeaders:   []string{"Link"},
@@ -43,12 +79,43 @@ func main() {
 		MaxAge:           300,
 	}))
 
-	r.Get("/ws", wsHandler.HandleWebSocket)
+	requireAuth := handlers.RequireAuth(authService)
+
+	r.With(requireAuth).Get("/ws", wsHandler.HandleWebSocket)
+	r.With(requireAuth).Get("/ws/playback", wsHandler.HandlePlayback)
 
 	r.Route("/api", func(r chi.Router) {
+		r.Use(requireAuth)
+
 		r.Post("/sessions", sessionHandler.CreateSession)
 		r.Get("/sessions/{id}", sessionHandler.GetSession)
+		r.Put("/sessions/{id}", sessionHandler.UpdateSession)
 		r.Post("/sessions/{id}/join", sessionHandler.JoinSession)
+		r.Post("/sessions/{id}/archive", sessionHandler.ArchiveSession)
+		r.Get("/sessions/{id}/log", sessionHandler.GetSessionLog)
+		r.Get("/sessions/{id}/history", sessionHandler.GetSessionHistory)
+		r.Get("/sessions/{id}/revisions/{rev}", sessionHandler.GetRevision)
+		r.Get("/sessions/{id}/diff", sessionHandler.GetDiff)
+		r.Get("/sessions/{id}/blame", sessionHandler.GetBlame)
+		r.Get("/sessions/{id}/files", sessionHandler.ListFiles)
+		r.Get("/sessions/{id}/files/*", sessionHandler.GetFile)
+		r.Get("/sessions/{id}/comments", sessionHandler.ListComments)
+		r.Post("/sessions/{id}/comments", sessionHandler.CreateComment)
+		r.Put("/sessions/{id}/comments/{commentID}", sessionHandler.UpdateComment)
+		r.Delete("/sessions/{id}/comments/{commentID}", sessionHandler.DeleteComment)
+		r.Get("/sessions/{id}/suggestions", sessionHandler.ListSuggestions)
+		r.Post("/sessions/{id}/suggestions", sessionHandler.CreateSuggestion)
+		r.Post("/sessions/{id}/suggestions/{suggestionID}/accept", sessionHandler.AcceptSuggestion)
+		r.Post("/sessions/{id}/suggestions/{suggestionID}/reject", sessionHandler.RejectSuggestion)
+		r.Get("/sessions/{id}/review", sessionHandler.GetReview)
+		r.Put("/sessions/{id}/review/status", sessionHandler.ChangeReviewStatus)
+		r.Put("/sessions/{id}/review/verdict", sessionHandler.SetVerdict)
+		r.Get("/sessions/{id}/messages", sessionHandler.ListMessages)
+		r.Put("/sessions/{id}/participants/{userID}", sessionHandler.SetParticipantRole)
+		r.Delete("/sessions/{id}/participants/{userID}", sessionHandler.RemoveParticipant)
+		r.Post("/sessions/{id}/invites", sessionHandler.CreateInvite)
+		r.Get("/sessions/{id}/invites", sessionHandler.ListInvites)
+		r.Delete("/sessions/{id}/invites/{inviteID}", sessionHandler.RevokeInvite)
 
 		r.Post("/analyze", aiHandler.AnalyzeCode)
 		r.Post("/suggest", aiHandler.SuggestImprovements)
@@ -66,6 +133,19 @@ func main() {
 		port = "8080"
 	}
 
+	// Per-client stats name sessions and users, so they are only served on
+	// a separate listener meant to stay off the public network
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		metrics := chi.NewRouter()
+		metrics.Get("/metrics/clients", wsHandler.ClientStats)
+		go func() {
+			log.Printf("Metrics listening on %s", addr)
+			if err := http.ListenAndServe(addr, metrics); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	log.Printf("Server starting on port %s", port)
 	if err := http.ListenAndServe(":"+port, r); err != nil {
 		log.Fatal(err)
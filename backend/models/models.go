@@ -2,12 +2,62 @@ package models
 
 import "time"
 
+type Role string
+
+const (
+	RoleOwner  Role = "owner"
+	RoleEditor Role = "editor"
+	RoleViewer Role = "viewer"
+)
+
+// Session.Users lists who is currently present; Roles remembers every
+// participant's role across visits. DefaultRole is the role invites grant
+// unless they name one. Code and Language mirror the workspace's main file,
+// which is what clients that predate workspaces edit.
 type Session struct {
-	ID        string    `json:"id"`
-	Code      string    `json:"code"`
-	Language  string    `json:"language"`
-	CreatedAt time.Time `json:"created_at"`
-	Users     []User    `json:"users"`
+	ID          string          `json:"id"`
+	Code        string          `json:"code"`
+	Language    string          `json:"language"`
+	Revision    int             `json:"revision"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Users       []User          `json:"users"`
+	OwnerID     string          `json:"owner_id"`
+	DefaultRole Role            `json:"default_role"`
+	Roles       map[string]Role `json:"roles"`
+	Workspace
+}
+
+func (s *Session) RoleOf(userID string) Role {
+	return s.Roles[userID]
+}
+
+func (s *Session) CanEdit(userID string) bool {
+	role := s.RoleOf(userID)
+	return role == RoleOwner || role == RoleEditor
+}
+
+// Workspace is the file tree of a session. Files are sorted by path, which
+// is slash-separated and relative, such as "src/main.go". The main file
+// can be renamed but not deleted.
+type Workspace struct {
+	MainFile string `json:"main_file"`
+	Files    []File `json:"files"`
+}
+
+// File returns the file at path, or nil if there is none.
+func (w *Workspace) File(path string) *File {
+	for i := range w.Files {
+		if w.Files[i].Path == path {
+			return &w.Files[i]
+		}
+	}
+	return nil
+}
+
+type File struct {
+	Path     string `json:"path"`
+	Language string `json:"language"`
+	Code     string `json:"code"`
 }
 
 type User struct {
@@ -16,28 +66,426 @@ type User struct {
 	Email    string `json:"email"`
 	Color    string `json:"color"`
 	ImageURL string `json:"image_url"`
+	Role     Role   `json:"role,omitempty"`
 }
 
+// WSMessage is a message to or from a client. Origin is the connection a
+// broadcast was made on, which it isn't delivered to.
 type WSMessage struct {
 	Type      string      `json:"type"`
+	Seq       int64       `json:"seq,omitempty"`
 	SessionID string      `json:"session_id"`
 	UserID    string      `json:"user_id"`
+	Origin    string      `json:"origin,omitempty"`
 	User      *User       `json:"user,omitempty"`
 	Data      interface{} `json:"data,omitempty"`
 }
 
+// CursorPosition is the single cursor older clients send as cursor_move,
+// which is relayed as it is. Presence supersedes it.
 type CursorPosition struct {
 	Line   int    `json:"line"`
 	Column int    `json:"column"`
 	UserID string `json:"user_id"`
+	User   *User  `json:"user,omitempty"`
 }
 
+// Presence is what a user is doing in a session: the file they have
+// focused, or the main file if Path is empty, their selections and the
+// lines they can see in it, and whether they are typing. The server keeps
+// the latest from each present user.
+type Presence struct {
+	UserID     string      `json:"user_id"`
+	Path       string      `json:"path,omitempty"`
+	Selections []Selection `json:"selections"`
+	Viewport   *Viewport   `json:"viewport,omitempty"`
+	Typing     bool        `json:"typing"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+}
+
+// Position is a 1-based line and column.
+type Position struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Selection runs from Anchor, where it was started, to Head, where the
+// cursor is. A bare cursor has both at the same place.
+type Selection struct {
+	Anchor Position `json:"anchor"`
+	Head   Position `json:"head"`
+}
+
+// Viewport is the range of lines scrolled into view.
+type Viewport struct {
+	FirstLine int `json:"first_line"`
+	LastLine  int `json:"last_line"`
+}
+
+// CodeChange, EditData and LanguageChange address the file at Path, or the
+// main file if it is empty.
 type CodeChange struct {
+	Path      string `json:"path,omitempty"`
 	Code      string `json:"code"`
+	Revision  int    `json:"revision"`
 	UserID    string `json:"user_id"`
 	Timestamp int64  `json:"timestamp"`
 }
 
+type LanguageChange struct {
+	Path     string `json:"path,omitempty"`
+	Language string `json:"language"`
+	Revision int    `json:"revision"`
+}
+
+// OpComponent is one step of a text operation. Exactly one field is set;
+// positions are counted in runes and any text after the last component is
+// implicitly retained.
+type OpComponent struct {
+	Retain int    `json:"retain,omitempty"`
+	Insert string `json:"insert,omitempty"`
+	Delete int    `json:"delete,omitempty"`
+}
+
+// EditData is an edit to the file at Path, made against Revision. Its ops
+// count Unicode code points, not the UTF-16 units JavaScript strings are
+// indexed by, so browsers must convert: a character outside the Basic
+// Multilingual Plane, such as most emoji, is one position, not two.
+type EditData struct {
+	Path     string        `json:"path,omitempty"`
+	Revision int           `json:"revision"`
+	Ops      []OpComponent `json:"ops"`
+}
+
+// Kinds of OpRecord.Action.
+const (
+	FileCreate = "create"
+	FileRename = "rename"
+	FileDelete = "delete"
+)
+
+// OpRecord is one committed revision, which changed the file at Path.
+// Records from before workspaces have no Path and changed the main file.
+// Language is set when the revision switched the file's language. Action is
+// set for revisions that created, renamed or deleted the file rather than
+// edited it; a created file's content is inserted by Ops. Suggestion is
+// set when the revision accepted that suggestion, as an edit by its author.
+// Comments and Suggestions hold those the revision moved or closed, and
+// Review the review it sent back for review; none of them are kept.
+type OpRecord struct {
+	Revision    int           `json:"revision"`
+	UserID      string        `json:"user_id"`
+	Path        string        `json:"path,omitempty"`
+	Action      string        `json:"action,omitempty"`
+	NewPath     string        `json:"new_path,omitempty"`
+	Ops         []OpComponent `json:"ops"`
+	Language    string        `json:"language,omitempty"`
+	Suggestion  string        `json:"suggestion,omitempty"`
+	Timestamp   int64         `json:"timestamp"`
+	Comments    []Comment     `json:"-"`
+	Suggestions []Suggestion  `json:"-"`
+	Review      *Review       `json:"-"`
+}
+
+// FileChange creates, renames or deletes a workspace file. Action is set by
+// the message type it arrives as; Revision is the one it made once
+// committed.
+type FileChange struct {
+	Action   string `json:"-"`
+	Path     string `json:"path"`
+	NewPath  string `json:"new_path,omitempty"`
+	Language string `json:"language,omitempty"`
+	Code     string `json:"code,omitempty"`
+	Revision int    `json:"revision"`
+}
+
+// Kinds of HistoryEntry.
+const (
+	HistoryEdit     = "edit"
+	HistoryLanguage = "language"
+	HistoryJoin     = "join"
+	HistoryLeave    = "leave"
+
+	HistoryFileCreate = "file_create"
+	HistoryFileRename = "file_rename"
+	HistoryFileDelete = "file_delete"
+)
+
+// HistoryEntry is one entry of a session's change log. Edits carry Ops and
+// language changes carry Language, both for the file at Path; created files
+// carry both. Revision is the revision the entry made, or for joins and
+// leaves the one the session was at.
+type HistoryEntry struct {
+	ID        string        `json:"id"`
+	Type      string        `json:"type"`
+	UserID    string        `json:"user_id"`
+	Timestamp int64         `json:"timestamp"`
+	Revision  int           `json:"revision"`
+	Path      string        `json:"path,omitempty"`
+	NewPath   string        `json:"new_path,omitempty"`
+	Ops       []OpComponent `json:"ops,omitempty"`
+	Language  string        `json:"language,omitempty"`
+}
+
+// Snapshot is the session content as of a revision, with Code and Language
+// mirroring the main file as for sessions. EntryID is the last history
+// entry it includes, so replaying the entries after it rebuilds later
+// revisions.
+type Snapshot struct {
+	Revision  int       `json:"revision"`
+	Code      string    `json:"code"`
+	Language  string    `json:"language"`
+	EntryID   string    `json:"entry_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Workspace
+}
+
+// RevisionSummary describes one revision in a session's timeline: the file
+// it changed, with Inserted and Deleted counting runes and Language set when
+// the revision changed it.
+type RevisionSummary struct {
+	Revision  int    `json:"revision"`
+	UserID    string `json:"user_id"`
+	Path      string `json:"path,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+	Inserted  int    `json:"inserted"`
+	Deleted   int    `json:"deleted"`
+	Language  string `json:"language,omitempty"`
+}
+
+// Comment is a review comment. A thread starts with a comment anchored to
+// lines StartLine to EndLine of the file at Path, numbered from 1, and its
+// replies name it as their ThreadID. Anchors move with the code as it is
+// edited; once the anchored text is deleted the thread is Outdated.
+type Comment struct {
+	ID        string    `json:"id"`
+	SessionID string    `json:"session_id"`
+	ThreadID  string    `json:"thread_id,omitempty"`
+	UserID    string    `json:"user_id"`
+	Body      string    `json:"body"`
+	Path      string    `json:"path,omitempty"`
+	StartLine int       `json:"start_line,omitempty"`
+	EndLine   int       `json:"end_line,omitempty"`
+	Outdated  bool      `json:"outdated,omitempty"`
+	Resolved  bool      `json:"resolved,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// NewComment starts a thread on lines of the file at Path, or the main
+// file, as they were at Revision. With ThreadID set it replies to that
+// thread instead, and the anchor is ignored.
+type NewComment struct {
+	ThreadID  string `json:"thread_id,omitempty"`
+	Path      string `json:"path,omitempty"`
+	StartLine int    `json:"start_line,omitempty"`
+	EndLine   int    `json:"end_line,omitempty"`
+	Revision  int    `json:"revision"`
+	Body      string `json:"body"`
+}
+
+// CommentUpdate edits a comment or resolves its thread. Fields left out
+// are unchanged.
+type CommentUpdate struct {
+	ID       string  `json:"id"`
+	Body     *string `json:"body,omitempty"`
+	Resolved *bool   `json:"resolved,omitempty"`
+}
+
+// CommentRef names a comment to delete.
+type CommentRef struct {
+	ID string `json:"id"`
+}
+
+// Suggestion states.
+const (
+	SuggestionPending  = "pending"
+	SuggestionAccepted = "accepted"
+	SuggestionRejected = "rejected"
+	SuggestionOutdated = "outdated"
+)
+
+// Suggestion is an edit UserID proposed rather than applied. While it is
+// pending its Ops apply to the file at Path as it is now: every revision
+// changing the file rebases them, and Revision is the last that did. Start
+// to End are the runes of the file the suggestion replaces. It is outdated
+// once its file is deleted.
+type Suggestion struct {
+	ID         string        `json:"id"`
+	SessionID  string        `json:"session_id"`
+	UserID     string        `json:"user_id"`
+	Path       string        `json:"path"`
+	Revision   int           `json:"revision"`
+	Ops        []OpComponent `json:"ops"`
+	Start      int           `json:"start"`
+	End        int           `json:"end"`
+	Status     string        `json:"status"`
+	CreatedAt  time.Time     `json:"created_at"`
+	ResolvedAt *time.Time    `json:"resolved_at,omitempty"`
+}
+
+// SuggestionRef names a suggestion to accept or reject.
+type SuggestionRef struct {
+	ID string `json:"id"`
+}
+
+// Review states. Approved and changes requested double as verdicts.
+const (
+	ReviewDraft            = "draft"
+	ReviewInReview         = "in_review"
+	ReviewChangesRequested = "changes_requested"
+	ReviewApproved         = "approved"
+)
+
+// Review is the review outcome of a session. The owner moves it from draft
+// to in review, which starts a round of verdicts from the other
+// participants; while it lasts, the status follows them, any request for
+// changes outweighing approvals. History records every status change.
+type Review struct {
+	Status   string             `json:"status"`
+	Verdicts map[string]Verdict `json:"verdicts"` // by user ID
+	History  []ReviewTransition `json:"history"`
+}
+
+type Verdict struct {
+	Verdict  string    `json:"verdict"`
+	Body     string    `json:"body,omitempty"`
+	Revision int       `json:"revision"` // the session revision it was given at
+	At       time.Time `json:"at"`
+}
+
+// ReviewTransition is a change of review status, made by UserID either
+// directly or through their verdict.
+type ReviewTransition struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	UserID string    `json:"user_id"`
+	At     time.Time `json:"at"`
+}
+
+// ReviewStatusChange is the owner asking for review, or taking the session
+// back to draft.
+type ReviewStatusChange struct {
+	Status string `json:"status"`
+}
+
+// ReviewVerdict is a participant's verdict in the current review round.
+type ReviewVerdict struct {
+	Verdict string `json:"verdict"`
+	Body    string `json:"body,omitempty"`
+}
+
+// ChatMessage is a message in a session's chat. IDs count up from 1 in the
+// order messages were sent. Mentions lists the present participants the
+// body @mentions, by user ID.
+type ChatMessage struct {
+	ID        int64     `json:"id"`
+	SessionID string    `json:"session_id"`
+	UserID    string    `json:"user_id"`
+	Body      string    `json:"body"`
+	Mentions  []string  `json:"mentions,omitempty"`
+	Refs      []CodeRef `json:"refs,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CodeRef links to lines StartLine to EndLine of the file at Path, or of
+// the main file if Path is empty, as of Revision. The server sets Revision
+// to the one the message was sent at.
+type CodeRef struct {
+	Path      string `json:"path,omitempty"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	Revision  int    `json:"revision"`
+}
+
+// NewChatMessage is a chat message as sent by a client.
+type NewChatMessage struct {
+	Body string    `json:"body"`
+	Refs []CodeRef `json:"refs,omitempty"`
+}
+
+// LineBlame attributes a line of code to the user and revision that last
+// touched it. UserID is empty for lines written before attribution was
+// tracked.
+type LineBlame struct {
+	UserID   string `json:"user_id"`
+	Revision int    `json:"revision"`
+}
+
+// Kinds of DiffLine.
+const (
+	DiffContext = "context"
+	DiffInsert  = "insert"
+	DiffDelete  = "delete"
+)
+
+// DiffHunk is one group of changed lines and the unchanged lines around
+// them. Line numbers start at 1; a start with zero lines is the line the
+// hunk follows.
+type DiffHunk struct {
+	OldStart int        `json:"old_start"`
+	OldLines int        `json:"old_lines"`
+	NewStart int        `json:"new_start"`
+	NewLines int        `json:"new_lines"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+// DiffLine is a line of a hunk, without its newline. NoNewline marks the
+// last line of a document that doesn't end in one.
+type DiffLine struct {
+	Kind      string `json:"kind"`
+	Text      string `json:"text"`
+	OldLine   int    `json:"old_line,omitempty"`
+	NewLine   int    `json:"new_line,omitempty"`
+	NoNewline bool   `json:"no_newline,omitempty"`
+}
+
+// Invite is the server-side record behind an invite token. MaxUses of zero
+// means unlimited.
+type Invite struct {
+	ID        string    `json:"id"`
+	SessionID string    `json:"session_id"`
+	Role      Role      `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ArchivedSession is a session as kept in durable storage, along with its
+// operation history, change log and snapshots, comments, suggestions, review
+// and chat.
+type ArchivedSession struct {
+	Session     Session        `json:"session"`
+	Ops         []OpRecord     `json:"ops"`
+	History     []HistoryEntry `json:"history,omitempty"`
+	Snapshots   []Snapshot     `json:"snapshots,omitempty"`
+	Comments    []Comment      `json:"comments,omitempty"`
+	Suggestions []Suggestion   `json:"suggestions,omitempty"`
+	Review      *Review        `json:"review,omitempty"`
+	Messages    []ChatMessage  `json:"messages,omitempty"`
+	ArchivedAt  time.Time      `json:"archived_at"`
+	ArchivedBy  string         `json:"archived_by"`
+}
+
+type RoleChange struct {
+	UserID string `json:"user_id"`
+	Role   Role   `json:"role"`
+}
+
+type ParticipantRemoval struct {
+	UserID string `json:"user_id"`
+}
+
+// WSError is the payload of an "error" message sent back for a frame the
+// server could not accept.
+type WSError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Type    string `json:"type,omitempty"`
+}
+
 type AIRequest struct {
 	Code     string `json:"code"`
 	Language string `json:"language"`
@@ -0,0 +1,263 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Limits applied to incoming websocket payloads.
+const (
+	MaxCodeLength     = 1 << 20
+	MaxLanguageLength = 32
+	MaxPathLength     = 255
+	MaxCommentLength  = 10000
+	MaxChatLength     = 4000
+	MaxCodeRefs       = 10
+	MaxSelections     = 100
+)
+
+// ValidatePath checks that p is a clean, relative, slash-separated file
+// path such as "src/main.go".
+func ValidatePath(p string) error {
+	if p == "" || len(p) > MaxPathLength {
+		return fmt.Errorf("path must be 1 to %d bytes", MaxPathLength)
+	}
+	if strings.HasPrefix(p, "/") || strings.Contains(p, "\\") || path.Clean(p) != p {
+		return fmt.Errorf("path %q must be relative and clean", p)
+	}
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return fmt.Errorf("path %q must name a file in the workspace", p)
+	}
+	return nil
+}
+
+// validateFilePath checks an optional path addressing an existing file.
+func validateFilePath(p string) error {
+	if p == "" {
+		return nil
+	}
+	return ValidatePath(p)
+}
+
+func (c OpComponent) Validate() error {
+	set := 0
+	if c.Retain != 0 {
+		set++
+	}
+	if c.Insert != "" {
+		set++
+	}
+	if c.Delete != 0 {
+		set++
+	}
+	if set != 1 || c.Retain < 0 || c.Delete < 0 {
+		return errors.New("op component must set exactly one of a positive retain, a non-empty insert or a positive delete")
+	}
+	return nil
+}
+
+func (p *CursorPosition) Validate() error {
+	if p.Line < 1 || p.Column < 1 {
+		return errors.New("line and column must be at least 1")
+	}
+	return nil
+}
+
+func (p Position) Validate() error {
+	if p.Line < 1 || p.Column < 1 {
+		return errors.New("line and column must be at least 1")
+	}
+	return nil
+}
+
+func (p *Presence) Validate() error {
+	if err := validateFilePath(p.Path); err != nil {
+		return err
+	}
+	if len(p.Selections) > MaxSelections {
+		return fmt.Errorf("at most %d selections are allowed", MaxSelections)
+	}
+	for i, selection := range p.Selections {
+		if err := selection.Anchor.Validate(); err != nil {
+			return fmt.Errorf("selections[%d].anchor: %w", i, err)
+		}
+		if err := selection.Head.Validate(); err != nil {
+			return fmt.Errorf("selections[%d].head: %w", i, err)
+		}
+	}
+	if p.Viewport != nil && (p.Viewport.FirstLine < 1 || p.Viewport.LastLine < p.Viewport.FirstLine) {
+		return errors.New("viewport first_line must be at least 1 and last_line at least first_line")
+	}
+	return nil
+}
+
+func (p *CodeChange) Validate() error {
+	if err := validateFilePath(p.Path); err != nil {
+		return err
+	}
+	if len(p.Code) > MaxCodeLength {
+		return fmt.Errorf("code exceeds %d bytes", MaxCodeLength)
+	}
+	if p.Revision < 0 {
+		return errors.New("revision must not be negative")
+	}
+	return nil
+}
+
+func (p *EditData) Validate() error {
+	if err := validateFilePath(p.Path); err != nil {
+		return err
+	}
+	if p.Revision < 0 {
+		return errors.New("revision must not be negative")
+	}
+	for i, c := range p.Ops {
+		if err := c.Validate(); err != nil {
+			return fmt.Errorf("ops[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (p *LanguageChange) Validate() error {
+	if err := validateFilePath(p.Path); err != nil {
+		return err
+	}
+	if p.Language == "" || len(p.Language) > MaxLanguageLength {
+		return fmt.Errorf("language must be 1 to %d bytes", MaxLanguageLength)
+	}
+	if p.Revision < 0 {
+		return errors.New("revision must not be negative")
+	}
+	return nil
+}
+
+func (p *FileChange) Validate() error {
+	if err := ValidatePath(p.Path); err != nil {
+		return err
+	}
+	switch p.Action {
+	case FileCreate:
+		if len(p.Code) > MaxCodeLength {
+			return fmt.Errorf("code exceeds %d bytes", MaxCodeLength)
+		}
+		if len(p.Language) > MaxLanguageLength {
+			return fmt.Errorf("language exceeds %d bytes", MaxLanguageLength)
+		}
+	case FileRename:
+		if err := ValidatePath(p.NewPath); err != nil {
+			return fmt.Errorf("new_path: %w", err)
+		}
+	case FileDelete:
+	default:
+		return fmt.Errorf("unknown file action %q", p.Action)
+	}
+	return nil
+}
+
+func validateCommentBody(body string) error {
+	if strings.TrimSpace(body) == "" || len(body) > MaxCommentLength {
+		return fmt.Errorf("body must be 1 to %d bytes and not blank", MaxCommentLength)
+	}
+	return nil
+}
+
+func (p *NewComment) Validate() error {
+	if err := validateCommentBody(p.Body); err != nil {
+		return err
+	}
+	if p.ThreadID != "" {
+		return nil
+	}
+	if err := validateFilePath(p.Path); err != nil {
+		return err
+	}
+	if p.StartLine < 1 || p.EndLine < p.StartLine {
+		return errors.New("start_line must be at least 1 and end_line at least start_line")
+	}
+	if p.Revision < 0 {
+		return errors.New("revision must not be negative")
+	}
+	return nil
+}
+
+func (p *CommentUpdate) Validate() error {
+	if p.ID == "" {
+		return errors.New("id is required")
+	}
+	if p.Body == nil && p.Resolved == nil {
+		return errors.New("body or resolved is required")
+	}
+	if p.Body != nil {
+		return validateCommentBody(*p.Body)
+	}
+	return nil
+}
+
+func (p *CommentRef) Validate() error {
+	if p.ID == "" {
+		return errors.New("id is required")
+	}
+	return nil
+}
+
+func (p *SuggestionRef) Validate() error {
+	if p.ID == "" {
+		return errors.New("id is required")
+	}
+	return nil
+}
+
+func (p *ReviewStatusChange) Validate() error {
+	if p.Status != ReviewDraft && p.Status != ReviewInReview {
+		return errors.New("status must be draft or in_review")
+	}
+	return nil
+}
+
+func (p *ReviewVerdict) Validate() error {
+	if p.Verdict != ReviewApproved && p.Verdict != ReviewChangesRequested {
+		return errors.New("verdict must be approved or changes_requested")
+	}
+	if len(p.Body) > MaxCommentLength {
+		return fmt.Errorf("body must be at most %d bytes", MaxCommentLength)
+	}
+	return nil
+}
+
+func (p *NewChatMessage) Validate() error {
+	if strings.TrimSpace(p.Body) == "" || len(p.Body) > MaxChatLength {
+		return fmt.Errorf("body must be 1 to %d bytes and not blank", MaxChatLength)
+	}
+	if len(p.Refs) > MaxCodeRefs {
+		return fmt.Errorf("at most %d refs are allowed", MaxCodeRefs)
+	}
+	for i, ref := range p.Refs {
+		if err := validateFilePath(ref.Path); err != nil {
+			return fmt.Errorf("refs[%d]: %w", i, err)
+		}
+		if ref.StartLine < 1 || ref.EndLine < ref.StartLine {
+			return fmt.Errorf("refs[%d]: start_line must be at least 1 and end_line at least start_line", i)
+		}
+	}
+	return nil
+}
+
+func (p *RoleChange) Validate() error {
+	if p.UserID == "" {
+		return errors.New("user_id is required")
+	}
+	if p.Role != RoleEditor && p.Role != RoleViewer {
+		return errors.New("role must be editor or viewer")
+	}
+	return nil
+}
+
+func (p *ParticipantRemoval) Validate() error {
+	if p.UserID == "" {
+		return errors.New("user_id is required")
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"codestream/models"
+)
+
+var ErrNotArchived = errors.New("session is not archived")
+
+// SessionArchive is durable storage for sessions that should outlive the
+// session store's retention.
+type SessionArchive interface {
+	Save(archived *models.ArchivedSession) error
+	Load(sessionID string) (*models.ArchivedSession, error)
+	Close() error
+}
+
+// NewSessionArchive opens the archive named by ARCHIVE_STORE: "file" (the
+// default) keeps one JSON file per session in ARCHIVE_DIR, "sqlite" keeps
+// them in the database at ARCHIVE_SQLITE_PATH.
+func NewSessionArchive() (SessionArchive, error) {
+	switch kind := os.Getenv("ARCHIVE_STORE"); kind {
+	case "", "file":
+		dir := os.Getenv("ARCHIVE_DIR")
+		if dir == "" {
+			dir = "archive"
+		}
+		return NewFileArchive(dir)
+	case "sqlite":
+		path := os.Getenv("ARCHIVE_SQLITE_PATH")
+		if path == "" {
+			path = "archive.db"
+		}
+		return NewSQLiteArchive(path)
+	default:
+		return nil, fmt.Errorf("unknown ARCHIVE_STORE %q", kind)
+	}
+}
+
+// ArchivingStore wraps a SessionStore so that archived sessions the store
+// no longer holds are restored into it when they are next looked up.
+type ArchivingStore struct {
+	SessionStore
+	archive SessionArchive
+}
+
+func NewArchivingStore(store SessionStore, archive SessionArchive) *ArchivingStore {
+	return &ArchivingStore{
+		SessionStore: store,
+		archive:      archive,
+	}
+}
+
+func (s *ArchivingStore) GetSession(sessionID string) (*models.Session, error) {
+	session, err := s.SessionStore.GetSession(sessionID)
+	if !errors.Is(err, ErrSessionNotFound) {
+		return session, err
+	}
+
+	archived, err := s.archive.Load(sessionID)
+	if errors.Is(err, ErrNotArchived) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.SessionStore.RestoreSession(archived); err != nil {
+		return nil, err
+	}
+	return s.SessionStore.GetSession(sessionID)
+}
+
+// Archive writes the session, its history, change log and snapshots,
+// comments, suggestions, review and chat to the archive. The live session
+// is left as it is, and archiving again replaces the earlier copy.
+func (s *ArchivingStore) Archive(sessionID, userID string) (*models.ArchivedSession, error) {
+	session, err := s.GetSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	ops, err := s.SessionStore.GetOpsSince(sessionID, 0)
+	if err != nil {
+		return nil, err
+	}
+	history, err := s.SessionStore.GetHistory(sessionID, "-", "+", 0)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := s.SessionStore.GetSnapshots(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	comments, err := s.SessionStore.GetComments(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	suggestions, err := s.SessionStore.GetSuggestions(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	review, err := s.SessionStore.GetReview(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := s.SessionStore.GetMessages(sessionID, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Whoever is connected now won't be when it is restored
+	session.Users = []models.User{}
+
+	archived := &models.ArchivedSession{
+		Session:     *session,
+		Ops:         ops,
+		History:     history,
+		Snapshots:   snapshots,
+		Comments:    comments,
+		Suggestions: suggestions,
+		Review:      review,
+		Messages:    messages,
+		ArchivedAt:  time.Now(),
+		ArchivedBy:  userID,
+	}
+	if err := s.archive.Save(archived); err != nil {
+		return nil, err
+	}
+
+	return archived, nil
+}
+
+func (s *ArchivingStore) Close() error {
+	s.archive.Close()
+	return s.SessionStore.Close()
+}
+
+// archivableID guards file names built from session IDs.
+var archivableID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// FileArchive keeps each archived session as a JSON file in a directory.
+type FileArchive struct {
+	dir string
+}
+
+func NewFileArchive(dir string) (*FileArchive, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileArchive{dir: dir}, nil
+}
+
+func (a *FileArchive) path(sessionID string) (string, error) {
+	if !archivableID.MatchString(sessionID) {
+		return "", fmt.Errorf("invalid session ID %q", sessionID)
+	}
+	return filepath.Join(a.dir, sessionID+".json"), nil
+}
+
+func (a *FileArchive) Save(archived *models.ArchivedSession) error {
+	path, err := a.path(archived.Session.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(archived)
+	if err != nil {
+		return err
+	}
+
+	// Write then rename, so a crash never leaves a truncated archive
+	tmp, err := os.CreateTemp(a.dir, archived.Session.ID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (a *FileArchive) Load(sessionID string) (*models.ArchivedSession, error) {
+	path, err := a.path(sessionID)
+	if err != nil {
+		return nil, ErrNotArchived
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotArchived
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var archived models.ArchivedSession
+	if err := json.Unmarshal(data, &archived); err != nil {
+		return nil, err
+	}
+	return &archived, nil
+}
+
+func (a *FileArchive) Close() error {
+	return nil
+}
+
+// SQLiteArchive keeps archived sessions in a SQLite database.
+type SQLiteArchive struct {
+	db *sql.DB
+}
+
+func NewSQLiteArchive(path string) (*SQLiteArchive, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS archived_sessions (
+		id          TEXT PRIMARY KEY,
+		archived_at TEXT NOT NULL,
+		data        TEXT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema: %w", err)
+	}
+
+	return &SQLiteArchive{db: db}, nil
+}
+
+func (a *SQLiteArchive) Save(archived *models.ArchivedSession) error {
+	data, err := json.Marshal(archived)
+	if err != nil {
+		return err
+	}
+
+	_, err = a.db.Exec(`INSERT INTO archived_sessions (id, archived_at, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET archived_at = excluded.archived_at, data = excluded.data`,
+		archived.Session.ID, archived.ArchivedAt.Format(time.RFC3339Nano), string(data))
+	return err
+}
+
+func (a *SQLiteArchive) Load(sessionID string) (*models.ArchivedSession, error) {
+	var data string
+	err := a.db.QueryRow(`SELECT data FROM archived_sessions WHERE id = ?`, sessionID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotArchived
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var archived models.ArchivedSession
+	if err := json.Unmarshal([]byte(data), &archived); err != nil {
+		return nil, err
+	}
+	return &archived, nil
+}
+
+func (a *SQLiteArchive) Close() error {
+	return a.db.Close()
+}
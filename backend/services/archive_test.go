@@ -0,0 +1,130 @@
+package services
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"codestream/models"
+)
+
+func forEachArchive(t *testing.T, test func(t *testing.T, archive SessionArchive)) {
+	t.Run("file", func(t *testing.T) {
+		archive, err := NewFileArchive(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		test(t, archive)
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		archive, err := NewSQLiteArchive(filepath.Join(t.TempDir(), "archive.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { archive.Close() })
+		test(t, archive)
+	})
+}
+
+// An archived session is restored, history, change log, comments and review
+// included, into a store that has lost it, and carries on from where it was
+// archived.
+func TestArchivedSessionsAreRestored(t *testing.T) {
+	forEachArchive(t, func(t *testing.T, archive SessionArchive) {
+		forEachStore(t, func(t *testing.T, store SessionStore) {
+			live := NewArchivingStore(NewMemoryStore(), archive)
+			createTestSession(t, live, "s1")
+			if _, err := live.AdmitUser("s1", models.User{ID: "bob"}, models.RoleEditor); err != nil {
+				t.Fatal(err)
+			}
+			for revision, code := range []string{"a", "ab", "abc"} {
+				code := code
+				if _, err := live.UpdateContent("s1", "bob", "", revision, &code, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := AddComment(live, "s1", "bob", &models.NewComment{StartLine: 1, EndLine: 1, Revision: 3, Body: "nice"}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ChangeReviewStatus(live, "s1", "owner", models.ReviewInReview); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := live.Archive("s1", "owner"); err != nil {
+				t.Fatal(err)
+			}
+
+			restored := NewArchivingStore(store, archive)
+			session, err := restored.GetSession("s1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if session.Code != "abc" || session.Revision != 3 {
+				t.Fatalf("restored %q at revision %d, want %q at 3", session.Code, session.Revision, "abc")
+			}
+			if session.Roles["bob"] != models.RoleEditor || len(session.Users) != 0 {
+				t.Fatalf("restored roles %v and users %v", session.Roles, session.Users)
+			}
+
+			comments, err := restored.GetComments("s1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(comments) != 1 || comments[0].Body != "nice" {
+				t.Fatalf("restored comments %+v", comments)
+			}
+			review, err := restored.GetReview("s1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if review.Status != models.ReviewInReview || len(review.History) != 1 {
+				t.Fatalf("restored review %+v", review)
+			}
+
+			ops, err := restored.GetOpsSince("s1", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ops) != 3 {
+				t.Fatalf("restored %d ops, want 3", len(ops))
+			}
+
+			revisions, err := ListRevisions(restored, "s1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(revisions) != 3 {
+				t.Fatalf("restored %d revisions, want 3", len(revisions))
+			}
+			snapshot, err := Rebuild(restored, "s1", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snapshot.Code != "a" {
+				t.Fatalf("rebuilt %q at revision 1, want %q", snapshot.Code, "a")
+			}
+
+			// An edit based on the old revision is still transformed
+			edit := []models.OpComponent{{Insert: "x"}}
+			if _, err := restored.ApplyEdit("s1", "bob", "", 2, edit); err != nil {
+				t.Fatal(err)
+			}
+			session, err = restored.GetSession("s1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if session.Code != "xabc" {
+				t.Fatalf("code %q after edit, want %q", session.Code, "xabc")
+			}
+			if revisions, err = ListRevisions(restored, "s1"); err != nil {
+				t.Fatal(err)
+			}
+			if len(revisions) != 4 || revisions[3].Revision != 4 {
+				t.Fatalf("revisions after edit %+v", revisions)
+			}
+
+			if _, err := restored.GetSession("missing"); !errors.Is(err, ErrSessionNotFound) {
+				t.Fatalf("missing session: got %v, want ErrSessionNotFound", err)
+			}
+		})
+	})
+}
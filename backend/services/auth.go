@@ -0,0 +1,358 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"codestream/models"
+)
+
+// jwksRefreshInterval limits how often an unknown key ID triggers a refetch
+// of a remote key set, whether or not the last attempt succeeded.
+const jwksRefreshInterval = 5 * time.Minute
+
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// AuthService verifies bearer JWTs against a JSON Web Key Set loaded from a
+// file (JWKS_FILE) or URL (JWKS_URL), such as the one Clerk publishes.
+type AuthService struct {
+	jwksURL   string
+	jwksFile  string
+	issuer    string
+	audience  string
+	client    *http.Client
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	attempted time.Time
+}
+
+func NewAuthService() *AuthService {
+	a := &AuthService{
+		jwksURL:  os.Getenv("JWKS_URL"),
+		jwksFile: os.Getenv("JWKS_FILE"),
+		issuer:   os.Getenv("JWT_ISSUER"),
+		audience: os.Getenv("JWT_AUDIENCE"),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		keys:     make(map[string]crypto.PublicKey),
+	}
+
+	if a.jwksURL == "" && a.jwksFile == "" {
+		fmt.Println("WARNING: JWKS_URL or JWKS_FILE is not set, all requests will be rejected!")
+		return a
+	}
+
+	if err := a.loadKeys(); err != nil {
+		log.Printf("Failed to load JWKS: %v", err)
+	}
+
+	return a
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (a *AuthService) loadKeys() error {
+	var data []byte
+	var err error
+	if a.jwksFile != "" {
+		data, err = os.ReadFile(a.jwksFile)
+	} else {
+		data, err = a.fetchKeys()
+	}
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWK %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+
+	return nil
+}
+
+func (a *AuthService) fetchKeys() ([]byte, error) {
+	resp, err := a.client.Get(a.jwksURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// key returns the verification key for kid, refetching a remote key set
+// when the ID is unknown, for example after the issuer rotated its keys.
+// The attempt is recorded up front so that tokens with made-up key IDs
+// can't hammer the endpoint while it is failing.
+func (a *AuthService) key(kid string) (crypto.PublicKey, error) {
+	a.mu.RLock()
+	key, ok := a.keys[kid]
+	a.mu.RUnlock()
+
+	if ok {
+		return key, nil
+	}
+
+	a.mu.Lock()
+	refetch := a.jwksURL != "" && time.Since(a.attempted) > jwksRefreshInterval
+	if refetch {
+		a.attempted = time.Now()
+	}
+	a.mu.Unlock()
+
+	if !refetch {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	if err := a.loadKeys(); err != nil {
+		return nil, err
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type tokenClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt float64  `json:"exp"`
+	NotBefore float64  `json:"nbf"`
+	Name      string   `json:"name"`
+	Email     string   `json:"email"`
+	ImageURL  string   `json:"image_url"`
+	Picture   string   `json:"picture"`
+}
+
+// audience accepts both forms of the "aud" claim: a string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Verify checks a compact JWT's signature and standard claims, and returns
+// the user it identifies.
+func (a *AuthService) Verify(token string) (*models.User, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrUnauthenticated)
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: invalid header", ErrUnauthenticated)
+	}
+
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid signature encoding", ErrUnauthenticated)
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	var claims tokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: invalid claims", ErrUnauthenticated)
+	}
+	if err := a.checkClaims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	user := &models.User{
+		ID:       claims.Subject,
+		Name:     claims.Name,
+		Email:    claims.Email,
+		Color:    UserColor(claims.Subject),
+		ImageURL: claims.ImageURL,
+	}
+	if user.ImageURL == "" {
+		user.ImageURL = claims.Picture
+	}
+
+	return user, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key does not match RS256")
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature)
+
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key does not match ES256")
+		}
+		if len(signature) != 64 {
+			return errors.New("invalid ES256 signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+func (a *AuthService) checkClaims(claims *tokenClaims) error {
+	now := float64(time.Now().Unix())
+
+	if claims.Subject == "" {
+		return errors.New("missing subject")
+	}
+	if claims.ExpiresAt == 0 || now >= claims.ExpiresAt {
+		return errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return errors.New("token not yet valid")
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return errors.New("unexpected issuer")
+	}
+	if a.audience != "" {
+		for _, aud := range claims.Audience {
+			if aud == a.audience {
+				return nil
+			}
+		}
+		return errors.New("unexpected audience")
+	}
+
+	return nil
+}
+
+var userColors = []string{
+	"#ef4444", "#f97316", "#eab308", "#22c55e",
+	"#14b8a6", "#3b82f6", "#8b5cf6", "#ec4899",
+}
+
+// UserColor picks a stable display color for a user ID.
+func UserColor(userID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return userColors[h.Sum32()%uint32(len(userColors))]
+}
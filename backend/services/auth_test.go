@@ -0,0 +1,211 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testKeys struct {
+	ec  *ecdsa.PrivateKey
+	rsa *rsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeys{ec: ecKey, rsa: rsaKey}
+}
+
+func (k *testKeys) jwks() []byte {
+	enc := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	coord := func(n *big.Int) string { return enc(n.FillBytes(make([]byte, 32))) }
+
+	data, _ := json.Marshal(map[string][]jwk{"keys": {
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: coord(k.ec.X), Y: coord(k.ec.Y)},
+		{Kty: "RSA", Kid: "rsa", N: enc(k.rsa.N.Bytes()), E: enc(big.NewInt(int64(k.rsa.E)).Bytes())},
+	}})
+	return data
+}
+
+// sign builds a compact JWT; alg picks the header and the key it is signed
+// with, so a mismatched kid exercises the algorithm check.
+func (k *testKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":   "user_1",
+		"iss":   "https://issuer.test",
+		"aud":   []string{"codestream", "other"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nbf":   time.Now().Add(-time.Minute).Unix(),
+		"name":  "Ada",
+		"email": "ada@example.com",
+	}
+}
+
+func withClaim(key string, value interface{}) map[string]interface{} {
+	claims := validClaims()
+	claims[key] = value
+	return claims
+}
+
+func newTestAuthService(t *testing.T, keys *testKeys) *AuthService {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, keys.jwks(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWKS_URL", "")
+	t.Setenv("JWKS_FILE", path)
+	t.Setenv("JWT_ISSUER", "https://issuer.test")
+	t.Setenv("JWT_AUDIENCE", "codestream")
+	return NewAuthService()
+}
+
+func TestVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	auth := newTestAuthService(t, keys)
+
+	for _, alg := range []string{"ES256", "RS256"} {
+		kid := map[string]string{"ES256": "ec", "RS256": "rsa"}[alg]
+		user, err := auth.Verify(keys.sign(t, alg, kid, validClaims()))
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if user.ID != "user_1" || user.Name != "Ada" || user.Email != "ada@example.com" || user.Color == "" {
+			t.Fatalf("%s: got %+v", alg, user)
+		}
+	}
+
+	if _, err := auth.Verify(keys.sign(t, "ES256", "ec", withClaim("aud", "codestream"))); err != nil {
+		t.Fatalf("a single audience string: %v", err)
+	}
+
+	tampered := keys.sign(t, "ES256", "ec", validClaims())
+	parts := strings.Split(tampered, ".")
+	forged, _ := json.Marshal(withClaim("sub", "admin"))
+	tampered = parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+
+	none := strings.Split(keys.sign(t, "ES256", "ec", validClaims()), ".")
+	noneHeader, _ := json.Marshal(map[string]string{"alg": "none", "kid": "ec"})
+	unsigned := base64.RawURLEncoding.EncodeToString(noneHeader) + "." + none[1] + "."
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", keys.sign(t, "ES256", "ec", withClaim("exp", time.Now().Add(-time.Minute).Unix()))},
+		{"no expiry", keys.sign(t, "ES256", "ec", withClaim("exp", 0))},
+		{"not yet valid", keys.sign(t, "ES256", "ec", withClaim("nbf", time.Now().Add(time.Hour).Unix()))},
+		{"wrong issuer", keys.sign(t, "ES256", "ec", withClaim("iss", "https://evil.test"))},
+		{"wrong audience", keys.sign(t, "ES256", "ec", withClaim("aud", []string{"other"}))},
+		{"missing subject", keys.sign(t, "ES256", "ec", withClaim("sub", ""))},
+		{"tampered claims", tampered},
+		{"alg none", unsigned},
+		{"ES256 header on an RSA key", keys.sign(t, "ES256", "rsa", validClaims())},
+		{"RS256 header on an EC key", keys.sign(t, "RS256", "ec", validClaims())},
+		{"unknown kid", keys.sign(t, "ES256", "rotated", validClaims())},
+		{"malformed", "not.a-token"},
+	}
+	for _, tt := range tests {
+		if user, err := auth.Verify(tt.token); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("%s: got %+v, %v; want ErrUnauthenticated", tt.name, user, err)
+		}
+	}
+}
+
+func TestUnknownKeyRefetchIsThrottled(t *testing.T) {
+	keys := newTestKeys(t)
+	var fetches atomic.Int32
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if !healthy.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(keys.jwks())
+	}))
+	defer server.Close()
+
+	t.Setenv("JWKS_FILE", "")
+	t.Setenv("JWKS_URL", server.URL)
+	t.Setenv("JWT_ISSUER", "")
+	t.Setenv("JWT_AUDIENCE", "")
+	auth := NewAuthService()
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("startup made %d fetches, want 1", n)
+	}
+
+	// The startup fetch failed, so the first token retries it; the ones
+	// after that must not, even though every attempt so far has failed.
+	token := keys.sign(t, "ES256", "ec", validClaims())
+	for i := 0; i < 5; i++ {
+		if _, err := auth.Verify(token); !errors.Is(err, ErrUnauthenticated) {
+			t.Fatalf("got %v while the key set is unavailable", err)
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("got %d fetches, want 2", n)
+	}
+
+	healthy.Store(true)
+	auth.mu.Lock()
+	auth.attempted = time.Now().Add(-jwksRefreshInterval - time.Second)
+	auth.mu.Unlock()
+	if _, err := auth.Verify(token); err != nil {
+		t.Fatalf("after the endpoint recovered: %v", err)
+	}
+	if _, err := auth.Verify(keys.sign(t, "ES256", "made-up", validClaims())); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("made-up kid: got %v", err)
+	}
+	if n := fetches.Load(); n != 3 {
+		t.Fatalf("got %d fetches, want 3", n)
+	}
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"encoding/json"
+
+	"codestream/models"
+)
+
+// Line attribution is carried through every committed operation: a line
+// keeps its attribution while it survives whole and unchanged, and any line
+// the operation touches is attributed to the writer at the new revision.
+
+// initialBlame attributes every line of a new session's file to its owner.
+func initialBlame(session *models.Session, file *models.File) []models.LineBlame {
+	blame := make([]models.LineBlame, len(splitLines(file.Code)))
+	for i := range blame {
+		blame[i] = models.LineBlame{UserID: session.OwnerID, Revision: session.Revision}
+	}
+	return blame
+}
+
+// recordBlame returns the attribution of the file record leaves behind,
+// given blame, that of the file it changed in the workspace before it.
+func recordBlame(blame []models.LineBlame, before *models.Workspace, record *models.OpRecord) []models.LineBlame {
+	if record.Action == models.FileRename {
+		return blame
+	}
+
+	var code string
+	if file := before.File(record.Path); file != nil && record.Action != models.FileCreate {
+		code = file.Code
+	}
+	return updateBlame(blame, code, record)
+}
+
+// checkBlame returns blame if it fits code, or else attribution to nobody,
+// as for sessions from before blame was tracked.
+func checkBlame(blame []models.LineBlame, code string) []models.LineBlame {
+	if n := len(splitLines(code)); len(blame) != n {
+		return make([]models.LineBlame, n)
+	}
+	return blame
+}
+
+// decodeBlame reads stored attribution, of which there is none for
+// sessions from before it was tracked.
+func decodeBlame(data string) ([]models.LineBlame, error) {
+	if data == "" {
+		return nil, nil
+	}
+
+	var blame []models.LineBlame
+	if err := json.Unmarshal([]byte(data), &blame); err != nil {
+		return nil, err
+	}
+	return blame, nil
+}
+
+// updateBlame carries the attribution of oldCode's lines through record,
+// which was applied to oldCode.
+func updateBlame(blame []models.LineBlame, oldCode string, record *models.OpRecord) []models.LineBlame {
+	blame = checkBlame(blame, oldCode)
+	if len(record.Ops) == 0 {
+		return blame
+	}
+
+	// Where each old rune sits: its line and whether it starts or ends it
+	src := []rune(oldCode)
+	lineOf := make([]int, len(src))
+	lineStart := make([]int, 0, len(blame))
+	line := 0
+	for i, r := range src {
+		if i == 0 || src[i-1] == '\n' {
+			lineStart = append(lineStart, i)
+		}
+		lineOf[i] = line
+		if r == '\n' {
+			line++
+		}
+	}
+	lineEnd := func(line int) int {
+		if line+1 < len(lineStart) {
+			return lineStart[line+1]
+		}
+		return len(src)
+	}
+
+	// For every rune of the new code, the old rune it was kept from, or -1
+	// if it was inserted
+	from := make([]int, 0, len(src))
+	out := make([]rune, 0, len(src))
+	pos := 0
+	for _, c := range record.Ops {
+		switch {
+		case c.Retain > 0:
+			for i := 0; i < c.Retain && pos < len(src); i++ {
+				from = append(from, pos)
+				out = append(out, src[pos])
+				pos++
+			}
+		case c.Insert != "":
+			for _, r := range c.Insert {
+				from = append(from, -1)
+				out = append(out, r)
+			}
+		case c.Delete > 0:
+			pos += c.Delete
+		}
+	}
+	for ; pos < len(src); pos++ {
+		from = append(from, pos)
+		out = append(out, src[pos])
+	}
+
+	touched := models.LineBlame{UserID: record.UserID, Revision: record.Revision}
+	updated := make([]models.LineBlame, 0, len(blame))
+	for start := 0; start < len(out); {
+		end := start
+		for end < len(out) && out[end] != '\n' {
+			end++
+		}
+		if end < len(out) {
+			end++
+		}
+
+		// A line is unchanged if nothing was inserted into it and it reads
+		// as the old line it was kept from. Character-level ops can splice
+		// it together from the ends of two old lines, as when the line
+		// before it is deleted.
+		attribution := touched
+		if unchanged(from[start:end]) {
+			text := string(out[start:end])
+			for _, old := range []int{lineOf[from[end-1]], lineOf[from[start]]} {
+				if text == string(src[lineStart[old]:lineEnd(old)]) {
+					attribution = blame[old]
+					break
+				}
+			}
+		}
+
+		updated = append(updated, attribution)
+		start = end
+	}
+	return updated
+}
+
+func unchanged(from []int) bool {
+	for _, i := range from {
+		if i < 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"codestream/models"
+)
+
+func TestUpdateBlame(t *testing.T) {
+	alice := models.LineBlame{UserID: "alice", Revision: 1}
+	bob := models.LineBlame{UserID: "bob", Revision: 2}
+	carol := models.LineBlame{UserID: "carol", Revision: 3}
+	old := "one\ntwo\nthree\n"
+	blame := []models.LineBlame{alice, bob, alice}
+
+	tests := []struct {
+		name string
+		new  string
+		want []models.LineBlame
+	}{
+		{"inserted line", "one\nnew\ntwo\nthree\n", []models.LineBlame{alice, carol, bob, alice}},
+		{"edited line", "one\ntwo!\nthree\n", []models.LineBlame{alice, carol, alice}},
+		{"deleted line", "one\nthree\n", []models.LineBlame{alice, alice}},
+		{"joined lines", "one two\nthree\n", []models.LineBlame{carol, alice}},
+		{"appended text", "one\ntwo\nthree\nfour", []models.LineBlame{alice, bob, alice, carol}},
+		{"cleared", "", []models.LineBlame{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := &models.OpRecord{UserID: "carol", Revision: 3, Ops: ReplaceOps(old, tt.new)}
+			got := updateBlame(blame, old, record)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("blame %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetBlameFollowsEdits(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+		if _, err := store.AdmitUser("s1", models.User{ID: "bob"}, models.RoleEditor); err != nil {
+			t.Fatal(err)
+		}
+
+		code := "package main\n\nfunc main() {}\n"
+		if _, err := store.UpdateContent("s1", "owner", "", 0, &code, nil); err != nil {
+			t.Fatal(err)
+		}
+		edit := []models.OpComponent{{Retain: 14}, {Insert: "import \"fmt\"\n\n"}}
+		if _, err := store.ApplyEdit("s1", "bob", "", 1, edit); err != nil {
+			t.Fatal(err)
+		}
+
+		blame, revision, err := store.GetBlame("s1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		owner := models.LineBlame{UserID: "owner", Revision: 1}
+		bob := models.LineBlame{UserID: "bob", Revision: 2}
+		want := []models.LineBlame{owner, owner, bob, bob, owner}
+		if revision != 2 || !reflect.DeepEqual(blame, want) {
+			t.Fatalf("blame %v at revision %d, want %v at 2", blame, revision, want)
+		}
+
+		if _, _, err := store.GetBlame("missing", ""); err == nil {
+			t.Fatal("blame of a missing session succeeded")
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// broker fans published messages out to subscribers in this process, for
+// stores without pub/sub of their own. It only reaches clients connected to
+// this instance.
+type broker struct {
+	mu   sync.Mutex
+	subs map[string]map[*brokerSubscription]bool // sessionID -> subscribers
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[string]map[*brokerSubscription]bool)}
+}
+
+type brokerSubscription struct {
+	broker    *broker
+	sessionID string
+	messages  chan []byte
+	done      chan struct{}
+	once      sync.Once
+}
+
+func (b *broker) publish(sessionID string, message interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	subs := make([]*brokerSubscription, 0, len(b.subs[sessionID]))
+	for sub := range b.subs[sessionID] {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.messages <- data:
+		case <-sub.done:
+		}
+	}
+	return nil
+}
+
+func (b *broker) subscribe(sessionID string) Subscription {
+	sub := &brokerSubscription{
+		broker:    b,
+		sessionID: sessionID,
+		messages:  make(chan []byte, 256),
+		done:      make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	if b.subs[sessionID] == nil {
+		b.subs[sessionID] = make(map[*brokerSubscription]bool)
+	}
+	b.subs[sessionID][sub] = true
+	b.mu.Unlock()
+
+	return sub
+}
+
+func (s *brokerSubscription) Messages() <-chan []byte {
+	return s.messages
+}
+
+func (s *brokerSubscription) Close() error {
+	s.once.Do(func() {
+		b := s.broker
+		b.mu.Lock()
+		delete(b.subs[s.sessionID], s)
+		if len(b.subs[s.sessionID]) == 0 {
+			delete(b.subs, s.sessionID)
+		}
+		b.mu.Unlock()
+
+		close(s.done)
+	})
+	return nil
+}
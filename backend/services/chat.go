@@ -0,0 +1,89 @@
+package services
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"codestream/models"
+)
+
+// maxChatHistory is how many chat messages each session keeps.
+const maxChatHistory = 5000
+
+// mentionPattern matches an @mention, which names a user by ID or by their
+// name with the spaces left out.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([\w.-]+)`)
+
+// PostMessage saves a chat message by userID, resolving its mentions and
+// pinning its code references to the current revision.
+func PostMessage(store SessionStore, sessionID, userID string, req *models.NewChatMessage) (*models.ChatMessage, error) {
+	session, err := store.GetSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.RoleOf(userID) == "" {
+		return nil, ErrForbidden
+	}
+
+	refs := make([]models.CodeRef, len(req.Refs))
+	for i, ref := range req.Refs {
+		ref.Path = resolvePath(&session.Workspace, ref.Path)
+		ref.Revision = session.Revision
+		if err := checkLines(&session.Workspace, ref.Path, ref.StartLine, ref.EndLine); err != nil {
+			return nil, err
+		}
+		refs[i] = ref
+	}
+
+	message := &models.ChatMessage{
+		SessionID: sessionID,
+		UserID:    userID,
+		Body:      req.Body,
+		Mentions:  resolveMentions(req.Body, session.Users),
+		Refs:      refs,
+		CreatedAt: time.Now(),
+	}
+	if err := store.SaveMessage(message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// resolveMentions returns the IDs of the users among users that body
+// @mentions, in the order first mentioned.
+func resolveMentions(body string, users []models.User) []string {
+	var mentions []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		name := strings.TrimRight(match[1], ".-")
+		for _, user := range users {
+			if seen[user.ID] {
+				continue
+			}
+			if strings.EqualFold(name, user.ID) || strings.EqualFold(name, strings.Join(strings.Fields(user.Name), "")) {
+				seen[user.ID] = true
+				mentions = append(mentions, user.ID)
+				break
+			}
+		}
+	}
+	return mentions
+}
+
+// pageMessages returns up to limit of messages, which are oldest first,
+// from before the ID before, or all of them if limit is zero. A zero before
+// pages from the newest.
+func pageMessages(messages []models.ChatMessage, before int64, limit int) []models.ChatMessage {
+	end := len(messages)
+	if before > 0 {
+		for end > 0 && messages[end-1].ID >= before {
+			end--
+		}
+	}
+	start := 0
+	if limit > 0 && end > limit {
+		start = end - limit
+	}
+	return append([]models.ChatMessage{}, messages[start:end]...)
+}
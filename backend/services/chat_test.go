@@ -0,0 +1,103 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"codestream/models"
+)
+
+func TestResolveMentions(t *testing.T) {
+	users := []models.User{
+		{ID: "u1", Name: "Ada Lovelace"},
+		{ID: "bob", Name: "Bob"},
+	}
+
+	tests := []struct {
+		body string
+		want []string
+	}{
+		{"@bob have a look", []string{"bob"}},
+		{"thanks @AdaLovelace, and @u1 again", []string{"u1"}},
+		{"@bob. @ada @nobody", []string{"bob"}},
+		{"mail bob@example.com", nil},
+		{"(@u1) and @Bob", []string{"u1", "bob"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			if got := resolveMentions(tt.body, users); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("mentions %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatHistoryPages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+		for userID, role := range map[string]models.Role{"owner": models.RoleOwner, "vic": models.RoleViewer} {
+			if err := joinUser(store, "s1", userID, role); err != nil {
+				t.Fatal(err)
+			}
+		}
+		code := "a\nb\nc\n"
+		if _, err := store.UpdateContent("s1", "owner", "", 0, &code, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		message, err := PostMessage(store, "s1", "vic", &models.NewChatMessage{
+			Body: "@owner is this right?",
+			Refs: []models.CodeRef{{StartLine: 2, EndLine: 3}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []models.CodeRef{{Path: "main.go", StartLine: 2, EndLine: 3, Revision: 1}}
+		if message.ID != 1 || !reflect.DeepEqual(message.Mentions, []string{"owner"}) || !reflect.DeepEqual(message.Refs, want) {
+			t.Fatalf("unexpected message %+v", message)
+		}
+
+		if _, err := PostMessage(store, "s1", "vic", &models.NewChatMessage{
+			Body: "and this?",
+			Refs: []models.CodeRef{{StartLine: 4, EndLine: 4}},
+		}); !errors.Is(err, ErrInvalidAnchor) {
+			t.Fatalf("referencing past the end: got %v, want ErrInvalidAnchor", err)
+		}
+		if _, err := PostMessage(store, "s1", "eve", &models.NewChatMessage{Body: "hi"}); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("posting as an outsider: got %v, want ErrForbidden", err)
+		}
+
+		for i := 2; i <= 5; i++ {
+			if _, err := PostMessage(store, "s1", "owner", &models.NewChatMessage{Body: fmt.Sprint(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pages := []struct {
+			before int64
+			limit  int
+			want   []int64
+		}{
+			{0, 2, []int64{4, 5}},
+			{4, 2, []int64{2, 3}},
+			{2, 2, []int64{1}},
+			{1, 2, nil},
+			{0, 0, []int64{1, 2, 3, 4, 5}},
+		}
+		for _, page := range pages {
+			messages, err := store.GetMessages("s1", page.before, page.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int64
+			for _, message := range messages {
+				ids = append(ids, message.ID)
+			}
+			if !reflect.DeepEqual(ids, page.want) {
+				t.Fatalf("page before %d of %d is %v, want %v", page.before, page.limit, ids, page.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,325 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+
+	"codestream/models"
+)
+
+var (
+	ErrCommentNotFound = errors.New("comment not found")
+	ErrInvalidAnchor   = errors.New("anchor is outside the file")
+	ErrNotThread       = errors.New("only threads can be resolved")
+	ErrRevisionChanged = errors.New("session revision changed")
+)
+
+// maxAnchorAttempts bounds how often AddComment re-anchors a comment while
+// edits keep landing before it can be saved.
+const maxAnchorAttempts = 10
+
+// AddComment saves a new comment by userID. A thread is anchored against
+// the revision the request names and carried through the edits committed
+// since, so its lines are those the author saw.
+func AddComment(store SessionStore, sessionID, userID string, req *models.NewComment) (*models.Comment, error) {
+	session, err := store.GetSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.RoleOf(userID) == "" {
+		return nil, ErrForbidden
+	}
+
+	now := time.Now()
+	comment := &models.Comment{
+		ID:        uuid.New().String(),
+		SessionID: sessionID,
+		ThreadID:  req.ThreadID,
+		UserID:    userID,
+		Body:      req.Body,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if comment.ThreadID != "" {
+		return comment, store.SaveComment(comment, session.Revision)
+	}
+
+	revision := req.Revision
+	if revision > session.Revision {
+		return nil, fmt.Errorf("%w: %d", ErrRevisionUnavailable, revision)
+	}
+	workspace := session.Workspace
+	if revision < session.Revision {
+		snapshot, err := Rebuild(store, sessionID, revision)
+		if err != nil {
+			return nil, err
+		}
+		workspace = snapshot.Workspace
+	}
+	comment.Path = resolvePath(&workspace, req.Path)
+	comment.StartLine, comment.EndLine = req.StartLine, req.EndLine
+	if err := checkAnchor(&workspace, comment); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < maxAnchorAttempts; attempt++ {
+		if revision, err = anchorSince(store, comment, &workspace, revision); err != nil {
+			return nil, err
+		}
+		err = store.SaveComment(comment, revision)
+		if !errors.Is(err, ErrRevisionChanged) {
+			return comment, err
+		}
+	}
+	return nil, ErrContention
+}
+
+// anchorSince carries comment, anchored in workspace as of revision,
+// through the records committed since, and returns the revision it and
+// workspace are then at.
+func anchorSince(store SessionStore, comment *models.Comment, workspace *models.Workspace, revision int) (int, error) {
+	records, err := store.GetOpsSince(comment.SessionID, revision)
+	if err != nil || len(records) == 0 {
+		return revision, err
+	}
+	if records[0].Revision != revision+1 {
+		return 0, fmt.Errorf("%w: %d is too old to anchor at", ErrRevisionUnavailable, revision)
+	}
+
+	for i := range records {
+		remapComment(comment, workspace, &records[i])
+		if *workspace, err = applyToWorkspace(*workspace, &records[i]); err != nil {
+			return 0, err
+		}
+	}
+	return records[len(records)-1].Revision, nil
+}
+
+// EditComment edits a comment, which only its author may do, or resolves
+// or reopens a thread, which its author and editors may do.
+func EditComment(store SessionStore, sessionID, userID string, update *models.CommentUpdate) (*models.Comment, error) {
+	session, err := store.GetSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.UpdateComment(sessionID, update.ID, func(comment *models.Comment) error {
+		if update.Body != nil {
+			if comment.UserID != userID {
+				return ErrForbidden
+			}
+			comment.Body = *update.Body
+		}
+		if update.Resolved != nil {
+			if comment.ThreadID != "" {
+				return ErrNotThread
+			}
+			if comment.UserID != userID && !session.CanEdit(userID) {
+				return ErrForbidden
+			}
+			comment.Resolved = *update.Resolved
+		}
+		comment.UpdatedAt = time.Now()
+		return nil
+	})
+}
+
+// RemoveComment deletes a comment, or a thread with its replies, and
+// returns the IDs deleted. Authors may delete their comments and the owner
+// any of them.
+func RemoveComment(store SessionStore, sessionID, userID, commentID string) ([]string, error) {
+	session, err := store.GetSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	comments, err := store.GetComments(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, comment := range comments {
+		if comment.ID != commentID {
+			continue
+		}
+		if comment.UserID != userID && session.OwnerID != userID {
+			return nil, ErrForbidden
+		}
+		return store.DeleteComment(sessionID, commentID)
+	}
+	return nil, ErrCommentNotFound
+}
+
+// The rules below are shared by the stores.
+
+// checkNewComment checks comment against session before it is saved.
+// thread is the comment a reply names, if it exists.
+func checkNewComment(session *models.Session, comment *models.Comment, revision int, thread *models.Comment) error {
+	if comment.ThreadID != "" {
+		if thread == nil || thread.ThreadID != "" {
+			return ErrCommentNotFound
+		}
+		return nil
+	}
+	if session.Revision != revision {
+		return ErrRevisionChanged
+	}
+	if comment.Outdated {
+		// Its text went while it was being anchored
+		return nil
+	}
+	return checkAnchor(&session.Workspace, comment)
+}
+
+// checkAnchor reports whether comment's lines are in its file in w.
+func checkAnchor(w *models.Workspace, comment *models.Comment) error {
+	return checkLines(w, comment.Path, comment.StartLine, comment.EndLine)
+}
+
+// checkLines reports whether lines start to end are in the file at path in
+// w.
+func checkLines(w *models.Workspace, path string, start, end int) error {
+	file := w.File(path)
+	if file == nil {
+		return ErrFileNotFound
+	}
+	if start < 1 || end < start || end > len(splitLines(file.Code)) {
+		return ErrInvalidAnchor
+	}
+	return nil
+}
+
+// remapComments carries the anchors of comments through record, applied to
+// the workspace before, and returns the comments it changed.
+func remapComments(comments []models.Comment, before *models.Workspace, record *models.OpRecord) []models.Comment {
+	var changed []models.Comment
+	for _, comment := range comments {
+		if remapComment(&comment, before, record) {
+			changed = append(changed, comment)
+		}
+	}
+	return changed
+}
+
+// remapComment carries comment's anchor through record, applied to the
+// workspace before, and reports whether it changed.
+func remapComment(comment *models.Comment, before *models.Workspace, record *models.OpRecord) bool {
+	if comment.ThreadID != "" || comment.Outdated || comment.Path != resolvePath(before, record.Path) {
+		return false
+	}
+
+	switch record.Action {
+	case models.FileRename:
+		comment.Path = record.NewPath
+		return true
+	case models.FileDelete:
+		comment.Outdated = true
+		return true
+	case models.FileCreate:
+		return false
+	}
+
+	file := before.File(comment.Path)
+	if file == nil {
+		return false
+	}
+	start, end, ok := remapLines(file.Code, comment.StartLine, comment.EndLine, record.Ops)
+	if !ok {
+		comment.Outdated = true
+		return true
+	}
+	if start == comment.StartLine && end == comment.EndLine {
+		return false
+	}
+	comment.StartLine, comment.EndLine = start, end
+	return true
+}
+
+// remapLines returns where lines start to end of code are after ops, or
+// false if their text was deleted. Line breaks only count as the anchored
+// text when the lines are blank.
+func remapLines(code string, start, end int, ops []models.OpComponent) (int, int, bool) {
+	src := []rune(code)
+	lo, hi := -1, len(src)
+	line := 1
+	for i, r := range src {
+		if line == start && lo < 0 {
+			lo = i
+		}
+		if r == '\n' {
+			if line == end {
+				hi = i + 1
+				break
+			}
+			line++
+		}
+	}
+	if lo < 0 {
+		return 0, 0, false
+	}
+
+	blank := true
+	for _, r := range src[lo:hi] {
+		if r != '\n' {
+			blank = false
+			break
+		}
+	}
+
+	// The line each kept rune of the anchored text ends up on
+	first, last := 0, 0
+	survived := false
+	pos, newLine := 0, 1
+	keep := func(r rune) {
+		if pos >= lo && pos < hi {
+			if first == 0 {
+				first = newLine
+			}
+			last = newLine
+			if blank || r != '\n' {
+				survived = true
+			}
+		}
+		if r == '\n' {
+			newLine++
+		}
+		pos++
+	}
+	for _, c := range ops {
+		switch {
+		case c.Retain > 0:
+			for i := 0; i < c.Retain && pos < len(src); i++ {
+				keep(src[pos])
+			}
+		case c.Insert != "":
+			for _, r := range c.Insert {
+				if r == '\n' {
+					newLine++
+				}
+			}
+		case c.Delete > 0:
+			pos += c.Delete
+		}
+	}
+	for pos < len(src) {
+		keep(src[pos])
+	}
+
+	if !survived {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// sortComments orders comments oldest first.
+func sortComments(comments []models.Comment) {
+	sort.Slice(comments, func(i, j int) bool {
+		if !comments[i].CreatedAt.Equal(comments[j].CreatedAt) {
+			return comments[i].CreatedAt.Before(comments[j].CreatedAt)
+		}
+		return comments[i].ID < comments[j].ID
+	})
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"codestream/models"
+)
+
+func TestRemapLines(t *testing.T) {
+	old := "one\ntwo\nthree\nfour\n"
+
+	tests := []struct {
+		name       string
+		new        string
+		start, end int // anchoring lines 2 to 3
+		outdated   bool
+	}{
+		{"line inserted above", "zero\none\ntwo\nthree\nfour\n", 3, 4, false},
+		{"line inserted below", "one\ntwo\nthree\nfour\nfive\n", 2, 3, false},
+		{"line inserted inside", "one\ntwo\nmore\nthree\nfour\n", 2, 4, false},
+		{"anchored line edited", "one\ntwo!\nthree\nfour\n", 2, 3, false},
+		{"first line deleted", "two\nthree\nfour\n", 1, 2, false},
+		{"one anchored line deleted", "one\nthree\nfour\n", 2, 2, false},
+		{"joined with the line above", "one two\nthree\nfour\n", 1, 2, false},
+		{"anchored lines deleted", "one\nfour\n", 0, 0, true},
+		{"anchored text cleared", "one\n\n\nfour\n", 0, 0, true},
+		{"everything replaced", "", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, ok := remapLines(old, 2, 3, ReplaceOps(old, tt.new))
+			if ok == tt.outdated {
+				t.Fatalf("kept %v, want %v", ok, !tt.outdated)
+			}
+			if ok && (start != tt.start || end != tt.end) {
+				t.Fatalf("lines %d-%d, want %d-%d", start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestCommentsFollowEdits(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+		for userID, role := range map[string]models.Role{"bob": models.RoleEditor, "vic": models.RoleViewer} {
+			if _, err := store.AdmitUser("s1", models.User{ID: userID}, role); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		code := "func a() {}\nfunc b() {}\n"
+		if _, err := store.UpdateContent("s1", "owner", "", 0, &code, nil); err != nil {
+			t.Fatal(err)
+		}
+		thread, err := AddComment(store, "s1", "vic", &models.NewComment{StartLine: 2, EndLine: 2, Revision: 1, Body: "rename b?"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if thread.Path != "main.go" {
+			t.Fatalf("anchored to %q, want the main file", thread.Path)
+		}
+
+		record, err := store.ApplyEdit("s1", "bob", "", 1, []models.OpComponent{{Insert: "// header\n"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(record.Comments) != 1 || record.Comments[0].StartLine != 3 {
+			t.Fatalf("moved comments %+v, want the thread on line 3", record.Comments)
+		}
+
+		// Anchored against the revision before the edit
+		stale, err := AddComment(store, "s1", "bob", &models.NewComment{StartLine: 1, EndLine: 1, Revision: 1, Body: "and a?"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stale.StartLine != 2 || stale.EndLine != 2 {
+			t.Fatalf("stale comment on lines %d-%d, want 2-2", stale.StartLine, stale.EndLine)
+		}
+		if _, err := AddComment(store, "s1", "bob", &models.NewComment{StartLine: 4, EndLine: 4, Revision: 2, Body: "x"}); !errors.Is(err, ErrInvalidAnchor) {
+			t.Fatalf("anchoring past the end: got %v, want ErrInvalidAnchor", err)
+		}
+
+		reply, err := AddComment(store, "s1", "bob", &models.NewComment{ThreadID: thread.ID, Body: "sure"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := AddComment(store, "s1", "bob", &models.NewComment{ThreadID: reply.ID, Body: "nested"}); !errors.Is(err, ErrCommentNotFound) {
+			t.Fatalf("replying to a reply: got %v, want ErrCommentNotFound", err)
+		}
+
+		body := "rename b to c?"
+		if _, err := EditComment(store, "s1", "bob", &models.CommentUpdate{ID: thread.ID, Body: &body}); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("editing another's comment: got %v, want ErrForbidden", err)
+		}
+		resolved := true
+		updated, err := EditComment(store, "s1", "bob", &models.CommentUpdate{ID: thread.ID, Resolved: &resolved})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !updated.Resolved || updated.StartLine != 3 {
+			t.Fatalf("resolved thread is %+v", updated)
+		}
+
+		// Deleting the anchored line outdates the thread
+		record, err = store.ApplyEdit("s1", "bob", "", 2, []models.OpComponent{{Retain: 22}, {Delete: 12}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(record.Comments) != 1 || !record.Comments[0].Outdated {
+			t.Fatalf("moved comments %+v, want the thread outdated", record.Comments)
+		}
+
+		if _, err := RemoveComment(store, "s1", "vic", stale.ID); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("deleting another's comment: got %v, want ErrForbidden", err)
+		}
+		deleted, err := RemoveComment(store, "s1", "owner", thread.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deleted) != 2 {
+			t.Fatalf("deleted %v, want the thread and its reply", deleted)
+		}
+
+		comments, err := store.GetComments("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(comments) != 1 || comments[0].ID != stale.ID {
+			t.Fatalf("comments left %+v, want only the one on a", comments)
+		}
+	})
+}
+
+func TestCommentsFollowFiles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+		if _, err := store.ChangeFile("s1", "owner", &models.FileChange{Action: models.FileCreate, Path: "a.go", Code: "package a\n"}); err != nil {
+			t.Fatal(err)
+		}
+		comment, err := AddComment(store, "s1", "owner", &models.NewComment{Path: "a.go", StartLine: 1, EndLine: 1, Revision: 1, Body: "hm"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		record, err := store.ChangeFile("s1", "owner", &models.FileChange{Action: models.FileRename, Path: "a.go", NewPath: "b.go"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(record.Comments) != 1 || record.Comments[0].Path != "b.go" {
+			t.Fatalf("moved comments %+v, want the comment on b.go", record.Comments)
+		}
+
+		if _, err := store.ChangeFile("s1", "owner", &models.FileChange{Action: models.FileDelete, Path: "b.go"}); err != nil {
+			t.Fatal(err)
+		}
+		comments, err := store.GetComments("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(comments) != 1 || comments[0].ID != comment.ID || !comments[0].Outdated {
+			t.Fatalf("comments %+v, want the comment outdated", comments)
+		}
+	})
+}
@@ -0,0 +1,262 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"codestream/models"
+)
+
+// Line diffs use Myers' algorithm in its linear-space form, which finds a
+// shortest edit script by recursively splitting on the middle snake.
+
+// diffOp is one line of an edit script: kept, deleted from the old text or
+// inserted from the new one.
+type diffOp struct {
+	kind     string
+	old, new int // line indexes, or -1 where the line isn't in that text
+}
+
+// Diff compares two texts line by line and groups the changes into hunks
+// with up to context unchanged lines around them.
+func Diff(oldText, newText string, context int) []models.DiffHunk {
+	a, b := splitLines(oldText), splitLines(newText)
+	d := &differ{a: a, b: b}
+	d.compare(0, len(a), 0, len(b))
+	return buildHunks(a, b, d.ops, context)
+}
+
+// splitLines splits text after each newline, keeping it, so that a last
+// line with and without one differ.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+type differ struct {
+	a, b []string
+	ops  []diffOp
+}
+
+func (d *differ) compare(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		d.ops = append(d.ops, diffOp{models.DiffContext, aLo, bLo})
+		aLo++
+		bLo++
+	}
+	suffix := 0
+	for aLo < aHi-suffix && bLo < bHi-suffix && d.a[aHi-suffix-1] == d.b[bHi-suffix-1] {
+		suffix++
+	}
+	aHi -= suffix
+	bHi -= suffix
+
+	switch {
+	case aLo == aHi:
+		for ; bLo < bHi; bLo++ {
+			d.ops = append(d.ops, diffOp{models.DiffInsert, -1, bLo})
+		}
+	case bLo == bHi:
+		for ; aLo < aHi; aLo++ {
+			d.ops = append(d.ops, diffOp{models.DiffDelete, aLo, -1})
+		}
+	default:
+		x0, y0, x1, y1 := d.middleSnake(aLo, aHi, bLo, bHi)
+		d.compare(aLo, x0, bLo, y0)
+		for ; x0 < x1; x0, y0 = x0+1, y0+1 {
+			d.ops = append(d.ops, diffOp{models.DiffContext, x0, y0})
+		}
+		d.compare(x1, aHi, y1, bHi)
+	}
+
+	for i := 0; i < suffix; i++ {
+		d.ops = append(d.ops, diffOp{models.DiffContext, aHi + i, bHi + i})
+	}
+}
+
+// middleSnake finds the snake, from (x0, y0) to (x1, y1), in the middle of
+// a shortest edit script for a[aLo:aHi] and b[bLo:bHi], by searching forward
+// from the start and backward from the end until the two meet.
+func (d *differ) middleSnake(aLo, aHi, bLo, bHi int) (x0, y0, x1, y1 int) {
+	n, m := aHi-aLo, bHi-bLo
+	delta := n - m
+	odd := delta%2 != 0
+	max := (n + m + 1) / 2
+
+	// forward[offset+k] is the furthest x reached on diagonal k = x - y;
+	// backward holds the same counted from the end, on diagonal delta - k
+	offset := max + 1
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+
+	for D := 0; D <= max; D++ {
+		for k := -D; k <= D; k += 2 {
+			var x int
+			if k == -D || (k != D && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && d.a[aLo+x] == d.b[bLo+y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+
+			if kb := delta - k; odd && kb >= -(D-1) && kb <= D-1 && x+backward[offset+kb] >= n {
+				return aLo + startX, bLo + startY, aLo + x, bLo + y
+			}
+		}
+
+		for k := -D; k <= D; k += 2 {
+			var x int
+			if k == -D || (k != D && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && d.a[aHi-x-1] == d.b[bHi-y-1] {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+
+			if kf := delta - k; !odd && kf >= -D && kf <= D && x+forward[offset+kf] >= n {
+				return aHi - x, bHi - y, aHi - startX, bHi - startY
+			}
+		}
+	}
+
+	// Unreachable: the searches always meet by max
+	panic(fmt.Sprintf("diff: no middle snake for %d and %d lines", n, m))
+}
+
+// buildHunks groups ops into hunks, keeping up to context unchanged lines
+// on either side of each change and merging changes closer than that.
+func buildHunks(a, b []string, ops []diffOp, context int) []models.DiffHunk {
+	hunks := make([]models.DiffHunk, 0)
+	for i := 0; i < len(ops); {
+		if ops[i].kind == models.DiffContext {
+			i++
+			continue
+		}
+
+		// Extend over changes separated by at most 2*context unchanged lines
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(ops) {
+			next := end
+			for next < len(ops) && ops[next].kind == models.DiffContext {
+				next++
+			}
+			if next == len(ops) || next-end > 2*context {
+				break
+			}
+			for next < len(ops) && ops[next].kind != models.DiffContext {
+				next++
+			}
+			end = next
+		}
+		stop := end + context
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		hunks = append(hunks, newHunk(a, b, ops[start:stop], ops[:start]))
+		i = stop
+	}
+	return hunks
+}
+
+// newHunk builds the hunk for ops, given the ops before it to place it.
+func newHunk(a, b []string, ops, before []diffOp) models.DiffHunk {
+	oldLine, newLine := 0, 0
+	for _, op := range before {
+		if op.old >= 0 {
+			oldLine++
+		}
+		if op.new >= 0 {
+			newLine++
+		}
+	}
+
+	hunk := models.DiffHunk{Lines: make([]models.DiffLine, 0, len(ops))}
+	for _, op := range ops {
+		var line models.DiffLine
+		var text string
+		switch op.kind {
+		case models.DiffInsert:
+			text = b[op.new]
+			line = models.DiffLine{Kind: op.kind, NewLine: op.new + 1}
+			hunk.NewLines++
+		case models.DiffDelete:
+			text = a[op.old]
+			line = models.DiffLine{Kind: op.kind, OldLine: op.old + 1}
+			hunk.OldLines++
+		default:
+			text = a[op.old]
+			line = models.DiffLine{Kind: op.kind, OldLine: op.old + 1, NewLine: op.new + 1}
+			hunk.OldLines++
+			hunk.NewLines++
+		}
+		line.Text = strings.TrimSuffix(text, "\n")
+		line.NoNewline = !strings.HasSuffix(text, "\n")
+		hunk.Lines = append(hunk.Lines, line)
+	}
+
+	hunk.OldStart, hunk.NewStart = oldLine, newLine
+	if hunk.OldLines > 0 {
+		hunk.OldStart++
+	}
+	if hunk.NewLines > 0 {
+		hunk.NewStart++
+	}
+	return hunk
+}
+
+// FormatUnified renders hunks as a unified diff between files named oldName
+// and newName, or returns "" when there are no hunks.
+func FormatUnified(oldName, newName string, hunks []models.DiffHunk) string {
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldName, newName)
+	for _, hunk := range hunks {
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", unifiedRange(hunk.OldStart, hunk.OldLines), unifiedRange(hunk.NewStart, hunk.NewLines))
+		for _, line := range hunk.Lines {
+			switch line.Kind {
+			case models.DiffInsert:
+				sb.WriteByte('+')
+			case models.DiffDelete:
+				sb.WriteByte('-')
+			default:
+				sb.WriteByte(' ')
+			}
+			sb.WriteString(line.Text)
+			sb.WriteByte('\n')
+			if line.NoNewline {
+				sb.WriteString("\\ No newline at end of file\n")
+			}
+		}
+	}
+	return sb.String()
+}
+
+func unifiedRange(start, lines int) string {
+	if lines == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, lines)
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"codestream/models"
+)
+
+func TestFormatUnified(t *testing.T) {
+	oldText := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	newText := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk"
+
+	got := FormatUnified("a/code", "b/code", Diff(oldText, newText, 2))
+	want := `--- a/code
++++ b/code
+@@ -1,4 +1,4 @@
+ a
+-b
++B
+ c
+ d
+@@ -9,2 +9,3 @@
+ i
+ j
++k
+\ No newline at end of file
+`
+	if got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+
+	if hunks := Diff("same\n", "same\n", 3); len(hunks) != 0 {
+		t.Fatalf("identical texts gave %d hunks", len(hunks))
+	}
+}
+
+// patch applies hunks to text the way patch(1) would.
+func patch(t *testing.T, text string, hunks []models.DiffHunk) string {
+	t.Helper()
+
+	lines := splitLines(text)
+	var out strings.Builder
+	next := 0
+	for _, hunk := range hunks {
+		start := hunk.OldStart - 1
+		if hunk.OldLines == 0 {
+			start = hunk.OldStart
+		}
+		for ; next < start; next++ {
+			out.WriteString(lines[next])
+		}
+		for _, line := range hunk.Lines {
+			if line.Kind != models.DiffDelete {
+				out.WriteString(line.Text)
+				if !line.NoNewline {
+					out.WriteString("\n")
+				}
+			}
+			if line.Kind != models.DiffInsert {
+				if strings.TrimSuffix(lines[next], "\n") != line.Text {
+					t.Fatalf("hunk expects %q at old line %d, found %q", line.Text, next+1, lines[next])
+				}
+				next++
+			}
+		}
+	}
+	for ; next < len(lines); next++ {
+		out.WriteString(lines[next])
+	}
+	return out.String()
+}
+
+// lcs is the length of the longest common subsequence of a and b.
+func lcs(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		cur := make([]int, len(b)+1)
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// Random diffs patch the old text into the new one, and change no more
+// lines than they must.
+func TestDiffIsMinimalAndApplies(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomText := func() string {
+		var sb strings.Builder
+		for i, n := 0, rng.Intn(30); i < n; i++ {
+			sb.WriteString(string(rune('a' + rng.Intn(4))))
+			if i < n-1 || rng.Intn(3) > 0 {
+				sb.WriteString("\n")
+			}
+		}
+		return sb.String()
+	}
+
+	for i := 0; i < 2000; i++ {
+		oldText, newText := randomText(), randomText()
+		context := rng.Intn(4)
+		hunks := Diff(oldText, newText, context)
+
+		if got := patch(t, oldText, hunks); got != newText {
+			t.Fatalf("diff of %q and %q patched to %q", oldText, newText, got)
+		}
+
+		a, b := splitLines(oldText), splitLines(newText)
+		changed := 0
+		for _, hunk := range hunks {
+			for _, line := range hunk.Lines {
+				if line.Kind != models.DiffContext {
+					changed++
+				}
+			}
+		}
+		if want := len(a) + len(b) - 2*lcs(a, b); changed != want {
+			t.Fatalf("diff of %q and %q changes %d lines, want %d", oldText, newText, changed, want)
+		}
+	}
+}
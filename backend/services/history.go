@@ -0,0 +1,377 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"codestream/models"
+)
+
+// snapshotInterval is how many revisions apart a session's content is
+// snapshotted.
+const snapshotInterval = 100
+
+// maxSnapshots bounds the snapshots kept per session. History from before
+// the oldest of them is compacted away.
+const maxSnapshots = 10
+
+// historyPage is how many entries Rebuild reads at a time.
+const historyPage = 500
+
+var (
+	ErrInvalidEntryID      = errors.New("invalid history entry ID")
+	ErrRevisionUnavailable = errors.New("revision is not in the history")
+)
+
+// History entries have stream IDs of the form "<ms>-<seq>", as Redis Streams
+// assign them. The other stores assign them the same way so ranges can be
+// read the same way from every store.
+type entryID struct {
+	ms, seq int64
+}
+
+// firstEntryID is the ID snapshots taken before any history refer to.
+var firstEntryID = entryID{}
+
+var lastEntryID = entryID{math.MaxInt64, math.MaxInt64}
+
+func parseEntryID(s string) (entryID, error) {
+	ms, seq, found := strings.Cut(s, "-")
+	var id entryID
+	var err error
+	if id.ms, err = strconv.ParseInt(ms, 10, 64); err != nil || id.ms < 0 {
+		return id, ErrInvalidEntryID
+	}
+	if found {
+		if id.seq, err = strconv.ParseInt(seq, 10, 64); err != nil || id.seq < 0 {
+			return id, ErrInvalidEntryID
+		}
+	}
+	return id, nil
+}
+
+func (id entryID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id entryID) less(other entryID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// next returns the ID of an entry added at now, after the one with this ID.
+func (id entryID) next(now time.Time) entryID {
+	if ms := now.UnixMilli(); ms > id.ms {
+		return entryID{ms: ms}
+	}
+	return entryID{ms: id.ms, seq: id.seq + 1}
+}
+
+// entryRange is an inclusive range of entry IDs.
+type entryRange struct {
+	start, end entryID
+}
+
+// parseEntryRange reads start and end the way XRANGE does: "-" and "+" are
+// the ends of the log, a "(" prefix makes a bound exclusive and an ID
+// without a sequence number covers all of that millisecond. Empty bounds
+// mean "-" and "+".
+func parseEntryRange(start, end string) (entryRange, error) {
+	var r entryRange
+	var err error
+	if r.start, err = parseBound(start, false); err != nil {
+		return r, err
+	}
+	if r.end, err = parseBound(end, true); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+func parseBound(s string, isEnd bool) (entryID, error) {
+	switch s {
+	case "", "-":
+		return firstEntryID, nil
+	case "+":
+		return lastEntryID, nil
+	}
+
+	exclusive := strings.HasPrefix(s, "(")
+	s = strings.TrimPrefix(s, "(")
+	id, err := parseEntryID(s)
+	if err != nil {
+		return id, err
+	}
+	if isEnd && !strings.Contains(s, "-") {
+		id.seq = math.MaxInt64
+	}
+
+	if exclusive {
+		switch {
+		case !isEnd && id.seq < math.MaxInt64:
+			id.seq++
+		case !isEnd:
+			id = entryID{ms: id.ms + 1}
+		case id.seq > 0:
+			id.seq--
+		case id.ms > 0:
+			id = entryID{ms: id.ms - 1, seq: math.MaxInt64}
+		default:
+			return id, ErrInvalidEntryID
+		}
+	}
+	return id, nil
+}
+
+func (r entryRange) contains(id entryID) bool {
+	return !id.less(r.start) && !r.end.less(id)
+}
+
+// fileEntryTypes are the history entries of records by their action.
+var fileEntryTypes = map[string]string{
+	models.FileCreate: models.HistoryFileCreate,
+	models.FileRename: models.HistoryFileRename,
+	models.FileDelete: models.HistoryFileDelete,
+}
+
+// recordEntries returns the history entries for a committed record: an
+// edit, a language change, both, or a change to the file tree.
+func recordEntries(record *models.OpRecord) []models.HistoryEntry {
+	if record.Action != "" {
+		return []models.HistoryEntry{{
+			Type:      fileEntryTypes[record.Action],
+			UserID:    record.UserID,
+			Timestamp: record.Timestamp,
+			Revision:  record.Revision,
+			Path:      record.Path,
+			NewPath:   record.NewPath,
+			Ops:       record.Ops,
+			Language:  record.Language,
+		}}
+	}
+
+	entries := make([]models.HistoryEntry, 0, 2)
+	if len(record.Ops) > 0 || record.Language == "" {
+		entries = append(entries, models.HistoryEntry{
+			Type:      models.HistoryEdit,
+			UserID:    record.UserID,
+			Timestamp: record.Timestamp,
+			Revision:  record.Revision,
+			Path:      record.Path,
+			Ops:       record.Ops,
+		})
+	}
+	if record.Language != "" {
+		entries = append(entries, models.HistoryEntry{
+			Type:      models.HistoryLanguage,
+			UserID:    record.UserID,
+			Timestamp: record.Timestamp,
+			Revision:  record.Revision,
+			Path:      record.Path,
+			Language:  record.Language,
+		})
+	}
+	return entries
+}
+
+func presenceEntry(kind, userID string, revision int) models.HistoryEntry {
+	return models.HistoryEntry{
+		Type:      kind,
+		UserID:    userID,
+		Timestamp: time.Now().UnixMilli(),
+		Revision:  revision,
+	}
+}
+
+func newSnapshot(session *models.Session, entryID string) models.Snapshot {
+	return models.Snapshot{
+		Revision:  session.Revision,
+		Code:      session.Code,
+		Language:  session.Language,
+		EntryID:   entryID,
+		CreatedAt: time.Now(),
+		Workspace: models.Workspace{
+			MainFile: session.MainFile,
+			Files:    append([]models.File{}, session.Files...),
+		},
+	}
+}
+
+// latestSnapshot picks the newest of snapshots taken at or before revision.
+func latestSnapshot(snapshots []models.Snapshot, revision int) (*models.Snapshot, error) {
+	var latest *models.Snapshot
+	for i := range snapshots {
+		if snapshots[i].Revision <= revision && (latest == nil || snapshots[i].Revision > latest.Revision) {
+			latest = &snapshots[i]
+		}
+	}
+	if latest == nil {
+		return nil, ErrRevisionUnavailable
+	}
+	return latest, nil
+}
+
+// Rebuild replays the history from the latest snapshot at or before
+// revision and returns the session content as of revision. Session.Code is
+// a cache of Rebuild at the current revision.
+func Rebuild(store SessionStore, sessionID string, revision int) (*models.Snapshot, error) {
+	snapshots, err := store.GetSnapshots(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := latestSnapshot(snapshots, revision)
+	if err != nil {
+		return nil, err
+	}
+	upgradeWorkspace(&snapshot.Workspace, snapshot.Code, snapshot.Language)
+
+	for {
+		entries, err := store.GetHistory(sessionID, "("+snapshot.EntryID, "+", historyPage)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.Revision > revision {
+				return checkRebuilt(snapshot, revision)
+			}
+			if err := replayEntry(snapshot, entry); err != nil {
+				return nil, err
+			}
+		}
+		if len(entries) < historyPage {
+			return checkRebuilt(snapshot, revision)
+		}
+	}
+}
+
+// EarliestRevision returns the oldest revision Rebuild can still produce.
+func EarliestRevision(store SessionStore, sessionID string) (int, error) {
+	snapshots, err := store.GetSnapshots(sessionID)
+	if err != nil {
+		return 0, err
+	}
+	if len(snapshots) == 0 {
+		return 0, ErrRevisionUnavailable
+	}
+
+	earliest := snapshots[0].Revision
+	for _, snapshot := range snapshots[1:] {
+		if snapshot.Revision < earliest {
+			earliest = snapshot.Revision
+		}
+	}
+	return earliest, nil
+}
+
+// ListRevisions summarizes every revision still in the history, oldest
+// first.
+func ListRevisions(store SessionStore, sessionID string) ([]models.RevisionSummary, error) {
+	entries, err := store.GetHistory(sessionID, "-", "+", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]models.RevisionSummary, 0)
+	for _, entry := range entries {
+		if entry.Type == models.HistoryJoin || entry.Type == models.HistoryLeave {
+			continue
+		}
+
+		// An edit and a language change can share a revision
+		if n := len(revisions); n == 0 || revisions[n-1].Revision != entry.Revision {
+			revisions = append(revisions, models.RevisionSummary{
+				Revision:  entry.Revision,
+				UserID:    entry.UserID,
+				Path:      entry.Path,
+				Timestamp: entry.Timestamp,
+			})
+		}
+		summary := &revisions[len(revisions)-1]
+
+		if entry.Language != "" {
+			summary.Language = entry.Language
+		}
+		for _, op := range entry.Ops {
+			summary.Inserted += utf8.RuneCountInString(op.Insert)
+			summary.Deleted += op.Delete
+		}
+	}
+	return revisions, nil
+}
+
+// JoinedRevision returns the revision the session was at when userID last
+// joined it, reading the history back from the newest entry.
+func JoinedRevision(store SessionStore, sessionID, userID string) (int, error) {
+	end := "+"
+	for {
+		entries, err := store.GetHistoryReverse(sessionID, "-", end, historyPage)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, entry := range entries {
+			if entry.Type == models.HistoryJoin && entry.UserID == userID {
+				return entry.Revision, nil
+			}
+		}
+		if len(entries) < historyPage {
+			return 0, ErrRevisionUnavailable
+		}
+		end = "(" + entries[len(entries)-1].ID
+	}
+}
+
+// lastArchivedEntry returns the ID of the newest entry in an archived change
+// log, which entries added after it is restored must follow.
+func lastArchivedEntry(archived *models.ArchivedSession) entryID {
+	var last entryID
+	for _, entry := range archived.History {
+		if id, err := parseEntryID(entry.ID); err == nil && last.less(id) {
+			last = id
+		}
+	}
+	return last
+}
+
+func checkRebuilt(snapshot *models.Snapshot, revision int) (*models.Snapshot, error) {
+	if snapshot.Revision != revision {
+		return nil, ErrRevisionUnavailable
+	}
+	return snapshot, nil
+}
+
+func replayEntry(snapshot *models.Snapshot, entry models.HistoryEntry) error {
+	record := &models.OpRecord{Path: entry.Path, NewPath: entry.NewPath}
+	switch entry.Type {
+	case models.HistoryEdit:
+		record.Ops = entry.Ops
+	case models.HistoryLanguage:
+		record.Language = entry.Language
+	case models.HistoryFileCreate:
+		record.Action = models.FileCreate
+		record.Ops = entry.Ops
+		record.Language = entry.Language
+	case models.HistoryFileRename:
+		record.Action = models.FileRename
+	case models.HistoryFileDelete:
+		record.Action = models.FileDelete
+	default:
+		snapshot.EntryID = entry.ID
+		return nil
+	}
+
+	workspace, err := applyToWorkspace(snapshot.Workspace, record)
+	if err != nil {
+		return fmt.Errorf("replaying entry %s: %w", entry.ID, err)
+	}
+	snapshot.Workspace = workspace
+	snapshot.Code, snapshot.Language = mainContent(&snapshot.Workspace)
+	snapshot.Revision = entry.Revision
+	snapshot.EntryID = entry.ID
+	return nil
+}
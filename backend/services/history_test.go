@@ -0,0 +1,202 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"codestream/models"
+)
+
+func TestHistoryRecordsChanges(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+		if err := joinUser(store, "s1", "bob", models.RoleEditor); err != nil {
+			t.Fatal(err)
+		}
+		code, language := "hello", "python"
+		if _, err := store.UpdateContent("s1", "bob", "", 0, &code, nil); err != nil {
+			t.Fatal(err)
+		}
+		code += "!"
+		if _, err := store.UpdateContent("s1", "bob", "", 1, &code, &language); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Disconnect("s1", "bob"); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := store.GetHistory("s1", "-", "+", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []struct {
+			kind     string
+			revision int
+		}{
+			{models.HistoryJoin, 0},
+			{models.HistoryEdit, 1},
+			{models.HistoryEdit, 2},
+			{models.HistoryLanguage, 2},
+			{models.HistoryLeave, 2},
+		}
+		if len(entries) != len(want) {
+			t.Fatalf("got %d entries, want %d: %+v", len(entries), len(want), entries)
+		}
+		for i, entry := range entries {
+			if entry.Type != want[i].kind || entry.Revision != want[i].revision || entry.UserID != "bob" {
+				t.Errorf("entry %d is %s at revision %d by %q, want %s at %d by bob",
+					i, entry.Type, entry.Revision, entry.UserID, want[i].kind, want[i].revision)
+			}
+		}
+		if entries[3].Language != "python" {
+			t.Errorf("language entry has %q", entries[3].Language)
+		}
+		if joined, err := JoinedRevision(store, "s1", "bob"); err != nil || joined != 0 {
+			t.Errorf("bob joined at revision %d (%v), want 0", joined, err)
+		}
+
+		// Paging with exclusive starts visits every entry once
+		var paged []models.HistoryEntry
+		start := "-"
+		for {
+			page, err := store.GetHistory("s1", start, "+", 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paged = append(paged, page...)
+			if len(page) < 2 {
+				break
+			}
+			start = "(" + page[len(page)-1].ID
+		}
+		if len(paged) != len(entries) {
+			t.Fatalf("paged through %d entries, want %d", len(paged), len(entries))
+		}
+		for i := range paged {
+			if paged[i].ID != entries[i].ID {
+				t.Fatalf("page entry %d is %s, want %s", i, paged[i].ID, entries[i].ID)
+			}
+		}
+
+		// and so does paging back from the newest with exclusive ends
+		paged = nil
+		end := "+"
+		for {
+			page, err := store.GetHistoryReverse("s1", "-", end, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paged = append(paged, page...)
+			if len(page) < 2 {
+				break
+			}
+			end = "(" + page[len(page)-1].ID
+		}
+		if len(paged) != len(entries) {
+			t.Fatalf("paged back through %d entries, want %d", len(paged), len(entries))
+		}
+		for i := range paged {
+			if want := entries[len(entries)-1-i]; paged[i].ID != want.ID {
+				t.Fatalf("reverse page entry %d is %s, want %s", i, paged[i].ID, want.ID)
+			}
+		}
+
+		if _, err := store.GetHistory("s1", "nope", "+", 0); !errors.Is(err, ErrInvalidEntryID) {
+			t.Fatalf("invalid start: got %v, want ErrInvalidEntryID", err)
+		}
+	})
+}
+
+// Rebuilding from snapshots and the log gives the code of any revision
+// still covered, and old history is compacted once snapshots roll over.
+func TestRebuildFromSnapshots(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+
+		revisions := snapshotInterval*(maxSnapshots+1) + 5
+		codes := []string{""}
+		code := ""
+		for revision := 1; revision <= revisions; revision++ {
+			code += fmt.Sprintf("%d\n", revision)
+			if _, err := store.UpdateContent("s1", "owner", "", revision-1, &code, nil); err != nil {
+				t.Fatal(err)
+			}
+			codes = append(codes, code)
+		}
+
+		session, err := store.GetSession("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rebuilt, err := Rebuild(store, "s1", session.Revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rebuilt.Code != session.Code {
+			t.Fatalf("rebuilt code differs from the session's at revision %d", session.Revision)
+		}
+
+		oldest := revisions - revisions%snapshotInterval - (maxSnapshots-1)*snapshotInterval
+		for _, revision := range []int{oldest, oldest + 1, oldest + snapshotInterval/2, revisions - 1} {
+			rebuilt, err := Rebuild(store, "s1", revision)
+			if err != nil {
+				t.Fatalf("revision %d: %v", revision, err)
+			}
+			if rebuilt.Code != codes[revision] || rebuilt.Revision != revision {
+				t.Fatalf("revision %d rebuilt as revision %d with the wrong code", revision, rebuilt.Revision)
+			}
+		}
+
+		if _, err := Rebuild(store, "s1", oldest-1); !errors.Is(err, ErrRevisionUnavailable) {
+			t.Fatalf("compacted revision: got %v, want ErrRevisionUnavailable", err)
+		}
+		entries, err := store.GetHistory("s1", "-", "+", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Revision != oldest {
+			t.Fatalf("history starts at %+v, want revision %d", entries, oldest)
+		}
+	})
+}
+
+func TestListRevisions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+		code, language := "héllo", "python"
+		if _, err := store.UpdateContent("s1", "owner", "", 0, &code, nil); err != nil {
+			t.Fatal(err)
+		}
+		code = "hé"
+		if _, err := store.UpdateContent("s1", "owner", "", 1, &code, &language); err != nil {
+			t.Fatal(err)
+		}
+
+		revisions, err := ListRevisions(store, "s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []models.RevisionSummary{
+			{Revision: 1, UserID: "owner", Path: "main.go", Inserted: 5},
+			{Revision: 2, UserID: "owner", Path: "main.go", Deleted: 3, Language: "python"},
+		}
+		if len(revisions) != len(want) {
+			t.Fatalf("got %d revisions, want %d", len(revisions), len(want))
+		}
+		for i := range want {
+			want[i].Timestamp = revisions[i].Timestamp
+			if revisions[i] != want[i] {
+				t.Errorf("revision %d is %+v, want %+v", i, revisions[i], want[i])
+			}
+		}
+
+		earliest, err := EarliestRevision(store, "s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if earliest != 0 {
+			t.Fatalf("earliest revision is %d, want 0", earliest)
+		}
+	})
+}
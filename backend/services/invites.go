@@ -0,0 +1,185 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"codestream/models"
+)
+
+// MaxInviteTTL bounds how long an invite may stay valid.
+const MaxInviteTTL = 7 * 24 * time.Hour
+
+var (
+	ErrInvalidInvite = errors.New("invalid invite")
+	ErrInviteExpired = errors.New("invite expired")
+	ErrInviteUsedUp  = errors.New("invite has no uses left")
+)
+
+// InviteService mints and redeems invite tokens. A token is signed with
+// INVITE_SECRET and names an invite record kept in the session store, so
+// invites can be listed, counted and revoked.
+type InviteService struct {
+	store  SessionStore
+	secret []byte
+}
+
+func NewInviteService(store SessionStore) *InviteService {
+	secret := []byte(os.Getenv("INVITE_SECRET"))
+	if len(secret) == 0 {
+		fmt.Println("WARNING: INVITE_SECRET is not set, invites will not survive a restart!")
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+
+	return &InviteService{
+		store:  store,
+		secret: secret,
+	}
+}
+
+type inviteClaims struct {
+	ID        string      `json:"id"`
+	SessionID string      `json:"sid"`
+	Role      models.Role `json:"role"`
+	ExpiresAt int64       `json:"exp"`
+}
+
+// Create stores a new invite and returns it with its token.
+func (s *InviteService) Create(sessionID, createdBy string, role models.Role, ttl time.Duration, maxUses int) (*models.Invite, string, error) {
+	now := time.Now()
+	invite := &models.Invite{
+		ID:        uuid.New().String(),
+		SessionID: sessionID,
+		Role:      role,
+		ExpiresAt: now.Add(ttl),
+		MaxUses:   maxUses,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+	}
+
+	if err := s.store.SaveInvite(invite); err != nil {
+		return nil, "", err
+	}
+
+	token, err := s.sign(inviteClaims{
+		ID:        invite.ID,
+		SessionID: sessionID,
+		Role:      role,
+		ExpiresAt: invite.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return invite, token, nil
+}
+
+// List returns the session's live invites, dropping expired ones.
+func (s *InviteService) List(sessionID string) ([]models.Invite, error) {
+	invites, err := s.store.ListInvites(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	live := invites[:0]
+	for _, invite := range invites {
+		if now.After(invite.ExpiresAt) {
+			s.store.DeleteInvite(sessionID, invite.ID)
+			continue
+		}
+		live = append(live, invite)
+	}
+	return live, nil
+}
+
+func (s *InviteService) Revoke(sessionID, inviteID string) error {
+	return s.store.DeleteInvite(sessionID, inviteID)
+}
+
+// Admit lets user into the session, where they are present once they
+// connect. Existing participants join as they are; anyone else needs an
+// invite token, which is used up by joining.
+func (s *InviteService) Admit(sessionID string, user models.User, token string) (*models.User, error) {
+	session, err := s.store.GetSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.RoleOf(user.ID) != "" {
+		return s.store.AdmitUser(sessionID, user, "")
+	}
+
+	if token == "" {
+		return nil, ErrNotParticipant
+	}
+	invite, err := s.consume(sessionID, token)
+	if err != nil {
+		return nil, err
+	}
+	return s.store.AdmitUser(sessionID, user, invite.Role)
+}
+
+func (s *InviteService) consume(sessionID, token string) (*models.Invite, error) {
+	claims, err := s.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.SessionID != sessionID {
+		return nil, ErrInvalidInvite
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrInviteExpired
+	}
+
+	// A revoked invite's record is gone even though its token still verifies
+	invite, err := s.store.UseInvite(sessionID, claims.ID)
+	if errors.Is(err, ErrInviteNotFound) {
+		return nil, ErrInvalidInvite
+	}
+	return invite, err
+}
+
+func (s *InviteService) sign(claims inviteClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.mac(encoded)), nil
+}
+
+func (s *InviteService) verify(token string) (*inviteClaims, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidInvite
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(signature, s.mac(encoded)) {
+		return nil, ErrInvalidInvite
+	}
+
+	var claims inviteClaims
+	if err := decodeSegment(encoded, &claims); err != nil {
+		return nil, ErrInvalidInvite
+	}
+	return &claims, nil
+}
+
+func (s *InviteService) mac(payload string) []byte {
+	m := hmac.New(sha256.New, s.secret)
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"codestream/models"
+)
+
+func TestAdmitRejectsBadInvites(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		t.Setenv("INVITE_SECRET", "test-secret")
+		invites := NewInviteService(store)
+		createTestSession(t, store, "s1")
+		createTestSession(t, store, "s2")
+
+		newToken := func(sessionID string, ttl time.Duration, maxUses int) (*models.Invite, string) {
+			invite, token, err := invites.Create(sessionID, "owner", models.RoleEditor, ttl, maxUses)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return invite, token
+		}
+
+		_, valid := newToken("s1", time.Hour, 0)
+		payload, signature, _ := strings.Cut(valid, ".")
+		forged := base64.RawURLEncoding.EncodeToString([]byte(`{"id":"x","sid":"s1","role":"editor","exp":9999999999}`))
+		resigned := NewInviteService(store)
+		resigned.secret = []byte("another-secret")
+		_, otherSecret, err := resigned.Create("s1", "owner", models.RoleEditor, time.Hour, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, expired := newToken("s1", -time.Minute, 0)
+		revoked, revokedToken := newToken("s1", time.Hour, 0)
+		if err := invites.Revoke("s1", revoked.ID); err != nil {
+			t.Fatal(err)
+		}
+		_, otherSession := newToken("s2", time.Hour, 0)
+		_, usedUp := newToken("s1", time.Hour, 1)
+		if _, err := invites.Admit("s1", models.User{ID: "first"}, usedUp); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name  string
+			token string
+			want  error
+		}{
+			{"no token", "", ErrNotParticipant},
+			{"malformed", "not-a-token", ErrInvalidInvite},
+			{"tampered payload", forged + "." + signature, ErrInvalidInvite},
+			{"tampered signature", payload + "." + base64.RawURLEncoding.EncodeToString([]byte("forged")), ErrInvalidInvite},
+			{"signed with another secret", otherSecret, ErrInvalidInvite},
+			{"expired", expired, ErrInviteExpired},
+			{"revoked", revokedToken, ErrInvalidInvite},
+			{"for another session", otherSession, ErrInvalidInvite},
+			{"used up", usedUp, ErrInviteUsedUp},
+		}
+		for _, tt := range tests {
+			user, err := invites.Admit("s1", models.User{ID: "mallory"}, tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("%s: got %+v, %v; want %v", tt.name, user, err, tt.want)
+			}
+		}
+
+		session, err := store.GetSession("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if role := session.RoleOf("mallory"); role != "" {
+			t.Fatalf("rejected user was given role %q", role)
+		}
+
+		user, err := invites.Admit("s1", models.User{ID: "bob"}, valid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Role != models.RoleEditor {
+			t.Fatalf("admitted as %q, want editor", user.Role)
+		}
+	})
+}
@@ -0,0 +1,939 @@
+package services
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"codestream/models"
+)
+
+// MemoryStore keeps sessions in process memory, for tests and single-node
+// development. Nothing survives a restart and nothing expires.
+type MemoryStore struct {
+	mu        sync.Mutex
+	publishMu sync.Mutex // keeps broadcasts published in sequence order
+	sessions  map[string]*models.Session
+	ops       map[string][]models.OpRecord
+	blame     map[string]map[string][]models.LineBlame // sessionID -> path -> lines
+	comments  map[string]map[string]models.Comment     // sessionID -> commentID -> comment
+	suggests  map[string]map[string]models.Suggestion  // sessionID -> suggestionID -> suggestion
+	reviews   map[string]*models.Review
+	chat      map[string][]models.ChatMessage
+	presence  map[string]map[string]models.Presence // sessionID -> userID -> presence
+	conns     map[string]map[string]connection      // sessionID -> connID -> connection
+	history   map[string][]models.HistoryEntry
+	lastEntry map[string]entryID
+	snapshots map[string][]models.Snapshot
+	logs      map[string]*eventLog
+	invites   map[string]map[string]models.Invite // sessionID -> inviteID -> invite
+	broker    *broker
+}
+
+// connection is a client connection that keeps its user present until its
+// lease expires.
+type connection struct {
+	userID  string
+	expires time.Time
+}
+
+// eventLog holds the latest maxEventLog broadcasts of a session, the last
+// of which has sequence number seq.
+type eventLog struct {
+	seq    int64
+	events [][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions:  make(map[string]*models.Session),
+		ops:       make(map[string][]models.OpRecord),
+		blame:     make(map[string]map[string][]models.LineBlame),
+		comments:  make(map[string]map[string]models.Comment),
+		suggests:  make(map[string]map[string]models.Suggestion),
+		reviews:   make(map[string]*models.Review),
+		chat:      make(map[string][]models.ChatMessage),
+		presence:  make(map[string]map[string]models.Presence),
+		conns:     make(map[string]map[string]connection),
+		history:   make(map[string][]models.HistoryEntry),
+		lastEntry: make(map[string]entryID),
+		snapshots: make(map[string][]models.Snapshot),
+		logs:      make(map[string]*eventLog),
+		invites:   make(map[string]map[string]models.Invite),
+		broker:    newBroker(),
+	}
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// copySession returns a deep copy, so callers never share state with the
+// store.
+func copySession(session *models.Session) *models.Session {
+	c := *session
+	c.Users = append([]models.User{}, session.Users...)
+	c.Files = append([]models.File{}, session.Files...)
+	c.Roles = make(map[string]models.Role, len(session.Roles))
+	for userID, role := range session.Roles {
+		c.Roles[userID] = role
+	}
+	return &c
+}
+
+// copyReview returns a deep copy, so callers never share state with the
+// store.
+func copyReview(review *models.Review) *models.Review {
+	c := *review
+	c.Verdicts = make(map[string]models.Verdict, len(review.Verdicts))
+	for userID, verdict := range review.Verdicts {
+		c.Verdicts[userID] = verdict
+	}
+	c.History = append([]models.ReviewTransition{}, review.History...)
+	return &c
+}
+
+func (m *MemoryStore) CreateSession(session *models.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	initWorkspace(session)
+	m.sessions[session.ID] = copySession(session)
+	m.resetBlame(session)
+	m.resetHistory(session)
+	delete(m.comments, session.ID)
+	delete(m.suggests, session.ID)
+	delete(m.reviews, session.ID)
+	delete(m.chat, session.ID)
+	delete(m.presence, session.ID)
+	delete(m.conns, session.ID)
+	return nil
+}
+
+func (m *MemoryStore) GetSession(sessionID string) (*models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return copySession(session), nil
+}
+
+func (m *MemoryStore) RestoreSession(archived *models.ArchivedSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ops := &archived.Session, trimOps(archived.Ops)
+	initWorkspace(session)
+	m.sessions[session.ID] = copySession(session)
+	m.ops[session.ID] = append([]models.OpRecord{}, ops...)
+	m.resetBlame(session)
+	if len(archived.Snapshots) > 0 {
+		m.history[session.ID] = append([]models.HistoryEntry{}, archived.History...)
+		m.snapshots[session.ID] = append([]models.Snapshot{}, archived.Snapshots...)
+		m.lastEntry[session.ID] = lastArchivedEntry(archived)
+	} else {
+		m.resetHistory(session)
+	}
+
+	comments := make(map[string]models.Comment, len(archived.Comments))
+	for _, comment := range archived.Comments {
+		comments[comment.ID] = comment
+	}
+	m.comments[session.ID] = comments
+
+	suggestions := make(map[string]models.Suggestion, len(archived.Suggestions))
+	for _, suggestion := range archived.Suggestions {
+		suggestions[suggestion.ID] = suggestion
+	}
+	m.suggests[session.ID] = suggestions
+
+	delete(m.reviews, session.ID)
+	if archived.Review != nil {
+		m.reviews[session.ID] = copyReview(archived.Review)
+	}
+	m.chat[session.ID] = append([]models.ChatMessage{}, archived.Messages...)
+	delete(m.presence, session.ID)
+	delete(m.conns, session.ID)
+	return nil
+}
+
+func (m *MemoryStore) resetBlame(session *models.Session) {
+	blame := make(map[string][]models.LineBlame, len(session.Files))
+	for i := range session.Files {
+		blame[session.Files[i].Path] = initialBlame(session, &session.Files[i])
+	}
+	m.blame[session.ID] = blame
+}
+
+// AdmitUser gives user a role in the session. Participants keep their role;
+// newcomers are given role, and rejected with ErrNotParticipant if it is
+// empty. The returned user carries their role.
+func (m *MemoryStore) AdmitUser(sessionID string, user models.User, role models.Role) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	role, err := admissionRole(session.Roles[user.ID], role)
+	if err != nil {
+		return nil, err
+	}
+	session.Roles[user.ID] = role
+	user.Role = role
+	return &user, nil
+}
+
+func (m *MemoryStore) removePresence(session *models.Session, userID string) {
+	delete(m.presence[session.ID], userID)
+	users := session.Users[:0]
+	for _, u := range session.Users {
+		if u.ID != userID {
+			users = append(users, u)
+		}
+	}
+	session.Users = users
+}
+
+func (m *MemoryStore) SetPresence(sessionID string, presence *models.Presence) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	if !isPresent(session, presence.UserID) {
+		return ErrNotParticipant
+	}
+
+	if m.presence[sessionID] == nil {
+		m.presence[sessionID] = make(map[string]models.Presence)
+	}
+	m.presence[sessionID][presence.UserID] = *presence
+	return nil
+}
+
+func (m *MemoryStore) GetPresence(sessionID string) ([]models.Presence, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	presence := make([]models.Presence, 0, len(m.presence[sessionID]))
+	for _, p := range m.presence[sessionID] {
+		presence = append(presence, p)
+	}
+	sortPresence(presence)
+	return presence, nil
+}
+
+// SetRole changes a participant's role. The owner's role can't be changed.
+func (m *MemoryStore) SetRole(sessionID, userID string, role models.Role) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	if err := checkRemovable(session, userID); err != nil {
+		return err
+	}
+
+	session.Roles[userID] = role
+	for i := range session.Users {
+		if session.Users[i].ID == userID {
+			session.Users[i].Role = role
+		}
+	}
+	return nil
+}
+
+// RemoveParticipant drops a participant's role and presence, recording that
+// they left if they were present. The owner can't be removed.
+func (m *MemoryStore) RemoveParticipant(sessionID, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	if err := checkRemovable(session, userID); err != nil {
+		return err
+	}
+
+	if isPresent(session, userID) {
+		m.appendHistory(sessionID, presenceEntry(models.HistoryLeave, userID, session.Revision))
+	}
+	delete(session.Roles, userID)
+	m.removePresence(session, userID)
+	for connID, conn := range m.conns[sessionID] {
+		if conn.userID == userID {
+			delete(m.conns[sessionID], connID)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Connect(sessionID string, user models.User, connID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return false, ErrSessionNotFound
+	}
+	if user.Role = session.Roles[user.ID]; user.Role == "" {
+		return false, ErrNotParticipant
+	}
+
+	first := true
+	for _, conn := range m.conns[sessionID] {
+		if conn.userID == user.ID {
+			first = false
+		}
+	}
+	if m.conns[sessionID] == nil {
+		m.conns[sessionID] = make(map[string]connection)
+	}
+	m.conns[sessionID][connID] = connection{userID: user.ID, expires: time.Now().Add(ConnectionLease)}
+
+	users := session.Users[:0]
+	for _, u := range session.Users {
+		if u.ID != user.ID {
+			users = append(users, u)
+		}
+	}
+	session.Users = append(users, user)
+	sort.Slice(session.Users, func(i, j int) bool {
+		return session.Users[i].ID < session.Users[j].ID
+	})
+
+	if first {
+		m.appendHistory(sessionID, presenceEntry(models.HistoryJoin, user.ID, session.Revision))
+	}
+	return first, nil
+}
+
+func (m *MemoryStore) Disconnect(sessionID, connID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, left := m.disconnect(sessionID, connID)
+	return left, nil
+}
+
+// disconnect drops connID and, if it was its user's last connection, the
+// user's presence. It returns the user and whether they left.
+func (m *MemoryStore) disconnect(sessionID, connID string) (string, bool) {
+	conn, ok := m.conns[sessionID][connID]
+	if !ok {
+		return "", false
+	}
+	delete(m.conns[sessionID], connID)
+	if len(m.conns[sessionID]) == 0 {
+		delete(m.conns, sessionID)
+	}
+
+	for _, other := range m.conns[sessionID] {
+		if other.userID == conn.userID {
+			return conn.userID, false
+		}
+	}
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return conn.userID, false
+	}
+	m.removePresence(session, conn.userID)
+	m.appendHistory(sessionID, presenceEntry(models.HistoryLeave, conn.userID, session.Revision))
+	return conn.userID, true
+}
+
+func (m *MemoryStore) RenewConnections(sessionID string, connIDs []string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var lost []string
+	expires := time.Now().Add(ConnectionLease)
+	for _, connID := range connIDs {
+		conn, ok := m.conns[sessionID][connID]
+		if !ok {
+			lost = append(lost, connID)
+			continue
+		}
+		conn.expires = expires
+		m.conns[sessionID][connID] = conn
+	}
+	return lost, nil
+}
+
+func (m *MemoryStore) ExpireConnections(now time.Time) ([]Departure, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var departures []Departure
+	for sessionID, conns := range m.conns {
+		for connID, conn := range conns {
+			if conn.expires.After(now) {
+				continue
+			}
+			if userID, left := m.disconnect(sessionID, connID); left {
+				departures = append(departures, Departure{SessionID: sessionID, UserID: userID})
+			}
+		}
+	}
+	sortDepartures(departures)
+	return departures, nil
+}
+
+// UpdateContent replaces the code and/or language if the session is still at
+// the expected revision, and returns a *ConflictError otherwise.
+func (m *MemoryStore) UpdateContent(sessionID, userID, path string, revision int, code, language *string) (*models.OpRecord, error) {
+	return m.commit(sessionID, func(session *models.Session) (*models.OpRecord, error) {
+		return contentRecord(session, userID, path, revision, code, language)
+	})
+}
+
+// ApplyEdit transforms ops, made against the given base revision, past every
+// operation committed since and applies the result to the file.
+func (m *MemoryStore) ApplyEdit(sessionID, userID, path string, revision int, ops []models.OpComponent) (*models.OpRecord, error) {
+	if err := ValidateOps(ops); err != nil {
+		return nil, err
+	}
+
+	return m.commit(sessionID, func(session *models.Session) (*models.OpRecord, error) {
+		return editRecord(session, userID, path, revision, ops, m.opsSince(sessionID, revision))
+	})
+}
+
+// ChangeFile creates, renames or deletes a file as the next revision.
+func (m *MemoryStore) ChangeFile(sessionID, userID string, change *models.FileChange) (*models.OpRecord, error) {
+	return m.commit(sessionID, func(session *models.Session) (*models.OpRecord, error) {
+		return fileRecord(session, userID, change)
+	})
+}
+
+// commit applies the record built by fn to the session as the next revision
+// and appends it to the operation history.
+func (m *MemoryStore) commit(sessionID string, fn func(session *models.Session) (*models.OpRecord, error)) (*models.OpRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.sessions[sessionID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	// Work on a copy so a failed write leaves the session untouched
+	session := copySession(stored)
+	record, err := fn(session)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyRecord(session, record); err != nil {
+		return nil, err
+	}
+
+	m.sessions[sessionID] = session
+	blame := m.blame[sessionID]
+	changed := blame[record.Path]
+	delete(blame, record.Path)
+	if target := recordTarget(record); session.File(target) != nil {
+		blame[target] = recordBlame(changed, &stored.Workspace, record)
+	}
+	comments := m.comments[sessionID]
+	for _, comment := range comments {
+		if remapComment(&comment, &stored.Workspace, record) {
+			comments[comment.ID] = comment
+			record.Comments = append(record.Comments, comment)
+		}
+	}
+	suggestions := m.suggests[sessionID]
+	for _, suggestion := range suggestions {
+		if rebaseSuggestion(&suggestion, &stored.Workspace, record) {
+			suggestions[suggestion.ID] = suggestion
+			record.Suggestions = append(record.Suggestions, suggestion)
+		}
+	}
+	if review, ok := m.reviews[sessionID]; ok && reopenReview(review, record) {
+		record.Review = copyReview(review)
+	}
+	m.ops[sessionID] = trimOps(append(m.ops[sessionID], *record))
+
+	var last string
+	for _, entry := range recordEntries(record) {
+		last = m.appendHistory(sessionID, entry)
+	}
+	if session.Revision%snapshotInterval == 0 {
+		m.snapshot(sessionID, newSnapshot(session, last))
+	}
+
+	return record, nil
+}
+
+// GetOpsSince returns the recorded operations after the given revision that
+// are still in the history window, oldest first.
+func (m *MemoryStore) GetOpsSince(sessionID string, revision int) ([]models.OpRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.opsSince(sessionID, revision), nil
+}
+
+func (m *MemoryStore) opsSince(sessionID string, revision int) []models.OpRecord {
+	records := make([]models.OpRecord, 0)
+	for _, record := range m.ops[sessionID] {
+		if record.Revision > revision {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func (m *MemoryStore) GetBlame(sessionID, path string) ([]models.LineBlame, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return nil, 0, ErrSessionNotFound
+	}
+	path = resolvePath(&session.Workspace, path)
+	file := session.File(path)
+	if file == nil {
+		return nil, 0, ErrFileNotFound
+	}
+	return append([]models.LineBlame{}, checkBlame(m.blame[sessionID][path], file.Code)...), session.Revision, nil
+}
+
+func (m *MemoryStore) SaveComment(comment *models.Comment, revision int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[comment.SessionID]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	var thread *models.Comment
+	if c, ok := m.comments[comment.SessionID][comment.ThreadID]; ok {
+		thread = &c
+	}
+	if err := checkNewComment(session, comment, revision, thread); err != nil {
+		return err
+	}
+
+	if m.comments[comment.SessionID] == nil {
+		m.comments[comment.SessionID] = make(map[string]models.Comment)
+	}
+	m.comments[comment.SessionID][comment.ID] = *comment
+	return nil
+}
+
+func (m *MemoryStore) UpdateComment(sessionID, commentID string, fn func(comment *models.Comment) error) (*models.Comment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	comment, ok := m.comments[sessionID][commentID]
+	if !ok {
+		return nil, ErrCommentNotFound
+	}
+	if err := fn(&comment); err != nil {
+		return nil, err
+	}
+
+	m.comments[sessionID][commentID] = comment
+	return &comment, nil
+}
+
+func (m *MemoryStore) DeleteComment(sessionID, commentID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	comments := m.comments[sessionID]
+	if _, ok := comments[commentID]; !ok {
+		return nil, ErrCommentNotFound
+	}
+
+	deleted := []string{commentID}
+	delete(comments, commentID)
+	for id, comment := range comments {
+		if comment.ThreadID == commentID {
+			deleted = append(deleted, id)
+			delete(comments, id)
+		}
+	}
+	return deleted, nil
+}
+
+func (m *MemoryStore) GetComments(sessionID string) ([]models.Comment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	comments := make([]models.Comment, 0, len(m.comments[sessionID]))
+	for _, comment := range m.comments[sessionID] {
+		comments = append(comments, comment)
+	}
+	sortComments(comments)
+	return comments, nil
+}
+
+func (m *MemoryStore) Suggest(sessionID, userID, path string, revision int, ops []models.OpComponent) (*models.Suggestion, error) {
+	if err := ValidateOps(ops); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	suggestion, err := newSuggestion(session, userID, path, revision, ops, m.opsSince(sessionID, revision))
+	if err != nil {
+		return nil, err
+	}
+
+	if m.suggests[sessionID] == nil {
+		m.suggests[sessionID] = make(map[string]models.Suggestion)
+	}
+	m.suggests[sessionID][suggestion.ID] = *suggestion
+	return suggestion, nil
+}
+
+func (m *MemoryStore) AcceptSuggestion(sessionID, suggestionID, userID string) (*models.OpRecord, error) {
+	return m.commit(sessionID, func(session *models.Session) (*models.OpRecord, error) {
+		var suggestion *models.Suggestion
+		if s, ok := m.suggests[sessionID][suggestionID]; ok {
+			suggestion = &s
+		}
+		return acceptRecord(session, suggestion, userID)
+	})
+}
+
+func (m *MemoryStore) UpdateSuggestion(sessionID, suggestionID string, fn func(suggestion *models.Suggestion) error) (*models.Suggestion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	suggestion, ok := m.suggests[sessionID][suggestionID]
+	if !ok {
+		return nil, ErrSuggestionNotFound
+	}
+	if err := fn(&suggestion); err != nil {
+		return nil, err
+	}
+
+	m.suggests[sessionID][suggestionID] = suggestion
+	return &suggestion, nil
+}
+
+func (m *MemoryStore) GetSuggestions(sessionID string) ([]models.Suggestion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	suggestions := make([]models.Suggestion, 0, len(m.suggests[sessionID]))
+	for _, suggestion := range m.suggests[sessionID] {
+		suggestions = append(suggestions, suggestion)
+	}
+	sortSuggestions(suggestions)
+	return suggestions, nil
+}
+
+func (m *MemoryStore) GetReview(sessionID string) (*models.Review, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[sessionID]; !ok {
+		return nil, ErrSessionNotFound
+	}
+	if review, ok := m.reviews[sessionID]; ok {
+		return copyReview(review), nil
+	}
+	return newReview(), nil
+}
+
+func (m *MemoryStore) UpdateReview(sessionID string, fn func(session *models.Session, review *models.Review) error) (*models.Review, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	review := newReview()
+	if stored, ok := m.reviews[sessionID]; ok {
+		review = copyReview(stored)
+	}
+	if err := fn(copySession(session), review); err != nil {
+		return nil, err
+	}
+
+	m.reviews[sessionID] = copyReview(review)
+	return review, nil
+}
+
+func (m *MemoryStore) SaveMessage(message *models.ChatMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[message.SessionID]; !ok {
+		return ErrSessionNotFound
+	}
+
+	chat := m.chat[message.SessionID]
+	message.ID = 1
+	if len(chat) > 0 {
+		message.ID = chat[len(chat)-1].ID + 1
+	}
+	chat = append(chat, *message)
+	if len(chat) > maxChatHistory {
+		chat = chat[len(chat)-maxChatHistory:]
+	}
+	m.chat[message.SessionID] = chat
+	return nil
+}
+
+func (m *MemoryStore) GetMessages(sessionID string, before int64, limit int) ([]models.ChatMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return pageMessages(m.chat[sessionID], before, limit), nil
+}
+
+// resetHistory starts the history of session afresh from a snapshot of it.
+func (m *MemoryStore) resetHistory(session *models.Session) {
+	delete(m.history, session.ID)
+	m.snapshots[session.ID] = []models.Snapshot{newSnapshot(session, firstEntryID.String())}
+}
+
+func (m *MemoryStore) appendHistory(sessionID string, entry models.HistoryEntry) string {
+	id := m.lastEntry[sessionID].next(time.Now())
+	m.lastEntry[sessionID] = id
+
+	entry.ID = id.String()
+	m.history[sessionID] = append(m.history[sessionID], entry)
+	return entry.ID
+}
+
+// snapshot keeps snapshot, drops the oldest beyond maxSnapshots and compacts
+// away the history they covered.
+func (m *MemoryStore) snapshot(sessionID string, snapshot models.Snapshot) {
+	snapshots := append(m.snapshots[sessionID], snapshot)
+	if len(snapshots) > maxSnapshots {
+		snapshots = snapshots[len(snapshots)-maxSnapshots:]
+	}
+	m.snapshots[sessionID] = snapshots
+
+	oldest, err := parseEntryID(snapshots[0].EntryID)
+	if err != nil {
+		return
+	}
+	history := m.history[sessionID]
+	i := 0
+	for i < len(history) {
+		id, _ := parseEntryID(history[i].ID)
+		if !id.less(oldest) {
+			break
+		}
+		i++
+	}
+	m.history[sessionID] = append([]models.HistoryEntry{}, history[i:]...)
+}
+
+func (m *MemoryStore) GetHistory(sessionID, start, end string, count int) ([]models.HistoryEntry, error) {
+	r, err := parseEntryRange(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := make([]models.HistoryEntry, 0)
+	for _, entry := range m.history[sessionID] {
+		if count > 0 && len(entries) == count {
+			break
+		}
+		id, _ := parseEntryID(entry.ID)
+		if r.contains(id) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (m *MemoryStore) GetHistoryReverse(sessionID, start, end string, count int) ([]models.HistoryEntry, error) {
+	r, err := parseEntryRange(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := make([]models.HistoryEntry, 0)
+	history := m.history[sessionID]
+	for i := len(history) - 1; i >= 0; i-- {
+		if count > 0 && len(entries) == count {
+			break
+		}
+		id, _ := parseEntryID(history[i].ID)
+		if r.contains(id) {
+			entries = append(entries, history[i])
+		}
+	}
+	return entries, nil
+}
+
+func (m *MemoryStore) GetSnapshots(sessionID string) ([]models.Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]models.Snapshot{}, m.snapshots[sessionID]...), nil
+}
+
+// AppendEvent stamps message with the session's next sequence number, keeps
+// it in the bounded replay log and returns its encoded form.
+func (m *MemoryStore) AppendEvent(sessionID string, message *models.WSMessage) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log := m.logs[sessionID]
+	if log == nil {
+		log = &eventLog{}
+		m.logs[sessionID] = log
+	}
+
+	message.Seq = log.seq + 1
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	log.seq++
+	log.events = append(log.events, data)
+	if len(log.events) > maxEventLog {
+		log.events = log.events[len(log.events)-maxEventLog:]
+	}
+
+	return data, nil
+}
+
+// GetEventsSince returns the logged messages with a sequence number above
+// seq, oldest first. ok is false when the log no longer reaches back that far.
+func (m *MemoryStore) GetEventsSince(sessionID string, seq int64) ([][]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log := m.logs[sessionID]
+	if log == nil {
+		log = &eventLog{}
+	}
+	if seq >= log.seq {
+		return [][]byte{}, seq == log.seq, nil
+	}
+
+	first := log.seq - int64(len(log.events)) + 1
+	if seq+1 < first {
+		return nil, false, nil
+	}
+
+	return append([][]byte{}, log.events[seq+1-first:]...), true, nil
+}
+
+func (m *MemoryStore) GetEventSeq(sessionID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if log := m.logs[sessionID]; log != nil {
+		return log.seq, nil
+	}
+	return 0, nil
+}
+
+func (m *MemoryStore) Broadcast(sessionID string, message *models.WSMessage) error {
+	m.publishMu.Lock()
+	defer m.publishMu.Unlock()
+
+	data, err := m.AppendEvent(sessionID, message)
+	if err != nil {
+		return err
+	}
+	return m.broker.publish(sessionID, newEnvelope(message, data))
+}
+
+func (m *MemoryStore) Publish(sessionID string, message interface{}) error {
+	return m.broker.publish(sessionID, message)
+}
+
+func (m *MemoryStore) Subscribe(sessionID string) Subscription {
+	return m.broker.subscribe(sessionID)
+}
+
+func (m *MemoryStore) SaveInvite(invite *models.Invite) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.invites[invite.SessionID] == nil {
+		m.invites[invite.SessionID] = make(map[string]models.Invite)
+	}
+	m.invites[invite.SessionID][invite.ID] = *invite
+	return nil
+}
+
+func (m *MemoryStore) GetInvite(sessionID, inviteID string) (*models.Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invite, ok := m.invites[sessionID][inviteID]
+	if !ok {
+		return nil, ErrInviteNotFound
+	}
+	return &invite, nil
+}
+
+// UseInvite counts one use of an invite, failing with ErrInviteUsedUp once
+// it has none left.
+func (m *MemoryStore) UseInvite(sessionID, inviteID string) (*models.Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invite, ok := m.invites[sessionID][inviteID]
+	if !ok {
+		return nil, ErrInviteNotFound
+	}
+	if err := useInvite(&invite); err != nil {
+		return nil, err
+	}
+
+	m.invites[sessionID][inviteID] = invite
+	return &invite, nil
+}
+
+func (m *MemoryStore) ListInvites(sessionID string) ([]models.Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invites := make([]models.Invite, 0, len(m.invites[sessionID]))
+	for _, invite := range m.invites[sessionID] {
+		invites = append(invites, invite)
+	}
+	return invites, nil
+}
+
+func (m *MemoryStore) DeleteInvite(sessionID, inviteID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.invites[sessionID][inviteID]; !ok {
+		return ErrInviteNotFound
+	}
+	delete(m.invites[sessionID], inviteID)
+	return nil
+}
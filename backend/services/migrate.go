@@ -0,0 +1,215 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+
+	"codestream/models"
+)
+
+// legacySessionKey is where sessions used to be stored as a single JSON blob.
+func legacySessionKey(sessionID string) string {
+	return fmt.Sprintf("session:%s", sessionID)
+}
+
+// Before workspaces, a session's code was a string of its own, its language
+// a field of the meta hash and its line attribution a JSON list.
+func legacyCodeKey(sessionID string) string  { return fmt.Sprintf("session:%s:code", sessionID) }
+func legacyBlameKey(sessionID string) string { return fmt.Sprintf("session:%s:blame", sessionID) }
+
+// migrateLegacySession moves a session stored as a single JSON blob into
+// the split keys. It reports false if there is no such session.
+func (r *RedisService) migrateLegacySession(sessionID string) (bool, error) {
+	key := legacySessionKey(sessionID)
+
+	migrated := false
+	err := r.watch(func(tx *redis.Tx) error {
+		data, err := tx.Get(r.ctx, key).Result()
+		if err == redis.Nil {
+			// Someone else may have migrated it first
+			n, err := tx.Exists(r.ctx, metaKey(sessionID)).Result()
+			migrated = n > 0
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		var session models.Session
+		if err := json.Unmarshal([]byte(data), &session); err != nil {
+			return fmt.Errorf("invalid legacy session %s: %w", sessionID, err)
+		}
+		upgradeLegacySession(&session)
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			if err := r.writeSession(pipe, &session); err != nil {
+				return err
+			}
+			pipe.Del(r.ctx, key)
+			return nil
+		})
+		migrated = err == nil
+		return err
+	}, key)
+
+	return migrated, err
+}
+
+// migrateSingleFileSession turns a session from before workspaces into a
+// one-file workspace holding its code and line attribution.
+func (r *RedisService) migrateSingleFileSession(sessionID string) error {
+	return r.watch(func(tx *redis.Tx) error {
+		meta, err := tx.HGetAll(r.ctx, metaKey(sessionID)).Result()
+		if err != nil {
+			return err
+		}
+		if len(meta) == 0 || meta["main_file"] != "" {
+			// Gone, or someone else migrated it first
+			return nil
+		}
+
+		code, err := tx.Get(r.ctx, legacyCodeKey(sessionID)).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		data, err := tx.Get(r.ctx, legacyBlameKey(sessionID)).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		blame, err := decodeBlame(data)
+		if err != nil {
+			return err
+		}
+
+		var workspace models.Workspace
+		upgradeWorkspace(&workspace, code, meta["language"])
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			if err := r.setFile(pipe, sessionID, &workspace.Files[0], blame); err != nil {
+				return err
+			}
+			pipe.HSet(r.ctx, metaKey(sessionID), "main_file", workspace.MainFile)
+			pipe.HDel(r.ctx, metaKey(sessionID), "language")
+			pipe.Del(r.ctx, legacyCodeKey(sessionID), legacyBlameKey(sessionID))
+			r.touchSession(pipe, sessionID)
+			return nil
+		})
+		return err
+	}, metaKey(sessionID))
+}
+
+// migrateAnchorIndex indexes the comments and suggestions of a session from
+// before commits read them by path.
+func (r *RedisService) migrateAnchorIndex(sessionID string) error {
+	return r.watch(func(tx *redis.Tx) error {
+		meta, err := tx.HGetAll(r.ctx, metaKey(sessionID)).Result()
+		if err != nil {
+			return err
+		}
+		if len(meta) == 0 || meta["anchor_index"] != "" {
+			// Gone, or someone else migrated it first
+			return nil
+		}
+
+		comments, err := r.getComments(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		suggestions, err := r.getSuggestions(tx, sessionID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			for i := range comments {
+				if err := r.setComment(pipe, &comments[i]); err != nil {
+					return err
+				}
+			}
+			for i := range suggestions {
+				if err := r.setSuggestion(pipe, &suggestions[i]); err != nil {
+					return err
+				}
+			}
+			pipe.HSet(r.ctx, metaKey(sessionID), "anchor_index", 1)
+			r.touchSession(pipe, sessionID)
+			return nil
+		})
+		return err
+	}, metaKey(sessionID), commentsKey(sessionID), suggestionsKey(sessionID))
+}
+
+// upgradeLegacySession fills in what blobs written before roles existed
+// lack: everyone who was present becomes an editor, and the first of them
+// the owner.
+func upgradeLegacySession(session *models.Session) {
+	if session.DefaultRole == "" {
+		session.DefaultRole = models.RoleEditor
+	}
+	if session.Roles == nil {
+		session.Roles = make(map[string]models.Role)
+	}
+	if session.OwnerID == "" && len(session.Users) > 0 {
+		session.OwnerID = session.Users[0].ID
+	}
+	if session.OwnerID != "" {
+		session.Roles[session.OwnerID] = models.RoleOwner
+	}
+
+	for i, user := range session.Users {
+		role, ok := session.Roles[user.ID]
+		if !ok {
+			role = models.RoleEditor
+			session.Roles[user.ID] = role
+		}
+		session.Users[i].Role = role
+	}
+}
+
+// MigrateLegacySessions migrates every session still stored in a legacy
+// format: as a single blob, or with a single file instead of a workspace.
+// Sessions are also migrated lazily on first access, so this only saves that
+// first request the work.
+func (r *RedisService) MigrateLegacySessions() (int, error) {
+	count := 0
+	iter := r.client.ScanType(r.ctx, 0, "session:*", 100, "string").Iterator()
+	for iter.Next(r.ctx) {
+		sessionID := strings.TrimPrefix(iter.Val(), "session:")
+		if strings.Contains(sessionID, ":") {
+			// A per-session key such as the event sequence, not a session
+			continue
+		}
+
+		migrated, err := r.migrateLegacySession(sessionID)
+		if err != nil {
+			return count, err
+		}
+		if migrated {
+			count++
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return count, err
+	}
+
+	iter = r.client.ScanType(r.ctx, 0, "session:*:meta", 100, "hash").Iterator()
+	for iter.Next(r.ctx) {
+		sessionID := strings.TrimSuffix(strings.TrimPrefix(iter.Val(), "session:"), ":meta")
+		mainFile, err := r.client.HGet(r.ctx, iter.Val(), "main_file").Result()
+		if err != nil && err != redis.Nil {
+			return count, err
+		}
+		if mainFile != "" {
+			continue
+		}
+
+		if err := r.migrateSingleFileSession(sessionID); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, iter.Err()
+}
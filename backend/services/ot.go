@@ -0,0 +1,224 @@
+package services
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"codestream/models"
+)
+
+// Operational transform over retain/insert/delete component lists, in the
+// style of ot.js. Positions are rune offsets and a trailing retain is
+// implicit, so an empty operation is the identity.
+
+func ValidateOps(ops []models.OpComponent) error {
+	for i, c := range ops {
+		if err := c.Validate(); err != nil {
+			return fmt.Errorf("invalid op component at index %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func ApplyOps(doc string, ops []models.OpComponent) (string, error) {
+	src := []rune(doc)
+	out := make([]rune, 0, len(src))
+	pos := 0
+
+	for _, c := range ops {
+		switch {
+		case c.Retain > 0:
+			if pos+c.Retain > len(src) {
+				return "", fmt.Errorf("retain past end of document")
+			}
+			out = append(out, src[pos:pos+c.Retain]...)
+			pos += c.Retain
+		case c.Insert != "":
+			out = append(out, []rune(c.Insert)...)
+		case c.Delete > 0:
+			if pos+c.Delete > len(src) {
+				return "", fmt.Errorf("delete past end of document")
+			}
+			pos += c.Delete
+		}
+	}
+
+	out = append(out, src[pos:]...)
+	return string(out), nil
+}
+
+// TransformOps takes two operations made against the same document and
+// returns a' and b' such that applying a then b' equals applying b then a'.
+// When both insert at the same position, a's text goes first.
+func TransformOps(a, b []models.OpComponent) ([]models.OpComponent, []models.OpComponent) {
+	var aPrime, bPrime opBuilder
+	ia, ib := opIter{ops: a}, opIter{ops: b}
+	ca, cb := ia.next(), ib.next()
+
+	for ca != nil || cb != nil {
+		if ca != nil && ca.Insert != "" {
+			aPrime.insert(ca.Insert)
+			bPrime.retain(utf8.RuneCountInString(ca.Insert))
+			ca = ia.next()
+			continue
+		}
+		if cb != nil && cb.Insert != "" {
+			aPrime.retain(utf8.RuneCountInString(cb.Insert))
+			bPrime.insert(cb.Insert)
+			cb = ib.next()
+			continue
+		}
+
+		// Past the end of one operation the other is implicitly retained.
+		if ca == nil {
+			if cb.Delete > 0 {
+				bPrime.delete(cb.Delete)
+			} else {
+				bPrime.retain(cb.Retain)
+			}
+			cb = ib.next()
+			continue
+		}
+		if cb == nil {
+			if ca.Delete > 0 {
+				aPrime.delete(ca.Delete)
+			} else {
+				aPrime.retain(ca.Retain)
+			}
+			ca = ia.next()
+			continue
+		}
+
+		n := min(ca.Retain+ca.Delete, cb.Retain+cb.Delete)
+		switch {
+		case ca.Retain > 0 && cb.Retain > 0:
+			aPrime.retain(n)
+			bPrime.retain(n)
+		case ca.Delete > 0 && cb.Retain > 0:
+			aPrime.delete(n)
+		case ca.Retain > 0 && cb.Delete > 0:
+			bPrime.delete(n)
+		}
+		// Both deleting the same text: neither side has anything left to do.
+
+		ca = ia.consume(ca, n)
+		cb = ib.consume(cb, n)
+	}
+
+	return aPrime.finish(), bPrime.finish()
+}
+
+// ReplaceOps builds the smallest single-edit operation turning oldDoc into
+// newDoc by trimming their common prefix and suffix.
+func ReplaceOps(oldDoc, newDoc string) []models.OpComponent {
+	o, n := []rune(oldDoc), []rune(newDoc)
+
+	prefix := 0
+	for prefix < len(o) && prefix < len(n) && o[prefix] == n[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(o)-prefix && suffix < len(n)-prefix && o[len(o)-1-suffix] == n[len(n)-1-suffix] {
+		suffix++
+	}
+
+	var b opBuilder
+	b.retain(prefix)
+	b.delete(len(o) - prefix - suffix)
+	b.insert(string(n[prefix : len(n)-suffix]))
+	return b.finish()
+}
+
+type opIter struct {
+	ops []models.OpComponent
+	i   int
+}
+
+func (it *opIter) next() *models.OpComponent {
+	if it.i >= len(it.ops) {
+		return nil
+	}
+	c := it.ops[it.i]
+	it.i++
+	return &c
+}
+
+// consume shortens c by n runes, advancing to the next component once c is
+// used up.
+func (it *opIter) consume(c *models.OpComponent, n int) *models.OpComponent {
+	if c.Retain > 0 {
+		c.Retain -= n
+		if c.Retain > 0 {
+			return c
+		}
+	} else {
+		c.Delete -= n
+		if c.Delete > 0 {
+			return c
+		}
+	}
+	return it.next()
+}
+
+type opBuilder struct {
+	ops []models.OpComponent
+}
+
+func (b *opBuilder) last() *models.OpComponent {
+	if len(b.ops) == 0 {
+		return nil
+	}
+	return &b.ops[len(b.ops)-1]
+}
+
+func (b *opBuilder) retain(n int) {
+	if n <= 0 {
+		return
+	}
+	if l := b.last(); l != nil && l.Retain > 0 {
+		l.Retain += n
+		return
+	}
+	b.ops = append(b.ops, models.OpComponent{Retain: n})
+}
+
+func (b *opBuilder) insert(s string) {
+	if s == "" {
+		return
+	}
+	if l := b.last(); l != nil && l.Insert != "" {
+		l.Insert += s
+		return
+	}
+	// Keep inserts ahead of deletes so equivalent operations compare equal.
+	if l := b.last(); l != nil && l.Delete > 0 {
+		d := *l
+		b.ops = b.ops[:len(b.ops)-1]
+		b.insert(s)
+		b.ops = append(b.ops, d)
+		return
+	}
+	b.ops = append(b.ops, models.OpComponent{Insert: s})
+}
+
+func (b *opBuilder) delete(n int) {
+	if n <= 0 {
+		return
+	}
+	if l := b.last(); l != nil && l.Delete > 0 {
+		l.Delete += n
+		return
+	}
+	b.ops = append(b.ops, models.OpComponent{Delete: n})
+}
+
+func (b *opBuilder) finish() []models.OpComponent {
+	ops := b.ops
+	if len(ops) > 0 && ops[len(ops)-1].Retain > 0 {
+		ops = ops[:len(ops)-1]
+	}
+	if ops == nil {
+		ops = []models.OpComponent{}
+	}
+	return ops
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"math/rand"
+	"testing"
+	"unicode/utf8"
+
+	"codestream/models"
+)
+
+func retain(n int) models.OpComponent    { return models.OpComponent{Retain: n} }
+func insert(s string) models.OpComponent { return models.OpComponent{Insert: s} }
+func del(n int) models.OpComponent       { return models.OpComponent{Delete: n} }
+
+func ops(components ...models.OpComponent) []models.OpComponent { return components }
+
+func TestApplyOps(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		ops  []models.OpComponent
+		want string
+	}{
+		{"empty operation", "abc", nil, "abc"},
+		{"implicit trailing retain", "abcdef", ops(retain(1), del(2)), "adef"},
+		{"explicit full retain", "abc", ops(retain(3), insert("!")), "abc!"},
+		{"insert into empty", "", ops(insert("hi")), "hi"},
+		{"multi-byte runes", "héllo wörld", ops(retain(1), del(1), insert("e"), retain(5), del(1), insert("o")), "hello world"},
+		{"astral runes", "🙂🙃🙂", ops(retain(1), del(1), insert("x")), "🙂x🙂"},
+		// A surrogate pair in UTF-16 is a single position
+		{"surrogate pair", "a🙂b", ops(retain(2), insert("x"), del(1)), "a🙂x"},
+	}
+	for _, tt := range tests {
+		got, err := ApplyOps(tt.doc, tt.ops)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Fatalf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := ApplyOps("abc", ops(retain(4))); err == nil {
+		t.Fatal("retain past the end applied")
+	}
+	if _, err := ApplyOps("🙂", ops(del(2))); err == nil {
+		t.Fatal("delete of both halves of a surrogate pair applied")
+	}
+}
+
+// Both orders of applying two concurrent operations, each transformed
+// against the other, reach the same document.
+func TestTransformOpsConverges(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		a, b []models.OpComponent
+		want string
+	}{
+		{"inserts at the same position put a first", "abc", ops(retain(1), insert("X")), ops(retain(1), insert("Y")), "aXYbc"},
+		{"inserts at the start tie the same way", "abc", ops(insert("X")), ops(insert("Y")), "XYabc"},
+		{"inserts at either end", "abc", ops(insert("<")), ops(retain(3), insert(">")), "<abc>"},
+		{"overlapping deletes", "abcdef", ops(retain(1), del(3)), ops(retain(2), del(3)), "af"},
+		{"nested deletes", "abcdef", ops(retain(1), del(4)), ops(retain(2), del(1)), "af"},
+		{"identical deletes", "abcd", ops(retain(1), del(2)), ops(retain(1), del(2)), "ad"},
+		{"insert inside a deleted range", "abcdef", ops(retain(1), del(4)), ops(retain(3), insert("X")), "aXf"},
+		{"insert at the edge of a deleted range", "abcdef", ops(retain(1), del(2)), ops(retain(3), insert("X")), "aXdef"},
+		{"multi-byte runes", "héllo wörld", ops(retain(1), del(1), insert("e")), ops(retain(7), del(1), insert("o")), "hello world"},
+		{"astral runes", "🙂🙃", ops(retain(1), insert("x")), ops(del(1)), "x🙃"},
+		{"implicit trailing retain", "abcdef", ops(insert("X")), ops(retain(4), del(2)), "Xabcd"},
+		{"empty operation", "abc", nil, ops(retain(2), insert("!")), "ab!c"},
+	}
+	for _, tt := range tests {
+		got := converge(t, tt.doc, tt.a, tt.b)
+		if got != tt.want {
+			t.Fatalf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTransformOpsConvergesOnRandomEdits(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	alphabet := []rune("ab é🙂\n")
+	randomText := func(n int) string {
+		text := make([]rune, n)
+		for i := range text {
+			text[i] = alphabet[rng.Intn(len(alphabet))]
+		}
+		return string(text)
+	}
+	randomOps := func(doc string) []models.OpComponent {
+		var b opBuilder
+		for left := utf8.RuneCountInString(doc); left > 0; {
+			n := 1 + rng.Intn(left)
+			switch rng.Intn(3) {
+			case 0:
+				b.retain(n)
+				left -= n
+			case 1:
+				b.delete(n)
+				left -= n
+			default:
+				b.insert(randomText(1 + rng.Intn(3)))
+			}
+		}
+		if rng.Intn(2) == 0 {
+			b.insert(randomText(1 + rng.Intn(3)))
+		}
+		return b.finish()
+	}
+
+	for i := 0; i < 2000; i++ {
+		doc := randomText(rng.Intn(12))
+		converge(t, doc, randomOps(doc), randomOps(doc))
+	}
+}
+
+// converge applies a then b' and b then a' to doc, fails the test unless
+// they agree and returns the result.
+func converge(t *testing.T, doc string, a, b []models.OpComponent) string {
+	t.Helper()
+	aPrime, bPrime := TransformOps(a, b)
+	if err := ValidateOps(aPrime); err != nil {
+		t.Fatalf("a' of %v and %v: %v", a, b, err)
+	}
+	if err := ValidateOps(bPrime); err != nil {
+		t.Fatalf("b' of %v and %v: %v", a, b, err)
+	}
+
+	apply := func(doc string, ops []models.OpComponent) string {
+		t.Helper()
+		out, err := ApplyOps(doc, ops)
+		if err != nil {
+			t.Fatalf("applying %v to %q: %v", ops, doc, err)
+		}
+		return out
+	}
+	ab := apply(apply(doc, a), bPrime)
+	ba := apply(apply(doc, b), aPrime)
+	if ab != ba {
+		t.Fatalf("%v and %v on %q diverged: %q then b' but %q then a'", a, b, doc, ab, ba)
+	}
+	return ab
+}
@@ -3,9 +3,14 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -13,9 +18,28 @@ import (
 	"codestream/models"
 )
 
+// defaultSessionTTL is how long a session is kept after its last write,
+// unless SESSION_TTL says otherwise.
+const defaultSessionTTL = 24 * time.Hour
+
+// maxTxRetries bounds how often an optimistic transaction is retried when
+// its watched keys keep changing.
+const maxTxRetries = 100
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrNotParticipant  = errors.New("user is not a participant")
+	ErrForbidden       = errors.New("not allowed for this role")
+	ErrInviteNotFound  = errors.New("invite not found")
+	ErrContention      = errors.New("too many concurrent writes, try again")
+)
+
+// RedisService is the SessionStore for multi-instance deployments: sessions
+// live in Redis and broadcasts fan out over Redis pub/sub.
 type RedisService struct {
 	client *redis.Client
 	ctx    context.Context
+	ttl    time.Duration
 }
 
 func NewRedisService() *RedisService {
@@ -39,9 +63,19 @@ func NewRedisService() *RedisService {
 		log.Println("Connected to Redis successfully")
 	}
 
+	ttl := defaultSessionTTL
+	if v := os.Getenv("SESSION_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			ttl = d
+		} else {
+			log.Printf("Invalid SESSION_TTL %q, keeping sessions for %s", v, ttl)
+		}
+	}
+
 	return &RedisService{
 		client: client,
 		ctx:    ctx,
+		ttl:    ttl,
 	}
 }
 
@@ -50,115 +84,1895 @@ func (r *RedisService) Close() error {
 }
 
 // Session management
+//
+// A session is split across keys so that each write only touches what it
+// changes:
+//
+//	session:{id}:meta      hash of revision, main file, owner and other
+//	                       metadata
+//	session:{id}:files     hash of path to file JSON: language and code
+//	session:{id}:roles     hash of user ID to role, for everyone ever admitted
+//	session:{id}:users     hash of user ID to user JSON, for who is present
+//	session:{id}:presence  hash of user ID to the presence they last sent
+//	session:{id}:conns     hash of connection ID to user ID, for every open
+//	                       connection
+//
+// Who wrote each line of a file is kept apart from its code, in the
+// session:{id}:file_blame hash by path, so reading a session doesn't decode
+// it.
+//
+// Alongside them, session:{id}:history is a stream of the session's changes
+// and session:{id}:snapshots a list of snapshots of its content, from which
+// the code can be rebuilt. session:{id}:comments and
+// session:{id}:suggestions hash the session's comments and suggestions by
+// ID, and session:{id}:comment_index and session:{id}:suggestion_index
+// index the comments and pending suggestions an edit can move, as sorted
+// sets of "{path}\x00{ID}", so a commit reads only those on the path it
+// changes. session:{id}:review holds the session's review as JSON. session:{id}:chat
+// is a sorted set of chat messages scored by their ID, the last of which
+// is in session:{id}:chat_seq.
+//
+// Every write re-arms the TTL of all of these so a session expires as a
+// whole, SESSION_TTL after it was last written to.
+//
+// The connections of every session are leased in connections:leases, a
+// sorted set of "{id}/{connection ID}" scored by when the lease runs out.
+func metaKey(sessionID string) string        { return fmt.Sprintf("session:%s:meta", sessionID) }
+func filesKey(sessionID string) string       { return fmt.Sprintf("session:%s:files", sessionID) }
+func blameKey(sessionID string) string       { return fmt.Sprintf("session:%s:file_blame", sessionID) }
+func rolesKey(sessionID string) string       { return fmt.Sprintf("session:%s:roles", sessionID) }
+func usersKey(sessionID string) string       { return fmt.Sprintf("session:%s:users", sessionID) }
+func historyKey(sessionID string) string     { return fmt.Sprintf("session:%s:history", sessionID) }
+func snapshotsKey(sessionID string) string   { return fmt.Sprintf("session:%s:snapshots", sessionID) }
+func commentsKey(sessionID string) string    { return fmt.Sprintf("session:%s:comments", sessionID) }
+func suggestionsKey(sessionID string) string { return fmt.Sprintf("session:%s:suggestions", sessionID) }
+func reviewKey(sessionID string) string      { return fmt.Sprintf("session:%s:review", sessionID) }
+func chatKey(sessionID string) string        { return fmt.Sprintf("session:%s:chat", sessionID) }
+func chatSeqKey(sessionID string) string     { return fmt.Sprintf("session:%s:chat_seq", sessionID) }
+func presenceKey(sessionID string) string    { return fmt.Sprintf("session:%s:presence", sessionID) }
+func connsKey(sessionID string) string       { return fmt.Sprintf("session:%s:conns", sessionID) }
+
+func commentIndexKey(sessionID string) string {
+	return fmt.Sprintf("session:%s:comment_index", sessionID)
+}
+
+func suggestionIndexKey(sessionID string) string {
+	return fmt.Sprintf("session:%s:suggestion_index", sessionID)
+}
+
+const leasesKey = "connections:leases"
+
+func leaseMember(sessionID, connID string) string { return sessionID + "/" + connID }
+
 func (r *RedisService) CreateSession(session *models.Session) error {
-	sessionJSON, err := json.Marshal(session)
+	_, err := r.client.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		return r.writeSession(pipe, session)
+	})
+	return err
+}
+
+func (r *RedisService) GetSession(sessionID string) (*models.Session, error) {
+	return r.getSession(r.client, sessionID)
+}
+
+func (r *RedisService) getSession(c redis.Cmdable, sessionID string) (*models.Session, error) {
+	var meta, files, roles, users *redis.MapStringStringCmd
+	_, err := c.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		meta = pipe.HGetAll(r.ctx, metaKey(sessionID))
+		files = pipe.HGetAll(r.ctx, filesKey(sessionID))
+		roles = pipe.HGetAll(r.ctx, rolesKey(sessionID))
+		users = pipe.HGetAll(r.ctx, usersKey(sessionID))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	if len(meta.Val()) == 0 {
+		migrated, err := r.migrateLegacySession(sessionID)
+		if err != nil {
+			return nil, err
+		}
+		if !migrated {
+			return nil, ErrSessionNotFound
+		}
+		return r.getSession(c, sessionID)
+	}
+	if meta.Val()["main_file"] == "" {
+		if err := r.migrateSingleFileSession(sessionID); err != nil {
+			return nil, err
+		}
+		return r.getSession(c, sessionID)
+	}
+	if meta.Val()["anchor_index"] == "" {
+		if err := r.migrateAnchorIndex(sessionID); err != nil {
+			return nil, err
+		}
+		return r.getSession(c, sessionID)
+	}
+
+	session := &models.Session{
+		ID:          sessionID,
+		OwnerID:     meta.Val()["owner_id"],
+		DefaultRole: models.Role(meta.Val()["default_role"]),
+		Users:       make([]models.User, 0, len(users.Val())),
+		Roles:       make(map[string]models.Role, len(roles.Val())),
+	}
+	if session.Revision, err = strconv.Atoi(meta.Val()["revision"]); err != nil {
+		return nil, fmt.Errorf("invalid revision for session %s: %w", sessionID, err)
+	}
+	if session.CreatedAt, err = time.Parse(time.RFC3339Nano, meta.Val()["created_at"]); err != nil {
+		return nil, fmt.Errorf("invalid created_at for session %s: %w", sessionID, err)
+	}
+
+	for userID, role := range roles.Val() {
+		session.Roles[userID] = models.Role(role)
+	}
+	for _, data := range users.Val() {
+		var user models.User
+		if err := json.Unmarshal([]byte(data), &user); err != nil {
+			return nil, err
+		}
+		session.Users = append(session.Users, user)
+	}
+	sort.Slice(session.Users, func(i, j int) bool {
+		return session.Users[i].ID < session.Users[j].ID
+	})
+
+	session.MainFile = meta.Val()["main_file"]
+	for path, data := range files.Val() {
+		var file redisFile
+		if err := json.Unmarshal([]byte(data), &file); err != nil {
+			return nil, err
+		}
+		session.Files = append(session.Files, models.File{Path: path, Language: file.Language, Code: file.Code})
+	}
+	sort.Slice(session.Files, func(i, j int) bool {
+		return session.Files[i].Path < session.Files[j].Path
+	})
+	session.Code, session.Language = mainContent(&session.Workspace)
+
+	return session, nil
+}
+
+// redisFile is a file as kept in the files hash, under its path. Blame is
+// only set on files written before it moved to a hash of its own.
+type redisFile struct {
+	Language string             `json:"language"`
+	Code     string             `json:"code"`
+	Blame    []models.LineBlame `json:"blame,omitempty"`
+}
+
+func (r *RedisService) setFile(pipe redis.Pipeliner, sessionID string, file *models.File, blame []models.LineBlame) error {
+	fileJSON, err := json.Marshal(redisFile{Language: file.Language, Code: file.Code})
+	if err != nil {
+		return err
+	}
+	blameJSON, err := json.Marshal(blame)
 	if err != nil {
 		return err
 	}
 
-	key := fmt.Sprintf("session:%s", session.ID)
-	return r.client.Set(r.ctx, key, sessionJSON, 24*time.Hour).Err()
+	pipe.HSet(r.ctx, filesKey(sessionID), file.Path, fileJSON)
+	pipe.HSet(r.ctx, blameKey(sessionID), file.Path, blameJSON)
+	return nil
 }
 
-func (r *RedisService) GetSession(sessionID string) (*models.Session, error) {
-	key := fmt.Sprintf("session:%s", sessionID)
-	data, err := r.client.Get(r.ctx, key).Result()
+// getBlame reads who wrote each line of the file at path.
+func (r *RedisService) getBlame(c redis.Cmdable, sessionID, path string) ([]models.LineBlame, error) {
+	data, err := c.HGet(r.ctx, blameKey(sessionID), path).Result()
+	if err == redis.Nil {
+		file, err := r.getFile(c, sessionID, path)
+		if err != nil || file == nil {
+			return nil, err
+		}
+		return file.Blame, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlame(data)
+}
+
+// getFile reads the stored file at path, or nil if there is none.
+func (r *RedisService) getFile(c redis.Cmdable, sessionID, path string) (*redisFile, error) {
+	data, err := c.HGet(r.ctx, filesKey(sessionID), path).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	var session models.Session
-	if err := json.Unmarshal([]byte(data), &session); err != nil {
+	var file redisFile
+	if err := json.Unmarshal([]byte(data), &file); err != nil {
 		return nil, err
 	}
+	return &file, nil
+}
+
+// writeSession queues every key of session, replacing what was stored, and
+// starts its history afresh from a snapshot of it. Sessions without a
+// workspace are given one holding their code.
+func (r *RedisService) writeSession(pipe redis.Pipeliner, session *models.Session) error {
+	initWorkspace(session)
+	pipe.HDel(r.ctx, metaKey(session.ID), "language")
+	pipe.HSet(r.ctx, metaKey(session.ID),
+		"revision", session.Revision,
+		"main_file", session.MainFile,
+		"created_at", session.CreatedAt.Format(time.RFC3339Nano),
+		"owner_id", session.OwnerID,
+		"default_role", string(session.DefaultRole),
+		"anchor_index", 1,
+	)
+	pipe.Del(r.ctx, filesKey(session.ID), blameKey(session.ID), legacyCodeKey(session.ID), legacyBlameKey(session.ID))
+	for i := range session.Files {
+		if err := r.setFile(pipe, session.ID, &session.Files[i], initialBlame(session, &session.Files[i])); err != nil {
+			return err
+		}
+	}
+
+	pipe.Del(r.ctx, rolesKey(session.ID), usersKey(session.ID), presenceKey(session.ID), connsKey(session.ID))
+	for userID, role := range session.Roles {
+		pipe.HSet(r.ctx, rolesKey(session.ID), userID, string(role))
+	}
+	for _, user := range session.Users {
+		if err := r.setUser(pipe, session.ID, user); err != nil {
+			return err
+		}
+	}
+
+	pipe.Del(r.ctx, historyKey(session.ID), snapshotsKey(session.ID), commentsKey(session.ID), commentIndexKey(session.ID), suggestionsKey(session.ID), suggestionIndexKey(session.ID), reviewKey(session.ID), chatKey(session.ID), chatSeqKey(session.ID))
+	snapshotJSON, err := json.Marshal(newSnapshot(session, firstEntryID.String()))
+	if err != nil {
+		return err
+	}
+	pipe.RPush(r.ctx, snapshotsKey(session.ID), snapshotJSON)
 
-	return &session, nil
+	r.touchSession(pipe, session.ID)
+	return nil
 }
 
-func (r *RedisService) UpdateSession(session *models.Session) error {
-	sessionJSON, err := json.Marshal(session)
+func (r *RedisService) setUser(pipe redis.Pipeliner, sessionID string, user models.User) error {
+	userJSON, err := json.Marshal(user)
 	if err != nil {
 		return err
 	}
 
-	key := fmt.Sprintf("session:%s", session.ID)
-	return r.client.Set(r.ctx, key, sessionJSON, 24*time.Hour).Err()
+	pipe.HSet(r.ctx, usersKey(sessionID), user.ID, userJSON)
+	return nil
 }
 
-func (r *RedisService) AddUserToSession(sessionID string, user models.User) error {
-	session, err := r.GetSession(sessionID)
+// touchSession re-arms the TTL of every key making up the session.
+func (r *RedisService) touchSession(pipe redis.Pipeliner, sessionID string) {
+	for _, key := range []string{metaKey(sessionID), filesKey(sessionID), blameKey(sessionID), rolesKey(sessionID), usersKey(sessionID), presenceKey(sessionID), connsKey(sessionID), historyKey(sessionID), snapshotsKey(sessionID), commentsKey(sessionID), commentIndexKey(sessionID), suggestionsKey(sessionID), suggestionIndexKey(sessionID), reviewKey(sessionID), chatKey(sessionID), chatSeqKey(sessionID)} {
+		pipe.Expire(r.ctx, key, r.ttl)
+	}
+}
+
+// ensureSession returns ErrSessionNotFound unless the session exists,
+// migrating it from the legacy format if needed.
+func (r *RedisService) ensureSession(c redis.Cmdable, sessionID string) error {
+	n, err := c.Exists(r.ctx, metaKey(sessionID)).Result()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	migrated, err := r.migrateLegacySession(sessionID)
 	if err != nil {
 		return err
 	}
+	if !migrated {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// watch runs fn in a WATCH on keys, retrying with a short random backoff
+// while another writer changes them before fn's transaction executes.
+func (r *RedisService) watch(fn func(tx *redis.Tx) error, keys ...string) error {
+	for attempt := 0; attempt < maxTxRetries; attempt++ {
+		err := r.client.Watch(r.ctx, fn, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+		time.Sleep(time.Duration(rand.Int63n(int64(attempt+1) * int64(time.Millisecond))))
+	}
+	return ErrContention
+}
+
+func (r *RedisService) RestoreSession(archived *models.ArchivedSession) error {
+	session, ops := &archived.Session, trimOps(archived.Ops)
+
+	opsKey := fmt.Sprintf("session:%s:ops", session.ID)
+	_, err := r.client.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		if err := r.writeSession(pipe, session); err != nil {
+			return err
+		}
+
+		pipe.Del(r.ctx, opsKey)
+		for _, record := range ops {
+			recordJSON, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			pipe.RPush(r.ctx, opsKey, recordJSON)
+		}
+		pipe.Expire(r.ctx, opsKey, r.ttl)
+
+		for i := range archived.Comments {
+			if err := r.setComment(pipe, &archived.Comments[i]); err != nil {
+				return err
+			}
+		}
+		for i := range archived.Suggestions {
+			if err := r.setSuggestion(pipe, &archived.Suggestions[i]); err != nil {
+				return err
+			}
+		}
+		if archived.Review != nil {
+			reviewJSON, err := json.Marshal(archived.Review)
+			if err != nil {
+				return err
+			}
+			pipe.Set(r.ctx, reviewKey(session.ID), reviewJSON, r.ttl)
+		}
+		for _, message := range archived.Messages {
+			messageJSON, err := json.Marshal(message)
+			if err != nil {
+				return err
+			}
+			pipe.ZAdd(r.ctx, chatKey(session.ID), redis.Z{Score: float64(message.ID), Member: messageJSON})
+		}
+		if n := len(archived.Messages); n > 0 {
+			pipe.Set(r.ctx, chatSeqKey(session.ID), archived.Messages[n-1].ID, r.ttl)
+		}
+		pipe.ZRemRangeByRank(r.ctx, chatKey(session.ID), 0, -maxChatHistory-1)
+		// Keys created since writeSession touched the session need their TTL
+		r.touchSession(pipe, session.ID)
 
-	// Check if user already in session
-	for _, u := range session.Users {
-		if u.ID == user.ID {
+		if len(archived.Snapshots) == 0 {
 			return nil
 		}
+		return r.restoreHistory(pipe, session.ID, archived)
+	})
+	return err
+}
+
+// restoreHistory replaces the fresh snapshot writeSession queued with an
+// archived change log and snapshots, keeping their original entry IDs.
+func (r *RedisService) restoreHistory(pipe redis.Pipeliner, sessionID string, archived *models.ArchivedSession) error {
+	pipe.Del(r.ctx, snapshotsKey(sessionID))
+	for _, snapshot := range archived.Snapshots {
+		snapshotJSON, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+		pipe.RPush(r.ctx, snapshotsKey(sessionID), snapshotJSON)
 	}
+	pipe.Expire(r.ctx, snapshotsKey(sessionID), r.ttl)
 
-	session.Users = append(session.Users, user)
-	return r.UpdateSession(session)
+	for _, entry := range archived.History {
+		if _, err := r.addHistory(pipe, sessionID, entry); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (r *RedisService) RemoveUserFromSession(sessionID, userID string) error {
-	session, err := r.GetSession(sessionID)
+// AdmitUser gives user a role in the session. Participants keep their role;
+// newcomers are given role, and rejected with ErrNotParticipant if it is
+// empty. The returned user carries their role.
+func (r *RedisService) AdmitUser(sessionID string, user models.User, role models.Role) (*models.User, error) {
+	invitedRole := role
+	err := r.watch(func(tx *redis.Tx) error {
+		if err := r.ensureSession(tx, sessionID); err != nil {
+			return err
+		}
+
+		existing, err := tx.HGet(r.ctx, rolesKey(sessionID), user.ID).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		role, err = admissionRole(models.Role(existing), invitedRole)
+		if err != nil {
+			return err
+		}
+		user.Role = role
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(r.ctx, rolesKey(sessionID), user.ID, string(role))
+			r.touchSession(pipe, sessionID)
+			return nil
+		})
+		return err
+	}, rolesKey(sessionID))
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// SetRole changes a participant's role. The owner's role can't be changed.
+func (r *RedisService) SetRole(sessionID, userID string, role models.Role) error {
+	return r.watch(func(tx *redis.Tx) error {
+		session, err := r.getSession(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		if err := checkRemovable(session, userID); err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(r.ctx, rolesKey(sessionID), userID, string(role))
+			for _, user := range session.Users {
+				if user.ID == userID {
+					user.Role = role
+					if err := r.setUser(pipe, sessionID, user); err != nil {
+						return err
+					}
+				}
+			}
+			r.touchSession(pipe, sessionID)
+			return nil
+		})
+		return err
+	}, rolesKey(sessionID), usersKey(sessionID))
+}
+
+// RemoveParticipant drops a participant's role and presence, recording that
+// they left if they were present. The owner can't be removed.
+func (r *RedisService) RemoveParticipant(sessionID, userID string) error {
+	return r.watch(func(tx *redis.Tx) error {
+		session, err := r.getSession(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		if err := checkRemovable(session, userID); err != nil {
+			return err
+		}
+
+		conns, err := tx.HGetAll(r.ctx, connsKey(sessionID)).Result()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(r.ctx, rolesKey(sessionID), userID)
+			pipe.HDel(r.ctx, usersKey(sessionID), userID)
+			pipe.HDel(r.ctx, presenceKey(sessionID), userID)
+			for connID, connUserID := range conns {
+				if connUserID == userID {
+					pipe.HDel(r.ctx, connsKey(sessionID), connID)
+					pipe.ZRem(r.ctx, leasesKey, leaseMember(sessionID, connID))
+				}
+			}
+			if isPresent(session, userID) {
+				if _, err := r.addHistory(pipe, sessionID, presenceEntry(models.HistoryLeave, userID, session.Revision)); err != nil {
+					return err
+				}
+			}
+			r.touchSession(pipe, sessionID)
+			return nil
+		})
+		return err
+	}, rolesKey(sessionID), connsKey(sessionID))
+}
+
+func (r *RedisService) Connect(sessionID string, user models.User, connID string) (bool, error) {
+	var first bool
+	err := r.watch(func(tx *redis.Tx) error {
+		if err := r.ensureSession(tx, sessionID); err != nil {
+			return err
+		}
+
+		role, err := tx.HGet(r.ctx, rolesKey(sessionID), user.ID).Result()
+		if err == redis.Nil {
+			return ErrNotParticipant
+		}
+		if err != nil {
+			return err
+		}
+		user.Role = models.Role(role)
+
+		conns, err := tx.HVals(r.ctx, connsKey(sessionID)).Result()
+		if err != nil {
+			return err
+		}
+		first = true
+		for _, connUserID := range conns {
+			if connUserID == user.ID {
+				first = false
+			}
+		}
+		revision, err := tx.HGet(r.ctx, metaKey(sessionID), "revision").Int()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			if err := r.setUser(pipe, sessionID, user); err != nil {
+				return err
+			}
+			pipe.HSet(r.ctx, connsKey(sessionID), connID, user.ID)
+			pipe.ZAdd(r.ctx, leasesKey, redis.Z{
+				Score:  float64(time.Now().Add(ConnectionLease).UnixMilli()),
+				Member: leaseMember(sessionID, connID),
+			})
+			if first {
+				if _, err := r.addHistory(pipe, sessionID, presenceEntry(models.HistoryJoin, user.ID, revision)); err != nil {
+					return err
+				}
+			}
+			r.touchSession(pipe, sessionID)
+			return nil
+		})
+		return err
+	}, rolesKey(sessionID), connsKey(sessionID))
+	return first, err
+}
+
+func (r *RedisService) Disconnect(sessionID, connID string) (bool, error) {
+	_, left, err := r.disconnect(sessionID, connID, time.Time{})
+	return left, err
+}
+
+// disconnect drops connID and, if it was its user's last connection, the
+// user's presence. It returns the user and whether they left. Unless
+// expiredBy is zero, connID is only dropped if its lease ran out by then.
+func (r *RedisService) disconnect(sessionID, connID string, expiredBy time.Time) (string, bool, error) {
+	var userID string
+	var left bool
+	member := leaseMember(sessionID, connID)
+	keys := []string{connsKey(sessionID)}
+	if !expiredBy.IsZero() {
+		keys = append(keys, leasesKey)
+	}
+	err := r.watch(func(tx *redis.Tx) error {
+		userID, left = "", false
+		if !expiredBy.IsZero() {
+			expires, err := tx.ZScore(r.ctx, leasesKey, member).Result()
+			if err == redis.Nil || (err == nil && expires > float64(expiredBy.UnixMilli())) {
+				// Renewed or dropped since it was seen expired
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		conns, err := tx.HGetAll(r.ctx, connsKey(sessionID)).Result()
+		if err != nil {
+			return err
+		}
+		connUserID, ok := conns[connID]
+		if !ok {
+			return tx.ZRem(r.ctx, leasesKey, member).Err()
+		}
+		userID, left = connUserID, true
+		for id, other := range conns {
+			if id != connID && other == userID {
+				left = false
+			}
+		}
+
+		var revision int
+		if left {
+			revision, err = tx.HGet(r.ctx, metaKey(sessionID), "revision").Int()
+			if err == redis.Nil {
+				left = false
+			} else if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(r.ctx, connsKey(sessionID), connID)
+			pipe.ZRem(r.ctx, leasesKey, member)
+			if !left {
+				return nil
+			}
+			pipe.HDel(r.ctx, usersKey(sessionID), userID)
+			pipe.HDel(r.ctx, presenceKey(sessionID), userID)
+			_, err := r.addHistory(pipe, sessionID, presenceEntry(models.HistoryLeave, userID, revision))
+			return err
+		})
+		return err
+	}, keys...)
 	if err != nil {
+		return "", false, err
+	}
+	return userID, left, nil
+}
+
+func (r *RedisService) RenewConnections(sessionID string, connIDs []string) ([]string, error) {
+	if len(connIDs) == 0 {
+		return nil, nil
+	}
+
+	expires := float64(time.Now().Add(ConnectionLease).UnixMilli())
+	members := make([]redis.Z, len(connIDs))
+	for i, connID := range connIDs {
+		members[i] = redis.Z{Score: expires, Member: leaseMember(sessionID, connID)}
+	}
+
+	// Only renew leases that are still held, not ones already expired,
+	// which have left the connection hash along with the lease
+	pipe := r.client.TxPipeline()
+	pipe.ZAddXX(r.ctx, leasesKey, members...)
+	held := pipe.HMGet(r.ctx, connsKey(sessionID), connIDs...)
+	if _, err := pipe.Exec(r.ctx); err != nil {
+		return nil, err
+	}
+
+	var lost []string
+	for i, userID := range held.Val() {
+		if userID == nil {
+			lost = append(lost, connIDs[i])
+		}
+	}
+	return lost, nil
+}
+
+// ExpireConnections drops the connections of every session whose leases
+// ran out by now. Instances may race to expire the same connection, and
+// only one of them sees its user leave. Connections that fail to expire are
+// left for the next sweep, and the users who did leave are still returned.
+func (r *RedisService) ExpireConnections(now time.Time) ([]Departure, error) {
+	expired, err := r.client.ZRangeByScore(r.ctx, leasesKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var departures []Departure
+	var errs []error
+	for _, member := range expired {
+		i := strings.LastIndex(member, "/")
+		if i < 0 {
+			r.client.ZRem(r.ctx, leasesKey, member)
+			continue
+		}
+		sessionID := member[:i]
+		userID, left, err := r.disconnect(sessionID, member[i+1:], now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("connection %s: %w", member, err))
+			continue
+		}
+		if left {
+			departures = append(departures, Departure{SessionID: sessionID, UserID: userID})
+		}
+	}
+	sortDepartures(departures)
+	return departures, errors.Join(errs...)
+}
+
+func (r *RedisService) SetPresence(sessionID string, presence *models.Presence) error {
+	if err := r.ensureSession(r.client, sessionID); err != nil {
+		return err
+	}
+	presenceJSON, err := json.Marshal(presence)
+	if err != nil {
+		return err
+	}
+
+	// Watching who is present keeps a leaving user's presence from being
+	// written back after it was dropped
+	return r.watch(func(tx *redis.Tx) error {
+		present, err := tx.HExists(r.ctx, usersKey(sessionID), presence.UserID).Result()
+		if err != nil {
+			return err
+		}
+		if !present {
+			return ErrNotParticipant
+		}
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(r.ctx, presenceKey(sessionID), presence.UserID, presenceJSON)
+			pipe.Expire(r.ctx, presenceKey(sessionID), r.ttl)
+			return nil
+		})
 		return err
+	}, usersKey(sessionID))
+}
+
+func (r *RedisService) GetPresence(sessionID string) ([]models.Presence, error) {
+	data, err := r.client.HGetAll(r.ctx, presenceKey(sessionID)).Result()
+	if err != nil {
+		return nil, err
 	}
 
-	users := make([]models.User, 0)
-	for _, u := range session.Users {
-		if u.ID != userID {
-			users = append(users, u)
+	presence := make([]models.Presence, 0, len(data))
+	for _, presenceJSON := range data {
+		var p models.Presence
+		if err := json.Unmarshal([]byte(presenceJSON), &p); err != nil {
+			return nil, err
 		}
+		presence = append(presence, p)
 	}
+	sortPresence(presence)
+	return presence, nil
+}
 
-	session.Users = users
-	return r.UpdateSession(session)
+// Invites
+func (r *RedisService) SaveInvite(invite *models.Invite) error {
+	_, err := r.client.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		return r.setInvite(pipe, invite)
+	})
+	return err
 }
 
-// Pub/Sub
-func (r *RedisService) Publish(channel string, message interface{}) error {
-	messageJSON, err := json.Marshal(message)
+func (r *RedisService) setInvite(pipe redis.Pipeliner, invite *models.Invite) error {
+	inviteJSON, err := json.Marshal(invite)
 	if err != nil {
 		return err
 	}
 
-	return r.client.Publish(r.ctx, channel, messageJSON).Err()
+	key := fmt.Sprintf("session:%s:invites", invite.SessionID)
+	pipe.HSet(r.ctx, key, invite.ID, inviteJSON)
+	pipe.Expire(r.ctx, key, MaxInviteTTL)
+	return nil
 }
 
-func (r *RedisService) Subscribe(channel string) *redis.PubSub {
-	return r.client.Subscribe(r.ctx, channel)
+func (r *RedisService) GetInvite(sessionID, inviteID string) (*models.Invite, error) {
+	return r.getInvite(r.client, sessionID, inviteID)
 }
 
-// Code management
-func (r *RedisService) UpdateCode(sessionID, code string) error {
-	session, err := r.GetSession(sessionID)
+func (r *RedisService) getInvite(c redis.Cmdable, sessionID, inviteID string) (*models.Invite, error) {
+	key := fmt.Sprintf("session:%s:invites", sessionID)
+	data, err := c.HGet(r.ctx, key, inviteID).Result()
+	if err == redis.Nil {
+		return nil, ErrInviteNotFound
+	}
 	if err != nil {
+		return nil, err
+	}
+
+	var invite models.Invite
+	if err := json.Unmarshal([]byte(data), &invite); err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// UseInvite atomically counts one use of an invite, failing with
+// ErrInviteUsedUp once it has none left.
+func (r *RedisService) UseInvite(sessionID, inviteID string) (*models.Invite, error) {
+	var invite *models.Invite
+	err := r.watch(func(tx *redis.Tx) error {
+		var err error
+		invite, err = r.getInvite(tx, sessionID, inviteID)
+		if err != nil {
+			return err
+		}
+		if err := useInvite(invite); err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			return r.setInvite(pipe, invite)
+		})
 		return err
+	}, fmt.Sprintf("session:%s:invites", sessionID))
+	if err != nil {
+		return nil, err
 	}
 
-	session.Code = code
-	return r.UpdateSession(session)
+	return invite, nil
 }
 
-func (r *RedisService) GetCode(sessionID string) (string, error) {
-	session, err := r.GetSession(sessionID)
+func (r *RedisService) ListInvites(sessionID string) ([]models.Invite, error) {
+	key := fmt.Sprintf("session:%s:invites", sessionID)
+	data, err := r.client.HGetAll(r.ctx, key).Result()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return session.Code, nil
+	invites := make([]models.Invite, 0, len(data))
+	for _, item := range data {
+		var invite models.Invite
+		if err := json.Unmarshal([]byte(item), &invite); err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, nil
 }
 
-func (r *RedisService) UpdateLanguage(sessionID, language string) error {
-	session, err := r.GetSession(sessionID)
+func (r *RedisService) DeleteInvite(sessionID, inviteID string) error {
+	key := fmt.Sprintf("session:%s:invites", sessionID)
+	n, err := r.client.HDel(r.ctx, key, inviteID).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// Pub/Sub
+func SessionChannel(sessionID string) string {
+	return fmt.Sprintf("session:%s:events", sessionID)
+}
+
+func (r *RedisService) Publish(sessionID string, message interface{}) error {
+	messageJSON, err := json.Marshal(message)
 	if err != nil {
 		return err
 	}
 
-	session.Language = language
-	return r.UpdateSession(session)
+	return r.client.Publish(r.ctx, SessionChannel(sessionID), messageJSON).Err()
+}
+
+func (r *RedisService) Subscribe(sessionID string) Subscription {
+	pubsub := r.client.Subscribe(r.ctx, SessionChannel(sessionID))
+
+	// Wait for the subscription to be confirmed so nothing published from
+	// here on is missed.
+	if _, err := pubsub.Receive(r.ctx); err != nil {
+		log.Printf("Failed to subscribe to session %s: %v", sessionID, err)
+	}
+
+	sub := &redisSubscription{
+		pubsub:   pubsub,
+		messages: make(chan []byte),
+		done:     make(chan struct{}),
+	}
+	go sub.forward()
+	return sub
+}
+
+type redisSubscription struct {
+	pubsub   *redis.PubSub
+	messages chan []byte
+	done     chan struct{}
+}
+
+func (s *redisSubscription) forward() {
+	defer close(s.messages)
+	for msg := range s.pubsub.Channel() {
+		select {
+		case s.messages <- []byte(msg.Payload):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *redisSubscription) Messages() <-chan []byte {
+	return s.messages
+}
+
+func (s *redisSubscription) Close() error {
+	close(s.done)
+	return s.pubsub.Close()
+}
+
+// Event log
+
+// appendEventScript stamps a message with the session's next sequence
+// number, logs it and, given a channel, publishes it, all atomically so
+// that messages reach subscribers in sequence order. The message comes
+// without its seq, which is spliced in as its first field, and the
+// envelope as the JSON that goes before the message, its last field.
+var appendEventScript = redis.NewScript(`
+local seq = redis.call('INCR', KEYS[1])
+local data = '{"seq":' .. seq .. ',' .. string.sub(ARGV[1], 2)
+redis.call('ZADD', KEYS[2], seq, data)
+redis.call('ZREMRANGEBYRANK', KEYS[2], 0, -tonumber(ARGV[2]) - 1)
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+if ARGV[4] ~= '' then
+	redis.call('PUBLISH', ARGV[4], ARGV[5] .. data .. '}')
+end
+return {seq, data}
+`)
+
+// AppendEvent stamps message with the session's next sequence number, keeps
+// it in the bounded replay log and returns its encoded form.
+func (r *RedisService) AppendEvent(sessionID string, message *models.WSMessage) ([]byte, error) {
+	return r.appendEvent(sessionID, message, false)
+}
+
+func (r *RedisService) Broadcast(sessionID string, message *models.WSMessage) error {
+	_, err := r.appendEvent(sessionID, message, true)
+	return err
+}
+
+func (r *RedisService) appendEvent(sessionID string, message *models.WSMessage, publish bool) ([]byte, error) {
+	seqKey := fmt.Sprintf("session:%s:seq", sessionID)
+	logKey := fmt.Sprintf("session:%s:log", sessionID)
+
+	// The type always comes first, so the message is never empty
+	message.Seq = 0
+	messageJSON, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, prefix := "", ""
+	if publish {
+		envelopeJSON, err := json.Marshal(newEnvelope(message, json.RawMessage("0")))
+		if err != nil {
+			return nil, err
+		}
+		channel, prefix = SessionChannel(sessionID), strings.TrimSuffix(string(envelopeJSON), "0}")
+	}
+
+	result, err := appendEventScript.Run(r.ctx, r.client, []string{seqKey, logKey},
+		messageJSON, maxEventLog, r.ttl.Milliseconds(), channel, prefix).Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(result) != 2 {
+		return nil, fmt.Errorf("unexpected event log reply %v", result)
+	}
+	seq, _ := result[0].(int64)
+	data, _ := result[1].(string)
+
+	message.Seq = seq
+	return []byte(data), nil
+}
+
+// GetEventsSince returns the logged messages with a sequence number above
+// seq, oldest first. ok is false when the log no longer reaches back that far.
+func (r *RedisService) GetEventsSince(sessionID string, seq int64) (events [][]byte, ok bool, err error) {
+	current, err := r.GetEventSeq(sessionID)
+	if err != nil {
+		return nil, false, err
+	}
+	if seq >= current {
+		return [][]byte{}, seq == current, nil
+	}
+
+	logKey := fmt.Sprintf("session:%s:log", sessionID)
+	entries, err := r.client.ZRangeByScoreWithScores(r.ctx, logKey, &redis.ZRangeBy{
+		Min: fmt.Sprintf("(%d", seq),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(entries) == 0 || int64(entries[0].Score) != seq+1 {
+		return nil, false, nil
+	}
+
+	events = make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		events = append(events, []byte(entry.Member.(string)))
+	}
+
+	return events, true, nil
+}
+
+func (r *RedisService) GetEventSeq(sessionID string) (int64, error) {
+	seqKey := fmt.Sprintf("session:%s:seq", sessionID)
+	seq, err := r.client.Get(r.ctx, seqKey).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// Code management
+
+// ConflictError reports a write made against a revision other than the
+// session's current one, along with the state of the file written that the
+// writer should rebase on.
+type ConflictError struct {
+	Revision int    `json:"revision"`
+	Path     string `json:"path"`
+	Code     string `json:"code"`
+	Language string `json:"language"`
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("stale write: session is at revision %d", e.Revision)
+}
+
+func (r *RedisService) UpdateCode(sessionID, userID string, revision int, code string) (*models.OpRecord, error) {
+	return r.UpdateContent(sessionID, userID, "", revision, &code, nil)
+}
+
+func (r *RedisService) UpdateLanguage(sessionID, userID string, revision int, language string) (*models.OpRecord, error) {
+	return r.UpdateContent(sessionID, userID, "", revision, nil, &language)
+}
+
+// UpdateContent replaces the code and/or language if the session is still at
+// the expected revision, and returns a *ConflictError otherwise.
+func (r *RedisService) UpdateContent(sessionID, userID, path string, revision int, code, language *string) (*models.OpRecord, error) {
+	return r.commit(sessionID, func(tx *redis.Tx, session *models.Session) (*models.OpRecord, error) {
+		return contentRecord(session, userID, path, revision, code, language)
+	})
+}
+
+// ApplyEdit transforms ops, made against the given base revision, past every
+// operation committed since and applies the result to the file.
+func (r *RedisService) ApplyEdit(sessionID, userID, path string, revision int, ops []models.OpComponent) (*models.OpRecord, error) {
+	if err := ValidateOps(ops); err != nil {
+		return nil, err
+	}
+
+	return r.commit(sessionID, func(tx *redis.Tx, session *models.Session) (*models.OpRecord, error) {
+		var concurrent []models.OpRecord
+		if revision >= 0 && revision <= session.Revision {
+			var err error
+			concurrent, err = r.getOpsSince(tx, sessionID, revision)
+			if err != nil {
+				return nil, err
+			}
+			if len(concurrent) > session.Revision-revision {
+				// Another commit landed between reading the session and its
+				// history; EXEC would fail anyway, so retry now
+				return nil, redis.TxFailedErr
+			}
+		}
+
+		return editRecord(session, userID, path, revision, ops, concurrent)
+	})
+}
+
+// ChangeFile creates, renames or deletes a file as the next revision.
+func (r *RedisService) ChangeFile(sessionID, userID string, change *models.FileChange) (*models.OpRecord, error) {
+	return r.commit(sessionID, func(tx *redis.Tx, session *models.Session) (*models.OpRecord, error) {
+		return fileRecord(session, userID, change)
+	})
+}
+
+// commit atomically applies the record built by fn to the session as the
+// next revision and appends it to the operation history. fn sees the session
+// and history as of the transaction and may run more than once; a role
+// changed meanwhile makes it run again, so it is never checked against a
+// stale one.
+func (r *RedisService) commit(sessionID string, fn func(tx *redis.Tx, session *models.Session) (*models.OpRecord, error)) (*models.OpRecord, error) {
+	opsKey := fmt.Sprintf("session:%s:ops", sessionID)
+
+	var record *models.OpRecord
+	err := r.watch(func(tx *redis.Tx) error {
+		session, err := r.getSession(tx, sessionID)
+		if err != nil {
+			return err
+		}
+
+		record, err = fn(tx, session)
+		if err != nil {
+			return err
+		}
+		before := session.Workspace
+		if err := applyRecord(session, record); err != nil {
+			return err
+		}
+
+		// Only what is on the changed path can move
+		path := resolvePath(&before, record.Path)
+		blame, err := r.getBlame(tx, sessionID, path)
+		if err != nil {
+			return err
+		}
+		comments, err := r.getAnchoredComments(tx, sessionID, path)
+		if err != nil {
+			return err
+		}
+		record.Comments = remapComments(comments, &before, record)
+		suggestions, err := r.getAnchoredSuggestions(tx, sessionID, path)
+		if err != nil {
+			return err
+		}
+		record.Suggestions = rebaseSuggestions(suggestions, &before, record)
+		review, err := r.getReview(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		var reviewJSON []byte
+		if reopenReview(review, record) {
+			record.Review = review
+			if reviewJSON, err = json.Marshal(review); err != nil {
+				return err
+			}
+		}
+
+		recordJSON, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		var added *redis.StringCmd
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			if record.Action == models.FileRename || record.Action == models.FileDelete {
+				pipe.HDel(r.ctx, filesKey(sessionID), record.Path)
+				pipe.HDel(r.ctx, blameKey(sessionID), record.Path)
+			}
+			if file := session.File(recordTarget(record)); file != nil {
+				if err := r.setFile(pipe, sessionID, file, recordBlame(blame, &before, record)); err != nil {
+					return err
+				}
+			}
+			// Saving indexes them again under the path they are on now, if
+			// edits still move them
+			for i := range record.Comments {
+				pipe.ZRem(r.ctx, commentIndexKey(sessionID), anchorMember(path, record.Comments[i].ID))
+				if err := r.setComment(pipe, &record.Comments[i]); err != nil {
+					return err
+				}
+			}
+			for i := range record.Suggestions {
+				pipe.ZRem(r.ctx, suggestionIndexKey(sessionID), anchorMember(path, record.Suggestions[i].ID))
+				if err := r.setSuggestion(pipe, &record.Suggestions[i]); err != nil {
+					return err
+				}
+			}
+			if record.Review != nil {
+				pipe.Set(r.ctx, reviewKey(sessionID), reviewJSON, r.ttl)
+			}
+			pipe.HSet(r.ctx, metaKey(sessionID), "revision", session.Revision, "main_file", session.MainFile)
+			r.touchSession(pipe, sessionID)
+			pipe.RPush(r.ctx, opsKey, recordJSON)
+			pipe.LTrim(r.ctx, opsKey, -maxOpHistory, -1)
+			pipe.Expire(r.ctx, opsKey, r.ttl)
+			for _, entry := range recordEntries(record) {
+				if added, err = r.addHistory(pipe, sessionID, entry); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// The snapshot needs the ID Redis gave the entry, so it is saved
+		// after the commit. Missing one only makes rebuilds replay further.
+		if session.Revision%snapshotInterval == 0 {
+			if err := r.saveSnapshot(sessionID, newSnapshot(session, added.Val())); err != nil {
+				log.Printf("Failed to snapshot session %s: %v", sessionID, err)
+			}
+		}
+		return nil
+	}, metaKey(sessionID), rolesKey(sessionID), opsKey, commentsKey(sessionID), suggestionsKey(sessionID), reviewKey(sessionID))
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// Blame
+
+func (r *RedisService) GetBlame(sessionID, path string) ([]models.LineBlame, int, error) {
+	session, err := r.getSession(r.client, sessionID)
+	if err != nil {
+		return nil, 0, err
+	}
+	path = resolvePath(&session.Workspace, path)
+
+	// Read the file and revision in one transaction so they belong together
+	var data, blameData, revision *redis.StringCmd
+	_, err = r.client.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		data = pipe.HGet(r.ctx, filesKey(sessionID), path)
+		blameData = pipe.HGet(r.ctx, blameKey(sessionID), path)
+		revision = pipe.HGet(r.ctx, metaKey(sessionID), "revision")
+		return nil
+	})
+	if data.Err() == redis.Nil {
+		return nil, 0, ErrFileNotFound
+	}
+	if err != nil && err != redis.Nil {
+		return nil, 0, err
+	}
+
+	rev, err := revision.Int()
+	if err != nil {
+		return nil, 0, err
+	}
+	var file redisFile
+	if err := json.Unmarshal([]byte(data.Val()), &file); err != nil {
+		return nil, 0, err
+	}
+	if blameData.Err() == nil {
+		if file.Blame, err = decodeBlame(blameData.Val()); err != nil {
+			return nil, 0, err
+		}
+	}
+	return checkBlame(file.Blame, file.Code), rev, nil
+}
+
+// Comments
+
+func (r *RedisService) SaveComment(comment *models.Comment, revision int) error {
+	return r.watch(func(tx *redis.Tx) error {
+		session, err := r.getSession(tx, comment.SessionID)
+		if err != nil {
+			return err
+		}
+		var thread *models.Comment
+		if comment.ThreadID != "" {
+			if thread, err = r.getComment(tx, comment.SessionID, comment.ThreadID); err != nil {
+				return err
+			}
+		}
+		if err := checkNewComment(session, comment, revision, thread); err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			if err := r.setComment(pipe, comment); err != nil {
+				return err
+			}
+			r.touchSession(pipe, comment.SessionID)
+			return nil
+		})
+		return err
+	}, metaKey(comment.SessionID), commentsKey(comment.SessionID))
+}
+
+func (r *RedisService) UpdateComment(sessionID, commentID string, fn func(comment *models.Comment) error) (*models.Comment, error) {
+	var comment *models.Comment
+	err := r.watch(func(tx *redis.Tx) error {
+		var err error
+		comment, err = r.getComment(tx, sessionID, commentID)
+		if err != nil {
+			return err
+		}
+		if comment == nil {
+			return ErrCommentNotFound
+		}
+		if err := fn(comment); err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			return r.setComment(pipe, comment)
+		})
+		return err
+	}, commentsKey(sessionID))
+	if err != nil {
+		return nil, err
+	}
+
+	return comment, nil
+}
+
+func (r *RedisService) DeleteComment(sessionID, commentID string) ([]string, error) {
+	var deleted []string
+	err := r.watch(func(tx *redis.Tx) error {
+		comments, err := r.getComments(tx, sessionID)
+		if err != nil {
+			return err
+		}
+
+		deleted = nil
+		var anchor string
+		for _, comment := range comments {
+			if comment.ID == commentID || comment.ThreadID == commentID {
+				deleted = append(deleted, comment.ID)
+			}
+			if comment.ID == commentID {
+				anchor = anchorMember(comment.Path, comment.ID)
+			}
+		}
+		if anchor == "" {
+			return ErrCommentNotFound
+		}
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(r.ctx, commentsKey(sessionID), deleted...)
+			pipe.ZRem(r.ctx, commentIndexKey(sessionID), anchor)
+			return nil
+		})
+		return err
+	}, commentsKey(sessionID))
+	if err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
+
+func (r *RedisService) GetComments(sessionID string) ([]models.Comment, error) {
+	return r.getComments(r.client, sessionID)
+}
+
+func (r *RedisService) getComments(c redis.Cmdable, sessionID string) ([]models.Comment, error) {
+	data, err := c.HGetAll(r.ctx, commentsKey(sessionID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	comments := make([]models.Comment, 0, len(data))
+	for _, commentJSON := range data {
+		var comment models.Comment
+		if err := json.Unmarshal([]byte(commentJSON), &comment); err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	sortComments(comments)
+	return comments, nil
+}
+
+// getComment reads one comment, or nil if there is none.
+func (r *RedisService) getComment(c redis.Cmdable, sessionID, commentID string) (*models.Comment, error) {
+	data, err := c.HGet(r.ctx, commentsKey(sessionID), commentID).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var comment models.Comment
+	if err := json.Unmarshal([]byte(data), &comment); err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+func (r *RedisService) setComment(pipe redis.Pipeliner, comment *models.Comment) error {
+	commentJSON, err := json.Marshal(comment)
+	if err != nil {
+		return err
+	}
+
+	pipe.HSet(r.ctx, commentsKey(comment.SessionID), comment.ID, commentJSON)
+	if comment.ThreadID == "" {
+		member := anchorMember(comment.Path, comment.ID)
+		if comment.Outdated {
+			pipe.ZRem(r.ctx, commentIndexKey(comment.SessionID), member)
+		} else {
+			pipe.ZAdd(r.ctx, commentIndexKey(comment.SessionID), redis.Z{Member: member})
+		}
+	}
+	return nil
+}
+
+// getAnchoredComments reads the comments that edits to path move.
+func (r *RedisService) getAnchoredComments(c redis.Cmdable, sessionID, path string) ([]models.Comment, error) {
+	data, err := r.getAnchored(c, commentIndexKey(sessionID), commentsKey(sessionID), path)
+	if err != nil {
+		return nil, err
+	}
+
+	comments := make([]models.Comment, 0, len(data))
+	for _, commentJSON := range data {
+		var comment models.Comment
+		if err := json.Unmarshal([]byte(commentJSON), &comment); err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	sortComments(comments)
+	return comments, nil
+}
+
+// Suggestions
+
+func (r *RedisService) Suggest(sessionID, userID, path string, revision int, ops []models.OpComponent) (*models.Suggestion, error) {
+	if err := ValidateOps(ops); err != nil {
+		return nil, err
+	}
+
+	opsKey := fmt.Sprintf("session:%s:ops", sessionID)
+
+	var suggestion *models.Suggestion
+	err := r.watch(func(tx *redis.Tx) error {
+		session, err := r.getSession(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		var concurrent []models.OpRecord
+		if revision >= 0 && revision <= session.Revision {
+			if concurrent, err = r.getOpsSince(tx, sessionID, revision); err != nil {
+				return err
+			}
+			if len(concurrent) > session.Revision-revision {
+				return redis.TxFailedErr
+			}
+		}
+		if suggestion, err = newSuggestion(session, userID, path, revision, ops, concurrent); err != nil {
+			return err
+		}
+
+		// Saved in a WATCH on the revision, so no commit can land before
+		// the suggestion is there to be rebased
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			if err := r.setSuggestion(pipe, suggestion); err != nil {
+				return err
+			}
+			r.touchSession(pipe, sessionID)
+			return nil
+		})
+		return err
+	}, metaKey(sessionID), rolesKey(sessionID), opsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return suggestion, nil
+}
+
+func (r *RedisService) AcceptSuggestion(sessionID, suggestionID, userID string) (*models.OpRecord, error) {
+	return r.commit(sessionID, func(tx *redis.Tx, session *models.Session) (*models.OpRecord, error) {
+		suggestion, err := r.getSuggestion(tx, sessionID, suggestionID)
+		if err != nil {
+			return nil, err
+		}
+		return acceptRecord(session, suggestion, userID)
+	})
+}
+
+func (r *RedisService) UpdateSuggestion(sessionID, suggestionID string, fn func(suggestion *models.Suggestion) error) (*models.Suggestion, error) {
+	var suggestion *models.Suggestion
+	err := r.watch(func(tx *redis.Tx) error {
+		var err error
+		suggestion, err = r.getSuggestion(tx, sessionID, suggestionID)
+		if err != nil {
+			return err
+		}
+		if suggestion == nil {
+			return ErrSuggestionNotFound
+		}
+		if err := fn(suggestion); err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			return r.setSuggestion(pipe, suggestion)
+		})
+		return err
+	}, suggestionsKey(sessionID))
+	if err != nil {
+		return nil, err
+	}
+
+	return suggestion, nil
+}
+
+func (r *RedisService) GetSuggestions(sessionID string) ([]models.Suggestion, error) {
+	return r.getSuggestions(r.client, sessionID)
+}
+
+func (r *RedisService) getSuggestions(c redis.Cmdable, sessionID string) ([]models.Suggestion, error) {
+	data, err := c.HGetAll(r.ctx, suggestionsKey(sessionID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	suggestions := make([]models.Suggestion, 0, len(data))
+	for _, suggestionJSON := range data {
+		var suggestion models.Suggestion
+		if err := json.Unmarshal([]byte(suggestionJSON), &suggestion); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	sortSuggestions(suggestions)
+	return suggestions, nil
+}
+
+// getSuggestion reads one suggestion, or nil if there is none.
+func (r *RedisService) getSuggestion(c redis.Cmdable, sessionID, suggestionID string) (*models.Suggestion, error) {
+	data, err := c.HGet(r.ctx, suggestionsKey(sessionID), suggestionID).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var suggestion models.Suggestion
+	if err := json.Unmarshal([]byte(data), &suggestion); err != nil {
+		return nil, err
+	}
+	return &suggestion, nil
+}
+
+func (r *RedisService) setSuggestion(pipe redis.Pipeliner, suggestion *models.Suggestion) error {
+	suggestionJSON, err := json.Marshal(suggestion)
+	if err != nil {
+		return err
+	}
+
+	pipe.HSet(r.ctx, suggestionsKey(suggestion.SessionID), suggestion.ID, suggestionJSON)
+	member := anchorMember(suggestion.Path, suggestion.ID)
+	if suggestion.Status == models.SuggestionPending {
+		pipe.ZAdd(r.ctx, suggestionIndexKey(suggestion.SessionID), redis.Z{Member: member})
+	} else {
+		pipe.ZRem(r.ctx, suggestionIndexKey(suggestion.SessionID), member)
+	}
+	return nil
+}
+
+// getAnchoredSuggestions reads the suggestions that edits to path rebase.
+func (r *RedisService) getAnchoredSuggestions(c redis.Cmdable, sessionID, path string) ([]models.Suggestion, error) {
+	data, err := r.getAnchored(c, suggestionIndexKey(sessionID), suggestionsKey(sessionID), path)
+	if err != nil {
+		return nil, err
+	}
+
+	suggestions := make([]models.Suggestion, 0, len(data))
+	for _, suggestionJSON := range data {
+		var suggestion models.Suggestion
+		if err := json.Unmarshal([]byte(suggestionJSON), &suggestion); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	sortSuggestions(suggestions)
+	return suggestions, nil
+}
+
+// anchorMember is how a comment or suggestion on path is kept in its
+// session's index. Members sharing a path sort together, so those on one
+// path are a lexical range.
+func anchorMember(path, id string) string { return path + "\x00" + id }
+
+// getAnchored reads from the hash at key the JSON of everything indexed
+// under path.
+func (r *RedisService) getAnchored(c redis.Cmdable, indexKey, key, path string) ([]string, error) {
+	members, err := c.ZRangeByLex(r.ctx, indexKey, &redis.ZRangeBy{
+		Min: "[" + path + "\x00",
+		Max: "(" + path + "\x01",
+	}).Result()
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+
+	ids := make([]string, len(members))
+	for i, member := range members {
+		ids[i] = strings.TrimPrefix(member, path+"\x00")
+	}
+	values, err := c.HMGet(r.ctx, key, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]string, 0, len(values))
+	for _, value := range values {
+		if value, ok := value.(string); ok {
+			data = append(data, value)
+		}
+	}
+	return data, nil
+}
+
+// Review
+
+func (r *RedisService) GetReview(sessionID string) (*models.Review, error) {
+	return r.getReview(r.client, sessionID)
+}
+
+func (r *RedisService) UpdateReview(sessionID string, fn func(session *models.Session, review *models.Review) error) (*models.Review, error) {
+	var review *models.Review
+	err := r.watch(func(tx *redis.Tx) error {
+		session, err := r.getSession(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		review, err = r.getReview(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		if err := fn(session, review); err != nil {
+			return err
+		}
+		reviewJSON, err := json.Marshal(review)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(r.ctx, reviewKey(sessionID), reviewJSON, r.ttl)
+			return nil
+		})
+		return err
+	}, metaKey(sessionID), rolesKey(sessionID), reviewKey(sessionID))
+	if err != nil {
+		return nil, err
+	}
+
+	return review, nil
+}
+
+// getReview reads the session's review, which is in draft if nobody has
+// changed it yet.
+func (r *RedisService) getReview(c redis.Cmdable, sessionID string) (*models.Review, error) {
+	if err := r.ensureSession(c, sessionID); err != nil {
+		return nil, err
+	}
+	data, err := c.Get(r.ctx, reviewKey(sessionID)).Result()
+	if err == redis.Nil {
+		return newReview(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	review := newReview()
+	if err := json.Unmarshal([]byte(data), review); err != nil {
+		return nil, err
+	}
+	return review, nil
+}
+
+// Chat
+
+func (r *RedisService) SaveMessage(message *models.ChatMessage) error {
+	if err := r.ensureSession(r.client, message.SessionID); err != nil {
+		return err
+	}
+
+	id, err := r.client.Incr(r.ctx, chatSeqKey(message.SessionID)).Result()
+	if err != nil {
+		return err
+	}
+
+	message.ID = id
+	messageJSON, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	pipe := r.client.TxPipeline()
+	pipe.ZAdd(r.ctx, chatKey(message.SessionID), redis.Z{Score: float64(id), Member: messageJSON})
+	pipe.ZRemRangeByRank(r.ctx, chatKey(message.SessionID), 0, -maxChatHistory-1)
+	r.touchSession(pipe, message.SessionID)
+	_, err = pipe.Exec(r.ctx)
+	return err
+}
+
+func (r *RedisService) GetMessages(sessionID string, before int64, limit int) ([]models.ChatMessage, error) {
+	max := "+inf"
+	if before > 0 {
+		max = fmt.Sprintf("(%d", before)
+	}
+	data, err := r.client.ZRevRangeByScore(r.ctx, chatKey(sessionID), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   max,
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]models.ChatMessage, len(data))
+	for i, messageJSON := range data {
+		// Newest first from Redis, oldest first to the caller
+		if err := json.Unmarshal([]byte(messageJSON), &messages[len(data)-1-i]); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+// History
+
+// historyPayload holds the fields of a history entry that depend on its type.
+type historyPayload struct {
+	Path     string               `json:"path,omitempty"`
+	NewPath  string               `json:"new_path,omitempty"`
+	Ops      []models.OpComponent `json:"ops,omitempty"`
+	Language string               `json:"language,omitempty"`
+}
+
+func (r *RedisService) addHistory(pipe redis.Pipeliner, sessionID string, entry models.HistoryEntry) (*redis.StringCmd, error) {
+	payload, err := json.Marshal(historyPayload{
+		Path:     entry.Path,
+		NewPath:  entry.NewPath,
+		Ops:      entry.Ops,
+		Language: entry.Language,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// New entries have no ID yet and get one from the stream
+	cmd := pipe.XAdd(r.ctx, &redis.XAddArgs{
+		Stream: historyKey(sessionID),
+		ID:     entry.ID,
+		Values: []interface{}{
+			"type", entry.Type,
+			"user_id", entry.UserID,
+			"timestamp", entry.Timestamp,
+			"revision", entry.Revision,
+			"payload", payload,
+		},
+	})
+	pipe.Expire(r.ctx, historyKey(sessionID), r.ttl)
+	return cmd, nil
+}
+
+// saveSnapshot keeps snapshot, drops the oldest beyond maxSnapshots and
+// compacts away the history they covered.
+func (r *RedisService) saveSnapshot(sessionID string, snapshot models.Snapshot) error {
+	snapshotJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	key := snapshotsKey(sessionID)
+	var oldest *redis.StringCmd
+	_, err = r.client.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(r.ctx, key, snapshotJSON)
+		pipe.LTrim(r.ctx, key, -maxSnapshots, -1)
+		pipe.Expire(r.ctx, key, r.ttl)
+		oldest = pipe.LIndex(r.ctx, key, 0)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var first models.Snapshot
+	if err := json.Unmarshal([]byte(oldest.Val()), &first); err != nil {
+		return err
+	}
+	return r.client.XTrimMinID(r.ctx, historyKey(sessionID), first.EntryID).Err()
+}
+
+func (r *RedisService) GetHistory(sessionID, start, end string, count int) ([]models.HistoryEntry, error) {
+	if _, err := parseEntryRange(start, end); err != nil {
+		return nil, err
+	}
+	if start == "" {
+		start = "-"
+	}
+	if end == "" {
+		end = "+"
+	}
+
+	var messages []redis.XMessage
+	var err error
+	if count > 0 {
+		messages, err = r.client.XRangeN(r.ctx, historyKey(sessionID), start, end, int64(count)).Result()
+	} else {
+		messages, err = r.client.XRange(r.ctx, historyKey(sessionID), start, end).Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return historyEntries(messages)
+}
+
+func (r *RedisService) GetHistoryReverse(sessionID, start, end string, count int) ([]models.HistoryEntry, error) {
+	if _, err := parseEntryRange(start, end); err != nil {
+		return nil, err
+	}
+	if start == "" {
+		start = "-"
+	}
+	if end == "" {
+		end = "+"
+	}
+
+	var messages []redis.XMessage
+	var err error
+	if count > 0 {
+		messages, err = r.client.XRevRangeN(r.ctx, historyKey(sessionID), end, start, int64(count)).Result()
+	} else {
+		messages, err = r.client.XRevRange(r.ctx, historyKey(sessionID), end, start).Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return historyEntries(messages)
+}
+
+func historyEntries(messages []redis.XMessage) ([]models.HistoryEntry, error) {
+	entries := make([]models.HistoryEntry, 0, len(messages))
+	for _, message := range messages {
+		entry, err := historyEntry(message)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func historyEntry(message redis.XMessage) (models.HistoryEntry, error) {
+	field := func(name string) string {
+		value, _ := message.Values[name].(string)
+		return value
+	}
+
+	entry := models.HistoryEntry{
+		ID:     message.ID,
+		Type:   field("type"),
+		UserID: field("user_id"),
+	}
+	var err error
+	if entry.Timestamp, err = strconv.ParseInt(field("timestamp"), 10, 64); err != nil {
+		return entry, fmt.Errorf("invalid timestamp in history entry %s: %w", message.ID, err)
+	}
+	if entry.Revision, err = strconv.Atoi(field("revision")); err != nil {
+		return entry, fmt.Errorf("invalid revision in history entry %s: %w", message.ID, err)
+	}
+
+	var payload historyPayload
+	if err := json.Unmarshal([]byte(field("payload")), &payload); err != nil {
+		return entry, err
+	}
+	entry.Path = payload.Path
+	entry.NewPath = payload.NewPath
+	entry.Ops = payload.Ops
+	entry.Language = payload.Language
+	return entry, nil
+}
+
+func (r *RedisService) GetSnapshots(sessionID string) ([]models.Snapshot, error) {
+	data, err := r.client.LRange(r.ctx, snapshotsKey(sessionID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]models.Snapshot, 0, len(data))
+	for _, item := range data {
+		var snapshot models.Snapshot
+		if err := json.Unmarshal([]byte(item), &snapshot); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// GetOpsSince returns the recorded operations after the given revision that
+// are still in the history window, oldest first.
+func (r *RedisService) GetOpsSince(sessionID string, revision int) ([]models.OpRecord, error) {
+	return r.getOpsSince(r.client, sessionID, revision)
+}
+
+func (r *RedisService) getOpsSince(c redis.Cmdable, sessionID string, revision int) ([]models.OpRecord, error) {
+	key := fmt.Sprintf("session:%s:ops", sessionID)
+
+	// The list holds consecutive revisions, so the first entry tells us
+	// where the requested revision starts.
+	first, err := c.LIndex(r.ctx, key, 0).Result()
+	if err == redis.Nil {
+		return []models.OpRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var head models.OpRecord
+	if err := json.Unmarshal([]byte(first), &head); err != nil {
+		return nil, err
+	}
+	start := int64(revision - head.Revision + 1)
+	if start < 0 {
+		start = 0
+	}
+
+	data, err := c.LRange(r.ctx, key, start, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]models.OpRecord, 0, len(data))
+	for _, item := range data {
+		var record models.OpRecord
+		if err := json.Unmarshal([]byte(item), &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (r *RedisService) GetCode(sessionID string) (string, error) {
+	session, err := r.GetSession(sessionID)
+	if err != nil {
+		return "", err
+	}
+
+	return session.Code, nil
 }
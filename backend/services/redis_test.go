@@ -0,0 +1,218 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+
+	"codestream/models"
+)
+
+func newTestRedis(t *testing.T) *RedisService {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", mr.Addr())
+
+	redis := NewRedisService()
+	t.Cleanup(func() { redis.Close() })
+	return redis
+}
+
+func TestLegacySessionsAreMigrated(t *testing.T) {
+	redis := newTestRedis(t)
+
+	// Written before roles existed, as a single blob
+	legacy := `{"id":"old","code":"print(1)","language":"python","revision":3,` +
+		`"created_at":"2024-01-02T03:04:05Z","users":[{"id":"a","name":"A"},{"id":"b","name":"B"}]}`
+	for _, id := range []string{"old", "other"} {
+		if err := redis.client.Set(redis.ctx, "session:"+id, strings.Replace(legacy, `"old"`, `"`+id+`"`, 1), 0).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	session, err := redis.GetSession("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Code != "print(1)" || session.Language != "python" || session.Revision != 3 || session.MainFile != "main.py" {
+		t.Fatalf("content not migrated: %+v", session)
+	}
+	if session.OwnerID != "a" || session.RoleOf("a") != models.RoleOwner || session.RoleOf("b") != models.RoleEditor {
+		t.Fatalf("roles not migrated: owner %q, roles %v", session.OwnerID, session.Roles)
+	}
+	if len(session.Users) != 2 {
+		t.Fatalf("expected 2 users, got %d", len(session.Users))
+	}
+	if n := redis.client.Exists(redis.ctx, "session:old").Val(); n != 0 {
+		t.Fatal("legacy key was not removed")
+	}
+
+	if _, err := redis.UpdateCode("old", "b", 3, "print(2)"); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := redis.MigrateLegacySessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 1 {
+		t.Fatalf("expected 1 session left to migrate, got %d", migrated)
+	}
+	if _, err := redis.GetSession("other"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSingleFileSessionsAreUpgraded(t *testing.T) {
+	redis := newTestRedis(t)
+
+	// Written before workspaces, with the code in a key of its own
+	meta := map[string]interface{}{
+		"revision":     "2",
+		"language":     "go",
+		"created_at":   "2024-01-02T03:04:05Z",
+		"owner_id":     "a",
+		"default_role": string(models.RoleEditor),
+	}
+	if err := redis.client.HSet(redis.ctx, metaKey("old"), meta).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := redis.client.Set(redis.ctx, legacyCodeKey("old"), "package main\n", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := redis.client.Set(redis.ctx, legacyBlameKey("old"), `[{"user_id":"a","revision":1}]`, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := redis.GetSession("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.MainFile != "main.go" || len(session.Files) != 1 || session.Code != "package main\n" || session.Language != "go" {
+		t.Fatalf("workspace not upgraded: %+v", session.Workspace)
+	}
+	if n := redis.client.Exists(redis.ctx, legacyCodeKey("old"), legacyBlameKey("old")).Val(); n != 0 {
+		t.Fatal("legacy keys were not removed")
+	}
+
+	blame, _, err := redis.GetBlame("old", "main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blame) != 1 || blame[0].UserID != "a" {
+		t.Fatalf("blame not carried over: %v", blame)
+	}
+}
+
+// Commits find the comments to move through the index, which sessions from
+// before it get on first read.
+func TestAnchorIndexIsMigrated(t *testing.T) {
+	redis := newTestRedis(t)
+	createTestSession(t, redis, "s1")
+	code := "package main\n"
+	if _, err := redis.UpdateContent("s1", "owner", "", 0, &code, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := redis.ChangeFile("s1", "owner", &models.FileChange{Action: models.FileCreate, Path: "a.go", Code: "package a\n"}); err != nil {
+		t.Fatal(err)
+	}
+	var comments []*models.Comment
+	for _, path := range []string{"main.go", "a.go"} {
+		comment, err := AddComment(redis, "s1", "owner", &models.NewComment{Path: path, StartLine: 1, EndLine: 1, Revision: 2, Body: "hm"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		comments = append(comments, comment)
+	}
+
+	redis.client.HDel(redis.ctx, metaKey("s1"), "anchor_index")
+	redis.client.Del(redis.ctx, commentIndexKey("s1"))
+
+	code = "// moved down\npackage main\n"
+	record, err := redis.UpdateContent("s1", "owner", "main.go", 2, &code, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Comments) != 1 || record.Comments[0].ID != comments[0].ID || record.Comments[0].StartLine != 2 {
+		t.Fatalf("moved comments %+v, want only the one on main.go", record.Comments)
+	}
+	members := redis.client.ZRange(redis.ctx, commentIndexKey("s1"), 0, -1).Val()
+	if len(members) != 2 {
+		t.Fatalf("index %q, want both comments", members)
+	}
+}
+
+func TestBlameIsStoredApartFromCode(t *testing.T) {
+	redis := newTestRedis(t)
+	createTestSession(t, redis, "s1")
+	code := "a\n"
+	if _, err := redis.UpdateContent("s1", "owner", "", 0, &code, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if file := redis.client.HGet(redis.ctx, filesKey("s1"), "main.go").Val(); strings.Contains(file, "blame") {
+		t.Fatalf("file %s still carries its blame", file)
+	}
+	blame, _, err := redis.GetBlame("s1", "main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blame) != 1 || blame[0].UserID != "owner" {
+		t.Fatalf("got blame %v", blame)
+	}
+
+	// Files written before blame moved out still carry their own
+	redis.client.HSet(redis.ctx, filesKey("s1"), "main.go", `{"language":"go","code":"a\n","blame":[{"user_id":"old","revision":1}]}`)
+	redis.client.HDel(redis.ctx, blameKey("s1"), "main.go")
+	if blame, _, err = redis.GetBlame("s1", "main.go"); err != nil {
+		t.Fatal(err)
+	}
+	if len(blame) != 1 || blame[0].UserID != "old" {
+		t.Fatalf("got legacy blame %v", blame)
+	}
+}
+
+// An editor demoted or removed after their edit was checked but before it
+// commits has the edit rejected, not applied on the strength of the old role.
+func TestRoleChangeDuringCommitRejectsTheEdit(t *testing.T) {
+	changes := map[string]func(redis *RedisService) error{
+		"demoted": func(redis *RedisService) error { return redis.SetRole("s1", "bob", models.RoleViewer) },
+		"removed": func(redis *RedisService) error { return redis.RemoveParticipant("s1", "bob") },
+	}
+	for name, change := range changes {
+		t.Run(name, func(t *testing.T) {
+			redis := newTestRedis(t)
+			createTestSession(t, redis, "s1")
+			if _, err := redis.AdmitUser("s1", models.User{ID: "bob"}, models.RoleEditor); err != nil {
+				t.Fatal(err)
+			}
+
+			var once sync.Once
+			_, err := redis.commit("s1", func(tx *goredis.Tx, session *models.Session) (*models.OpRecord, error) {
+				record, err := editRecord(session, "bob", "", session.Revision, []models.OpComponent{{Insert: "x"}}, nil)
+				once.Do(func() {
+					if err := change(redis); err != nil {
+						t.Error(err)
+					}
+				})
+				return record, err
+			})
+			if !errors.Is(err, ErrForbidden) {
+				t.Fatalf("got %v, want ErrForbidden", err)
+			}
+
+			session, err := redis.GetSession("s1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if session.Revision != 0 || session.Code != "" {
+				t.Fatalf("edit applied: revision %d, code %q", session.Revision, session.Code)
+			}
+		})
+	}
+}
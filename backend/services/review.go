@@ -0,0 +1,122 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"codestream/models"
+)
+
+var (
+	ErrInvalidTransition = errors.New("review is already in that status")
+	ErrNotInReview       = errors.New("review has not been requested")
+
+	errNoVerdict = errors.New("no verdict to withdraw")
+)
+
+// ChangeReviewStatus asks for review of the session or takes it back to
+// draft, which only the owner may do. Either starts the verdicts afresh.
+func ChangeReviewStatus(store SessionStore, sessionID, userID, status string) (*models.Review, error) {
+	return store.UpdateReview(sessionID, func(session *models.Session, review *models.Review) error {
+		if userID != session.OwnerID {
+			return ErrForbidden
+		}
+		if review.Status == status {
+			return ErrInvalidTransition
+		}
+		review.Verdicts = map[string]models.Verdict{}
+		transitionReview(review, userID, status)
+		return nil
+	})
+}
+
+// SetVerdict records userID's verdict on the current revision in the
+// current review round, which any participant but the owner may give, and
+// moves the status to follow.
+func SetVerdict(store SessionStore, sessionID, userID string, verdict *models.ReviewVerdict) (*models.Review, error) {
+	return store.UpdateReview(sessionID, func(session *models.Session, review *models.Review) error {
+		if session.RoleOf(userID) == "" || userID == session.OwnerID {
+			return ErrForbidden
+		}
+		if review.Status == models.ReviewDraft {
+			return ErrNotInReview
+		}
+		review.Verdicts[userID] = models.Verdict{
+			Verdict:  verdict.Verdict,
+			Body:     verdict.Body,
+			Revision: session.Revision,
+			At:       time.Now(),
+		}
+		transitionReview(review, userID, reviewOutcome(review.Verdicts))
+		return nil
+	})
+}
+
+// WithdrawVerdict drops userID's verdict from the current review round,
+// since it was given in a role they no longer hold once they are removed or
+// their role changes, and moves the status to follow on the owner's behalf.
+// It returns nil if they had no verdict.
+func WithdrawVerdict(store SessionStore, sessionID, userID string) (*models.Review, error) {
+	review, err := store.UpdateReview(sessionID, func(session *models.Session, review *models.Review) error {
+		if _, ok := review.Verdicts[userID]; !ok {
+			return errNoVerdict
+		}
+		delete(review.Verdicts, userID)
+		transitionReview(review, session.OwnerID, reviewOutcome(review.Verdicts))
+		return nil
+	})
+	if errors.Is(err, errNoVerdict) {
+		return nil, nil
+	}
+	return review, err
+}
+
+// The rules below are shared by the stores.
+
+// newReview is the review of a session nobody has asked to review yet.
+func newReview() *models.Review {
+	return &models.Review{
+		Status:   models.ReviewDraft,
+		Verdicts: map[string]models.Verdict{},
+		History:  []models.ReviewTransition{},
+	}
+}
+
+// transitionReview moves review to status on behalf of userID, recording
+// the change if there is one.
+func transitionReview(review *models.Review, userID, status string) {
+	if review.Status == status {
+		return
+	}
+	review.History = append(review.History, models.ReviewTransition{
+		From:   review.Status,
+		To:     status,
+		UserID: userID,
+		At:     time.Now(),
+	})
+	review.Status = status
+}
+
+// reopenReview sends an approved review back for review when record lands
+// after the approvals, which no longer cover the code. The verdicts are
+// kept, their revisions showing they are stale. It reports whether the
+// review changed.
+func reopenReview(review *models.Review, record *models.OpRecord) bool {
+	if review.Status != models.ReviewApproved {
+		return false
+	}
+	transitionReview(review, record.UserID, models.ReviewInReview)
+	return true
+}
+
+// reviewOutcome is the status a review round with verdicts is in.
+func reviewOutcome(verdicts map[string]models.Verdict) string {
+	status := models.ReviewInReview
+	for _, verdict := range verdicts {
+		if verdict.Verdict == models.ReviewChangesRequested {
+			return models.ReviewChangesRequested
+		}
+		status = models.ReviewApproved
+	}
+	return status
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"codestream/models"
+)
+
+func TestReviewFollowsVerdicts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+		for userID, role := range map[string]models.Role{"bob": models.RoleEditor, "vic": models.RoleViewer} {
+			if _, err := store.AdmitUser("s1", models.User{ID: userID}, role); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		review, err := store.GetReview("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if review.Status != models.ReviewDraft {
+			t.Fatalf("new session is %q, want draft", review.Status)
+		}
+
+		approve := &models.ReviewVerdict{Verdict: models.ReviewApproved}
+		if _, err := SetVerdict(store, "s1", "bob", approve); !errors.Is(err, ErrNotInReview) {
+			t.Fatalf("approving a draft: got %v, want ErrNotInReview", err)
+		}
+		if _, err := ChangeReviewStatus(store, "s1", "bob", models.ReviewInReview); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("an editor asking for review: got %v, want ErrForbidden", err)
+		}
+		if _, err := ChangeReviewStatus(store, "s1", "owner", models.ReviewInReview); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ChangeReviewStatus(store, "s1", "owner", models.ReviewInReview); !errors.Is(err, ErrInvalidTransition) {
+			t.Fatalf("asking for review twice: got %v, want ErrInvalidTransition", err)
+		}
+		if _, err := SetVerdict(store, "s1", "owner", approve); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("the owner approving: got %v, want ErrForbidden", err)
+		}
+
+		if review, err = SetVerdict(store, "s1", "bob", approve); err != nil {
+			t.Fatal(err)
+		}
+		if review.Status != models.ReviewApproved {
+			t.Fatalf("approved review is %q", review.Status)
+		}
+		review, err = SetVerdict(store, "s1", "vic", &models.ReviewVerdict{Verdict: models.ReviewChangesRequested, Body: "tests?"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if review.Status != models.ReviewChangesRequested || review.Verdicts["vic"].Body != "tests?" {
+			t.Fatalf("unexpected review %+v", review)
+		}
+
+		// A new round starts without verdicts
+		if review, err = ChangeReviewStatus(store, "s1", "owner", models.ReviewInReview); err != nil {
+			t.Fatal(err)
+		}
+		if review.Status != models.ReviewInReview || len(review.Verdicts) != 0 {
+			t.Fatalf("unexpected review %+v", review)
+		}
+
+		review, err = store.GetReview("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"draft", "in_review", "approved", "changes_requested", "in_review"}
+		if len(review.History) != len(want)-1 {
+			t.Fatalf("history %+v, want %v", review.History, want)
+		}
+		for i, transition := range review.History {
+			if transition.From != want[i] || transition.To != want[i+1] || transition.At.IsZero() {
+				t.Fatalf("history %+v, want %v", review.History, want)
+			}
+		}
+		if review.History[2].UserID != "vic" {
+			t.Fatalf("changes requested by %q, want vic", review.History[2].UserID)
+		}
+	})
+}
+
+func TestCommitsReopenApprovedReviews(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+		if _, err := store.AdmitUser("s1", models.User{ID: "bob"}, models.RoleEditor); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ChangeReviewStatus(store, "s1", "owner", models.ReviewInReview); err != nil {
+			t.Fatal(err)
+		}
+		review, err := SetVerdict(store, "s1", "bob", &models.ReviewVerdict{Verdict: models.ReviewApproved})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if review.Status != models.ReviewApproved || review.Verdicts["bob"].Revision != 0 {
+			t.Fatalf("unexpected review %+v", review)
+		}
+
+		code := "changed after approval"
+		record, err := store.UpdateContent("s1", "owner", "", 0, &code, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Review == nil || record.Review.Status != models.ReviewInReview {
+			t.Fatalf("commit after approval carried review %+v", record.Review)
+		}
+		review, err = store.GetReview("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if review.Status != models.ReviewInReview || review.Verdicts["bob"].Revision != 0 {
+			t.Fatalf("unexpected review %+v", review)
+		}
+		if last := review.History[len(review.History)-1]; last.From != models.ReviewApproved || last.UserID != "owner" {
+			t.Fatalf("reopened by %+v", last)
+		}
+
+		// Only approved reviews are reopened
+		code = "changed again"
+		if record, err = store.UpdateContent("s1", "owner", "", 1, &code, nil); err != nil {
+			t.Fatal(err)
+		}
+		if record.Review != nil {
+			t.Fatalf("commit during review carried review %+v", record.Review)
+		}
+
+		if review, err = SetVerdict(store, "s1", "bob", &models.ReviewVerdict{Verdict: models.ReviewApproved}); err != nil {
+			t.Fatal(err)
+		}
+		if review.Status != models.ReviewApproved || review.Verdicts["bob"].Revision != 2 {
+			t.Fatalf("unexpected review %+v", review)
+		}
+	})
+}
+
+func TestVerdictsAreWithdrawnWithTheirRole(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+		for _, userID := range []string{"bob", "carl"} {
+			if _, err := store.AdmitUser("s1", models.User{ID: userID}, models.RoleEditor); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := ChangeReviewStatus(store, "s1", "owner", models.ReviewInReview); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := SetVerdict(store, "s1", "bob", &models.ReviewVerdict{Verdict: models.ReviewApproved}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := SetVerdict(store, "s1", "carl", &models.ReviewVerdict{Verdict: models.ReviewChangesRequested}); err != nil {
+			t.Fatal(err)
+		}
+
+		// A removed participant's request for changes no longer holds the
+		// review back
+		if err := store.RemoveParticipant("s1", "carl"); err != nil {
+			t.Fatal(err)
+		}
+		review, err := WithdrawVerdict(store, "s1", "carl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if review == nil || review.Status != models.ReviewApproved || len(review.Verdicts) != 1 {
+			t.Fatalf("unexpected review %+v", review)
+		}
+
+		// Nor does a demoted participant's approval count any more
+		if err := store.SetRole("s1", "bob", models.RoleViewer); err != nil {
+			t.Fatal(err)
+		}
+		if review, err = WithdrawVerdict(store, "s1", "bob"); err != nil {
+			t.Fatal(err)
+		}
+		if review == nil || review.Status != models.ReviewInReview || len(review.Verdicts) != 0 {
+			t.Fatalf("unexpected review %+v", review)
+		}
+		if last := review.History[len(review.History)-1]; last.From != models.ReviewApproved || last.UserID != "owner" {
+			t.Fatalf("withdrawn by %+v", last)
+		}
+
+		if review, err = WithdrawVerdict(store, "s1", "bob"); err != nil || review != nil {
+			t.Fatalf("withdrawing twice: got %+v, %v", review, err)
+		}
+	})
+}
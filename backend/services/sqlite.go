@@ -0,0 +1,1644 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"codestream/models"
+)
+
+// SQLiteStore keeps sessions in a SQLite database so they survive restarts.
+// Broadcasts only reach this process, so it suits single-node deployments.
+// Unlike the Redis store it keeps every session's full operation history,
+// though its change history is compacted like the others.
+type SQLiteStore struct {
+	db        *sql.DB
+	broker    *broker
+	publishMu sync.Mutex // keeps broadcasts published in sequence order
+}
+
+// sessions.code and language mirror the main file. Sessions from before
+// workspaces have no files, and their blame is moved into files when they are
+// upgraded on first load.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id           TEXT PRIMARY KEY,
+	code         TEXT NOT NULL,
+	language     TEXT NOT NULL,
+	revision     INTEGER NOT NULL,
+	created_at   TEXT NOT NULL,
+	owner_id     TEXT NOT NULL,
+	default_role TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS participants (
+	session_id TEXT NOT NULL,
+	user_id    TEXT NOT NULL,
+	role       TEXT NOT NULL,
+	PRIMARY KEY (session_id, user_id)
+);
+CREATE TABLE IF NOT EXISTS presence (
+	session_id TEXT NOT NULL,
+	user_id    TEXT NOT NULL,
+	user       TEXT NOT NULL,
+	PRIMARY KEY (session_id, user_id)
+);
+CREATE TABLE IF NOT EXISTS presence_states (
+	session_id TEXT NOT NULL,
+	user_id    TEXT NOT NULL,
+	presence   TEXT NOT NULL,
+	PRIMARY KEY (session_id, user_id)
+);
+CREATE TABLE IF NOT EXISTS connections (
+	session_id TEXT NOT NULL,
+	id         TEXT NOT NULL,
+	user_id    TEXT NOT NULL,
+	expires_at INTEGER NOT NULL,
+	PRIMARY KEY (session_id, id)
+);
+CREATE TABLE IF NOT EXISTS ops (
+	session_id TEXT NOT NULL,
+	revision   INTEGER NOT NULL,
+	record     TEXT NOT NULL,
+	PRIMARY KEY (session_id, revision)
+);
+CREATE TABLE IF NOT EXISTS files (
+	session_id TEXT NOT NULL,
+	path       TEXT NOT NULL,
+	language   TEXT NOT NULL,
+	code       TEXT NOT NULL,
+	blame      TEXT NOT NULL,
+	main       INTEGER NOT NULL,
+	PRIMARY KEY (session_id, path)
+);
+CREATE TABLE IF NOT EXISTS blame (
+	session_id TEXT PRIMARY KEY,
+	lines      TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS history (
+	session_id TEXT NOT NULL,
+	ms         INTEGER NOT NULL,
+	seq        INTEGER NOT NULL,
+	entry      TEXT NOT NULL,
+	PRIMARY KEY (session_id, ms, seq)
+);
+CREATE TABLE IF NOT EXISTS snapshots (
+	session_id TEXT NOT NULL,
+	revision   INTEGER NOT NULL,
+	snapshot   TEXT NOT NULL,
+	PRIMARY KEY (session_id, revision)
+);
+CREATE TABLE IF NOT EXISTS events (
+	session_id TEXT NOT NULL,
+	seq        INTEGER NOT NULL,
+	message    BLOB NOT NULL,
+	PRIMARY KEY (session_id, seq)
+);
+CREATE TABLE IF NOT EXISTS event_seqs (
+	session_id TEXT PRIMARY KEY,
+	seq        INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS comments (
+	session_id TEXT NOT NULL,
+	id         TEXT NOT NULL,
+	thread_id  TEXT NOT NULL,
+	comment    TEXT NOT NULL,
+	PRIMARY KEY (session_id, id)
+);
+CREATE TABLE IF NOT EXISTS suggestions (
+	session_id TEXT NOT NULL,
+	id         TEXT NOT NULL,
+	suggestion TEXT NOT NULL,
+	PRIMARY KEY (session_id, id)
+);
+CREATE TABLE IF NOT EXISTS reviews (
+	session_id TEXT PRIMARY KEY,
+	review     TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS chat_messages (
+	session_id TEXT NOT NULL,
+	id         INTEGER NOT NULL,
+	message    TEXT NOT NULL,
+	PRIMARY KEY (session_id, id)
+);
+CREATE TABLE IF NOT EXISTS invites (
+	session_id TEXT NOT NULL,
+	id         TEXT NOT NULL,
+	invite     TEXT NOT NULL,
+	PRIMARY KEY (session_id, id)
+);
+`
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+
+	// One connection serializes writes, which is all SQLite allows anyway
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema: %w", err)
+	}
+
+	// Nobody is connected to a process that just started
+	if _, err := db.Exec(`DELETE FROM presence; DELETE FROM presence_states; DELETE FROM connections`); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{
+		db:     db,
+		broker: newBroker(),
+	}, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// sqlQuerier is satisfied by both *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s *SQLiteStore) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) CreateSession(session *models.Session) error {
+	initWorkspace(session)
+	return s.withTx(func(tx *sql.Tx) error {
+		if err := insertSession(tx, session); err != nil {
+			return err
+		}
+		return resetHistory(tx, session)
+	})
+}
+
+// insertSession stores session with every line of its files attributed to
+// the owner.
+func insertSession(q sqlQuerier, session *models.Session) error {
+	_, err := q.Exec(`INSERT INTO sessions (id, code, language, revision, created_at, owner_id, default_role)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		session.ID, session.Code, session.Language, session.Revision,
+		session.CreatedAt.Format(time.RFC3339Nano), session.OwnerID, string(session.DefaultRole))
+	if err != nil {
+		return err
+	}
+
+	for userID, role := range session.Roles {
+		if err := setParticipant(q, session.ID, userID, role); err != nil {
+			return err
+		}
+	}
+	for _, user := range session.Users {
+		if err := setPresence(q, session.ID, user); err != nil {
+			return err
+		}
+	}
+	for i := range session.Files {
+		file := &session.Files[i]
+		if err := setFile(q, session.ID, file, initialBlame(session, file), file.Path == session.MainFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) RestoreSession(archived *models.ArchivedSession) error {
+	session := &archived.Session
+	initWorkspace(session)
+	return s.withTx(func(tx *sql.Tx) error {
+		for _, table := range []string{"participants", "presence", "presence_states", "connections", "ops", "files", "blame", "history", "snapshots", "comments", "suggestions", "reviews", "chat_messages"} {
+			if _, err := tx.Exec(`DELETE FROM `+table+` WHERE session_id = ?`, session.ID); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM sessions WHERE id = ?`, session.ID); err != nil {
+			return err
+		}
+
+		if err := insertSession(tx, session); err != nil {
+			return err
+		}
+		for _, record := range trimOps(archived.Ops) {
+			recordJSON, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`INSERT INTO ops (session_id, revision, record) VALUES (?, ?, ?)`,
+				session.ID, record.Revision, string(recordJSON)); err != nil {
+				return err
+			}
+		}
+		for i := range archived.Comments {
+			if err := setComment(tx, &archived.Comments[i]); err != nil {
+				return err
+			}
+		}
+		for i := range archived.Suggestions {
+			if err := setSuggestion(tx, &archived.Suggestions[i]); err != nil {
+				return err
+			}
+		}
+		if archived.Review != nil {
+			if err := setReview(tx, session.ID, archived.Review); err != nil {
+				return err
+			}
+		}
+		for i := range archived.Messages {
+			if err := insertMessage(tx, &archived.Messages[i]); err != nil {
+				return err
+			}
+		}
+		if len(archived.Snapshots) == 0 {
+			return resetHistory(tx, session)
+		}
+		return restoreHistory(tx, session.ID, archived)
+	})
+}
+
+func (s *SQLiteStore) GetSession(sessionID string) (*models.Session, error) {
+	var session *models.Session
+	err := s.withTx(func(tx *sql.Tx) error {
+		var err error
+		session, err = loadSession(tx, sessionID)
+		return err
+	})
+	return session, err
+}
+
+func loadSession(q sqlQuerier, sessionID string) (*models.Session, error) {
+	session := &models.Session{ID: sessionID}
+	var createdAt, defaultRole string
+	err := q.QueryRow(`SELECT code, language, revision, created_at, owner_id, default_role FROM sessions WHERE id = ?`, sessionID).
+		Scan(&session.Code, &session.Language, &session.Revision, &createdAt, &session.OwnerID, &defaultRole)
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	session.DefaultRole = models.Role(defaultRole)
+	if session.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return nil, err
+	}
+
+	session.Roles = make(map[string]models.Role)
+	rows, err := q.Query(`SELECT user_id, role FROM participants WHERE session_id = ?`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID, role string
+		if err := rows.Scan(&userID, &role); err != nil {
+			return nil, err
+		}
+		session.Roles[userID] = models.Role(role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	session.Users = []models.User{}
+	rows, err = q.Query(`SELECT user FROM presence WHERE session_id = ? ORDER BY user_id`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var user models.User
+		if err := json.Unmarshal([]byte(data), &user); err != nil {
+			return nil, err
+		}
+		session.Users = append(session.Users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := loadFiles(q, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// loadFiles reads the workspace of session, upgrading sessions from before
+// workspaces to a one-file workspace.
+func loadFiles(q sqlQuerier, session *models.Session) error {
+	rows, err := q.Query(`SELECT path, language, code, main FROM files WHERE session_id = ? ORDER BY path`, session.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var file models.File
+		var main bool
+		if err := rows.Scan(&file.Path, &file.Language, &file.Code, &main); err != nil {
+			return err
+		}
+		if main {
+			session.MainFile = file.Path
+		}
+		session.Files = append(session.Files, file)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if session.MainFile != "" {
+		session.Code, session.Language = mainContent(&session.Workspace)
+		return nil
+	}
+
+	upgradeWorkspace(&session.Workspace, session.Code, session.Language)
+	var data string
+	err = q.QueryRow(`SELECT lines FROM blame WHERE session_id = ?`, session.ID).Scan(&data)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	blame, err := decodeBlame(data)
+	if err != nil {
+		return err
+	}
+	if err := setFile(q, session.ID, &session.Files[0], blame, true); err != nil {
+		return err
+	}
+	_, err = q.Exec(`DELETE FROM blame WHERE session_id = ?`, session.ID)
+	return err
+}
+
+func setFile(q sqlQuerier, sessionID string, file *models.File, blame []models.LineBlame, main bool) error {
+	blameJSON, err := json.Marshal(blame)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(`INSERT INTO files (session_id, path, language, code, blame, main) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (session_id, path) DO UPDATE SET
+			language = excluded.language, code = excluded.code, blame = excluded.blame, main = excluded.main`,
+		sessionID, file.Path, file.Language, file.Code, string(blameJSON), main)
+	return err
+}
+
+func setParticipant(q sqlQuerier, sessionID, userID string, role models.Role) error {
+	_, err := q.Exec(`INSERT INTO participants (session_id, user_id, role) VALUES (?, ?, ?)
+		ON CONFLICT (session_id, user_id) DO UPDATE SET role = excluded.role`,
+		sessionID, userID, string(role))
+	return err
+}
+
+func setPresence(q sqlQuerier, sessionID string, user models.User) error {
+	userJSON, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(`INSERT INTO presence (session_id, user_id, user) VALUES (?, ?, ?)
+		ON CONFLICT (session_id, user_id) DO UPDATE SET user = excluded.user`,
+		sessionID, user.ID, string(userJSON))
+	return err
+}
+
+// AdmitUser gives user a role in the session. Participants keep their role;
+// newcomers are given role, and rejected with ErrNotParticipant if it is
+// empty. The returned user carries their role.
+func (s *SQLiteStore) AdmitUser(sessionID string, user models.User, role models.Role) (*models.User, error) {
+	err := s.withTx(func(tx *sql.Tx) error {
+		session, err := loadSession(tx, sessionID)
+		if err != nil {
+			return err
+		}
+
+		role, err = admissionRole(session.Roles[user.ID], role)
+		if err != nil {
+			return err
+		}
+		user.Role = role
+		return setParticipant(tx, sessionID, user.ID, role)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// SetRole changes a participant's role. The owner's role can't be changed.
+func (s *SQLiteStore) SetRole(sessionID, userID string, role models.Role) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		session, err := loadSession(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		if err := checkRemovable(session, userID); err != nil {
+			return err
+		}
+
+		if err := setParticipant(tx, sessionID, userID, role); err != nil {
+			return err
+		}
+		for _, user := range session.Users {
+			if user.ID == userID {
+				user.Role = role
+				if err := setPresence(tx, sessionID, user); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveParticipant drops a participant's role and presence, recording that
+// they left if they were present. The owner can't be removed.
+func (s *SQLiteStore) RemoveParticipant(sessionID, userID string) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		session, err := loadSession(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		if err := checkRemovable(session, userID); err != nil {
+			return err
+		}
+
+		for _, table := range []string{"participants", "connections"} {
+			if _, err := tx.Exec(`DELETE FROM `+table+` WHERE session_id = ? AND user_id = ?`, sessionID, userID); err != nil {
+				return err
+			}
+		}
+		if isPresent(session, userID) {
+			if _, err := appendHistory(tx, sessionID, presenceEntry(models.HistoryLeave, userID, session.Revision)); err != nil {
+				return err
+			}
+		}
+		return deletePresence(tx, sessionID, userID)
+	})
+}
+
+func (s *SQLiteStore) Connect(sessionID string, user models.User, connID string) (bool, error) {
+	var first bool
+	err := s.withTx(func(tx *sql.Tx) error {
+		var revision int
+		err := tx.QueryRow(`SELECT revision FROM sessions WHERE id = ?`, sessionID).Scan(&revision)
+		if err == sql.ErrNoRows {
+			return ErrSessionNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var role string
+		err = tx.QueryRow(`SELECT role FROM participants WHERE session_id = ? AND user_id = ?`, sessionID, user.ID).Scan(&role)
+		if err == sql.ErrNoRows {
+			return ErrNotParticipant
+		}
+		if err != nil {
+			return err
+		}
+		user.Role = models.Role(role)
+
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM connections WHERE session_id = ? AND user_id = ?`,
+			sessionID, user.ID).Scan(&n); err != nil {
+			return err
+		}
+		first = n == 0
+
+		if _, err := tx.Exec(`INSERT INTO connections (session_id, id, user_id, expires_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (session_id, id) DO UPDATE SET expires_at = excluded.expires_at`,
+			sessionID, connID, user.ID, time.Now().Add(ConnectionLease).UnixMilli()); err != nil {
+			return err
+		}
+		if err := setPresence(tx, sessionID, user); err != nil {
+			return err
+		}
+		if first {
+			_, err = appendHistory(tx, sessionID, presenceEntry(models.HistoryJoin, user.ID, revision))
+		}
+		return err
+	})
+	return first, err
+}
+
+func (s *SQLiteStore) Disconnect(sessionID, connID string) (bool, error) {
+	var left bool
+	err := s.withTx(func(tx *sql.Tx) error {
+		var err error
+		_, left, err = disconnect(tx, sessionID, connID)
+		return err
+	})
+	return left, err
+}
+
+// disconnect drops connID and, if it was its user's last connection, the
+// user's presence. It returns the user and whether they left.
+func disconnect(q sqlQuerier, sessionID, connID string) (string, bool, error) {
+	var userID string
+	err := q.QueryRow(`SELECT user_id FROM connections WHERE session_id = ? AND id = ?`, sessionID, connID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if _, err := q.Exec(`DELETE FROM connections WHERE session_id = ? AND id = ?`, sessionID, connID); err != nil {
+		return "", false, err
+	}
+
+	var n, revision int
+	if err := q.QueryRow(`SELECT COUNT(*) FROM connections WHERE session_id = ? AND user_id = ?`,
+		sessionID, userID).Scan(&n); err != nil || n > 0 {
+		return userID, false, err
+	}
+	err = q.QueryRow(`SELECT revision FROM sessions WHERE id = ?`, sessionID).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return userID, false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	if err := deletePresence(q, sessionID, userID); err != nil {
+		return "", false, err
+	}
+	if _, err := appendHistory(q, sessionID, presenceEntry(models.HistoryLeave, userID, revision)); err != nil {
+		return "", false, err
+	}
+	return userID, true, nil
+}
+
+func (s *SQLiteStore) RenewConnections(sessionID string, connIDs []string) ([]string, error) {
+	var lost []string
+	expires := time.Now().Add(ConnectionLease).UnixMilli()
+	err := s.withTx(func(tx *sql.Tx) error {
+		lost = nil
+		for _, connID := range connIDs {
+			result, err := tx.Exec(`UPDATE connections SET expires_at = ? WHERE session_id = ? AND id = ?`,
+				expires, sessionID, connID)
+			if err != nil {
+				return err
+			}
+			if n, err := result.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				lost = append(lost, connID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lost, nil
+}
+
+func (s *SQLiteStore) ExpireConnections(now time.Time) ([]Departure, error) {
+	var departures []Departure
+	err := s.withTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT session_id, id FROM connections WHERE expires_at <= ?`, now.UnixMilli())
+		if err != nil {
+			return err
+		}
+		var expired [][2]string
+		for rows.Next() {
+			var sessionID, connID string
+			if err := rows.Scan(&sessionID, &connID); err != nil {
+				rows.Close()
+				return err
+			}
+			expired = append(expired, [2]string{sessionID, connID})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, conn := range expired {
+			userID, left, err := disconnect(tx, conn[0], conn[1])
+			if err != nil {
+				return err
+			}
+			if left {
+				departures = append(departures, Departure{SessionID: conn[0], UserID: userID})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortDepartures(departures)
+	return departures, nil
+}
+
+// deletePresence marks userID as gone, along with the presence they sent.
+func deletePresence(q sqlQuerier, sessionID, userID string) error {
+	for _, table := range []string{"presence", "presence_states"} {
+		if _, err := q.Exec(`DELETE FROM `+table+` WHERE session_id = ? AND user_id = ?`, sessionID, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SetPresence(sessionID string, presence *models.Presence) error {
+	presenceJSON, err := json.Marshal(presence)
+	if err != nil {
+		return err
+	}
+
+	return s.withTx(func(tx *sql.Tx) error {
+		if _, err := loadSession(tx, sessionID); err != nil {
+			return err
+		}
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM presence WHERE session_id = ? AND user_id = ?`,
+			sessionID, presence.UserID).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotParticipant
+		}
+
+		_, err := tx.Exec(`INSERT INTO presence_states (session_id, user_id, presence) VALUES (?, ?, ?)
+			ON CONFLICT (session_id, user_id) DO UPDATE SET presence = excluded.presence`,
+			sessionID, presence.UserID, string(presenceJSON))
+		return err
+	})
+}
+
+func (s *SQLiteStore) GetPresence(sessionID string) ([]models.Presence, error) {
+	rows, err := s.db.Query(`SELECT presence FROM presence_states WHERE session_id = ? ORDER BY user_id`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	presence := make([]models.Presence, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var p models.Presence
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			return nil, err
+		}
+		presence = append(presence, p)
+	}
+	return presence, rows.Err()
+}
+
+// UpdateContent replaces the code and/or language if the session is still at
+// the expected revision, and returns a *ConflictError otherwise.
+func (s *SQLiteStore) UpdateContent(sessionID, userID, path string, revision int, code, language *string) (*models.OpRecord, error) {
+	return s.commit(sessionID, func(tx *sql.Tx, session *models.Session) (*models.OpRecord, error) {
+		return contentRecord(session, userID, path, revision, code, language)
+	})
+}
+
+// ApplyEdit transforms ops, made against the given base revision, past every
+// operation committed since and applies the result to the file.
+func (s *SQLiteStore) ApplyEdit(sessionID, userID, path string, revision int, ops []models.OpComponent) (*models.OpRecord, error) {
+	if err := ValidateOps(ops); err != nil {
+		return nil, err
+	}
+
+	return s.commit(sessionID, func(tx *sql.Tx, session *models.Session) (*models.OpRecord, error) {
+		concurrent, err := opsSince(tx, sessionID, revision)
+		if err != nil {
+			return nil, err
+		}
+		return editRecord(session, userID, path, revision, ops, concurrent)
+	})
+}
+
+// ChangeFile creates, renames or deletes a file as the next revision.
+func (s *SQLiteStore) ChangeFile(sessionID, userID string, change *models.FileChange) (*models.OpRecord, error) {
+	return s.commit(sessionID, func(tx *sql.Tx, session *models.Session) (*models.OpRecord, error) {
+		return fileRecord(session, userID, change)
+	})
+}
+
+// commit applies the record built by fn to the session as the next revision
+// and appends it to the operation history, in one transaction.
+func (s *SQLiteStore) commit(sessionID string, fn func(tx *sql.Tx, session *models.Session) (*models.OpRecord, error)) (*models.OpRecord, error) {
+	var record *models.OpRecord
+	err := s.withTx(func(tx *sql.Tx) error {
+		session, err := loadSession(tx, sessionID)
+		if err != nil {
+			return err
+		}
+
+		record, err = fn(tx, session)
+		if err != nil {
+			return err
+		}
+		before := session.Workspace
+		if err := applyRecord(session, record); err != nil {
+			return err
+		}
+
+		blame, err := loadFileBlame(tx, sessionID, record.Path)
+		if err != nil {
+			return err
+		}
+		comments, err := loadComments(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		record.Comments = remapComments(comments, &before, record)
+		for i := range record.Comments {
+			if err := setComment(tx, &record.Comments[i]); err != nil {
+				return err
+			}
+		}
+		suggestions, err := loadSuggestions(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		record.Suggestions = rebaseSuggestions(suggestions, &before, record)
+		for i := range record.Suggestions {
+			if err := setSuggestion(tx, &record.Suggestions[i]); err != nil {
+				return err
+			}
+		}
+		review, err := loadReview(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		if reopenReview(review, record) {
+			record.Review = review
+			if err := setReview(tx, sessionID, review); err != nil {
+				return err
+			}
+		}
+		if record.Action == models.FileRename || record.Action == models.FileDelete {
+			if _, err := tx.Exec(`DELETE FROM files WHERE session_id = ? AND path = ?`, sessionID, record.Path); err != nil {
+				return err
+			}
+		}
+		if file := session.File(recordTarget(record)); file != nil {
+			if err := setFile(tx, sessionID, file, recordBlame(blame, &before, record), file.Path == session.MainFile); err != nil {
+				return err
+			}
+		}
+
+		recordJSON, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`UPDATE sessions SET code = ?, language = ?, revision = ? WHERE id = ?`,
+			session.Code, session.Language, session.Revision, sessionID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO ops (session_id, revision, record) VALUES (?, ?, ?)`,
+			sessionID, record.Revision, string(recordJSON)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM ops WHERE session_id = ? AND revision <= ?`,
+			sessionID, record.Revision-maxOpHistory); err != nil {
+			return err
+		}
+
+		var last string
+		for _, entry := range recordEntries(record) {
+			if last, err = appendHistory(tx, sessionID, entry); err != nil {
+				return err
+			}
+		}
+		if session.Revision%snapshotInterval == 0 {
+			return saveSnapshot(tx, sessionID, newSnapshot(session, last))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// GetOpsSince returns the recorded operations after the given revision,
+// oldest first.
+func (s *SQLiteStore) GetOpsSince(sessionID string, revision int) ([]models.OpRecord, error) {
+	return opsSince(s.db, sessionID, revision)
+}
+
+func opsSince(q sqlQuerier, sessionID string, revision int) ([]models.OpRecord, error) {
+	rows, err := q.Query(`SELECT record FROM ops WHERE session_id = ? AND revision > ? ORDER BY revision`, sessionID, revision)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]models.OpRecord, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var record models.OpRecord
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+func (s *SQLiteStore) GetBlame(sessionID, path string) ([]models.LineBlame, int, error) {
+	var blame []models.LineBlame
+	var revision int
+	err := s.withTx(func(tx *sql.Tx) error {
+		session, err := loadSession(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		path = resolvePath(&session.Workspace, path)
+		file := session.File(path)
+		if file == nil {
+			return ErrFileNotFound
+		}
+
+		if blame, err = loadFileBlame(tx, sessionID, path); err != nil {
+			return err
+		}
+		blame = checkBlame(blame, file.Code)
+		revision = session.Revision
+		return nil
+	})
+	return blame, revision, err
+}
+
+func loadFileBlame(q sqlQuerier, sessionID, path string) ([]models.LineBlame, error) {
+	var data string
+	err := q.QueryRow(`SELECT blame FROM files WHERE session_id = ? AND path = ?`, sessionID, path).Scan(&data)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return decodeBlame(data)
+}
+
+// resetHistory starts the history of session afresh from a snapshot of it.
+func resetHistory(q sqlQuerier, session *models.Session) error {
+	return saveSnapshot(q, session.ID, newSnapshot(session, firstEntryID.String()))
+}
+
+// restoreHistory writes an archived change log and snapshots back under
+// their original entry IDs.
+func restoreHistory(q sqlQuerier, sessionID string, archived *models.ArchivedSession) error {
+	for _, entry := range archived.History {
+		id, err := parseEntryID(entry.ID)
+		if err != nil {
+			return err
+		}
+		entryJSON, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if _, err := q.Exec(`INSERT INTO history (session_id, ms, seq, entry) VALUES (?, ?, ?, ?)`,
+			sessionID, id.ms, id.seq, string(entryJSON)); err != nil {
+			return err
+		}
+	}
+	for _, snapshot := range archived.Snapshots {
+		snapshotJSON, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+		if _, err := q.Exec(`INSERT INTO snapshots (session_id, revision, snapshot) VALUES (?, ?, ?)
+			ON CONFLICT (session_id, revision) DO UPDATE SET snapshot = excluded.snapshot`,
+			sessionID, snapshot.Revision, string(snapshotJSON)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendHistory(q sqlQuerier, sessionID string, entry models.HistoryEntry) (string, error) {
+	var last entryID
+	err := q.QueryRow(`SELECT ms, seq FROM history WHERE session_id = ? ORDER BY ms DESC, seq DESC LIMIT 1`, sessionID).
+		Scan(&last.ms, &last.seq)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	id := last.next(time.Now())
+	entry.ID = id.String()
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = q.Exec(`INSERT INTO history (session_id, ms, seq, entry) VALUES (?, ?, ?, ?)`,
+		sessionID, id.ms, id.seq, string(entryJSON))
+	return entry.ID, err
+}
+
+// saveSnapshot keeps snapshot, drops the oldest beyond maxSnapshots and
+// compacts away the history they covered.
+func saveSnapshot(q sqlQuerier, sessionID string, snapshot models.Snapshot) error {
+	snapshotJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	if _, err := q.Exec(`INSERT INTO snapshots (session_id, revision, snapshot) VALUES (?, ?, ?)
+		ON CONFLICT (session_id, revision) DO UPDATE SET snapshot = excluded.snapshot`,
+		sessionID, snapshot.Revision, string(snapshotJSON)); err != nil {
+		return err
+	}
+	if _, err := q.Exec(`DELETE FROM snapshots WHERE session_id = ? AND revision NOT IN
+		(SELECT revision FROM snapshots WHERE session_id = ? ORDER BY revision DESC LIMIT ?)`,
+		sessionID, sessionID, maxSnapshots); err != nil {
+		return err
+	}
+
+	var data string
+	if err := q.QueryRow(`SELECT snapshot FROM snapshots WHERE session_id = ? ORDER BY revision LIMIT 1`, sessionID).
+		Scan(&data); err != nil {
+		return err
+	}
+	var oldest models.Snapshot
+	if err := json.Unmarshal([]byte(data), &oldest); err != nil {
+		return err
+	}
+	id, err := parseEntryID(oldest.EntryID)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(`DELETE FROM history WHERE session_id = ? AND (ms, seq) < (?, ?)`, sessionID, id.ms, id.seq)
+	return err
+}
+
+func (s *SQLiteStore) GetHistory(sessionID, start, end string, count int) ([]models.HistoryEntry, error) {
+	return s.queryHistory(sessionID, start, end, count, "ms, seq")
+}
+
+func (s *SQLiteStore) GetHistoryReverse(sessionID, start, end string, count int) ([]models.HistoryEntry, error) {
+	return s.queryHistory(sessionID, start, end, count, "ms DESC, seq DESC")
+}
+
+func (s *SQLiteStore) queryHistory(sessionID, start, end string, count int, order string) ([]models.HistoryEntry, error) {
+	r, err := parseEntryRange(start, end)
+	if err != nil {
+		return nil, err
+	}
+	if count <= 0 {
+		count = -1
+	}
+
+	rows, err := s.db.Query(`SELECT entry FROM history
+		WHERE session_id = ? AND (ms, seq) >= (?, ?) AND (ms, seq) <= (?, ?)
+		ORDER BY `+order+` LIMIT ?`,
+		sessionID, r.start.ms, r.start.seq, r.end.ms, r.end.seq, count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]models.HistoryEntry, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var entry models.HistoryEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (s *SQLiteStore) GetSnapshots(sessionID string) ([]models.Snapshot, error) {
+	rows, err := s.db.Query(`SELECT snapshot FROM snapshots WHERE session_id = ? ORDER BY revision`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := make([]models.Snapshot, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var snapshot models.Snapshot
+		if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, rows.Err()
+}
+
+// AppendEvent stamps message with the session's next sequence number, keeps
+// it in the bounded replay log and returns its encoded form.
+func (s *SQLiteStore) AppendEvent(sessionID string, message *models.WSMessage) ([]byte, error) {
+	var data []byte
+	err := s.withTx(func(tx *sql.Tx) error {
+		err := tx.QueryRow(`INSERT INTO event_seqs (session_id, seq) VALUES (?, 1)
+			ON CONFLICT (session_id) DO UPDATE SET seq = seq + 1
+			RETURNING seq`, sessionID).Scan(&message.Seq)
+		if err != nil {
+			return err
+		}
+
+		data, err = json.Marshal(message)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`INSERT INTO events (session_id, seq, message) VALUES (?, ?, ?)`, sessionID, message.Seq, data); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM events WHERE session_id = ? AND seq <= ?`, sessionID, message.Seq-maxEventLog)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// GetEventsSince returns the logged messages with a sequence number above
+// seq, oldest first. ok is false when the log no longer reaches back that far.
+func (s *SQLiteStore) GetEventsSince(sessionID string, seq int64) (events [][]byte, ok bool, err error) {
+	err = s.withTx(func(tx *sql.Tx) error {
+		current, err := eventSeq(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		if seq >= current {
+			events, ok = [][]byte{}, seq == current
+			return nil
+		}
+
+		rows, err := tx.Query(`SELECT seq, message FROM events WHERE session_id = ? AND seq > ? ORDER BY seq`, sessionID, seq)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		events = make([][]byte, 0)
+		next := seq + 1
+		for rows.Next() {
+			var eventSeq int64
+			var data []byte
+			if err := rows.Scan(&eventSeq, &data); err != nil {
+				return err
+			}
+			if eventSeq != next {
+				events = nil
+				return nil
+			}
+			events = append(events, data)
+			next++
+		}
+		ok = len(events) > 0
+		if !ok {
+			events = nil
+		}
+		return rows.Err()
+	})
+	return events, ok, err
+}
+
+func (s *SQLiteStore) GetEventSeq(sessionID string) (int64, error) {
+	return eventSeq(s.db, sessionID)
+}
+
+func eventSeq(q sqlQuerier, sessionID string) (int64, error) {
+	var seq int64
+	err := q.QueryRow(`SELECT seq FROM event_seqs WHERE session_id = ?`, sessionID).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+func (s *SQLiteStore) Broadcast(sessionID string, message *models.WSMessage) error {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+
+	data, err := s.AppendEvent(sessionID, message)
+	if err != nil {
+		return err
+	}
+	return s.broker.publish(sessionID, newEnvelope(message, data))
+}
+
+func (s *SQLiteStore) Publish(sessionID string, message interface{}) error {
+	return s.broker.publish(sessionID, message)
+}
+
+func (s *SQLiteStore) Subscribe(sessionID string) Subscription {
+	return s.broker.subscribe(sessionID)
+}
+
+func (s *SQLiteStore) SaveInvite(invite *models.Invite) error {
+	return setInvite(s.db, invite)
+}
+
+func setInvite(q sqlQuerier, invite *models.Invite) error {
+	inviteJSON, err := json.Marshal(invite)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(`INSERT INTO invites (session_id, id, invite) VALUES (?, ?, ?)
+		ON CONFLICT (session_id, id) DO UPDATE SET invite = excluded.invite`,
+		invite.SessionID, invite.ID, string(inviteJSON))
+	return err
+}
+
+func (s *SQLiteStore) GetInvite(sessionID, inviteID string) (*models.Invite, error) {
+	return getInvite(s.db, sessionID, inviteID)
+}
+
+func getInvite(q sqlQuerier, sessionID, inviteID string) (*models.Invite, error) {
+	var data string
+	err := q.QueryRow(`SELECT invite FROM invites WHERE session_id = ? AND id = ?`, sessionID, inviteID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var invite models.Invite
+	if err := json.Unmarshal([]byte(data), &invite); err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// UseInvite counts one use of an invite, failing with ErrInviteUsedUp once
+// it has none left.
+func (s *SQLiteStore) UseInvite(sessionID, inviteID string) (*models.Invite, error) {
+	var invite *models.Invite
+	err := s.withTx(func(tx *sql.Tx) error {
+		var err error
+		invite, err = getInvite(tx, sessionID, inviteID)
+		if err != nil {
+			return err
+		}
+		if err := useInvite(invite); err != nil {
+			return err
+		}
+		return setInvite(tx, invite)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return invite, nil
+}
+
+func (s *SQLiteStore) SaveComment(comment *models.Comment, revision int) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		session, err := loadSession(tx, comment.SessionID)
+		if err != nil {
+			return err
+		}
+		var thread *models.Comment
+		if comment.ThreadID != "" {
+			thread, err = loadComment(tx, comment.SessionID, comment.ThreadID)
+			if err != nil && err != ErrCommentNotFound {
+				return err
+			}
+		}
+		if err := checkNewComment(session, comment, revision, thread); err != nil {
+			return err
+		}
+		return setComment(tx, comment)
+	})
+}
+
+func (s *SQLiteStore) UpdateComment(sessionID, commentID string, fn func(comment *models.Comment) error) (*models.Comment, error) {
+	var comment *models.Comment
+	err := s.withTx(func(tx *sql.Tx) error {
+		var err error
+		comment, err = loadComment(tx, sessionID, commentID)
+		if err != nil {
+			return err
+		}
+		if err := fn(comment); err != nil {
+			return err
+		}
+		return setComment(tx, comment)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return comment, nil
+}
+
+func (s *SQLiteStore) DeleteComment(sessionID, commentID string) ([]string, error) {
+	var deleted []string
+	err := s.withTx(func(tx *sql.Tx) error {
+		if _, err := loadComment(tx, sessionID, commentID); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(`SELECT id FROM comments WHERE session_id = ? AND (id = ? OR thread_id = ?)`, sessionID, commentID, commentID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			deleted = append(deleted, id)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`DELETE FROM comments WHERE session_id = ? AND (id = ? OR thread_id = ?)`, sessionID, commentID, commentID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
+
+func (s *SQLiteStore) GetComments(sessionID string) ([]models.Comment, error) {
+	return loadComments(s.db, sessionID)
+}
+
+func loadComments(q sqlQuerier, sessionID string) ([]models.Comment, error) {
+	rows, err := q.Query(`SELECT comment FROM comments WHERE session_id = ?`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := make([]models.Comment, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var comment models.Comment
+		if err := json.Unmarshal([]byte(data), &comment); err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	sortComments(comments)
+
+	return comments, rows.Err()
+}
+
+func loadComment(q sqlQuerier, sessionID, commentID string) (*models.Comment, error) {
+	var data string
+	err := q.QueryRow(`SELECT comment FROM comments WHERE session_id = ? AND id = ?`, sessionID, commentID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrCommentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var comment models.Comment
+	if err := json.Unmarshal([]byte(data), &comment); err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+func setComment(q sqlQuerier, comment *models.Comment) error {
+	commentJSON, err := json.Marshal(comment)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(`INSERT INTO comments (session_id, id, thread_id, comment) VALUES (?, ?, ?, ?)
+		ON CONFLICT (session_id, id) DO UPDATE SET comment = excluded.comment`,
+		comment.SessionID, comment.ID, comment.ThreadID, string(commentJSON))
+	return err
+}
+
+func (s *SQLiteStore) Suggest(sessionID, userID, path string, revision int, ops []models.OpComponent) (*models.Suggestion, error) {
+	if err := ValidateOps(ops); err != nil {
+		return nil, err
+	}
+
+	var suggestion *models.Suggestion
+	err := s.withTx(func(tx *sql.Tx) error {
+		session, err := loadSession(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		concurrent, err := opsSince(tx, sessionID, revision)
+		if err != nil {
+			return err
+		}
+		if suggestion, err = newSuggestion(session, userID, path, revision, ops, concurrent); err != nil {
+			return err
+		}
+		return setSuggestion(tx, suggestion)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return suggestion, nil
+}
+
+func (s *SQLiteStore) AcceptSuggestion(sessionID, suggestionID, userID string) (*models.OpRecord, error) {
+	return s.commit(sessionID, func(tx *sql.Tx, session *models.Session) (*models.OpRecord, error) {
+		suggestion, err := loadSuggestion(tx, sessionID, suggestionID)
+		if err != nil {
+			return nil, err
+		}
+		return acceptRecord(session, suggestion, userID)
+	})
+}
+
+func (s *SQLiteStore) UpdateSuggestion(sessionID, suggestionID string, fn func(suggestion *models.Suggestion) error) (*models.Suggestion, error) {
+	var suggestion *models.Suggestion
+	err := s.withTx(func(tx *sql.Tx) error {
+		var err error
+		suggestion, err = loadSuggestion(tx, sessionID, suggestionID)
+		if err != nil {
+			return err
+		}
+		if err := fn(suggestion); err != nil {
+			return err
+		}
+		return setSuggestion(tx, suggestion)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return suggestion, nil
+}
+
+func (s *SQLiteStore) GetSuggestions(sessionID string) ([]models.Suggestion, error) {
+	return loadSuggestions(s.db, sessionID)
+}
+
+func loadSuggestions(q sqlQuerier, sessionID string) ([]models.Suggestion, error) {
+	rows, err := q.Query(`SELECT suggestion FROM suggestions WHERE session_id = ?`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := make([]models.Suggestion, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var suggestion models.Suggestion
+		if err := json.Unmarshal([]byte(data), &suggestion); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	sortSuggestions(suggestions)
+
+	return suggestions, rows.Err()
+}
+
+func loadSuggestion(q sqlQuerier, sessionID, suggestionID string) (*models.Suggestion, error) {
+	var data string
+	err := q.QueryRow(`SELECT suggestion FROM suggestions WHERE session_id = ? AND id = ?`, sessionID, suggestionID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrSuggestionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var suggestion models.Suggestion
+	if err := json.Unmarshal([]byte(data), &suggestion); err != nil {
+		return nil, err
+	}
+	return &suggestion, nil
+}
+
+func setSuggestion(q sqlQuerier, suggestion *models.Suggestion) error {
+	suggestionJSON, err := json.Marshal(suggestion)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(`INSERT INTO suggestions (session_id, id, suggestion) VALUES (?, ?, ?)
+		ON CONFLICT (session_id, id) DO UPDATE SET suggestion = excluded.suggestion`,
+		suggestion.SessionID, suggestion.ID, string(suggestionJSON))
+	return err
+}
+
+func (s *SQLiteStore) GetReview(sessionID string) (*models.Review, error) {
+	return loadReview(s.db, sessionID)
+}
+
+func (s *SQLiteStore) UpdateReview(sessionID string, fn func(session *models.Session, review *models.Review) error) (*models.Review, error) {
+	var review *models.Review
+	err := s.withTx(func(tx *sql.Tx) error {
+		session, err := loadSession(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		review, err = loadReview(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		if err := fn(session, review); err != nil {
+			return err
+		}
+		return setReview(tx, sessionID, review)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return review, nil
+}
+
+// loadReview reads the session's review, which is in draft if nobody has
+// changed it yet.
+func loadReview(q sqlQuerier, sessionID string) (*models.Review, error) {
+	var data string
+	err := q.QueryRow(`SELECT review FROM reviews WHERE session_id = ?`, sessionID).Scan(&data)
+	if err == sql.ErrNoRows {
+		if _, err := loadSession(q, sessionID); err != nil {
+			return nil, err
+		}
+		return newReview(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	review := newReview()
+	if err := json.Unmarshal([]byte(data), review); err != nil {
+		return nil, err
+	}
+	return review, nil
+}
+
+func setReview(q sqlQuerier, sessionID string, review *models.Review) error {
+	reviewJSON, err := json.Marshal(review)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(`INSERT INTO reviews (session_id, review) VALUES (?, ?)
+		ON CONFLICT (session_id) DO UPDATE SET review = excluded.review`,
+		sessionID, string(reviewJSON))
+	return err
+}
+
+func (s *SQLiteStore) SaveMessage(message *models.ChatMessage) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		if _, err := loadSession(tx, message.SessionID); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(`SELECT COALESCE(MAX(id), 0) + 1 FROM chat_messages WHERE session_id = ?`,
+			message.SessionID).Scan(&message.ID); err != nil {
+			return err
+		}
+		if err := insertMessage(tx, message); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM chat_messages WHERE session_id = ? AND id <= ?`,
+			message.SessionID, message.ID-maxChatHistory)
+		return err
+	})
+}
+
+func (s *SQLiteStore) GetMessages(sessionID string, before int64, limit int) ([]models.ChatMessage, error) {
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(`SELECT message FROM chat_messages WHERE session_id = ? AND id < ? ORDER BY id DESC LIMIT ?`,
+		sessionID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]models.ChatMessage, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var message models.ChatMessage
+		if err := json.Unmarshal([]byte(data), &message); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Newest first from the query, oldest first to the caller
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func insertMessage(q sqlQuerier, message *models.ChatMessage) error {
+	messageJSON, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(`INSERT INTO chat_messages (session_id, id, message) VALUES (?, ?, ?)`,
+		message.SessionID, message.ID, string(messageJSON))
+	return err
+}
+
+func (s *SQLiteStore) ListInvites(sessionID string) ([]models.Invite, error) {
+	rows, err := s.db.Query(`SELECT invite FROM invites WHERE session_id = ?`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := make([]models.Invite, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var invite models.Invite
+		if err := json.Unmarshal([]byte(data), &invite); err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].CreatedAt.Before(invites[j].CreatedAt)
+	})
+
+	return invites, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteInvite(sessionID, inviteID string) error {
+	result, err := s.db.Exec(`DELETE FROM invites WHERE session_id = ? AND id = ?`, sessionID, inviteID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
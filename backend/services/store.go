@@ -0,0 +1,381 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"codestream/models"
+)
+
+// SessionStore is the session storage the handlers depend on. RedisService
+// is the default; MemoryStore and SQLiteStore suit tests and single-node
+// deployments.
+type SessionStore interface {
+	// CreateSession and RestoreSession give sessions without a workspace a
+	// one-file workspace holding their code.
+	CreateSession(session *models.Session) error
+	GetSession(sessionID string) (*models.Session, error)
+	// AdmitUser gives user a role without making them present, which only
+	// connecting does.
+	AdmitUser(sessionID string, user models.User, role models.Role) (*models.User, error)
+	// SetPresence keeps the latest presence of a present user, failing with
+	// ErrNotParticipant for anyone else. Leaving or being removed drops it.
+	SetPresence(sessionID string, presence *models.Presence) error
+	GetPresence(sessionID string) ([]models.Presence, error)
+	SetRole(sessionID, userID string, role models.Role) error
+	// RemoveParticipant also drops the participant's connections.
+	RemoveParticipant(sessionID, userID string) error
+
+	// Connections keep their user present, so a user with several tabs open
+	// stays until the last one closes. Each is leased for ConnectionLease
+	// and renewed by whichever instance holds it, and ExpireConnections
+	// drops those an instance stopped renewing, say because it crashed.
+	// Connect marks an admitted user present along with their connection,
+	// failing with ErrNotParticipant for anyone else, and reports whether
+	// it is their first. Disconnect reports whether it was their last, in
+	// which case they leave. Unknown connections are ignored, except that
+	// RenewConnections returns those it can't renew, whose leases already
+	// ran out. Even when ExpireConnections fails, it returns the users who
+	// did leave.
+	Connect(sessionID string, user models.User, connID string) (bool, error)
+	Disconnect(sessionID, connID string) (bool, error)
+	RenewConnections(sessionID string, connIDs []string) ([]string, error)
+	ExpireConnections(now time.Time) ([]Departure, error)
+
+	// RestoreSession replaces a session with an archived copy, along with
+	// its operation history, change log and snapshots, comments,
+	// suggestions, review and chat. Archives without snapshots start the
+	// change log afresh.
+	RestoreSession(archived *models.ArchivedSession) error
+
+	// Writes address the file at path, or the main file if path is empty.
+	// Every write to any file makes the next session revision.
+	UpdateContent(sessionID, userID, path string, revision int, code, language *string) (*models.OpRecord, error)
+	ApplyEdit(sessionID, userID, path string, revision int, ops []models.OpComponent) (*models.OpRecord, error)
+	ChangeFile(sessionID, userID string, change *models.FileChange) (*models.OpRecord, error)
+	GetOpsSince(sessionID string, revision int) ([]models.OpRecord, error)
+	// GetBlame attributes each line of a file at the returned revision to
+	// whoever last touched it, as tracked by every commit.
+	GetBlame(sessionID, path string) ([]models.LineBlame, int, error)
+
+	// Comments are anchored to lines of a file, and every commit moves the
+	// anchors on the file it changes, returning those moved in the record.
+	// SaveComment adds a comment anchored as of revision, and fails with
+	// ErrRevisionChanged if the session has moved on since. DeleteComment
+	// deletes replies along with their thread and returns the IDs deleted.
+	SaveComment(comment *models.Comment, revision int) error
+	UpdateComment(sessionID, commentID string, fn func(comment *models.Comment) error) (*models.Comment, error)
+	DeleteComment(sessionID, commentID string) ([]string, error)
+	GetComments(sessionID string) ([]models.Comment, error)
+
+	// Suggestions are edits proposed rather than applied. Suggest checks and
+	// transforms ops as ApplyEdit does, but saves them as a pending
+	// suggestion. Every commit rebases the pending suggestions on the file
+	// it changes. AcceptSuggestion commits a pending suggestion as an edit
+	// by its author, which marks it accepted.
+	Suggest(sessionID, userID, path string, revision int, ops []models.OpComponent) (*models.Suggestion, error)
+	AcceptSuggestion(sessionID, suggestionID, userID string) (*models.OpRecord, error)
+	UpdateSuggestion(sessionID, suggestionID string, fn func(suggestion *models.Suggestion) error) (*models.Suggestion, error)
+	GetSuggestions(sessionID string) ([]models.Suggestion, error)
+
+	// The review is kept whole, and sessions nobody has asked to review are
+	// in draft. UpdateReview applies fn to it atomically, along with the
+	// session as of the same moment, which fn must not modify. Commits
+	// send approved reviews back for review.
+	GetReview(sessionID string) (*models.Review, error)
+	UpdateReview(sessionID string, fn func(session *models.Session, review *models.Review) error) (*models.Review, error)
+
+	// SaveMessage numbers a chat message as the session's next and keeps it
+	// among the latest maxChatHistory. GetMessages returns up to limit of
+	// those before the ID before, oldest first; zero for before pages from
+	// the newest and zero for limit returns them all.
+	SaveMessage(message *models.ChatMessage) error
+	GetMessages(sessionID string, before int64, limit int) ([]models.ChatMessage, error)
+
+	// The history logs every committed edit and language change, along with
+	// joins and leaves. GetHistory reads entries between two IDs the way
+	// XRANGE does, at most count of them unless count is zero, and
+	// GetHistoryReverse reads them newest first, as XREVRANGE does.
+	// Snapshots are taken every snapshotInterval revisions, and history
+	// from before the oldest one kept is compacted away. GetSnapshots
+	// returns those kept, oldest first.
+	GetHistory(sessionID, start, end string, count int) ([]models.HistoryEntry, error)
+	GetHistoryReverse(sessionID, start, end string, count int) ([]models.HistoryEntry, error)
+	GetSnapshots(sessionID string) ([]models.Snapshot, error)
+
+	// Broadcast stamps message with the session's next sequence number,
+	// logs it for replay and publishes it as an Envelope, as one step so
+	// that subscribers everywhere see a session's messages in sequence
+	// order. AppendEvent only stamps and logs.
+	Broadcast(sessionID string, message *models.WSMessage) error
+	AppendEvent(sessionID string, message *models.WSMessage) ([]byte, error)
+	GetEventsSince(sessionID string, seq int64) (events [][]byte, ok bool, err error)
+	GetEventSeq(sessionID string) (int64, error)
+	Publish(sessionID string, message interface{}) error
+	Subscribe(sessionID string) Subscription
+
+	SaveInvite(invite *models.Invite) error
+	GetInvite(sessionID, inviteID string) (*models.Invite, error)
+	UseInvite(sessionID, inviteID string) (*models.Invite, error)
+	ListInvites(sessionID string) ([]models.Invite, error)
+	DeleteInvite(sessionID, inviteID string) error
+
+	Close() error
+}
+
+// ConnectionLease is how long a connection keeps its user present unless
+// it is renewed.
+const ConnectionLease = 90 * time.Second
+
+// maxOpHistory bounds how many operations every store keeps per session for
+// transforming late edits. Edits based on older revisions are rejected.
+const maxOpHistory = 1000
+
+// maxEventLog bounds the per-session log of broadcast messages every store
+// keeps for replay. It stays below a client's send buffer so a replay
+// always fits.
+const maxEventLog = 200
+
+// Departure is a user who left a session when their last connection's lease
+// ran out.
+type Departure struct {
+	SessionID string
+	UserID    string
+}
+
+// Envelope is what Broadcast publishes to a session, so every instance can
+// deliver the message to its own clients while skipping Exclude, the
+// connection it came from.
+type Envelope struct {
+	Exclude string          `json:"exclude,omitempty"`
+	Type    string          `json:"type"`
+	UserID  string          `json:"user_id,omitempty"`
+	Message json.RawMessage `json:"message"`
+}
+
+func newEnvelope(message *models.WSMessage, data []byte) Envelope {
+	return Envelope{Exclude: message.Origin, Type: message.Type, UserID: message.UserID, Message: data}
+}
+
+// Subscription delivers the messages published to one session until closed.
+type Subscription interface {
+	Messages() <-chan []byte
+	Close() error
+}
+
+// NewSessionStore opens the store named by SESSION_STORE: "redis" (the
+// default), "memory", or "sqlite" with its database at SQLITE_PATH.
+func NewSessionStore() (SessionStore, error) {
+	switch kind := os.Getenv("SESSION_STORE"); kind {
+	case "", "redis":
+		return NewRedisService(), nil
+	case "memory":
+		return NewMemoryStore(), nil
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "codestream.db"
+		}
+		return NewSQLiteStore(path)
+	default:
+		return nil, fmt.Errorf("unknown SESSION_STORE %q", kind)
+	}
+}
+
+// The rules below are shared by every store, which only differ in how they
+// load and save atomically.
+
+// admissionRole is the role a joining user gets: the one they already have,
+// or else the one they were invited with.
+func admissionRole(existing, invited models.Role) (models.Role, error) {
+	if existing != "" {
+		return existing, nil
+	}
+	if invited == "" {
+		return "", ErrNotParticipant
+	}
+	return invited, nil
+}
+
+// checkRemovable reports whether userID is a participant other than the
+// owner, whose role is fixed.
+func checkRemovable(session *models.Session, userID string) error {
+	if _, ok := session.Roles[userID]; !ok {
+		return ErrNotParticipant
+	}
+	if userID == session.OwnerID {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// contentRecord checks a whole-file write against session and builds the
+// record for it.
+func contentRecord(session *models.Session, userID, path string, revision int, code, language *string) (*models.OpRecord, error) {
+	if !session.CanEdit(userID) {
+		return nil, ErrForbidden
+	}
+
+	path = resolvePath(&session.Workspace, path)
+	file := session.File(path)
+	if file == nil {
+		return nil, ErrFileNotFound
+	}
+
+	if revision != session.Revision {
+		return nil, &ConflictError{
+			Revision: session.Revision,
+			Path:     path,
+			Code:     file.Code,
+			Language: file.Language,
+		}
+	}
+
+	record := &models.OpRecord{UserID: userID, Path: path, Ops: []models.OpComponent{}}
+	if code != nil {
+		// Record the replacement as an operation so concurrent edits can
+		// still be transformed against it.
+		record.Ops = ReplaceOps(file.Code, *code)
+	}
+	if language != nil {
+		record.Language = *language
+	}
+	return record, nil
+}
+
+// editRecord checks an edit against session and transforms its ops, made
+// against the given base revision, past the records committed since. The
+// edit follows its file through renames.
+func editRecord(session *models.Session, userID, path string, revision int, ops []models.OpComponent, concurrent []models.OpRecord) (*models.OpRecord, error) {
+	if !session.CanEdit(userID) {
+		return nil, ErrForbidden
+	}
+
+	if revision < 0 || revision > session.Revision {
+		return nil, fmt.Errorf("invalid revision %d", revision)
+	}
+	if len(concurrent) != session.Revision-revision {
+		return nil, fmt.Errorf("revision %d is too old", revision)
+	}
+
+	if path == "" {
+		// The main file, by the name it had at the base revision
+		path = session.MainFile
+		for i := len(concurrent) - 1; i >= 0; i-- {
+			if concurrent[i].Action == models.FileRename && concurrent[i].NewPath == path {
+				path = concurrent[i].Path
+			}
+		}
+	}
+
+	for _, record := range concurrent {
+		// Records without a path predate workspaces, when there was one file
+		if record.Path != path && record.Path != "" {
+			continue
+		}
+		switch record.Action {
+		case models.FileRename:
+			path = record.NewPath
+		case models.FileCreate, models.FileDelete:
+			return nil, ErrFileNotFound
+		default:
+			ops, _ = TransformOps(ops, record.Ops)
+		}
+	}
+	return &models.OpRecord{UserID: userID, Path: path, Ops: ops}, nil
+}
+
+// fileRecord checks a change to the file tree against session and builds
+// the record for it. Whether the paths are free is checked when it is
+// applied.
+func fileRecord(session *models.Session, userID string, change *models.FileChange) (*models.OpRecord, error) {
+	if !session.CanEdit(userID) {
+		return nil, ErrForbidden
+	}
+	if err := change.Validate(); err != nil {
+		return nil, err
+	}
+
+	record := &models.OpRecord{
+		UserID: userID,
+		Path:   change.Path,
+		Action: change.Action,
+		Ops:    []models.OpComponent{},
+	}
+	switch change.Action {
+	case models.FileCreate:
+		record.Language = change.Language
+		if record.Language == "" {
+			record.Language = languageOf(change.Path)
+		}
+		if change.Code != "" {
+			record.Ops = []models.OpComponent{{Insert: change.Code}}
+		}
+	case models.FileRename:
+		record.NewPath = change.NewPath
+	}
+	return record, nil
+}
+
+// applyRecord applies record to session as its next revision.
+func applyRecord(session *models.Session, record *models.OpRecord) error {
+	workspace, err := applyToWorkspace(session.Workspace, record)
+	if err != nil {
+		return err
+	}
+
+	session.Workspace = workspace
+	session.Code, session.Language = mainContent(&session.Workspace)
+	session.Revision++
+
+	record.Revision = session.Revision
+	record.Timestamp = time.Now().UnixMilli()
+	return nil
+}
+
+// trimOps drops all but the latest maxOpHistory of ops.
+func trimOps(ops []models.OpRecord) []models.OpRecord {
+	if len(ops) > maxOpHistory {
+		return ops[len(ops)-maxOpHistory:]
+	}
+	return ops
+}
+
+// isPresent reports whether userID is connected to session.
+func isPresent(session *models.Session, userID string) bool {
+	for _, user := range session.Users {
+		if user.ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// sortPresence orders presence by user ID.
+func sortPresence(presence []models.Presence) {
+	sort.Slice(presence, func(i, j int) bool {
+		return presence[i].UserID < presence[j].UserID
+	})
+}
+
+// sortDepartures orders departures by session, then user.
+func sortDepartures(departures []Departure) {
+	sort.Slice(departures, func(i, j int) bool {
+		if departures[i].SessionID != departures[j].SessionID {
+			return departures[i].SessionID < departures[j].SessionID
+		}
+		return departures[i].UserID < departures[j].UserID
+	})
+}
+
+// useInvite counts one use of invite if it has any left.
+func useInvite(invite *models.Invite) error {
+	if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+		return ErrInviteUsedUp
+	}
+	invite.Uses++
+	return nil
+}
@@ -0,0 +1,596 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"codestream/models"
+)
+
+// forEachStore runs test against a fresh instance of every SessionStore.
+func forEachStore(t *testing.T, test func(t *testing.T, store SessionStore)) {
+	t.Run("redis", func(t *testing.T) {
+		test(t, newTestRedis(t))
+	})
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		test(t, store)
+	})
+}
+
+func createTestSession(t *testing.T, store SessionStore, sessionID string) {
+	t.Helper()
+
+	err := store.CreateSession(&models.Session{
+		ID:       sessionID,
+		Language: "go",
+		Users:    []models.User{},
+		OwnerID:  "owner",
+		Roles:    map[string]models.Role{"owner": models.RoleOwner},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// parallel runs fn n times concurrently and fails the test on any error.
+func parallel(t *testing.T, n int, fn func(i int) error) {
+	t.Helper()
+
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := fn(i); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// joinUser admits userID with role and connects them the way a websocket
+// client does, over a connection named after them.
+func joinUser(store SessionStore, sessionID, userID string, role models.Role) error {
+	user, err := store.AdmitUser(sessionID, models.User{ID: userID, Name: userID}, role)
+	if err != nil {
+		return err
+	}
+	_, err = store.Connect(sessionID, *user, userID)
+	return err
+}
+
+// writeUntilAccepted retries a whole-document write on conflicts, the way a
+// client rebases on the state it is sent back.
+func writeUntilAccepted(store SessionStore, sessionID, userID string, change func(code string) string) error {
+	revision, code := 0, ""
+	for {
+		next := change(code)
+		_, err := store.UpdateContent(sessionID, userID, "", revision, &next, nil)
+		var conflict *ConflictError
+		if !errors.As(err, &conflict) {
+			return err
+		}
+		revision, code = conflict.Revision, conflict.Code
+	}
+}
+
+func TestConcurrentJoinsKeepEveryUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s")
+
+		const users = 50
+		parallel(t, users, func(i int) error {
+			return joinUser(store, "s", fmt.Sprintf("u%d", i), models.RoleEditor)
+		})
+
+		session, err := store.GetSession("s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(session.Users) != users {
+			t.Fatalf("expected %d present users, got %d", users, len(session.Users))
+		}
+		if len(session.Roles) != users+1 {
+			t.Fatalf("expected %d roles, got %d", users+1, len(session.Roles))
+		}
+	})
+}
+
+func TestJoinsAndLeavesDontClobberEachOther(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s")
+
+		for i := 0; i < 20; i++ {
+			if err := joinUser(store, "s", fmt.Sprintf("leaver%d", i), models.RoleEditor); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		parallel(t, 40, func(i int) error {
+			if i%2 == 0 {
+				_, err := store.Disconnect("s", fmt.Sprintf("leaver%d", i/2))
+				return err
+			}
+			return joinUser(store, "s", fmt.Sprintf("joiner%d", i/2), models.RoleViewer)
+		})
+
+		session, err := store.GetSession("s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range session.Users {
+			if !strings.HasPrefix(u.ID, "joiner") {
+				t.Fatalf("%s is still present after leaving", u.ID)
+			}
+		}
+		if len(session.Users) != 20 {
+			t.Fatalf("expected 20 joiners present, got %d", len(session.Users))
+		}
+	})
+}
+
+func TestJoinsRacingWritesLoseNothing(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s")
+
+		const writers = 20
+		const joiners = 20
+		parallel(t, writers+joiners, func(i int) error {
+			if i < joiners {
+				return joinUser(store, "s", fmt.Sprintf("u%d", i), models.RoleEditor)
+			}
+			line := fmt.Sprintf("line %d\n", i)
+			return writeUntilAccepted(store, "s", "owner", func(code string) string { return code + line })
+		})
+
+		session, err := store.GetSession("s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(session.Users) != joiners {
+			t.Fatalf("expected %d present users, got %d", joiners, len(session.Users))
+		}
+		if session.Revision != writers {
+			t.Fatalf("expected revision %d, got %d", writers, session.Revision)
+		}
+		for i := joiners; i < joiners+writers; i++ {
+			if !strings.Contains(session.Code, fmt.Sprintf("line %d\n", i)) {
+				t.Fatalf("write %d was lost: %q", i, session.Code)
+			}
+		}
+	})
+}
+
+func TestConcurrentEditsAllApply(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s")
+
+		// Every edit is based on the empty document and inserts its own letter
+		const edits = 26
+		parallel(t, edits, func(i int) error {
+			ops := []models.OpComponent{{Insert: string(rune('a' + i))}}
+			_, err := store.ApplyEdit("s", "owner", "", 0, ops)
+			return err
+		})
+
+		session, err := store.GetSession("s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.Revision != edits {
+			t.Fatalf("expected revision %d, got %d", edits, session.Revision)
+		}
+
+		letters := strings.Split(session.Code, "")
+		sort.Strings(letters)
+		if got := strings.Join(letters, ""); got != "abcdefghijklmnopqrstuvwxyz" {
+			t.Fatalf("expected every letter once, got %q", session.Code)
+		}
+
+		ops, err := store.GetOpsSince("s", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, record := range ops {
+			if record.Revision != i+1 {
+				t.Fatalf("history out of order at %d: revision %d", i, record.Revision)
+			}
+		}
+	})
+}
+
+func TestInviteUsesAreCountedExactly(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s")
+
+		invite := &models.Invite{ID: "i", SessionID: "s", Role: models.RoleEditor, MaxUses: 5}
+		if err := store.SaveInvite(invite); err != nil {
+			t.Fatal(err)
+		}
+
+		var mu sync.Mutex
+		accepted := 0
+		parallel(t, 30, func(i int) error {
+			_, err := store.UseInvite("s", "i")
+			if errors.Is(err, ErrInviteUsedUp) {
+				return nil
+			}
+			if err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+			return err
+		})
+
+		if accepted != 5 {
+			t.Fatalf("expected 5 accepted uses, got %d", accepted)
+		}
+		stored, err := store.GetInvite("s", "i")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Uses != 5 {
+			t.Fatalf("expected 5 recorded uses, got %d", stored.Uses)
+		}
+	})
+}
+
+func TestParticipantRules(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s")
+
+		if _, err := store.AdmitUser("s", models.User{ID: "stranger"}, ""); !errors.Is(err, ErrNotParticipant) {
+			t.Fatalf("expected ErrNotParticipant for an uninvited user, got %v", err)
+		}
+		if _, err := store.AdmitUser("missing", models.User{ID: "a"}, models.RoleEditor); !errors.Is(err, ErrSessionNotFound) {
+			t.Fatalf("expected ErrSessionNotFound, got %v", err)
+		}
+
+		user, err := store.AdmitUser("s", models.User{ID: "a"}, models.RoleViewer)
+		if err != nil || user.Role != models.RoleViewer {
+			t.Fatalf("expected viewer, got %v %v", user, err)
+		}
+		// Returning participants keep their role whatever they are invited as
+		if user, _ = store.AdmitUser("s", models.User{ID: "a"}, models.RoleEditor); user.Role != models.RoleViewer {
+			t.Fatalf("expected role to stay viewer, got %s", user.Role)
+		}
+
+		if _, err := store.UpdateContent("s", "a", "", 0, nil, nil); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("expected viewers to be refused writes, got %v", err)
+		}
+		if err := store.SetRole("s", "owner", models.RoleViewer); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("expected the owner's role to be fixed, got %v", err)
+		}
+		if err := store.SetRole("s", "a", models.RoleEditor); err != nil {
+			t.Fatal(err)
+		}
+
+		// Admitted users are only present once they connect
+		session, err := store.GetSession("s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(session.Users) != 0 {
+			t.Fatalf("expected nobody present before connecting, got %+v", session.Users)
+		}
+		if _, err := store.Connect("s", models.User{ID: "stranger"}, "x"); !errors.Is(err, ErrNotParticipant) {
+			t.Fatalf("expected ErrNotParticipant connecting an uninvited user, got %v", err)
+		}
+		if _, err := store.Connect("s", models.User{ID: "a"}, "a1"); err != nil {
+			t.Fatal(err)
+		}
+
+		session, err = store.GetSession("s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.RoleOf("a") != models.RoleEditor || len(session.Users) != 1 || session.Users[0].Role != models.RoleEditor {
+			t.Fatalf("role change not stored: %+v", session)
+		}
+
+		if err := store.RemoveParticipant("s", "a"); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.RemoveParticipant("s", "a"); !errors.Is(err, ErrNotParticipant) {
+			t.Fatalf("expected ErrNotParticipant, got %v", err)
+		}
+		if session, _ = store.GetSession("s"); len(session.Users) != 0 || session.RoleOf("a") != "" {
+			t.Fatalf("participant not removed: %+v", session)
+		}
+
+		// Being removed while present is leaving, as far as the history goes
+		entries, err := store.GetHistoryReverse("s", "-", "+", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Type != models.HistoryLeave || entries[0].UserID != "a" {
+			t.Fatalf("expected a leave by a last, got %+v", entries)
+		}
+	})
+}
+
+func TestPresenceIsKeptWhilePresent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s")
+		for _, userID := range []string{"owner", "a"} {
+			if err := joinUser(store, "s", userID, models.RoleEditor); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		cursor := models.Position{Line: 3, Column: 1}
+		for _, userID := range []string{"owner", "a"} {
+			err := store.SetPresence("s", &models.Presence{
+				UserID:     userID,
+				Path:       "main.go",
+				Selections: []models.Selection{{Anchor: cursor, Head: cursor}},
+				Typing:     userID == "a",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.SetPresence("s", &models.Presence{UserID: "gone"}); !errors.Is(err, ErrNotParticipant) {
+			t.Fatalf("expected ErrNotParticipant for an absent user, got %v", err)
+		}
+
+		// The latest presence replaces the earlier one
+		viewport := &models.Viewport{FirstLine: 1, LastLine: 40}
+		if err := store.SetPresence("s", &models.Presence{UserID: "owner", Viewport: viewport}); err != nil {
+			t.Fatal(err)
+		}
+		presence, err := store.GetPresence("s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(presence) != 2 || presence[0].UserID != "a" || !presence[0].Typing ||
+			presence[1].UserID != "owner" || *presence[1].Viewport != *viewport || len(presence[1].Selections) != 0 {
+			t.Fatalf("unexpected presence %+v", presence)
+		}
+
+		if _, err := store.Disconnect("s", "a"); err != nil {
+			t.Fatal(err)
+		}
+		if presence, _ = store.GetPresence("s"); len(presence) != 1 || presence[0].UserID != "owner" {
+			t.Fatalf("expected the leaver's presence dropped, got %+v", presence)
+		}
+	})
+}
+
+func TestConnectionsKeepTheirUserPresent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s")
+		for _, userID := range []string{"a", "b", "c"} {
+			if _, err := store.AdmitUser("s", models.User{ID: userID}, models.RoleEditor); err != nil {
+				t.Fatal(err)
+			}
+		}
+		present := func(userID string) bool {
+			t.Helper()
+			session, err := store.GetSession("s")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return isPresent(session, userID)
+		}
+
+		// Two tabs of the same user count as one presence
+		for i, connID := range []string{"a1", "a2"} {
+			first, err := store.Connect("s", models.User{ID: "a"}, connID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first != (i == 0) {
+				t.Fatalf("connection %s reported first=%v", connID, first)
+			}
+		}
+		if left, err := store.Disconnect("s", "a1"); err != nil || left || !present("a") {
+			t.Fatalf("closing one of two tabs: left=%v err=%v present=%v", left, err, present("a"))
+		}
+		if left, err := store.Disconnect("s", "a2"); err != nil || !left || present("a") {
+			t.Fatalf("closing the last tab: left=%v err=%v present=%v", left, err, present("a"))
+		}
+		if left, err := store.Disconnect("s", "a2"); err != nil || left {
+			t.Fatalf("closing a closed tab: left=%v err=%v", left, err)
+		}
+
+		// Removed participants take their connections with them
+		if _, err := store.Connect("s", models.User{ID: "c"}, "c1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.RemoveParticipant("s", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if left, err := store.Disconnect("s", "c1"); err != nil || left {
+			t.Fatalf("closing a removed participant's tab: left=%v err=%v", left, err)
+		}
+
+		// Connections nobody renews expire, along with their users
+		for _, conn := range []struct{ userID, connID string }{{"b", "b1"}, {"owner", "o1"}} {
+			if _, err := store.AdmitUser("s", models.User{ID: conn.userID}, ""); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Connect("s", models.User{ID: conn.userID}, conn.connID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		lost, err := store.RenewConnections("s", []string{"b1", "o1", "gone"})
+		if err != nil || !reflect.DeepEqual(lost, []string{"gone"}) {
+			t.Fatalf("expected only the unknown connection lost, got %v %v", lost, err)
+		}
+		departures, err := store.ExpireConnections(time.Now())
+		if err != nil || len(departures) != 0 {
+			t.Fatalf("expected live leases kept, got %v %v", departures, err)
+		}
+		departures, err = store.ExpireConnections(time.Now().Add(ConnectionLease + time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Departure{{SessionID: "s", UserID: "b"}, {SessionID: "s", UserID: "owner"}}
+		if !reflect.DeepEqual(departures, want) || present("b") || present("owner") {
+			t.Fatalf("expected %v to expire, got %v", want, departures)
+		}
+		if departures, _ = store.ExpireConnections(time.Now().Add(ConnectionLease + time.Second)); len(departures) != 0 {
+			t.Fatalf("expected connections to expire once, got %v", departures)
+		}
+
+		// Expired leases aren't renewed, so their sockets can be closed to
+		// reconnect
+		if lost, err = store.RenewConnections("s", []string{"b1"}); err != nil || !reflect.DeepEqual(lost, []string{"b1"}) {
+			t.Fatalf("expected the expired connection lost, got %v %v", lost, err)
+		}
+		if present("b") {
+			t.Fatal("renewing an expired connection made its user present again")
+		}
+	})
+}
+
+func TestOpHistoryIsTrimmed(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s")
+
+		for revision := 0; revision <= maxOpHistory; revision++ {
+			if _, err := store.ApplyEdit("s", "owner", "", revision, []models.OpComponent{{Insert: "x"}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ops, err := store.GetOpsSince("s", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ops) != maxOpHistory || ops[0].Revision != 2 {
+			t.Fatalf("expected the latest %d operations from revision 2, got %d", maxOpHistory, len(ops))
+		}
+
+		// Edits need every operation since their base revision
+		if _, err := store.ApplyEdit("s", "owner", "", 0, []models.OpComponent{{Insert: "y"}}); err == nil {
+			t.Fatal("expected an edit older than the history to be rejected")
+		}
+		if _, err := store.ApplyEdit("s", "owner", "", 1, []models.OpComponent{{Insert: "y"}}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestEventLogReplay(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		for i := 0; i < 3; i++ {
+			if _, err := store.AppendEvent("s", &models.WSMessage{Type: "cursor_move"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		events, ok, err := store.GetEventsSince("s", 1)
+		if err != nil || !ok || len(events) != 2 {
+			t.Fatalf("expected 2 events since 1, got %d %v %v", len(events), ok, err)
+		}
+		if events, ok, _ = store.GetEventsSince("s", 3); !ok || len(events) != 0 {
+			t.Fatalf("expected an up to date client to get nothing, got %d %v", len(events), ok)
+		}
+		if _, ok, _ = store.GetEventsSince("s", 7); ok {
+			t.Fatal("expected a sequence from the future to need a snapshot")
+		}
+
+		for i := 0; i < maxEventLog; i++ {
+			store.AppendEvent("s", &models.WSMessage{Type: "cursor_move"})
+		}
+		if _, ok, _ = store.GetEventsSince("s", 1); ok {
+			t.Fatal("expected a trimmed log to need a snapshot")
+		}
+		if events, ok, _ = store.GetEventsSince("s", 3); !ok || len(events) != maxEventLog {
+			t.Fatalf("expected the latest %d events kept, got %d %v", maxEventLog, len(events), ok)
+		}
+		if seq, _ := store.GetEventSeq("s"); seq != 3+maxEventLog {
+			t.Fatalf("expected seq %d, got %d", 3+maxEventLog, seq)
+		}
+	})
+}
+
+func TestBroadcastsArriveInSequence(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		sub := store.Subscribe("s")
+		defer sub.Close()
+
+		const broadcasts = 50
+		parallel(t, broadcasts, func(i int) error {
+			return store.Broadcast("s", &models.WSMessage{Type: "cursor_move", Origin: fmt.Sprint(i)})
+		})
+
+		for want := int64(1); want <= broadcasts; want++ {
+			select {
+			case data := <-sub.Messages():
+				var env Envelope
+				var message models.WSMessage
+				if err := json.Unmarshal(data, &env); err != nil {
+					t.Fatal(err)
+				}
+				if err := json.Unmarshal(env.Message, &message); err != nil {
+					t.Fatal(err)
+				}
+				if message.Seq != want || env.Exclude != message.Origin || env.Type != "cursor_move" {
+					t.Fatalf("expected seq %d, got %s", want, data)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("broadcast %d was not delivered", want)
+			}
+		}
+
+		events, ok, err := store.GetEventsSince("s", 0)
+		if err != nil || !ok || len(events) != broadcasts {
+			t.Fatalf("expected every broadcast logged, got %d %v %v", len(events), ok, err)
+		}
+	})
+}
+
+func TestPublishReachesSubscribers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		sub := store.Subscribe("s")
+		defer sub.Close()
+		other := store.Subscribe("other")
+		defer other.Close()
+
+		if err := store.Publish("s", map[string]string{"type": "ping"}); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case msg := <-sub.Messages():
+			if string(msg) != `{"type":"ping"}` {
+				t.Fatalf("unexpected message %s", msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message was not delivered")
+		}
+
+		select {
+		case msg := <-other.Messages():
+			t.Fatalf("other session received %s", msg)
+		default:
+		}
+	})
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+
+	"codestream/models"
+)
+
+var (
+	ErrSuggestionNotFound = errors.New("suggestion not found")
+	ErrSuggestionClosed   = errors.New("suggestion is no longer pending")
+	ErrInvalidSuggestion  = errors.New("suggestion does not apply")
+)
+
+// RejectSuggestion closes a pending suggestion without applying it, which
+// the owner and its author may do.
+func RejectSuggestion(store SessionStore, sessionID, userID, suggestionID string) (*models.Suggestion, error) {
+	session, err := store.GetSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.UpdateSuggestion(sessionID, suggestionID, func(suggestion *models.Suggestion) error {
+		if err := checkResolvable(session, suggestion, userID); err != nil {
+			return err
+		}
+		now := time.Now()
+		suggestion.Status = models.SuggestionRejected
+		suggestion.ResolvedAt = &now
+		return nil
+	})
+}
+
+// The rules below are shared by the stores.
+
+// newSuggestion checks a proposed edit against session and transforms its
+// ops, made against the given base revision, past the records committed
+// since, as for an edit.
+func newSuggestion(session *models.Session, userID, path string, revision int, ops []models.OpComponent, concurrent []models.OpRecord) (*models.Suggestion, error) {
+	record, err := editRecord(session, userID, path, revision, ops, concurrent)
+	if errors.Is(err, ErrForbidden) || errors.Is(err, ErrFileNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSuggestion, err)
+	}
+	file := session.File(record.Path)
+	if file == nil {
+		return nil, ErrFileNotFound
+	}
+	if _, err := ApplyOps(file.Code, record.Ops); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSuggestion, err)
+	}
+
+	suggestion := &models.Suggestion{
+		ID:        uuid.New().String(),
+		SessionID: session.ID,
+		UserID:    userID,
+		Path:      record.Path,
+		Revision:  session.Revision,
+		Ops:       record.Ops,
+		Status:    models.SuggestionPending,
+		CreatedAt: time.Now(),
+	}
+	suggestion.Start, suggestion.End = opsRange(record.Ops)
+	return suggestion, nil
+}
+
+// checkResolvable reports whether userID may accept or reject suggestion.
+func checkResolvable(session *models.Session, suggestion *models.Suggestion, userID string) error {
+	if suggestion.Status != models.SuggestionPending {
+		return ErrSuggestionClosed
+	}
+	if userID != session.OwnerID && (userID != suggestion.UserID || !session.CanEdit(userID)) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// acceptRecord builds the record applying suggestion, which userID accepts,
+// as an edit by its author. Pending suggestions always apply as they are.
+func acceptRecord(session *models.Session, suggestion *models.Suggestion, userID string) (*models.OpRecord, error) {
+	if suggestion == nil {
+		return nil, ErrSuggestionNotFound
+	}
+	if err := checkResolvable(session, suggestion, userID); err != nil {
+		return nil, err
+	}
+
+	return &models.OpRecord{
+		UserID:     suggestion.UserID,
+		Path:       suggestion.Path,
+		Ops:        suggestion.Ops,
+		Suggestion: suggestion.ID,
+	}, nil
+}
+
+// rebaseSuggestions carries the pending suggestions among suggestions
+// through record, applied to the workspace before, and returns those it
+// changed.
+func rebaseSuggestions(suggestions []models.Suggestion, before *models.Workspace, record *models.OpRecord) []models.Suggestion {
+	var changed []models.Suggestion
+	for _, suggestion := range suggestions {
+		if rebaseSuggestion(&suggestion, before, record) {
+			changed = append(changed, suggestion)
+		}
+	}
+	return changed
+}
+
+// rebaseSuggestion carries suggestion through record, applied to the
+// workspace before, and reports whether it changed.
+func rebaseSuggestion(suggestion *models.Suggestion, before *models.Workspace, record *models.OpRecord) bool {
+	if suggestion.Status != models.SuggestionPending || suggestion.Path != resolvePath(before, record.Path) {
+		return false
+	}
+
+	now := time.Now()
+	switch {
+	case record.Suggestion == suggestion.ID:
+		suggestion.Status = models.SuggestionAccepted
+		suggestion.ResolvedAt = &now
+	case record.Action == models.FileRename:
+		suggestion.Path = record.NewPath
+	case record.Action == models.FileDelete:
+		suggestion.Status = models.SuggestionOutdated
+		suggestion.ResolvedAt = &now
+	case record.Action == models.FileCreate:
+		return false
+	default:
+		ops, _ := TransformOps(suggestion.Ops, record.Ops)
+
+		// Once any of the text it replaces is gone, it no longer says what
+		// its author meant, like a comment whose lines were deleted. Inserts
+		// survive transforms, so this also catches suggestions left empty.
+		if deletedRunes(ops) < deletedRunes(suggestion.Ops) {
+			suggestion.Status = models.SuggestionOutdated
+			suggestion.ResolvedAt = &now
+			break
+		}
+		suggestion.Ops = ops
+		suggestion.Start, suggestion.End = opsRange(suggestion.Ops)
+	}
+	suggestion.Revision = record.Revision
+	return true
+}
+
+func deletedRunes(ops []models.OpComponent) int {
+	n := 0
+	for _, c := range ops {
+		n += c.Delete
+	}
+	return n
+}
+
+// opsRange returns the runes of the document from the first to the last
+// that ops touch, as a start and end offset.
+func opsRange(ops []models.OpComponent) (int, int) {
+	start, end := -1, 0
+	pos := 0
+	for _, c := range ops {
+		switch {
+		case c.Retain > 0:
+			pos += c.Retain
+			continue
+		case c.Delete > 0:
+			if start < 0 {
+				start = pos
+			}
+			pos += c.Delete
+		case c.Insert != "":
+			if start < 0 {
+				start = pos
+			}
+		}
+		end = pos
+	}
+	if start < 0 {
+		return 0, 0
+	}
+	return start, end
+}
+
+// sortSuggestions orders suggestions oldest first.
+func sortSuggestions(suggestions []models.Suggestion) {
+	sort.Slice(suggestions, func(i, j int) bool {
+		if !suggestions[i].CreatedAt.Equal(suggestions[j].CreatedAt) {
+			return suggestions[i].CreatedAt.Before(suggestions[j].CreatedAt)
+		}
+		return suggestions[i].ID < suggestions[j].ID
+	})
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"codestream/models"
+)
+
+func TestOpsRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		ops        []models.OpComponent
+		start, end int
+	}{
+		{"insert", []models.OpComponent{{Retain: 3}, {Insert: "x"}}, 3, 3},
+		{"delete", []models.OpComponent{{Retain: 3}, {Delete: 2}}, 3, 5},
+		{"replace", []models.OpComponent{{Retain: 1}, {Delete: 2}, {Insert: "ab"}, {Retain: 4}, {Delete: 1}}, 1, 8},
+		{"nothing", []models.OpComponent{{Retain: 3}}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if start, end := opsRange(tt.ops); start != tt.start || end != tt.end {
+				t.Fatalf("range %d-%d, want %d-%d", start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestSuggestionsAreRebasedAndAccepted(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+		for userID, role := range map[string]models.Role{"bob": models.RoleEditor, "eve": models.RoleEditor} {
+			if _, err := store.AdmitUser("s1", models.User{ID: userID}, role); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		code := "hello world\n"
+		if _, err := store.UpdateContent("s1", "owner", "", 0, &code, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.ApplyEdit("s1", "owner", "", 1, []models.OpComponent{{Insert: "// hi\n"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Made against revision 1, before the header went in
+		suggestion, err := store.Suggest("s1", "bob", "", 1, []models.OpComponent{{Retain: 6}, {Delete: 5}, {Insert: "there"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if suggestion.Path != "main.go" || suggestion.Start != 12 || suggestion.End != 17 || suggestion.Status != models.SuggestionPending {
+			t.Fatalf("unexpected suggestion %+v", suggestion)
+		}
+		if _, err := store.Suggest("s1", "bob", "", 2, []models.OpComponent{{Retain: 40}, {Insert: "x"}}); !errors.Is(err, ErrInvalidSuggestion) {
+			t.Fatalf("suggesting past the end: got %v, want ErrInvalidSuggestion", err)
+		}
+
+		session, err := store.GetSession("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.Code != "// hi\n"+code {
+			t.Fatalf("suggesting changed the code to %q", session.Code)
+		}
+
+		record, err := store.ApplyEdit("s1", "owner", "", 2, []models.OpComponent{{Insert: "\n"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(record.Suggestions) != 1 || record.Suggestions[0].Start != 13 || record.Suggestions[0].Revision != 3 {
+			t.Fatalf("rebased suggestions %+v, want bob's moved past the newline", record.Suggestions)
+		}
+
+		if _, err := store.AcceptSuggestion("s1", suggestion.ID, "eve"); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("accepting another's suggestion: got %v, want ErrForbidden", err)
+		}
+		if _, err := RejectSuggestion(store, "s1", "eve", suggestion.ID); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("rejecting another's suggestion: got %v, want ErrForbidden", err)
+		}
+
+		record, err = store.AcceptSuggestion("s1", suggestion.ID, "owner")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.UserID != "bob" || record.Suggestion != suggestion.ID || record.Revision != 4 {
+			t.Fatalf("unexpected record %+v", record)
+		}
+		if len(record.Suggestions) != 1 || record.Suggestions[0].Status != models.SuggestionAccepted {
+			t.Fatalf("closed suggestions %+v, want bob's accepted", record.Suggestions)
+		}
+		if _, err := store.AcceptSuggestion("s1", suggestion.ID, "owner"); !errors.Is(err, ErrSuggestionClosed) {
+			t.Fatalf("accepting twice: got %v, want ErrSuggestionClosed", err)
+		}
+
+		session, err = store.GetSession("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.Code != "\n// hi\nhello there\n" {
+			t.Fatalf("accepted code is %q", session.Code)
+		}
+		blame, _, err := store.GetBlame("s1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blame[2].UserID != "bob" {
+			t.Fatalf("blame %v, want the suggested line credited to bob", blame)
+		}
+	})
+}
+
+func TestSuggestionsCloseWithTheirFile(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+		if _, err := store.ChangeFile("s1", "owner", &models.FileChange{Action: models.FileCreate, Path: "a.go", Code: "package a\n"}); err != nil {
+			t.Fatal(err)
+		}
+
+		rejected, err := store.Suggest("s1", "owner", "a.go", 1, []models.OpComponent{{Insert: "// a\n"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := RejectSuggestion(store, "s1", "owner", rejected.ID); err != nil {
+			t.Fatal(err)
+		}
+		pending, err := store.Suggest("s1", "owner", "a.go", 1, []models.OpComponent{{Insert: "// b\n"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := store.ChangeFile("s1", "owner", &models.FileChange{Action: models.FileRename, Path: "a.go", NewPath: "b.go"}); err != nil {
+			t.Fatal(err)
+		}
+		record, err := store.ChangeFile("s1", "owner", &models.FileChange{Action: models.FileDelete, Path: "b.go"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(record.Suggestions) != 1 || record.Suggestions[0].ID != pending.ID {
+			t.Fatalf("closed suggestions %+v, want only the pending one", record.Suggestions)
+		}
+
+		suggestions, err := store.GetSuggestions("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(suggestions) != 2 || suggestions[0].Status != models.SuggestionRejected ||
+			suggestions[1].Status != models.SuggestionOutdated || suggestions[1].Path != "b.go" {
+			t.Fatalf("unexpected suggestions %+v", suggestions)
+		}
+	})
+}
+
+func TestSuggestionsGoOutdatedWithTheirText(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+		code := "hello world\n"
+		if _, err := store.UpdateContent("s1", "owner", "", 0, &code, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		replaced, err := store.Suggest("s1", "owner", "", 1, []models.OpComponent{{Retain: 6}, {Delete: 5}, {Insert: "there"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted, err := store.Suggest("s1", "owner", "", 1, []models.OpComponent{{Retain: 8}, {Delete: 3}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept, err := store.Suggest("s1", "owner", "", 1, []models.OpComponent{{Delete: 1}, {Insert: "H"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Deleting "rld" takes away part of what the first replaces and all
+		// the second deletes
+		if _, err := store.ApplyEdit("s1", "owner", "", 1, []models.OpComponent{{Retain: 8}, {Delete: 3}}); err != nil {
+			t.Fatal(err)
+		}
+
+		suggestions, err := store.GetSuggestions("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses := map[string]string{}
+		for _, suggestion := range suggestions {
+			statuses[suggestion.ID] = suggestion.Status
+		}
+		if statuses[replaced.ID] != models.SuggestionOutdated || statuses[deleted.ID] != models.SuggestionOutdated ||
+			statuses[kept.ID] != models.SuggestionPending {
+			t.Fatalf("unexpected suggestions %+v", suggestions)
+		}
+		if _, err := store.AcceptSuggestion("s1", replaced.ID, "owner"); !errors.Is(err, ErrSuggestionClosed) {
+			t.Fatalf("accepting an outdated suggestion: got %v, want ErrSuggestionClosed", err)
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"codestream/models"
+)
+
+var (
+	ErrFileNotFound = errors.New("file not found")
+	ErrFileExists   = errors.New("path is taken by another file")
+	ErrMainFile     = errors.New("the main file can't be deleted")
+)
+
+// languageExtensions maps languages to the extension of their files.
+var languageExtensions = map[string]string{
+	"javascript": ".js",
+	"typescript": ".ts",
+	"python":     ".py",
+	"go":         ".go",
+	"java":       ".java",
+	"c":          ".c",
+	"cpp":        ".cpp",
+	"csharp":     ".cs",
+	"rust":       ".rs",
+	"ruby":       ".rb",
+	"php":        ".php",
+	"shell":      ".sh",
+	"html":       ".html",
+	"css":        ".css",
+	"json":       ".json",
+	"markdown":   ".md",
+	"sql":        ".sql",
+}
+
+// mainFileName names the file a single-file session's code becomes.
+func mainFileName(language string) string {
+	if ext, ok := languageExtensions[language]; ok {
+		return "main" + ext
+	}
+	return "main.txt"
+}
+
+// languageOf guesses the language of a new file from its extension.
+func languageOf(p string) string {
+	ext := path.Ext(p)
+	for language, e := range languageExtensions {
+		if e == ext {
+			return language
+		}
+	}
+	return "plaintext"
+}
+
+// upgradeWorkspace turns the content of a session or snapshot from before
+// workspaces into a one-file workspace holding code.
+func upgradeWorkspace(w *models.Workspace, code, language string) {
+	if w.MainFile != "" {
+		return
+	}
+	w.MainFile = mainFileName(language)
+	w.Files = []models.File{{Path: w.MainFile, Language: language, Code: code}}
+}
+
+// initWorkspace gives a new session a one-file workspace holding its code
+// if it has none, and mirrors the main file into it otherwise.
+func initWorkspace(session *models.Session) {
+	upgradeWorkspace(&session.Workspace, session.Code, session.Language)
+	session.Code, session.Language = mainContent(&session.Workspace)
+}
+
+// mainContent returns the code and language of the main file, which
+// sessions and snapshots mirror.
+func mainContent(w *models.Workspace) (string, string) {
+	main := w.File(w.MainFile)
+	if main == nil {
+		return "", ""
+	}
+	return main.Code, main.Language
+}
+
+// resolvePath returns the file a write addresses: p, or the main file.
+func resolvePath(w *models.Workspace, p string) string {
+	if p == "" {
+		return w.MainFile
+	}
+	return p
+}
+
+// recordTarget is the path of the file record leaves behind, if any.
+func recordTarget(record *models.OpRecord) string {
+	if record.Action == models.FileRename {
+		return record.NewPath
+	}
+	return record.Path
+}
+
+// applyToWorkspace returns a copy of w with record applied.
+func applyToWorkspace(w models.Workspace, record *models.OpRecord) (models.Workspace, error) {
+	next := models.Workspace{
+		MainFile: w.MainFile,
+		Files:    append([]models.File{}, w.Files...),
+	}
+	p := resolvePath(&w, record.Path)
+
+	switch record.Action {
+	case "":
+		file := next.File(p)
+		if file == nil {
+			return w, ErrFileNotFound
+		}
+		code, err := ApplyOps(file.Code, record.Ops)
+		if err != nil {
+			return w, err
+		}
+		file.Code = code
+		if record.Language != "" {
+			file.Language = record.Language
+		}
+
+	case models.FileCreate:
+		if err := checkPathFree(&next, p, ""); err != nil {
+			return w, err
+		}
+		code, err := ApplyOps("", record.Ops)
+		if err != nil {
+			return w, err
+		}
+		next.Files = append(next.Files, models.File{Path: p, Language: record.Language, Code: code})
+
+	case models.FileRename:
+		file := next.File(p)
+		if file == nil {
+			return w, ErrFileNotFound
+		}
+		if err := checkPathFree(&next, record.NewPath, p); err != nil {
+			return w, err
+		}
+		file.Path = record.NewPath
+		if next.MainFile == p {
+			next.MainFile = record.NewPath
+		}
+
+	case models.FileDelete:
+		if next.File(p) == nil {
+			return w, ErrFileNotFound
+		}
+		if p == next.MainFile {
+			return w, ErrMainFile
+		}
+		files := next.Files[:0]
+		for _, file := range next.Files {
+			if file.Path != p {
+				files = append(files, file)
+			}
+		}
+		next.Files = files
+
+	default:
+		return w, fmt.Errorf("unknown file action %q", record.Action)
+	}
+
+	sort.Slice(next.Files, func(i, j int) bool {
+		return next.Files[i].Path < next.Files[j].Path
+	})
+	return next, nil
+}
+
+// checkPathFree reports ErrFileExists unless a file can be put at p: no
+// other file than except is there, in a directory p, or at a directory of
+// p.
+func checkPathFree(w *models.Workspace, p, except string) error {
+	for _, file := range w.Files {
+		if file.Path == except {
+			continue
+		}
+		if file.Path == p || strings.HasPrefix(file.Path, p+"/") || strings.HasPrefix(p, file.Path+"/") {
+			return ErrFileExists
+		}
+	}
+	return nil
+}
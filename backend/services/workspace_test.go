@@ -0,0 +1,114 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"codestream/models"
+)
+
+func TestWorkspaceFileChanges(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+
+		change := func(action, path, newPath, code string) (*models.OpRecord, error) {
+			return store.ChangeFile("s1", "owner", &models.FileChange{Action: action, Path: path, NewPath: newPath, Code: code})
+		}
+
+		record, err := change(models.FileCreate, "lib/util.go", "", "package lib\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Revision != 1 || record.Language != "go" {
+			t.Fatalf("created at revision %d as %q, want 1 as go", record.Revision, record.Language)
+		}
+		for _, path := range []string{"lib/util.go", "lib", "lib/util.go/x"} {
+			if _, err := change(models.FileCreate, path, "", ""); !errors.Is(err, ErrFileExists) {
+				t.Fatalf("creating %s: got %v, want ErrFileExists", path, err)
+			}
+		}
+
+		if _, err := store.ApplyEdit("s1", "owner", "lib/util.go", 1, []models.OpComponent{{Retain: 12}, {Insert: "// a\n"}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := change(models.FileRename, "lib/util.go", "lib/helpers.go", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		// Written against the old path, before the rename
+		record, err = store.ApplyEdit("s1", "owner", "lib/util.go", 2, []models.OpComponent{{Retain: 12}, {Insert: "// b\n"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Path != "lib/helpers.go" || record.Revision != 4 {
+			t.Fatalf("edit landed on %s at revision %d, want lib/helpers.go at 4", record.Path, record.Revision)
+		}
+
+		if _, err := change(models.FileDelete, "main.go", "", ""); !errors.Is(err, ErrMainFile) {
+			t.Fatalf("deleting the main file: got %v, want ErrMainFile", err)
+		}
+		if _, err := change(models.FileDelete, "lib/helpers.go", "", ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.ApplyEdit("s1", "owner", "lib/helpers.go", 4, []models.OpComponent{{Insert: "x"}}); !errors.Is(err, ErrFileNotFound) {
+			t.Fatalf("editing a deleted file: got %v, want ErrFileNotFound", err)
+		}
+		if _, _, err := store.GetBlame("s1", "lib/helpers.go"); !errors.Is(err, ErrFileNotFound) {
+			t.Fatalf("blame of a deleted file: got %v, want ErrFileNotFound", err)
+		}
+
+		if _, err := change(models.FileRename, "main.go", "cmd/main.go", ""); err != nil {
+			t.Fatal(err)
+		}
+		code := "package main\n"
+		if _, err := store.UpdateContent("s1", "owner", "", 6, &code, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		session, err := store.GetSession("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.MainFile != "cmd/main.go" || len(session.Files) != 1 || session.Code != code {
+			t.Fatalf("unexpected workspace %+v", session.Workspace)
+		}
+
+		snapshot, err := Rebuild(store, "s1", 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := snapshot.File("lib/helpers.go")
+		if file == nil || file.Code != "package lib\n// b\n// a\n" || snapshot.MainFile != "main.go" {
+			t.Fatalf("unexpected workspace at revision 4: %+v", snapshot.Workspace)
+		}
+	})
+}
+
+func TestBlameIsPerFile(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store SessionStore) {
+		createTestSession(t, store, "s1")
+		if _, err := store.AdmitUser("s1", models.User{ID: "bob"}, models.RoleEditor); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := store.ChangeFile("s1", "bob", &models.FileChange{Action: models.FileCreate, Path: "a.go", Code: "a\nb\n"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.ChangeFile("s1", "owner", &models.FileChange{Action: models.FileRename, Path: "a.go", NewPath: "b.go"}); err != nil {
+			t.Fatal(err)
+		}
+
+		blame, revision, err := store.GetBlame("s1", "b.go")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob := models.LineBlame{UserID: "bob", Revision: 1}
+		if revision != 2 || len(blame) != 2 || blame[0] != bob || blame[1] != bob {
+			t.Fatalf("blame %v at revision %d, want bob's lines kept through the rename", blame, revision)
+		}
+
+		if blame, _, err = store.GetBlame("s1", ""); err != nil || len(blame) != 0 {
+			t.Fatalf("blame of the main file: %v, %v", blame, err)
+		}
+	})
+}
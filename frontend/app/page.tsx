@@ -23,11 +23,12 @@ import {
 import Link from 'next/link'
 import { useRouter } from 'next/navigation'
 import { useState, useRef } from 'react'
-import { getBackendUrl } from '@/lib/utils'
+import { useBackend } from '@/hooks/use-backend'
 
 export default function Home() {
   const router = useRouter()
   const { user } = useUser()
+  const { backendFetch } = useBackend()
   const [creating, setCreating] = useState(false)
   const containerRef = useRef<HTMLDivElement>(null)
   
@@ -42,7 +43,7 @@ export default function Home() {
   const createSession = async () => {
     setCreating(true)
     try {
-        const response = await fetch(`${getBackendUrl()}/api/sessions`, {
+        const response = await backendFetch('/api/sessions', {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
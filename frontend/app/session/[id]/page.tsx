@@ -1,7 +1,7 @@
 'use client'
 
 import { useEffect, useState, useCallback, useRef } from 'react'
-import { useParams, useRouter } from 'next/navigation'
+import { useParams, useRouter, useSearchParams } from 'next/navigation'
 import { useUser } from '@clerk/nextjs'
 import { EditorComponent } from '@/components/Editor'
 import { AIPanel } from '@/components/AIPanel'
@@ -10,8 +10,10 @@ import { UserList } from '@/components/UserList'
 import { Button } from '@/components/ui/button'
 import { Badge } from '@/components/ui/badge'
 import { useWebSocket } from '@/hooks/use-websocket'
+import { useBackend } from '@/hooks/use-backend'
 import { useToast } from '@/hooks/use-toast'
-import { generateColor, getBackendUrl } from '@/lib/utils'
+import { generateColor } from '@/lib/utils'
+import { applyOps } from '@/lib/ot'
 import { Copy, Loader2, Code2, ArrowLeft, Sparkles, Play } from 'lucide-react'
 import { motion } from 'framer-motion'
 import Link from 'next/link'
@@ -43,6 +45,9 @@ const LANGUAGES = [
   { value: 'css', label: 'CSS' },
 ]
 
+// Messages carrying the session revision they leave it at
+const REVISION_MESSAGES = ['workspace', 'code_change', 'language_change', 'edit', 'ack', 'conflict']
+
 interface CursorData {
   line: number
   column: number
@@ -52,8 +57,10 @@ interface CursorData {
 export default function SessionPage() {
   const params = useParams()
   const router = useRouter()
+  const searchParams = useSearchParams()
   const { user, isLoaded } = useUser()
   const { toast } = useToast()
+  const { getToken, backendFetch } = useBackend()
 
   const sessionId = params.id as string
   const [session, setSession] = useState<any>(null)
@@ -65,28 +72,40 @@ export default function SessionPage() {
   const userColor = useRef(generateColor(user?.id || '')).current
   const lastCodeChangeRef = useRef<string>('')
 
-  const { connected, users, messages, sendMessage } = useWebSocket(
-    sessionId,
-    user?.id || '',
-    user?.fullName || user?.firstName || 'Anonymous',
-    user?.emailAddresses[0]?.emailAddress || '',
-    userColor,
-    user?.imageUrl || ''
-  )
+  // Writes name the revision they were made against, so only one is sent at
+  // a time and the latest unsent change waits for its ack
+  const revisionRef = useRef<number | null>(null)
+  const mainFileRef = useRef<string | null>(null)
+  const inFlightRef = useRef(false)
+  const pendingRef = useRef<{ code?: string; language?: string }>({})
+  const handledRef = useRef(0)
+
+  // Connecting waits for the join, which may redeem an invite first
+  const { connected, users, messages, sendMessage } = useWebSocket(session ? sessionId : '', getToken)
 
   useEffect(() => {
     const fetchSession = async () => {
       try {
-        const response = await fetch(
-          `${getBackendUrl()}/api/sessions/${sessionId}`
-        )
+        // Participants join as they are; anyone else needs the invite from
+        // the link they were sent
+        const invite = searchParams.get('invite')
+        const response = await backendFetch(`/api/sessions/${sessionId}/join`, {
+          method: 'POST',
+          headers: {
+            'Content-Type': 'application/json',
+          },
+          body: JSON.stringify(invite ? { invite } : {}),
+        })
         if (!response.ok) throw new Error('Session not found')
 
         const data = await response.json()
         setSession(data)
-        setCode(data.code || '// Start coding here...\n')
-        setLanguage(data.language || 'javascript')
-        lastCodeChangeRef.current = data.code || '// Start coding here...\n'
+        // The websocket snapshot may already have brought something newer
+        if (revisionRef.current === null) {
+          setCode(data.code || '// Start coding here...\n')
+          setLanguage(data.language || 'javascript')
+          lastCodeChangeRef.current = data.code || '// Start coding here...\n'
+        }
       } catch (error) {
         console.error('Failed to fetch session:', error)
         toast({
@@ -103,80 +122,147 @@ export default function SessionPage() {
     if (sessionId) {
       fetchSession()
     }
-  }, [sessionId, router, toast])
+  }, [sessionId, searchParams, router, toast, backendFetch])
+
+  const flushPending = useCallback(() => {
+    if (inFlightRef.current || revisionRef.current === null) return
+
+    const pending = pendingRef.current
+    if (pending.code !== undefined) {
+      sendMessage({
+        type: 'code_change',
+        session_id: sessionId,
+        data: { code: pending.code, revision: revisionRef.current, timestamp: Date.now() },
+      })
+      pending.code = undefined
+    } else if (pending.language !== undefined) {
+      sendMessage({
+        type: 'language_change',
+        session_id: sessionId,
+        data: { language: pending.language, revision: revisionRef.current },
+      })
+      pending.language = undefined
+    } else {
+      return
+    }
+    inFlightRef.current = true
+  }, [sendMessage, sessionId])
 
+  // A reconnect answers nothing sent before it; the snapshot that follows
+  // brings the revision up to date
   useEffect(() => {
-    const latestMessage = messages[messages.length - 1]
-    if (!latestMessage) return
-
-    switch (latestMessage.type) {
-      case 'cursor_move':
-        if (latestMessage.user_id !== user?.id && latestMessage.data) {
-          setCursors((prev) => {
-            const newCursors = new Map(prev)
-            newCursors.set(latestMessage.user_id!, {
-              line: latestMessage.data.line,
-              column: latestMessage.data.column,
-              user: latestMessage.data.user || { name: 'Unknown' },
+    if (!connected) {
+      inFlightRef.current = false
+    }
+  }, [connected])
+
+  useEffect(() => {
+    const isMainFile = (path?: string) => !path || !mainFileRef.current || path === mainFileRef.current
+
+    // Several messages can arrive between renders, so every new one is
+    // handled rather than just the latest
+    for (const message of messages.slice(handledRef.current)) {
+      const data = message.data
+      if (typeof data?.revision === 'number' &&
+          (REVISION_MESSAGES.includes(message.type) || message.type.startsWith('file_'))) {
+        revisionRef.current = data.revision
+      }
+
+      switch (message.type) {
+        case 'workspace':
+          mainFileRef.current = data?.main_file || null
+          break
+
+        case 'cursor_move':
+          if (message.user_id !== user?.id && data) {
+            setCursors((prev) => {
+              const newCursors = new Map(prev)
+              newCursors.set(message.user_id!, {
+                line: data.line,
+                column: data.column,
+                user: data.user || { name: 'Unknown' },
+              })
+              return newCursors
             })
-            return newCursors
-          })
-        }
-        break
-
-      case 'code_change':
-        // Always update code from WebSocket messages (source of truth)
-        // This ensures all users see the latest code state, including on reconnect
-        if (latestMessage.data && latestMessage.data.code !== undefined) {
-          const newCode = latestMessage.data.code
-          // Update if it's different from current state
-          // We check both code state and lastCodeChangeRef to handle all cases
-          if (newCode !== code) {
-            setCode(newCode)
-            lastCodeChangeRef.current = newCode
           }
-        }
-        break
-
-      case 'language_change':
-        // Update language from server/broadcast (source of truth)
-        if (latestMessage.data && latestMessage.data.language) {
-          const newLanguage = latestMessage.data.language
-          // Only update if it's different to avoid unnecessary re-renders
-          if (language !== newLanguage) {
-            setLanguage(newLanguage)
+          break
+
+        case 'code_change':
+          // The server's state is the source of truth, including on reconnect
+          if (data && data.code !== undefined && isMainFile(data.path)) {
+            setCode(data.code)
+            lastCodeChangeRef.current = data.code
           }
-        }
-        break
-
-      case 'user_leave':
-        if (latestMessage.user_id) {
-          setCursors((prev) => {
-            const newCursors = new Map(prev)
-            newCursors.delete(latestMessage.user_id!)
-            return newCursors
+          break
+
+        case 'edit':
+          if (data?.ops && isMainFile(data.path)) {
+            setCode((prev) => {
+              const next = applyOps(prev, data.ops)
+              lastCodeChangeRef.current = next
+              return next
+            })
+          }
+          break
+
+        case 'language_change':
+          if (data?.language && isMainFile(data.path)) {
+            setLanguage(data.language)
+          }
+          break
+
+        case 'ack':
+          inFlightRef.current = false
+          break
+
+        case 'conflict':
+          // Someone else wrote first; their version wins and what was
+          // waiting to be sent is dropped
+          inFlightRef.current = false
+          pendingRef.current = {}
+          if (isMainFile(data?.path)) {
+            setCode(data.code)
+            setLanguage(data.language)
+            lastCodeChangeRef.current = data.code
+          }
+          toast({
+            title: 'Edit conflict',
+            description: 'Someone else changed the code first, so your last change was not saved',
+            variant: 'destructive',
           })
-        }
-        break
+          break
+
+        case 'error':
+          // A rejected write is followed by a fresh snapshot
+          if (data?.type === 'code_change' || data?.type === 'language_change' || data?.code === 'write_rejected') {
+            inFlightRef.current = false
+          }
+          break
+
+        case 'user_leave':
+          if (message.user_id) {
+            setCursors((prev) => {
+              const newCursors = new Map(prev)
+              newCursors.delete(message.user_id!)
+              return newCursors
+            })
+          }
+          break
+      }
     }
-  }, [messages, user?.id])
+    handledRef.current = messages.length
+    flushPending()
+  }, [messages, user?.id, toast, flushPending])
 
   const handleCodeChange = useCallback(
     (newCode: string) => {
       setCode(newCode)
       lastCodeChangeRef.current = newCode
 
-      sendMessage({
-        type: 'code_change',
-        session_id: sessionId,
-        user_id: user?.id,
-        data: {
-          code: newCode,
-          timestamp: Date.now(),
-        },
-      })
+      pendingRef.current.code = newCode
+      flushPending()
     },
-    [sendMessage, sessionId, user?.id]
+    [flushPending]
   )
 
   const handleCursorChange = useCallback(
@@ -201,20 +287,28 @@ export default function SessionPage() {
 
   const handleLanguageChange = (newLanguage: string) => {
     setLanguage(newLanguage)
-    
+
     // Persist language change to backend and broadcast to other users
-    sendMessage({
-      type: 'language_change',
-      session_id: sessionId,
-      user_id: user?.id,
-      data: {
-        language: newLanguage,
+    pendingRef.current.language = newLanguage
+    flushPending()
+  }
+
+  const copyShareLink = async () => {
+    // Owners share an invite; anyone else's link only works for people
+    // already in the session
+    let link = `${window.location.origin}/session/${sessionId}`
+    const response = await backendFetch(`/api/sessions/${sessionId}/invites`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
       },
+      body: JSON.stringify({}),
     })
-  }
+    if (response.ok) {
+      const data = await response.json()
+      link += `?invite=${encodeURIComponent(data.token)}`
+    }
 
-  const copyShareLink = () => {
-    const link = window.location.href
     navigator.clipboard.writeText(link)
     toast({
       title: 'Link copied!',
@@ -1,7 +1,7 @@
 'use client'
 
 import { useState } from 'react'
-import { getBackendUrl } from '@/lib/utils'
+import { useBackend } from '@/hooks/use-backend'
 import { Button } from '@/components/ui/button'
 import { Card } from '@/components/ui/card'
 import { Sparkles, Lightbulb, Loader2 } from 'lucide-react'
@@ -13,6 +13,7 @@ interface AIPanelProps {
 }
 
 export function AIPanel({ code, language }: AIPanelProps) {
+  const { backendFetch } = useBackend()
   const [analyzing, setAnalyzing] = useState(false)
   const [suggesting, setSuggesting] = useState(false)
   const [analysis, setAnalysis] = useState('')
@@ -25,7 +26,7 @@ export function AIPanel({ code, language }: AIPanelProps) {
     setAnalysis('')
 
     try {
-      const response = await fetch(`${getBackendUrl()}/api/analyze`, {
+      const response = await backendFetch('/api/analyze', {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
@@ -67,7 +68,7 @@ export function AIPanel({ code, language }: AIPanelProps) {
     setSuggestions('')
 
     try {
-      const response = await fetch(`${getBackendUrl()}/api/suggest`, {
+      const response = await backendFetch('/api/suggest', {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
@@ -1,7 +1,7 @@
 'use client'
 
 import { useState } from 'react'
-import { getBackendUrl } from '@/lib/utils'
+import { useBackend } from '@/hooks/use-backend'
 import { Button } from '@/components/ui/button'
 import { Card } from '@/components/ui/card'
 import { Play, Loader2, Terminal, AlertCircle } from 'lucide-react'
@@ -13,6 +13,7 @@ interface CodeRunnerProps {
 }
 
 export function CodeRunner({ code, language }: CodeRunnerProps) {
+  const { backendFetch } = useBackend()
   const [running, setRunning] = useState(false)
   const [output, setOutput] = useState('')
   const [error, setError] = useState('')
@@ -28,7 +29,7 @@ export function CodeRunner({ code, language }: CodeRunnerProps) {
     setExecutionTime('')
 
     try {
-      const response = await fetch(`${getBackendUrl()}/api/run`, {
+      const response = await backendFetch('/api/run', {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
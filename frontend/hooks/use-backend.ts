@@ -0,0 +1,32 @@
+import { useCallback } from 'react'
+import { useAuth } from '@clerk/nextjs'
+import { getBackendUrl } from '@/lib/utils'
+
+// The backend checks the token's audience when JWT_AUDIENCE is set, which
+// Clerk's default session token doesn't carry; name a JWT template that
+// adds it here
+const JWT_TEMPLATE = process.env.NEXT_PUBLIC_CLERK_JWT_TEMPLATE
+
+export function useBackend() {
+  const { getToken } = useAuth()
+
+  const getBackendToken = useCallback(
+    () => getToken(JWT_TEMPLATE ? { template: JWT_TEMPLATE } : undefined),
+    [getToken]
+  )
+
+  // Calls the backend as the signed-in user
+  const backendFetch = useCallback(
+    async (path: string, init: RequestInit = {}) => {
+      const headers = new Headers(init.headers)
+      const token = await getBackendToken()
+      if (token) {
+        headers.set('Authorization', `Bearer ${token}`)
+      }
+      return fetch(`${getBackendUrl()}${path}`, { ...init, headers })
+    },
+    [getBackendToken]
+  )
+
+  return { getToken: getBackendToken, backendFetch }
+}
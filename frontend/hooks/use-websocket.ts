@@ -14,13 +14,12 @@ export interface WSMessage {
   data?: any
 }
 
+// The server takes the user's profile from the token, which is fetched
+// afresh for every connection attempt since Clerk tokens are short-lived.
+// Nothing connects while sessionId is empty.
 export function useWebSocket(
   sessionId: string,
-  userId: string,
-  userName: string,
-  userEmail: string,
-  userColor: string,
-  userImage: string
+  getToken: () => Promise<string | null>
 ) {
   const [connected, setConnected] = useState(false)
   const [users, setUsers] = useState<any[]>([])
@@ -29,20 +28,27 @@ export function useWebSocket(
   const reconnectTimeoutRef = useRef<NodeJS.Timeout>()
   const reconnectAttemptsRef = useRef(0)
   const messageQueueRef = useRef<WSMessage[]>([])
+  const getTokenRef = useRef(getToken)
+  const activeRef = useRef(false)
+  getTokenRef.current = getToken
 
-  const connect = useCallback(() => {
+  const connect = useCallback(async () => {
     if (wsRef.current?.readyState === WebSocket.OPEN) return
 
+    let token: string | null = null
+    try {
+      token = await getTokenRef.current()
+    } catch (error) {
+      console.error('Failed to get session token:', error)
+    }
+    if (!activeRef.current) return
+
     // Use environment variable for backend URL, fallback to localhost for development
     const backendUrl = process.env.NEXT_PUBLIC_BACKEND_URL || 'http://localhost:8080'
     const wsProtocol = backendUrl.startsWith('https') ? 'wss' : 'ws'
     const wsHost = backendUrl.replace(/^https?:\/\//, '').replace(/\/$/, '')
     
-    const wsUrl = `${wsProtocol}://${wsHost}/ws?session=${sessionId}&user_id=${userId}&user_name=${encodeURIComponent(
-      userName
-    )}&user_email=${encodeURIComponent(userEmail)}&user_color=${encodeURIComponent(
-      userColor
-    )}&user_image=${encodeURIComponent(userImage)}`
+    const wsUrl = `${wsProtocol}://${wsHost}/ws?session=${sessionId}&token=${encodeURIComponent(token || '')}`
 
     console.log('Connecting to WebSocket...')
     const ws = new WebSocket(wsUrl)
@@ -99,6 +105,7 @@ export function useWebSocket(
     ws.onclose = (event) => {
       console.log('WebSocket disconnected:', event.code, event.reason)
       setConnected(false)
+      if (!activeRef.current) return
       
       // Attempt to reconnect with exponential backoff
       const delay = Math.min(1000 * Math.pow(2, reconnectAttemptsRef.current), 10000)
@@ -112,12 +119,16 @@ export function useWebSocket(
     }
 
     wsRef.current = ws
-  }, [sessionId, userId, userName, userEmail, userColor, userImage])
+  }, [sessionId])
 
   useEffect(() => {
+    if (!sessionId) return
+
+    activeRef.current = true
     connect()
 
     return () => {
+      activeRef.current = false
       if (reconnectTimeoutRef.current) {
         clearTimeout(reconnectTimeoutRef.current)
       }
@@ -0,0 +1,28 @@
+export interface OpComponent {
+  retain?: number
+  insert?: string
+  delete?: number
+}
+
+// Applies a server text operation. Its positions count Unicode code points,
+// not the UTF-16 units JavaScript strings index by, so the document is
+// split into code points first.
+export function applyOps(doc: string, ops: OpComponent[]): string {
+  const chars = Array.from(doc)
+  const out: string[] = []
+  let pos = 0
+
+  for (const op of ops) {
+    if (op.retain) {
+      out.push(...chars.slice(pos, pos + op.retain))
+      pos += op.retain
+    } else if (op.insert) {
+      out.push(op.insert)
+    } else if (op.delete) {
+      pos += op.delete
+    }
+  }
+  out.push(...chars.slice(pos))
+
+  return out.join('')
+}